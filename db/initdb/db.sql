@@ -1,15 +1,31 @@
--- Users table
+-- Users table. external_id is the optional ID in an identity provider, unique_name
+-- is set to name only while unique names are enforced, status is the lifecycle status.
 CREATE TABLE IF NOT EXISTS users (
     id INT AUTO_INCREMENT PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    external_id VARCHAR(255) NULL,
+    unique_name VARCHAR(255) NULL,
+    status VARCHAR(32) NOT NULL DEFAULT 'active',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_external_id (external_id),
+    UNIQUE KEY uq_unique_name (unique_name),
+    INDEX idx_name (name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
--- User groups table
+-- User groups table. external_id is the optional ID in an identity provider, unique_name
+-- is set to name only while unique names are enforced, membership_rule is set for
+-- dynamic groups only.
 CREATE TABLE IF NOT EXISTS user_groups (
     id INT AUTO_INCREMENT PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    external_id VARCHAR(255) NULL,
+    unique_name VARCHAR(255) NULL,
+    membership_rule TEXT NULL,
+    group_type VARCHAR(64) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_external_id (external_id),
+    UNIQUE KEY uq_unique_name (unique_name),
+    INDEX idx_name (name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 -- User to group membership (direct membership only)
@@ -35,15 +51,133 @@ CREATE TABLE IF NOT EXISTS user_group_hierarchy (
     CHECK (child_group_id != parent_group_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
--- Permissions table
+-- Permissions table (condition_expr is NULL for unconditional grants)
 CREATE TABLE IF NOT EXISTS permissions (
     source_type ENUM('user', 'group') NOT NULL,
     source_id INT NOT NULL,
     target_type ENUM('user', 'group') NOT NULL,
     target_id INT NOT NULL,
+    condition_expr TEXT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     PRIMARY KEY (source_type, source_id, target_type, target_id),
     INDEX idx_source (source_type, source_id),
     INDEX idx_target (target_type, target_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Revisions table (one row per committed mutation, used as consistency token)
+CREATE TABLE IF NOT EXISTS revisions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Change events table (transactional outbox, written in the same transaction as each mutation;
+-- user_status is set for user_status_changed events only)
+CREATE TABLE IF NOT EXISTS change_events (
+    revision BIGINT PRIMARY KEY,
+    event_type VARCHAR(32) NOT NULL,
+    subject_type ENUM('user', 'group') NOT NULL,
+    subject_id INT NOT NULL,
+    object_type ENUM('user', 'group') NOT NULL,
+    object_id INT NOT NULL,
+    user_status VARCHAR(32) NULL,
+    previous_object_id INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (revision) REFERENCES revisions(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook subscriptions (filters are comma-separated lists, empty matches everything)
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(255) NOT NULL DEFAULT '',
+    group_ids VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook deliveries (one row per change event and matching subscription)
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    revision BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    status ENUM('pending', 'succeeded', 'dead_lettered') NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(3) NOT NULL,
+    last_error VARCHAR(1024) NOT NULL DEFAULT '',
+    last_status_code INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_subscription_revision (subscription_id, revision),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    INDEX idx_status_next_attempt (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook dead letters (deliveries that exhausted their attempts)
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    delivery_id INT PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    revision BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error VARCHAR(1024) NOT NULL,
+    last_status_code INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook dispatcher cursor (single row, last change event revision processed)
+CREATE TABLE IF NOT EXISTS webhook_cursor (
+    id TINYINT PRIMARY KEY,
+    revision BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+
+-- Idempotency keys (remembered creates, so a retried create returns the original ID)
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    operation VARCHAR(32) NOT NULL,
+    request_name VARCHAR(255) NOT NULL,
+    resource_id INT NOT NULL DEFAULT 0,
+    expires_at DATETIME(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Attributes of users and groups (attr_value is JSON-encoded according to value_type)
+CREATE TABLE IF NOT EXISTS attributes (
+    subject_type ENUM('user', 'group') NOT NULL,
+    subject_id INT NOT NULL,
+    attr_name VARCHAR(255) NOT NULL,
+    value_type VARCHAR(8) NOT NULL,
+    attr_value TEXT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (subject_type, subject_id, attr_name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- Named transaction-scoped locks, one row per lock, taken by the repository to
+-- serialize revisions, hierarchy writes and membership rule evaluation
+CREATE TABLE IF NOT EXISTS locks (
+    name VARCHAR(64) PRIMARY KEY
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Applied migrations. This file creates the schema of every MySQL migration in
+-- pkg/server/migrations/mysql, so MigrateMySQL only applies the ones added later.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO schema_migrations (version, name) VALUES
+    (1, 'core_schema'),
+    (2, 'revisions_and_change_events'),
+    (3, 'webhooks'),
+    (4, 'idempotency_keys'),
+    (5, 'external_ids'),
+    (6, 'attributes'),
+    (7, 'permission_conditions'),
+    (8, 'membership_rules'),
+    (9, 'user_status'),
+    (10, 'edge_moves'),
+    (11, 'group_types'),
+    (12, 'locks');
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"sort"
+)
+
+// GroupPath is a group that a user or group belongs to, with its distance and the
+// shortest way up to it. Path runs from the direct group or parent to GroupID, so
+// Depth is always len(Path) and direct groups and parents have depth 1. Among paths
+// of equal length, the one with the smallest IDs first is returned.
+type GroupPath struct {
+	GroupID int   `json:"group_id"`
+	Depth   int   `json:"depth"`
+	Path    []int `json:"path"`
+}
+
+// groupPaths walks up the hierarchy from the direct groups in starts along edges
+// and returns every group reached with its shortest path, in ascending group order
+func groupPaths(starts []int, edges []GroupEdge) []GroupPath {
+	parents := make(map[int][]int)
+	for _, e := range edges {
+		parents[e.ChildID] = append(parents[e.ChildID], e.ParentID)
+	}
+	for _, ids := range parents {
+		sort.Ints(ids)
+	}
+
+	// Breadth-first, with each level in the order of its paths: a group is reached
+	// first through its smallest path of the shortest length
+	seen := make(map[int]bool)
+	var level []GroupPath
+	for _, id := range sortedUnique(starts) {
+		seen[id] = true
+		level = append(level, GroupPath{GroupID: id, Depth: 1, Path: []int{id}})
+	}
+	paths := make([]GroupPath, 0)
+	for len(level) > 0 {
+		paths = append(paths, level...)
+		var next []GroupPath
+		for _, p := range level {
+			for _, parentID := range parents[p.GroupID] {
+				if seen[parentID] {
+					continue
+				}
+				seen[parentID] = true
+				path := append(append(make([]int, 0, len(p.Path)+1), p.Path...), parentID)
+				next = append(next, GroupPath{GroupID: parentID, Depth: p.Depth + 1, Path: path})
+			}
+		}
+		level = next
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].GroupID < paths[j].GroupID })
+	return paths
+}
+
+// sortedUnique returns ids in ascending order without duplicates
+func sortedUnique(ids []int) []int {
+	out := append([]int(nil), ids...)
+	sort.Ints(out)
+	n := 0
+	for i, id := range out {
+		if i == 0 || id != out[n-1] {
+			out[n] = id
+			n++
+		}
+	}
+	return out[:n]
+}
+
+// GetGroupsForUser returns the groups the user belongs to directly
+func (s *Server) GetGroupsForUser(ctx context.Context, userID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetGroupsForUser", IntAttr("user.id", userID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetGroupsForUser(ctx, userID)
+}
+
+// GetGroupsForUserTransitive returns the groups the user belongs to directly or through nested groups
+func (s *Server) GetGroupsForUserTransitive(ctx context.Context, userID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetGroupsForUserTransitive", IntAttr("user.id", userID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetGroupsForUserTransitive(ctx, userID)
+}
+
+// GetGroupsForUserWithPaths returns the groups the user belongs to directly or through
+// nested groups, each with its depth and path from the user's direct group
+func (s *Server) GetGroupsForUserWithPaths(ctx context.Context, userID int) (paths []GroupPath, err error) {
+	ctx, c := s.begin(ctx, "GetGroupsForUserWithPaths", IntAttr("user.id", userID))
+	defer func() { c.end(err, IntAttr("result.count", len(paths))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	direct, err := s.repo.GetGroupsForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := s.repo.GetAncestorEdges(ctx, "user", userID)
+	if err != nil {
+		return nil, err
+	}
+	return groupPaths(direct, edges), nil
+}
+
+// GetParentGroups returns the groups that directly contain the group
+func (s *Server) GetParentGroups(ctx context.Context, userGroupID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetParentGroups", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetParentGroups(ctx, userGroupID)
+}
+
+// GetAncestorGroups returns the groups that contain the group directly or transitively
+func (s *Server) GetAncestorGroups(ctx context.Context, userGroupID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetAncestorGroups", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetAncestorGroups(ctx, userGroupID)
+}
+
+// GetAncestorGroupsWithPaths returns the groups that contain the group directly or
+// transitively, each with its depth and path from the group's parent
+func (s *Server) GetAncestorGroupsWithPaths(ctx context.Context, userGroupID int) (paths []GroupPath, err error) {
+	ctx, c := s.begin(ctx, "GetAncestorGroupsWithPaths", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(paths))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	edges, err := s.repo.GetAncestorEdges(ctx, "group", userGroupID)
+	if err != nil {
+		return nil, err
+	}
+	var parents []int
+	for _, e := range edges {
+		if e.ChildID == userGroupID {
+			parents = append(parents, e.ParentID)
+		}
+	}
+	return groupPaths(parents, edges), nil
+}
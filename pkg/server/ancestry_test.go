@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func Test_Ancestry_GroupPaths(t *testing.T) {
+	// 5 reaches 1 through 3 and through 4, and 6 through 4; the smaller path wins
+	edges := []GroupEdge{{3, 1}, {4, 1}, {5, 4}, {5, 3}, {5, 2}, {6, 4}, {1, 7}}
+
+	got := groupPaths([]int{6, 5, 5}, edges)
+	want := []GroupPath{
+		{GroupID: 1, Depth: 3, Path: []int{5, 3, 1}},
+		{GroupID: 2, Depth: 2, Path: []int{5, 2}},
+		{GroupID: 3, Depth: 2, Path: []int{5, 3}},
+		{GroupID: 4, Depth: 2, Path: []int{5, 4}},
+		{GroupID: 5, Depth: 1, Path: []int{5}},
+		{GroupID: 6, Depth: 1, Path: []int{6}},
+		{GroupID: 7, Depth: 4, Path: []int{5, 3, 1, 7}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupPaths = %+v, want %+v", got, want)
+	}
+
+	if got := groupPaths(nil, edges); got == nil || len(got) != 0 {
+		t.Errorf("groupPaths(nil) = %v, want no paths", got)
+	}
+}
+
+func Test_Ancestry_Server(t *testing.T) {
+	s := New(newFakeRepository())
+	ctx := context.Background()
+
+	company, _ := s.CreateUserGroup(ctx, "Company")
+	eng, _ := s.CreateUserGroup(ctx, "Engineering")
+	oncall, _ := s.CreateUserGroup(ctx, "On-call")
+	backend, _ := s.CreateUserGroup(ctx, "Backend")
+	_ = s.AddUserGroupToGroup(ctx, eng, company)
+	_ = s.AddUserGroupToGroup(ctx, oncall, company)
+	_ = s.AddUserGroupToGroup(ctx, backend, eng)
+	_ = s.AddUserGroupToGroup(ctx, backend, oncall)
+	alice, _ := s.CreateUser(ctx, "Alice")
+	_ = s.AddUserToGroup(ctx, alice, backend)
+	_ = s.AddUserToGroup(ctx, alice, oncall)
+
+	if groups, err := s.GetGroupsForUser(ctx, alice); err != nil || !reflect.DeepEqual(groups, []int{oncall, backend}) {
+		t.Errorf("GetGroupsForUser = %v, %v; want [%d %d]", groups, err, oncall, backend)
+	}
+	if groups, err := s.GetGroupsForUserTransitive(ctx, alice); err != nil || !reflect.DeepEqual(groups, []int{company, eng, oncall, backend}) {
+		t.Errorf("GetGroupsForUserTransitive = %v, %v", groups, err)
+	}
+	if groups, err := s.GetParentGroups(ctx, backend); err != nil || !reflect.DeepEqual(groups, []int{eng, oncall}) {
+		t.Errorf("GetParentGroups = %v, %v; want [%d %d]", groups, err, eng, oncall)
+	}
+	if groups, err := s.GetAncestorGroups(ctx, backend); err != nil || !reflect.DeepEqual(groups, []int{company, eng, oncall}) {
+		t.Errorf("GetAncestorGroups = %v, %v", groups, err)
+	}
+
+	// Alice is directly in On-call, so Company is one level above it
+	paths, err := s.GetGroupsForUserWithPaths(ctx, alice)
+	want := []GroupPath{
+		{GroupID: company, Depth: 2, Path: []int{oncall, company}},
+		{GroupID: eng, Depth: 2, Path: []int{backend, eng}},
+		{GroupID: oncall, Depth: 1, Path: []int{oncall}},
+		{GroupID: backend, Depth: 1, Path: []int{backend}},
+	}
+	if err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("GetGroupsForUserWithPaths = %+v, %v; want %+v", paths, err, want)
+	}
+
+	paths, err = s.GetAncestorGroupsWithPaths(ctx, backend)
+	want = []GroupPath{
+		{GroupID: company, Depth: 2, Path: []int{eng, company}},
+		{GroupID: eng, Depth: 1, Path: []int{eng}},
+		{GroupID: oncall, Depth: 1, Path: []int{oncall}},
+	}
+	if err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("GetAncestorGroupsWithPaths = %+v, %v; want %+v", paths, err, want)
+	}
+	if paths, err := s.GetAncestorGroupsWithPaths(ctx, company); err != nil || len(paths) != 0 {
+		t.Errorf("GetAncestorGroupsWithPaths(root) = %+v, %v; want none", paths, err)
+	}
+}
+
+func Test_Ancestry_IndexedRepository(t *testing.T) {
+	ctx := context.Background()
+	file := openFileRepository(t, t.TempDir())
+	defer file.Close()
+
+	parent, _ := file.CreateUserGroup(ctx, "Parent")
+	child, _ := file.CreateUserGroup(ctx, "Child")
+	_, _ = file.AddGroupToGroup(ctx, child, parent)
+
+	repo, err := NewIndexedRepository(ctx, file)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	grandchild, _ := repo.CreateUserGroup(ctx, "Grandchild")
+	_, _ = repo.AddGroupToGroup(ctx, grandchild, child)
+
+	if parents, err := repo.GetParentGroups(ctx, child); err != nil || !reflect.DeepEqual(parents, []int{parent}) {
+		t.Errorf("GetParentGroups = %v, %v; want the loaded edge", parents, err)
+	}
+	want := []GroupEdge{{child, parent}, {grandchild, child}}
+	if edges, err := repo.GetAncestorEdges(ctx, "group", grandchild); err != nil || !reflect.DeepEqual(edges, want) {
+		t.Errorf("GetAncestorEdges = %v, %v; want %v", edges, err, want)
+	}
+}
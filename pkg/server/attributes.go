@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// MaxAttributeNameLength is the longest accepted attribute name in bytes
+const MaxAttributeNameLength = 255
+
+// AttributeType is the type of an attribute value
+type AttributeType string
+
+// Attribute types and the Go types of their values
+const (
+	AttributeString AttributeType = "string" // string
+	AttributeInt    AttributeType = "int"    // int
+	AttributeBool   AttributeType = "bool"   // bool
+	AttributeList   AttributeType = "list"   // []string
+)
+
+// Attributes are the attribute values of one user or group by name
+type Attributes map[string]interface{}
+
+// Names returns the attribute names in ascending order
+func (a Attributes) Names() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AttributeSchema declares the attributes users and groups may have. The Server
+// rejects attributes that are not declared for the subject's type or whose value
+// does not have the declared type.
+type AttributeSchema struct {
+	Users  map[string]AttributeType
+	Groups map[string]AttributeType
+}
+
+// validate checks a value about to be set on a subject of subjectType. A nil value
+// removes the attribute and only needs a declared name.
+func (s AttributeSchema) validate(subjectType, name string, value interface{}) error {
+	declared := s.Users
+	if subjectType == "group" {
+		declared = s.Groups
+	}
+	want, ok := declared[name]
+	if !ok {
+		return &AttributeError{SubjectType: subjectType, Name: name, Reason: "not declared in the schema"}
+	}
+	if value == nil {
+		return nil
+	}
+	got, _, err := normalizeAttribute(subjectType, name, value)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return &AttributeError{SubjectType: subjectType, Name: name, Reason: fmt.Sprintf("want a %s value, got a %s", want, got)}
+	}
+	return nil
+}
+
+// normalizeAttribute returns the type of value and value converted to the Go type of
+// that attribute type, so that every repository stores and returns the same values
+func normalizeAttribute(subjectType, name string, value interface{}) (AttributeType, interface{}, error) {
+	if err := validateAttributeName(subjectType, name); err != nil {
+		return "", nil, err
+	}
+	switch v := value.(type) {
+	case string:
+		return AttributeString, v, nil
+	case int:
+		return AttributeInt, v, nil
+	case int32:
+		return AttributeInt, int(v), nil
+	case int64:
+		return AttributeInt, int(v), nil
+	case bool:
+		return AttributeBool, v, nil
+	case []string:
+		return AttributeList, append([]string{}, v...), nil
+	}
+	return "", nil, &AttributeError{SubjectType: subjectType, Name: name, Reason: fmt.Sprintf("unsupported value type %T", value)}
+}
+
+// validateAttributeName rejects names that repositories cannot store
+func validateAttributeName(subjectType, name string) error {
+	if name == "" || len(name) > MaxAttributeNameLength {
+		return &AttributeError{SubjectType: subjectType, Name: name,
+			Reason: fmt.Sprintf("names must have 1 to %d bytes", MaxAttributeNameLength)}
+	}
+	return nil
+}
+
+// storedAttribute is an attribute value as repositories persist it
+type storedAttribute struct {
+	Type  AttributeType   `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// encodeAttribute normalizes value for storage
+func encodeAttribute(subjectType, name string, value interface{}) (storedAttribute, error) {
+	typ, v, err := normalizeAttribute(subjectType, name, value)
+	if err != nil {
+		return storedAttribute{}, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return storedAttribute{}, fmt.Errorf("failed to encode attribute %q: %w", name, err)
+	}
+	return storedAttribute{Type: typ, Value: data}, nil
+}
+
+// decode returns the stored value with the Go type of its attribute type
+func (a storedAttribute) decode() (interface{}, error) {
+	switch a.Type {
+	case AttributeString:
+		var v string
+		err := json.Unmarshal(a.Value, &v)
+		return v, err
+	case AttributeInt:
+		var v int
+		err := json.Unmarshal(a.Value, &v)
+		return v, err
+	case AttributeBool:
+		var v bool
+		err := json.Unmarshal(a.Value, &v)
+		return v, err
+	case AttributeList:
+		v := []string{}
+		err := json.Unmarshal(a.Value, &v)
+		return v, err
+	}
+	return nil, fmt.Errorf("unknown attribute type %q", a.Type)
+}
+
+// decodeAttributes decodes stored attributes by name
+func decodeAttributes(stored map[string]storedAttribute) (Attributes, error) {
+	attrs := make(Attributes, len(stored))
+	for name, a := range stored {
+		v, err := a.decode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode attribute %q: %w", name, err)
+		}
+		attrs[name] = v
+	}
+	return attrs, nil
+}
+
+// SetUserAttribute sets an attribute of a user after validating it against the
+// schema. A nil value removes the attribute.
+func (s *Server) SetUserAttribute(ctx context.Context, userID int, name string, value interface{}) error {
+	_, err := s.SetUserAttributeWithRevision(ctx, userID, name, value)
+	return err
+}
+
+// SetUserAttributeWithRevision sets an attribute of a user and returns the revision at
+// which the dynamic group memberships it changed are visible
+func (s *Server) SetUserAttributeWithRevision(ctx context.Context, userID int, name string, value interface{}) (Revision, error) {
+	return s.setAttribute(ctx, "SetUserAttribute", "user", userID, name, value)
+}
+
+// GetUserAttribute returns an attribute of a user, or an AttributeNotFoundError if
+// the user does not have it
+func (s *Server) GetUserAttribute(ctx context.Context, userID int, name string) (interface{}, error) {
+	return s.getAttribute(ctx, "GetUserAttribute", "user", userID, name)
+}
+
+// ListUserAttributes returns all attributes of a user
+func (s *Server) ListUserAttributes(ctx context.Context, userID int) (Attributes, error) {
+	return s.listAttributes(ctx, "ListUserAttributes", "user", userID)
+}
+
+// SetUserGroupAttribute sets an attribute of a user group after validating it
+// against the schema. A nil value removes the attribute.
+func (s *Server) SetUserGroupAttribute(ctx context.Context, userGroupID int, name string, value interface{}) error {
+	_, err := s.SetUserGroupAttributeWithRevision(ctx, userGroupID, name, value)
+	return err
+}
+
+// SetUserGroupAttributeWithRevision sets an attribute of a user group and returns the
+// current revision
+func (s *Server) SetUserGroupAttributeWithRevision(ctx context.Context, userGroupID int, name string, value interface{}) (Revision, error) {
+	return s.setAttribute(ctx, "SetUserGroupAttribute", "group", userGroupID, name, value)
+}
+
+// GetUserGroupAttribute returns an attribute of a user group, or an
+// AttributeNotFoundError if the group does not have it
+func (s *Server) GetUserGroupAttribute(ctx context.Context, userGroupID int, name string) (interface{}, error) {
+	return s.getAttribute(ctx, "GetUserGroupAttribute", "group", userGroupID, name)
+}
+
+// ListUserGroupAttributes returns all attributes of a user group
+func (s *Server) ListUserGroupAttributes(ctx context.Context, userGroupID int) (Attributes, error) {
+	return s.listAttributes(ctx, "ListUserGroupAttributes", "group", userGroupID)
+}
+
+func (s *Server) setAttribute(ctx context.Context, method, subjectType string, id int, name string, value interface{}) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, method, IntAttr(subjectType+".id", id), StringAttr("attribute", name))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
+	if err := s.schema.validate(subjectType, name, value); err != nil {
+		return 0, err
+	}
+	return s.repo.SetAttribute(ctx, subjectType, id, name, value)
+}
+
+func (s *Server) getAttribute(ctx context.Context, method, subjectType string, id int, name string) (value interface{}, err error) {
+	ctx, c := s.begin(ctx, method, IntAttr(subjectType+".id", id), StringAttr("attribute", name))
+	defer func() { c.end(err) }()
+
+	attrs, err := s.repo.GetAttributes(ctx, subjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return nil, &AttributeNotFoundError{SubjectType: subjectType, SubjectID: id, Name: name}
+	}
+	return value, nil
+}
+
+func (s *Server) listAttributes(ctx context.Context, method, subjectType string, id int) (attrs Attributes, err error) {
+	ctx, c := s.begin(ctx, method, IntAttr(subjectType+".id", id))
+	defer func() { c.end(err, IntAttr("result.count", len(attrs))) }()
+
+	return s.repo.GetAttributes(ctx, subjectType, id)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testAttributeSchema = AttributeSchema{
+	Users: map[string]AttributeType{
+		"email":      AttributeString,
+		"level":      AttributeInt,
+		"contractor": AttributeBool,
+		"roles":      AttributeList,
+	},
+	Groups: map[string]AttributeType{
+		"group_type": AttributeString,
+	},
+}
+
+func Test_Attributes_SchemaValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		subjectType string
+		attribute   string
+		value       interface{}
+		wantErr     bool
+	}{
+		{"string", "user", "email", "a@example.com", false},
+		{"int", "user", "level", 2, false},
+		{"int64", "user", "level", int64(2), false},
+		{"bool", "user", "contractor", true, false},
+		{"list", "user", "roles", []string{"admin"}, false},
+		{"remove", "user", "email", nil, false},
+		{"group attribute", "group", "group_type", "team", false},
+		{"undeclared", "user", "nickname", "Al", true},
+		{"declared for the other type", "group", "email", "a@example.com", true},
+		{"wrong type", "user", "level", "2", true},
+		{"unsupported type", "user", "level", 2.5, true},
+		{"list of ints", "user", "roles", []int{1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testAttributeSchema.validate(tt.subjectType, tt.attribute, tt.value)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validate = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidAttribute) {
+				t.Errorf("Expected ErrInvalidAttribute, got %v", err)
+			}
+		})
+	}
+
+	if err := (AttributeSchema{}).validate("user", "email", "a@example.com"); !errors.Is(err, ErrInvalidAttribute) {
+		t.Errorf("Expected an empty schema to reject every attribute, got %v", err)
+	}
+	long := strings.Repeat("a", MaxAttributeNameLength+1)
+	if _, _, err := normalizeAttribute("user", long, "x"); !errors.Is(err, ErrInvalidAttribute) {
+		t.Errorf("Expected a long name to be rejected, got %v", err)
+	}
+}
+
+func Test_Attributes_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithAttributeSchema(testAttributeSchema), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	user, _ := s.CreateUser(ctx, "Olga")
+	if err := s.SetUserAttribute(ctx, user, "roles", []string{"admin"}); err != nil {
+		t.Fatalf("SetUserAttribute failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "SetUserAttribute")
+	if !ok || entry["attribute"] != "roles" {
+		t.Errorf("Expected the attribute name in the log entry, got %v", entry)
+	}
+	if value, err := s.GetUserAttribute(ctx, user, "roles"); err != nil || !reflect.DeepEqual(value, []string{"admin"}) {
+		t.Errorf("GetUserAttribute = %v, %v; want [admin]", value, err)
+	}
+
+	var notFound *AttributeNotFoundError
+	if _, err := s.GetUserAttribute(ctx, user, "email"); !errors.As(err, &notFound) || notFound.SubjectID != user {
+		t.Errorf("Expected an AttributeNotFoundError, got %v", err)
+	}
+	if err := s.SetUserAttribute(ctx, user, "level", "senior"); !errors.Is(err, ErrInvalidAttribute) {
+		t.Errorf("Expected ErrInvalidAttribute, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "SetUserAttribute"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the invalid attribute to be logged as rejected, got %v", logs.entries(t))
+	}
+
+	group, _ := s.CreateUserGroup(ctx, "Platform")
+	if err := s.SetUserGroupAttribute(ctx, group, "group_type", "team"); err != nil {
+		t.Fatalf("SetUserGroupAttribute failed: %v", err)
+	}
+	attrs, err := s.ListUserGroupAttributes(ctx, group)
+	if err != nil || !reflect.DeepEqual(attrs, Attributes{"group_type": "team"}) {
+		t.Errorf("ListUserGroupAttributes = %v, %v", attrs, err)
+	}
+	if _, err := s.ListUserAttributes(ctx, 999); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func Test_Attributes_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	user, err := r.CreateUser(ctx, "Pia")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	for name, value := range map[string]interface{}{"email": "pia@example.com", "level": 4, "roles": []string{"ops"}} {
+		if _, err := r.SetAttribute(ctx, "user", user, name, value); err != nil {
+			t.Fatalf("SetAttribute(%s) failed: %v", name, err)
+		}
+	}
+	if _, err := r.SetAttribute(ctx, "user", user, "roles", nil); err != nil {
+		t.Fatalf("Removing an attribute failed: %v", err)
+	}
+	crash(t, r)
+
+	want := Attributes{"email": "pia@example.com", "level": 4}
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if attrs, err := r.GetAttributes(ctx, "user", user); err != nil || !reflect.DeepEqual(attrs, want) {
+			t.Errorf("GetAttributes = %v, %v; want %v", attrs, err, want)
+		}
+	}
+
+	// The attributes are replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+}
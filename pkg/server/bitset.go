@@ -0,0 +1,152 @@
+package server
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// bitset is a compressed set of non-negative IDs. Only non-empty 64-bit words are
+// stored, sorted by their word index, so sparse ID ranges cost memory
+// proportional to the number of members rather than to the largest ID.
+type bitset struct {
+	blocks []bitBlock
+}
+
+type bitBlock struct {
+	key  uint32 // id / 64
+	bits uint64
+}
+
+func newBitset(ids ...int) *bitset {
+	b := &bitset{}
+	for _, id := range ids {
+		b.add(id)
+	}
+	return b
+}
+
+// search returns the position of the block with key, or where it would be inserted
+func (b *bitset) search(key uint32) int {
+	return sort.Search(len(b.blocks), func(i int) bool { return b.blocks[i].key >= key })
+}
+
+func (b *bitset) add(id int) {
+	if id < 0 {
+		return
+	}
+	key, bit := uint32(id>>6), uint64(1)<<(uint(id)&63)
+	i := b.search(key)
+	if i < len(b.blocks) && b.blocks[i].key == key {
+		b.blocks[i].bits |= bit
+		return
+	}
+	b.blocks = append(b.blocks, bitBlock{})
+	copy(b.blocks[i+1:], b.blocks[i:])
+	b.blocks[i] = bitBlock{key: key, bits: bit}
+}
+
+// remove deletes id from b, dropping its block once the block is empty
+func (b *bitset) remove(id int) {
+	if b == nil || id < 0 {
+		return
+	}
+	key := uint32(id >> 6)
+	i := b.search(key)
+	if i == len(b.blocks) || b.blocks[i].key != key {
+		return
+	}
+	b.blocks[i].bits &^= uint64(1) << (uint(id) & 63)
+	if b.blocks[i].bits == 0 {
+		b.blocks = append(b.blocks[:i], b.blocks[i+1:]...)
+	}
+}
+
+func (b *bitset) has(id int) bool {
+	if b == nil || id < 0 {
+		return false
+	}
+	key := uint32(id >> 6)
+	i := b.search(key)
+	return i < len(b.blocks) && b.blocks[i].key == key && b.blocks[i].bits&(uint64(1)<<(uint(id)&63)) != 0
+}
+
+// unionWith adds every member of other to b
+func (b *bitset) unionWith(other *bitset) {
+	if other == nil || len(other.blocks) == 0 {
+		return
+	}
+	merged := make([]bitBlock, 0, len(b.blocks)+len(other.blocks))
+	i, j := 0, 0
+	for i < len(b.blocks) && j < len(other.blocks) {
+		switch x, y := b.blocks[i], other.blocks[j]; {
+		case x.key < y.key:
+			merged = append(merged, x)
+			i++
+		case x.key > y.key:
+			merged = append(merged, y)
+			j++
+		default:
+			merged = append(merged, bitBlock{key: x.key, bits: x.bits | y.bits})
+			i++
+			j++
+		}
+	}
+	merged = append(merged, b.blocks[i:]...)
+	merged = append(merged, other.blocks[j:]...)
+	b.blocks = merged
+}
+
+// intersects reports whether b and other share at least one member
+func (b *bitset) intersects(other *bitset) bool {
+	if b == nil || other == nil {
+		return false
+	}
+	i, j := 0, 0
+	for i < len(b.blocks) && j < len(other.blocks) {
+		switch x, y := b.blocks[i], other.blocks[j]; {
+		case x.key < y.key:
+			i++
+		case x.key > y.key:
+			j++
+		default:
+			if x.bits&y.bits != 0 {
+				return true
+			}
+			i++
+			j++
+		}
+	}
+	return false
+}
+
+func (b *bitset) clone() *bitset {
+	if b == nil {
+		return &bitset{}
+	}
+	return &bitset{blocks: append([]bitBlock(nil), b.blocks...)}
+}
+
+func (b *bitset) len() int {
+	if b == nil {
+		return 0
+	}
+	n := 0
+	for _, block := range b.blocks {
+		n += bits.OnesCount64(block.bits)
+	}
+	return n
+}
+
+// ids returns the members in ascending order
+func (b *bitset) ids() []int {
+	ids := make([]int, 0, b.len())
+	if b == nil {
+		return ids
+	}
+	for _, block := range b.blocks {
+		for word := block.bits; word != 0; word &= word - 1 {
+			ids = append(ids, int(block.key)<<6+bits.TrailingZeros64(word))
+		}
+	}
+	return ids
+}
@@ -0,0 +1,541 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// CacheConfig configures a CachingRepository
+type CacheConfig struct {
+	// MaxEntries bounds the number of cached decisions and group sets
+	MaxEntries int
+
+	// TTL bounds how long an entry is served; it limits staleness caused by
+	// writes that do not go through this process
+	TTL time.Duration
+}
+
+// DefaultCacheConfig returns a CacheConfig with sensible defaults
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxEntries: 10000,
+		TTL:        30 * time.Second,
+	}
+}
+
+// CacheStats holds cache counters
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// HitRate returns the fraction of lookups served from the cache
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// cacheKind identifies what a cache entry holds
+type cacheKind int
+
+const (
+	cacheKindUserOnUser      cacheKind = iota // HasUserPermissionOnUser decision
+	cacheKindUserOnGroup                      // HasUserPermissionOnGroup decision
+	cacheKindUserGroups                       // transitive groups of a user
+	cacheKindGroupAncestors                   // transitive ancestors of a group
+	cacheKindUsersTransitive                  // transitive users of a group
+)
+
+type cacheKey struct {
+	kind cacheKind
+	a, b int
+}
+
+// groupSet is a set of group IDs an entry depends on
+type groupSet map[int]struct{}
+
+func newGroupSet(ids ...int) groupSet {
+	set := make(groupSet, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func (s groupSet) has(id int) bool {
+	_, ok := s[id]
+	return ok
+}
+
+// cacheEntry holds a cached value together with the groups it was derived from.
+// For decisions, srcGroups are the transitive groups of the source user and
+// tgtGroups those of the target (including the target itself for groups).
+// For group sets, srcGroups holds the set itself.
+type cacheEntry struct {
+	key       cacheKey
+	allowed   bool
+	ids       []int
+	srcGroups groupSet
+	tgtGroups groupSet
+	revision  Revision
+	expires   time.Time
+}
+
+// CachingRepository decorates a Repository with a bounded, TTL-limited cache of
+// permission decisions and transitive group sets. Writes made through the
+// decorator invalidate exactly the entries whose inputs they change.
+type CachingRepository struct {
+	Repository
+
+	config CacheConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	entries  map[cacheKey]*list.Element
+	lru      *list.List
+	stats    CacheStats
+	epoch    uint64   // incremented on every write, used to drop fills that raced with a write
+	revision Revision // highest revision observed through this decorator
+}
+
+// NewCachingRepository wraps repo with a permission decision cache
+func NewCachingRepository(repo Repository, config CacheConfig) *CachingRepository {
+	return &CachingRepository{
+		Repository: repo,
+		config:     config,
+		now:        time.Now,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *CachingRepository) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// lookup returns a live entry for key, counting the hit or miss
+func (c *CachingRepository) lookup(ctx context.Context, key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		minRev, hasMin := MinRevisionFromContext(ctx)
+		switch {
+		case !c.now().Before(entry.expires):
+			c.removeLocked(elem)
+			c.stats.Evictions++
+		case hasMin && entry.revision < minRev:
+			// Entry predates the revision the caller needs; refill it
+		default:
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			return entry, true
+		}
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+// snapshot returns the current write epoch and revision for a fill
+func (c *CachingRepository) snapshot() (epoch uint64, rev Revision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch, c.revision
+}
+
+// store inserts entry unless a write happened since the fill started at epoch
+func (c *CachingRepository) store(epoch uint64, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch || c.config.MaxEntries <= 0 {
+		return
+	}
+
+	entry.expires = c.now().Add(c.config.TTL)
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.MaxEntries {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachingRepository) removeLocked(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// invalidate removes every entry matching pred and records the write
+func (c *CachingRepository) invalidate(rev Revision, pred func(*cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.observeLocked(rev)
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if pred(elem.Value.(*cacheEntry)) {
+			c.removeLocked(elem)
+			c.stats.Invalidations++
+		}
+		elem = next
+	}
+}
+
+func (c *CachingRepository) observeLocked(rev Revision) {
+	if rev > c.revision {
+		c.revision = rev
+	}
+}
+
+// cachedIDs serves a group set from the cache or loads it from the wrapped repository
+func (c *CachingRepository) cachedIDs(ctx context.Context, key cacheKey, load func() ([]int, error)) ([]int, error) {
+	if entry, ok := c.lookup(ctx, key); ok {
+		return append([]int(nil), entry.ids...), nil
+	}
+
+	epoch, rev := c.snapshot()
+	ids, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{key: key, ids: append([]int(nil), ids...), revision: rev}
+	if key.kind != cacheKindUsersTransitive {
+		entry.srcGroups = newGroupSet(ids...)
+	}
+	c.store(epoch, entry)
+	return ids, nil
+}
+
+// cachedDecision serves a permission decision from the cache or computes it with
+// check. Decisions that evaluated conditions are not cached.
+func (c *CachingRepository) cachedDecision(ctx context.Context, key cacheKey, check func(ctx context.Context) (bool, error)) (bool, error) {
+	if entry, ok := c.lookup(ctx, key); ok {
+		return entry.allowed, nil
+	}
+
+	epoch, rev := c.snapshot()
+	checkCtx, probe := withConditionProbe(ctx)
+	allowed, err := check(checkCtx)
+	if err != nil {
+		return false, err
+	}
+	if probe.used() {
+		// The decision depends on attributes, the request or the time
+		return allowed, nil
+	}
+
+	// Record the groups the decision depends on; without them the entry
+	// could not be invalidated precisely, so it is not cached
+	srcGroups, err := c.GetGroupsForUserTransitive(ctx, key.a)
+	if err != nil {
+		return allowed, nil
+	}
+	var tgtGroups []int
+	if key.kind == cacheKindUserOnUser {
+		tgtGroups, err = c.GetGroupsForUserTransitive(ctx, key.b)
+	} else {
+		tgtGroups, err = c.GetAncestorGroups(ctx, key.b)
+		tgtGroups = append(tgtGroups, key.b)
+	}
+	if err != nil {
+		return allowed, nil
+	}
+
+	c.store(epoch, &cacheEntry{
+		key:       key,
+		allowed:   allowed,
+		srcGroups: newGroupSet(srcGroups...),
+		tgtGroups: newGroupSet(tgtGroups...),
+		revision:  rev,
+	})
+	return allowed, nil
+}
+
+// GetGroupsForUserTransitive returns the cached transitive groups of a user
+func (c *CachingRepository) GetGroupsForUserTransitive(ctx context.Context, userID int) ([]int, error) {
+	return c.cachedIDs(ctx, cacheKey{kind: cacheKindUserGroups, a: userID}, func() ([]int, error) {
+		return c.Repository.GetGroupsForUserTransitive(ctx, userID)
+	})
+}
+
+// GetAncestorGroups returns the cached transitive ancestors of a group
+func (c *CachingRepository) GetAncestorGroups(ctx context.Context, groupID int) ([]int, error) {
+	return c.cachedIDs(ctx, cacheKey{kind: cacheKindGroupAncestors, a: groupID}, func() ([]int, error) {
+		return c.Repository.GetAncestorGroups(ctx, groupID)
+	})
+}
+
+// GetUsersInGroupTransitive returns the cached transitive users of a group
+func (c *CachingRepository) GetUsersInGroupTransitive(ctx context.Context, groupID int) ([]int, error) {
+	return c.cachedIDs(ctx, cacheKey{kind: cacheKindUsersTransitive, a: groupID}, func() ([]int, error) {
+		return c.Repository.GetUsersInGroupTransitive(ctx, groupID)
+	})
+}
+
+// HasUserPermissionOnUser returns the cached decision for a user-on-user check
+func (c *CachingRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	return c.cachedDecision(ctx, cacheKey{kind: cacheKindUserOnUser, a: sourceUserID, b: targetUserID}, func(ctx context.Context) (bool, error) {
+		return c.Repository.HasUserPermissionOnUser(ctx, sourceUserID, targetUserID)
+	})
+}
+
+// HasUserPermissionOnGroup returns the cached decision for a user-on-group check
+func (c *CachingRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	return c.cachedDecision(ctx, cacheKey{kind: cacheKindUserOnGroup, a: sourceUserID, b: targetGroupID}, func(ctx context.Context) (bool, error) {
+		return c.Repository.HasUserPermissionOnGroup(ctx, sourceUserID, targetGroupID)
+	})
+}
+
+// transitiveSetsAbove returns a predicate matching the transitive user sets of
+// groupID and all of its ancestors, which are the sets a change below groupID affects
+func (c *CachingRepository) transitiveSetsAbove(ctx context.Context, groupID int) func(*cacheEntry) bool {
+	ancestors, err := c.GetAncestorGroups(ctx, groupID)
+	if err != nil {
+		// Without the ancestors we cannot tell which sets are affected
+		return func(e *cacheEntry) bool { return e.key.kind == cacheKindUsersTransitive }
+	}
+	affected := newGroupSet(append(ancestors, groupID)...)
+	return func(e *cacheEntry) bool {
+		return e.key.kind == cacheKindUsersTransitive && affected.has(e.key.a)
+	}
+}
+
+// AddUserToGroup adds a user to a group and invalidates entries involving the user
+func (c *CachingRepository) AddUserToGroup(ctx context.Context, userID, groupID int) (Revision, error) {
+	rev, err := c.Repository.AddUserToGroup(ctx, userID, groupID)
+	if err != nil {
+		return rev, err
+	}
+
+	affectsTransitive := c.transitiveSetsAbove(ctx, groupID)
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		switch e.key.kind {
+		case cacheKindUserOnUser:
+			return e.key.a == userID || e.key.b == userID
+		case cacheKindUserOnGroup, cacheKindUserGroups:
+			return e.key.a == userID
+		case cacheKindUsersTransitive:
+			return affectsTransitive(e)
+		default:
+			return false
+		}
+	})
+	return rev, nil
+}
+
+// SetAttribute sets an attribute. A user attribute can move the user in or out of
+// dynamic groups, so the user's groups are compared before and after the write and
+// entries involving the user are invalidated if they changed.
+func (c *CachingRepository) SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error) {
+	if subjectType != "user" {
+		return c.Repository.SetAttribute(ctx, subjectType, subjectID, name, value)
+	}
+
+	before, beforeErr := c.Repository.GetGroupsForUserTransitive(ctx, subjectID)
+	rev, err := c.Repository.SetAttribute(ctx, subjectType, subjectID, name, value)
+	if err != nil {
+		return rev, err
+	}
+	after, afterErr := c.Repository.GetGroupsForUserTransitive(ctx, subjectID)
+	changed := difference(before, after)
+	if beforeErr == nil && afterErr == nil && len(changed) == 0 {
+		return rev, nil
+	}
+
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		switch e.key.kind {
+		case cacheKindUserOnUser:
+			return e.key.a == subjectID || e.key.b == subjectID
+		case cacheKindUserOnGroup, cacheKindUserGroups:
+			return e.key.a == subjectID
+		case cacheKindUsersTransitive:
+			// Without both group lists every transitive set may be affected
+			return beforeErr != nil || afterErr != nil || changed.has(e.key.a)
+		default:
+			return false
+		}
+	})
+	return rev, nil
+}
+
+// SetUserStatus sets the status of a user and invalidates the decisions with the
+// user as source. Memberships are kept, so cached group sets stay valid.
+func (c *CachingRepository) SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error) {
+	rev, err := c.Repository.SetUserStatus(ctx, userID, status)
+	if err != nil {
+		return rev, err
+	}
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		return (e.key.kind == cacheKindUserOnUser || e.key.kind == cacheKindUserOnGroup) && e.key.a == userID
+	})
+	return rev, nil
+}
+
+// SetGroupRule sets the membership rule of a group and invalidates entries
+// involving the users who joined or left it
+func (c *CachingRepository) SetGroupRule(ctx context.Context, groupID int, rule string) (Revision, error) {
+	before, beforeErr := c.Repository.GetUsersInGroup(ctx, groupID)
+	rev, err := c.Repository.SetGroupRule(ctx, groupID, rule)
+	if err != nil {
+		return rev, err
+	}
+	after, afterErr := c.Repository.GetUsersInGroup(ctx, groupID)
+	changed := difference(before, after)
+	if beforeErr == nil && afterErr == nil && len(changed) == 0 {
+		return rev, nil
+	}
+
+	unknown := beforeErr != nil || afterErr != nil
+	affectsTransitive := c.transitiveSetsAbove(ctx, groupID)
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		switch e.key.kind {
+		case cacheKindUserOnUser:
+			return unknown || changed.has(e.key.a) || changed.has(e.key.b)
+		case cacheKindUserOnGroup, cacheKindUserGroups:
+			return unknown || changed.has(e.key.a)
+		case cacheKindUsersTransitive:
+			return affectsTransitive(e)
+		default:
+			return false
+		}
+	})
+	return rev, nil
+}
+
+// difference returns the IDs that are in exactly one of a and b
+func difference(a, b []int) groupSet {
+	inA := newGroupSet(a...)
+	inB := newGroupSet(b...)
+	diff := make(groupSet)
+	for id := range inA {
+		if !inB.has(id) {
+			diff[id] = struct{}{}
+		}
+	}
+	for id := range inB {
+		if !inA.has(id) {
+			diff[id] = struct{}{}
+		}
+	}
+	return diff
+}
+
+// AddGroupToGroup adds a child group to a parent group and invalidates entries
+// that depend on the child's position in the hierarchy
+func (c *CachingRepository) AddGroupToGroup(ctx context.Context, childID, parentID int) (Revision, error) {
+	rev, err := c.Repository.AddGroupToGroup(ctx, childID, parentID)
+	if err != nil {
+		return rev, err
+	}
+
+	affectsTransitive := c.transitiveSetsAbove(ctx, parentID)
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		switch e.key.kind {
+		case cacheKindUserOnUser, cacheKindUserOnGroup, cacheKindUserGroups:
+			return e.srcGroups.has(childID) || e.tgtGroups.has(childID)
+		case cacheKindGroupAncestors:
+			return e.key.a == childID || e.srcGroups.has(childID)
+		case cacheKindUsersTransitive:
+			return affectsTransitive(e)
+		default:
+			return false
+		}
+	})
+	return rev, nil
+}
+
+// MoveGroup moves a child group from one parent group to another and invalidates
+// entries that depend on the child's position in the hierarchy, below either parent
+func (c *CachingRepository) MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (Revision, error) {
+	rev, err := c.Repository.MoveGroup(ctx, childID, fromParentID, toParentID)
+	if err != nil || fromParentID == toParentID {
+		return rev, err
+	}
+
+	belowFrom := c.transitiveSetsAbove(ctx, fromParentID)
+	belowTo := c.transitiveSetsAbove(ctx, toParentID)
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		switch e.key.kind {
+		case cacheKindUserOnUser, cacheKindUserOnGroup, cacheKindUserGroups:
+			return e.srcGroups.has(childID) || e.tgtGroups.has(childID)
+		case cacheKindGroupAncestors:
+			return e.key.a == childID || e.srcGroups.has(childID)
+		case cacheKindUsersTransitive:
+			return belowFrom(e) || belowTo(e)
+		default:
+			return false
+		}
+	})
+	return rev, nil
+}
+
+// AddPermission adds a permission record and invalidates the decisions it can change
+func (c *CachingRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	rev, err := c.Repository.AddPermission(ctx, sourceType, targetType, sourceID, targetID)
+	if err != nil {
+		return rev, err
+	}
+	c.invalidateGrant(rev, sourceType, targetType, sourceID, targetID)
+	return rev, nil
+}
+
+// AddConditionalPermission adds a conditional permission record and invalidates the
+// decisions it can change. Replacing an unconditional grant can revoke access, so
+// allowed decisions are invalidated as well.
+func (c *CachingRepository) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	rev, err := c.Repository.AddConditionalPermission(ctx, sourceType, targetType, sourceID, targetID, condition)
+	if err != nil {
+		return rev, err
+	}
+	c.invalidateGrant(rev, sourceType, targetType, sourceID, targetID)
+	return rev, nil
+}
+
+// invalidateGrant invalidates the decisions a grant of sourceID on targetID can change
+func (c *CachingRepository) invalidateGrant(rev Revision, sourceType, targetType string, sourceID, targetID int) {
+	c.invalidate(rev, func(e *cacheEntry) bool {
+		if e.key.kind != cacheKindUserOnUser && e.key.kind != cacheKindUserOnGroup {
+			return false
+		}
+
+		sourceMatches := (sourceType == "user" && e.key.a == sourceID) ||
+			(sourceType == "group" && e.srcGroups.has(sourceID))
+		targetMatches := (targetType == "user" && e.key.kind == cacheKindUserOnUser && e.key.b == targetID) ||
+			(targetType == "group" && e.tgtGroups.has(targetID))
+		return sourceMatches && targetMatches
+	})
+}
+
+// CurrentRevision returns the wrapped repository's revision and records it as observed
+func (c *CachingRepository) CurrentRevision(ctx context.Context) (Revision, error) {
+	rev, err := c.Repository.CurrentRevision(ctx)
+	if err != nil {
+		return rev, err
+	}
+
+	c.mu.Lock()
+	c.observeLocked(rev)
+	c.mu.Unlock()
+	return rev, nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test helper to create a caching repository over an in-memory fake
+func setupCachingRepository(t *testing.T, config CacheConfig) (*CachingRepository, *fakeRepository) {
+	t.Helper()
+
+	inner := newFakeRepository()
+	return NewCachingRepository(inner, config), inner
+}
+
+func Test_Cache_HitAfterMiss(t *testing.T) {
+	cache, inner := setupCachingRepository(t, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+	if _, err := cache.AddPermission(ctx, "user", "user", alice, bob); err != nil {
+		t.Fatalf("AddPermission failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		allowed, err := cache.HasUserPermissionOnUser(ctx, alice, bob)
+		if err != nil {
+			t.Fatalf("HasUserPermissionOnUser failed: %v", err)
+		}
+		if !allowed {
+			t.Error("Expected permission to be granted")
+		}
+	}
+
+	if got := inner.checkCount(); got != 1 {
+		t.Errorf("Expected 1 check against the wrapped repository, got %d", got)
+	}
+	stats := cache.Stats()
+	if stats.Hits < 2 {
+		t.Errorf("Expected at least 2 hits, got %d", stats.Hits)
+	}
+	if stats.HitRate() <= 0 {
+		t.Errorf("Expected positive hit rate, got %f", stats.HitRate())
+	}
+}
+
+func Test_Cache_PermissionInvalidatesOnlyAffectedDecisions(t *testing.T) {
+	cache, inner := setupCachingRepository(t, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+	charlie, _ := cache.CreateUser(ctx, "Charlie")
+	dave, _ := cache.CreateUser(ctx, "Dave")
+	admins, _ := cache.CreateUserGroup(ctx, "Admins")
+	guests, _ := cache.CreateUserGroup(ctx, "Guests")
+	_, _ = cache.AddUserToGroup(ctx, alice, admins)
+	_, _ = cache.AddUserToGroup(ctx, charlie, guests)
+
+	// Warm the cache with two unrelated denied decisions
+	for _, pair := range [][2]int{{alice, bob}, {charlie, dave}} {
+		if allowed, _ := cache.HasUserPermissionOnUser(ctx, pair[0], pair[1]); allowed {
+			t.Fatalf("Expected no permission for %v", pair)
+		}
+	}
+	before := inner.checkCount()
+
+	// Granting admins access to bob only affects decisions sourced from admins
+	if _, err := cache.AddPermission(ctx, "group", "user", admins, bob); err != nil {
+		t.Fatalf("AddPermission failed: %v", err)
+	}
+
+	allowed, _ := cache.HasUserPermissionOnUser(ctx, alice, bob)
+	if !allowed {
+		t.Error("Expected alice to gain access to bob through admins")
+	}
+	if allowed, _ := cache.HasUserPermissionOnUser(ctx, charlie, dave); allowed {
+		t.Error("Expected charlie to still be denied access to dave")
+	}
+
+	if got := inner.checkCount() - before; got != 1 {
+		t.Errorf("Expected exactly 1 re-check after invalidation, got %d", got)
+	}
+}
+
+func Test_Cache_HierarchyChangeInvalidatesDependents(t *testing.T) {
+	cache, inner := setupCachingRepository(t, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+	company, _ := cache.CreateUserGroup(ctx, "Company")
+	team, _ := cache.CreateUserGroup(ctx, "Team")
+	other, _ := cache.CreateUserGroup(ctx, "Other")
+	_, _ = cache.AddUserToGroup(ctx, bob, team)
+	_, _ = cache.AddPermission(ctx, "user", "group", alice, company)
+
+	// Alice cannot see team or bob until team is nested in company
+	if allowed, _ := cache.HasUserPermissionOnGroup(ctx, alice, team); allowed {
+		t.Fatal("Expected alice to be denied access to team")
+	}
+	if allowed, _ := cache.HasUserPermissionOnUser(ctx, alice, bob); allowed {
+		t.Fatal("Expected alice to be denied access to bob")
+	}
+	if allowed, _ := cache.HasUserPermissionOnGroup(ctx, alice, other); allowed {
+		t.Fatal("Expected alice to be denied access to other")
+	}
+	before := inner.checkCount()
+
+	if _, err := cache.AddGroupToGroup(ctx, team, company); err != nil {
+		t.Fatalf("AddGroupToGroup failed: %v", err)
+	}
+
+	if allowed, _ := cache.HasUserPermissionOnGroup(ctx, alice, team); !allowed {
+		t.Error("Expected alice to gain access to team")
+	}
+	if allowed, _ := cache.HasUserPermissionOnUser(ctx, alice, bob); !allowed {
+		t.Error("Expected alice to gain access to bob")
+	}
+	if allowed, _ := cache.HasUserPermissionOnGroup(ctx, alice, other); allowed {
+		t.Error("Expected alice to still be denied access to other")
+	}
+
+	if got := inner.checkCount() - before; got != 2 {
+		t.Errorf("Expected 2 re-checks after invalidation, got %d", got)
+	}
+}
+
+func Test_Cache_TransitiveUsersInvalidation(t *testing.T) {
+	cache, _ := setupCachingRepository(t, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+	company, _ := cache.CreateUserGroup(ctx, "Company")
+	team, _ := cache.CreateUserGroup(ctx, "Team")
+	other, _ := cache.CreateUserGroup(ctx, "Other")
+	_, _ = cache.AddGroupToGroup(ctx, team, company)
+	_, _ = cache.AddUserToGroup(ctx, alice, other)
+
+	if users, _ := cache.GetUsersInGroupTransitive(ctx, company); len(users) != 0 {
+		t.Fatalf("Expected empty company, got %v", users)
+	}
+	if users, _ := cache.GetUsersInGroupTransitive(ctx, other); len(users) != 1 {
+		t.Fatalf("Expected 1 user in other, got %v", users)
+	}
+	invalidationsBefore := cache.Stats().Invalidations
+
+	// Adding bob to the nested team changes company's transitive set only
+	_, _ = cache.AddUserToGroup(ctx, bob, team)
+
+	users, _ := cache.GetUsersInGroupTransitive(ctx, company)
+	if len(users) != 1 || users[0] != bob {
+		t.Errorf("Expected company to contain bob, got %v", users)
+	}
+	if got := cache.Stats().Invalidations - invalidationsBefore; got != 1 {
+		t.Errorf("Expected 1 invalidated entry, got %d", got)
+	}
+}
+
+func Test_Cache_TTLAndSizeBound(t *testing.T) {
+	cache, inner := setupCachingRepository(t, CacheConfig{MaxEntries: 2, TTL: time.Minute})
+	ctx := context.Background()
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+
+	t.Run("expires after TTL", func(t *testing.T) {
+		before := inner.checkCount()
+		_, _ = cache.HasUserPermissionOnUser(ctx, alice, bob)
+		_, _ = cache.HasUserPermissionOnUser(ctx, alice, bob)
+		now = now.Add(2 * time.Minute)
+		_, _ = cache.HasUserPermissionOnUser(ctx, alice, bob)
+
+		if got := inner.checkCount() - before; got != 2 {
+			t.Errorf("Expected 2 checks against the wrapped repository, got %d", got)
+		}
+	})
+
+	t.Run("evicts least recently used", func(t *testing.T) {
+		_, _ = cache.HasUserPermissionOnUser(ctx, bob, alice)
+		_, _ = cache.HasUserPermissionOnGroup(ctx, bob, 12345)
+
+		cache.mu.Lock()
+		size := cache.lru.Len()
+		cache.mu.Unlock()
+		if size > 2 {
+			t.Errorf("Expected at most 2 entries, got %d", size)
+		}
+		if cache.Stats().Evictions == 0 {
+			t.Error("Expected evictions to be counted")
+		}
+	})
+}
+
+func Test_Cache_MinRevisionBypassesOlderEntries(t *testing.T) {
+	cache, inner := setupCachingRepository(t, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := cache.CreateUser(ctx, "Alice")
+	bob, _ := cache.CreateUser(ctx, "Bob")
+	_, _ = cache.HasUserPermissionOnUser(ctx, alice, bob)
+
+	// A write that bypasses the cache, e.g. from another process
+	rev, _ := inner.AddPermission(ctx, "user", "user", alice, bob)
+
+	if allowed, _ := cache.HasUserPermissionOnUser(ctx, alice, bob); allowed {
+		t.Fatal("Expected cached denial without a minimum revision")
+	}
+
+	readCtx := WithMinRevision(ctx, rev)
+	if _, err := cache.CurrentRevision(readCtx); err != nil {
+		t.Fatalf("CurrentRevision failed: %v", err)
+	}
+	if allowed, _ := cache.HasUserPermissionOnUser(readCtx, alice, bob); !allowed {
+		t.Error("Expected fresh decision at the required revision")
+	}
+}
+
+func Test_Cache_OverMySQLRepository(t *testing.T) {
+	config := DefaultConfig()
+	db, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	s := New(NewCachingRepository(NewMySQLRepository(db), DefaultCacheConfig()))
+	defer s.Close()
+	ctx := context.Background()
+
+	admin, _ := s.CreateUser(ctx, "Admin")
+	developer, _ := s.CreateUser(ctx, "Developer")
+	admins, _ := s.CreateUserGroup(ctx, "Admins")
+	company, _ := s.CreateUserGroup(ctx, "Company")
+	team, _ := s.CreateUserGroup(ctx, "Team")
+	if err := s.AddUserToGroup(ctx, admin, admins); err != nil {
+		t.Fatalf("AddUserToGroup failed: %v", err)
+	}
+	if err := s.AddUserToGroup(ctx, developer, team); err != nil {
+		t.Fatalf("AddUserToGroup failed: %v", err)
+	}
+	if err := s.AddUserGroupToUserGroupPermission(ctx, admins, company); err != nil {
+		t.Fatalf("AddUserGroupToUserGroupPermission failed: %v", err)
+	}
+
+	// Denied and cached before the team joins the company
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, admin, developer); err == nil {
+		t.Fatal("Expected permission denied before nesting team in company")
+	}
+
+	if err := s.AddUserGroupToGroup(ctx, team, company); err != nil {
+		t.Fatalf("AddUserGroupToGroup failed: %v", err)
+	}
+
+	name, err := s.GetUserNameWithPermissionCheck(ctx, admin, developer)
+	if err != nil {
+		t.Fatalf("GetUserNameWithPermissionCheck failed after nesting: %v", err)
+	}
+	if name != "Developer" {
+		t.Errorf("Expected name 'Developer', got %q", name)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ChangeEventType identifies the kind of access change an event records
+type ChangeEventType string
+
+// Change event types. Membership events use a user subject and a group object,
+// edge events a child group subject and a parent group object, and permission
+// events the permission's source as subject and its target as object. Edge moved
+// events use the new parent as object and carry the old parent as previous object.
+// User status events use the user as both subject and object and carry the new status,
+// and rule changed events use the dynamic group as both subject and object.
+const (
+	EventMembershipAdded   ChangeEventType = "membership_added"
+	EventMembershipRemoved ChangeEventType = "membership_removed"
+	EventEdgeAdded         ChangeEventType = "edge_added"
+	EventEdgeRemoved       ChangeEventType = "edge_removed"
+	EventEdgeMoved         ChangeEventType = "edge_moved"
+	EventPermissionGranted ChangeEventType = "permission_granted"
+	EventPermissionRevoked ChangeEventType = "permission_revoked"
+	EventUserStatusChanged ChangeEventType = "user_status_changed"
+	EventRuleChanged       ChangeEventType = "rule_changed"
+)
+
+// ChangeEvent is one committed access change, ordered by revision
+type ChangeEvent struct {
+	Revision         Revision        `json:"revision"`
+	Type             ChangeEventType `json:"type"`
+	SubjectType      string          `json:"subject_type"` // "user" or "group"
+	SubjectID        int             `json:"subject_id"`
+	ObjectType       string          `json:"object_type"` // "user" or "group"
+	ObjectID         int             `json:"object_id"`
+	Status           UserStatus      `json:"status,omitempty"`             // new status of user_status_changed events
+	PreviousObjectID int             `json:"previous_object_id,omitempty"` // old parent group of edge_moved events
+	CreatedAt        time.Time       `json:"created_at"`
+}
+
+// membershipAddedEvent describes a user joining a group
+func membershipAddedEvent(userID, groupID int) ChangeEvent {
+	return ChangeEvent{Type: EventMembershipAdded, SubjectType: "user", SubjectID: userID, ObjectType: "group", ObjectID: groupID}
+}
+
+// membershipRemovedEvent describes a user leaving a group
+func membershipRemovedEvent(userID, groupID int) ChangeEvent {
+	return ChangeEvent{Type: EventMembershipRemoved, SubjectType: "user", SubjectID: userID, ObjectType: "group", ObjectID: groupID}
+}
+
+// edgeAddedEvent describes a group being nested in another group
+func edgeAddedEvent(childID, parentID int) ChangeEvent {
+	return ChangeEvent{Type: EventEdgeAdded, SubjectType: "group", SubjectID: childID, ObjectType: "group", ObjectID: parentID}
+}
+
+// edgeMovedEvent describes a group being moved from one parent group to another
+func edgeMovedEvent(childID, fromParentID, toParentID int) ChangeEvent {
+	return ChangeEvent{
+		Type:             EventEdgeMoved,
+		SubjectType:      "group",
+		SubjectID:        childID,
+		ObjectType:       "group",
+		ObjectID:         toParentID,
+		PreviousObjectID: fromParentID,
+	}
+}
+
+// permissionGrantedEvent describes a new permission record
+func permissionGrantedEvent(sourceType, targetType string, sourceID, targetID int) ChangeEvent {
+	return ChangeEvent{
+		Type:        EventPermissionGranted,
+		SubjectType: sourceType,
+		SubjectID:   sourceID,
+		ObjectType:  targetType,
+		ObjectID:    targetID,
+	}
+}
+
+// ruleChangedEvent describes the membership rule of a group being set or cleared
+func ruleChangedEvent(groupID int) ChangeEvent {
+	return ChangeEvent{Type: EventRuleChanged, SubjectType: "group", SubjectID: groupID, ObjectType: "group", ObjectID: groupID}
+}
+
+// Watch tuning
+const (
+	watchPollInterval = 250 * time.Millisecond
+	watchBatchSize    = 100
+
+	// watchGapTimeout bounds how long Watch holds back events behind a missing
+	// revision. The repositories commit revisions in ID order, the SQL ones under
+	// the revisions lock, so a missing revision behind a later one belongs to a
+	// transaction that rolled back and never fills in. Watch still waits briefly
+	// for Repository implementations that allocate revisions out of commit order.
+	watchGapTimeout = 2 * time.Second
+)
+
+// Watch streams change events with a revision greater than fromRevision to fn, in
+// revision order, until ctx is canceled or fn returns an error. To resume after a
+// disconnect, pass the revision of the last event that was processed.
+func (s *Server) Watch(ctx context.Context, fromRevision Revision, fn func(ChangeEvent) error) error {
+	cursor := fromRevision
+	var gapSince time.Time
+
+	for {
+		events, err := s.repo.ListChanges(ctx, cursor, watchBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to list changes: %w", err)
+		}
+
+		for _, event := range events {
+			if event.Revision != cursor+1 {
+				if gapSince.IsZero() {
+					gapSince = time.Now()
+				}
+				if time.Since(gapSince) < watchGapTimeout {
+					break
+				}
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+			cursor = event.Revision
+			gapSince = time.Time{}
+		}
+
+		// Poll again right away while a full batch was delivered
+		if len(events) == watchBatchSize && gapSince.IsZero() {
+			continue
+		}
+
+		timer := time.NewTimer(watchPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
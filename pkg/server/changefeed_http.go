@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ChangeFeedHandler streams change events as Server-Sent Events.
+// Each event carries its revision token as the SSE id, so clients resume after a
+// reconnect through the Last-Event-ID header (sent automatically by EventSource)
+// or explicitly with a "from" query parameter.
+type ChangeFeedHandler struct {
+	server *Server
+}
+
+// NewChangeFeedHandler creates a ChangeFeedHandler for the given server
+func NewChangeFeedHandler(server *Server) *ChangeFeedHandler {
+	return &ChangeFeedHandler{server: server}
+}
+
+func (h *ChangeFeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	from, err := resumeRevision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = h.server.Watch(r.Context(), from, func(event ChangeEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Revision, event.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && !errors.Is(err, r.Context().Err()) {
+		// Headers are already sent; report the failure as a final SSE event
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+		flusher.Flush()
+	}
+}
+
+// resumeRevision returns the revision to stream from, preferring Last-Event-ID over the "from" query parameter
+func resumeRevision(r *http.Request) (Revision, error) {
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = r.URL.Query().Get("from")
+	}
+	if token == "" {
+		return 0, nil
+	}
+	return ParseRevision(token)
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// errStopWatch ends a Watch call once a test has seen the events it needs
+var errStopWatch = errors.New("stop watching")
+
+// collectEvents watches from fromRevision until count events have been received
+func collectEvents(t *testing.T, s *Server, fromRevision Revision, count int) []ChangeEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var events []ChangeEvent
+	err := s.Watch(ctx, fromRevision, func(event ChangeEvent) error {
+		events = append(events, event)
+		if len(events) == count {
+			return errStopWatch
+		}
+		return nil
+	})
+	if !errors.Is(err, errStopWatch) {
+		t.Fatalf("Watch returned %v after %d of %d events", err, len(events), count)
+	}
+	return events
+}
+
+func Test_ChangeFeed_WatchStreamsOrderedEventsAndResumes(t *testing.T) {
+	s := New(newFakeRepository())
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	parent, _ := s.CreateUserGroup(ctx, "Parent")
+	child, _ := s.CreateUserGroup(ctx, "Child")
+	_ = s.AddUserToGroup(ctx, alice, child)
+	_ = s.AddUserGroupToGroup(ctx, child, parent)
+	_ = s.AddUserToUserGroupPermission(ctx, alice, parent)
+
+	events := collectEvents(t, s, 0, 3)
+	wantTypes := []ChangeEventType{EventMembershipAdded, EventEdgeAdded, EventPermissionGranted}
+	for i, event := range events {
+		if event.Type != wantTypes[i] {
+			t.Errorf("Event %d: expected type %s, got %s", i, wantTypes[i], event.Type)
+		}
+		if i > 0 && event.Revision <= events[i-1].Revision {
+			t.Errorf("Event %d: revisions not increasing", i)
+		}
+	}
+	if events[1].SubjectID != child || events[1].ObjectID != parent {
+		t.Errorf("Expected edge %d -> %d, got %+v", child, parent, events[1])
+	}
+
+	// Resuming from the first event delivers only the later ones
+	resumed := collectEvents(t, s, events[0].Revision, 2)
+	if resumed[0].Revision != events[1].Revision {
+		t.Errorf("Expected resume at revision %s, got %s", events[1].Revision, resumed[0].Revision)
+	}
+}
+
+func Test_ChangeFeed_WatchDeliversNewEvents(t *testing.T) {
+	s := New(newFakeRepository())
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	group, _ := s.CreateUserGroup(ctx, "Group")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = s.AddUserToGroup(ctx, alice, group)
+	}()
+
+	events := collectEvents(t, s, 0, 1)
+	if events[0].Type != EventMembershipAdded || events[0].SubjectID != alice {
+		t.Errorf("Unexpected event %+v", events[0])
+	}
+}
+
+// readSSEIDs reads count event ids from an SSE response body
+func readSSEIDs(t *testing.T, resp *http.Response, count int) []string {
+	t.Helper()
+
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < count && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) < count {
+		t.Fatalf("Expected %d events, got %d (%v)", count, len(ids), scanner.Err())
+	}
+	return ids
+}
+
+func Test_ChangeFeed_ServerSentEvents(t *testing.T) {
+	s := New(newFakeRepository())
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	group, _ := s.CreateUserGroup(ctx, "Group")
+	_ = s.AddUserToGroup(ctx, alice, group)
+	_ = s.AddUserToGroup(ctx, bob, group)
+	_ = s.AddUserToUserPermission(ctx, alice, bob)
+
+	httpServer := httptest.NewServer(NewChangeFeedHandler(s))
+	defer httpServer.Close()
+
+	stream := func(lastEventID string) *http.Response {
+		reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(reqCtx, "GET", httpServer.URL, http.NoBody)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Expected text/event-stream, got %q", ct)
+		}
+		return resp
+	}
+
+	ids := readSSEIDs(t, stream(""), 3)
+
+	// Reconnecting with the first id resumes after it
+	resumed := readSSEIDs(t, stream(ids[0]), 2)
+	if resumed[0] != ids[1] || resumed[1] != ids[2] {
+		t.Errorf("Expected resumed ids %v, got %v", ids[1:], resumed)
+	}
+}
+
+func Test_ChangeFeed_OutboxWrittenWithMutation(t *testing.T) {
+	s := setupTestServer(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	admins, _ := s.CreateUserGroup(ctx, "Admins")
+	company, _ := s.CreateUserGroup(ctx, "Company")
+
+	first, err := s.AddUserToGroupWithRevision(ctx, alice, admins)
+	if err != nil {
+		t.Fatalf("AddUserToGroupWithRevision failed: %v", err)
+	}
+	if err := s.AddUserGroupToGroup(ctx, admins, company); err != nil {
+		t.Fatalf("AddUserGroupToGroup failed: %v", err)
+	}
+	// A rejected mutation must not produce an event
+	if err := s.AddUserGroupToGroup(ctx, company, admins); err == nil {
+		t.Fatal("Expected cycle error")
+	}
+	if err := s.AddUserGroupToUserGroupPermission(ctx, admins, company); err != nil {
+		t.Fatalf("AddUserGroupToUserGroupPermission failed: %v", err)
+	}
+
+	// Other tests may write concurrently, so filter for this test's events
+	var mine []ChangeEvent
+	ctxWatch, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = s.Watch(ctxWatch, first-1, func(event ChangeEvent) error {
+		if event.SubjectID == alice || event.SubjectID == admins || event.SubjectID == company {
+			mine = append(mine, event)
+		}
+		if len(mine) == 3 {
+			return errStopWatch
+		}
+		return nil
+	})
+	if !errors.Is(err, errStopWatch) {
+		t.Fatalf("Watch returned %v with events %+v", err, mine)
+	}
+
+	want := []ChangeEvent{
+		{Type: EventMembershipAdded, SubjectType: "user", SubjectID: alice, ObjectType: "group", ObjectID: admins},
+		{Type: EventEdgeAdded, SubjectType: "group", SubjectID: admins, ObjectType: "group", ObjectID: company},
+		{Type: EventPermissionGranted, SubjectType: "group", SubjectID: admins, ObjectType: "group", ObjectID: company},
+	}
+	for i, event := range mine {
+		if event.Revision == 0 || event.CreatedAt.IsZero() {
+			t.Errorf("Event %d: missing revision or timestamp: %+v", i, event)
+		}
+		event.Revision, event.CreatedAt = 0, time.Time{}
+		if event != want[i] {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], event)
+		}
+	}
+}
+
+func Test_Integration_ChangeFeedOverHTTP(t *testing.T) {
+	httpServer, server := setupHTTPTestServer(t)
+	defer httpServer.Close()
+	defer server.Close()
+	baseURL := httpServer.URL
+
+	alice := createUserViaHTTP(t, baseURL, "Alice")
+	group := createGroupViaHTTP(t, baseURL, "Group")
+
+	rev, err := server.repo.CurrentRevision(context.Background())
+	if err != nil {
+		t.Fatalf("CurrentRevision failed: %v", err)
+	}
+	addUserToGroupViaHTTP(t, baseURL, alice, group)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", baseURL+"/changes?from="+rev.String(), http.NoBody)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open change feed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ids := readSSEIDs(t, resp, 1); ids[0] == "" {
+		t.Error("Expected an event id")
+	}
+}
+
+// runRevisionOrder polls the change feed of repo while concurrent writers commit
+// mutations of different sizes, and checks that no revision missing behind a later
+// one commits afterwards, which Watch would skip
+func runRevisionOrder(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	start, err := repo.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("CurrentRevision failed: %v", err)
+	}
+
+	var writers sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			group, err := repo.CreateUserGroup(ctx, fmt.Sprintf("Order %d", w))
+			if err != nil {
+				errs <- err
+				return
+			}
+			team := fmt.Sprintf("order-%d", group)
+			for i := 0; i < 10; i++ {
+				user, err := repo.CreateUser(ctx, "Writer")
+				if err == nil {
+					_, err = repo.SetAttribute(ctx, "user", user, "dyn_team", team)
+				}
+				if err == nil && w%2 == 0 {
+					_, err = repo.AddUserToGroup(ctx, user, group)
+				} else if err == nil {
+					// Rewriting every member makes a slow transaction
+					_, err = repo.SetGroupRule(ctx, group, fmt.Sprintf("user.dyn_team == %q", team))
+					if err == nil {
+						_, err = repo.SetGroupRule(ctx, group, "")
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() { writers.Wait(); close(done) }()
+
+	// Collect the revisions that were missing behind a visible later revision
+	missing := make(map[Revision]bool)
+	cursor := start
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		events, err := repo.ListChanges(ctx, cursor, 1000)
+		if err != nil {
+			t.Fatalf("ListChanges failed: %v", err)
+		}
+		for _, e := range events {
+			for r := cursor + 1; r < e.Revision; r++ {
+				missing[r] = true
+			}
+			cursor = e.Revision
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Writer failed: %v", err)
+	}
+
+	for cursor = start; ; {
+		events, err := repo.ListChanges(ctx, cursor, 1000)
+		if err != nil {
+			t.Fatalf("ListChanges failed: %v", err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, e := range events {
+			if missing[e.Revision] {
+				t.Errorf("Revision %s committed after a later revision was visible", e.Revision)
+			}
+			cursor = e.Revision
+		}
+	}
+}
+
+func Test_ChangeFeed_RevisionsCommitInOrder(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		repo := openFileRepository(t, t.TempDir())
+		defer repo.Close()
+		runRevisionOrder(t, repo)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		repo := NewSQLRepository(sqliteTestDB(t), SQLiteDialect{})
+		defer repo.Close()
+		runRevisionOrder(t, repo)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		repo := NewMySQLRepository(db)
+		defer repo.Close()
+		runRevisionOrder(t, repo)
+	})
+}
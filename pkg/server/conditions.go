@@ -0,0 +1,721 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Condition limits. Together with the grammar, which has no loops, calls or
+// assignments, they bound the time and memory an evaluation can take.
+const (
+	// MaxConditionLength is the longest accepted condition in bytes
+	MaxConditionLength = 1024
+
+	// maxConditionDepth bounds the nesting of parentheses and operators
+	maxConditionDepth = 32
+)
+
+// Condition is a parsed permission condition: a boolean expression over the
+// attributes of the source user, the target user or group, the request and the
+// current time. For example:
+//
+//	source.department == target.department
+//	request.tenant == "acme" && "admin" in source.roles
+//	now.weekday in [1, 2, 3, 4, 5] && now.hour >= 9 && now.hour < 17
+//
+// Values are read from paths: source.<attribute> and target.<attribute> are
+// attributes of the subjects of the check, request.<name> the request attributes
+// of the context (see WithRequestAttributes), and now.hour, now.minute and
+// now.weekday (0 is Sunday) the evaluation time in UTC, or in the time zone of
+// WithConditionLocation. Literals are strings in double quotes, integers, true,
+// false and lists in brackets.
+//
+// Operators are ==, !=, <, <=, >, >= (integers only), in (membership in a list),
+// !, && and ||, with the usual precedence, and parentheses. A comparison involving
+// a missing attribute or values of different types is unknown rather than false,
+// unknown propagates through ! and is only resolved by && with a false or || with
+// a true operand. A condition that is not true grants nothing.
+type Condition struct {
+	expr string
+	root condNode
+
+	// usesSource and usesTarget tell which attributes an evaluation must load
+	usesSource, usesTarget bool
+}
+
+// ConditionInput is the data a condition is evaluated against
+type ConditionInput struct {
+	Source  Attributes // attributes of the source user, or of the user a membership rule is checked for
+	Target  Attributes // attributes of the target user or group
+	Request Attributes // request attributes, see WithRequestAttributes
+	Now     time.Time
+	// Location is the time zone of now.hour, now.minute and now.weekday, UTC if nil
+	Location *time.Location
+}
+
+// ParseCondition parses and validates expr. Syntax errors, unknown paths and
+// operands of the wrong type fail with a ConditionError.
+func ParseCondition(expr string) (*Condition, error) {
+	return parseExpression(expr, conditionRoots)
+}
+
+// parseExpression parses expr as a boolean expression over paths from roots
+func parseExpression(expr string, roots pathRoots) (*Condition, error) {
+	if len(expr) > MaxConditionLength {
+		return nil, &ConditionError{Condition: expr, Reason: fmt.Sprintf("longer than %d bytes", MaxConditionLength)}
+	}
+	tokens, err := lexCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{expr: expr, tokens: tokens, roots: roots}
+	root, kind, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorAt(tok, "unexpected "+tok.describe())
+	}
+	if kind != kindBool && kind != kindAny {
+		return nil, p.errorAt(tokens[0], "the condition is not a boolean expression")
+	}
+	return &Condition{expr: expr, root: root, usesSource: p.usesSource, usesTarget: p.usesTarget}, nil
+}
+
+// String returns the condition as it was written
+func (c *Condition) String() string {
+	return c.expr
+}
+
+// Evaluate reports whether the condition is true for input
+func (c *Condition) Evaluate(input ConditionInput) bool {
+	v, ok := c.root.eval(&input).(bool)
+	return ok && v
+}
+
+// requestAttributesKey is the context key for request attributes
+type requestAttributesKey struct{}
+
+// conditionTimeKey is the context key for the evaluation time of conditions
+type conditionTimeKey struct{}
+
+// conditionLocationKey is the context key for the time zone of conditions
+type conditionLocationKey struct{}
+
+// WithRequestAttributes returns a context whose permission checks evaluate
+// conditions with attrs as request.<name>, e.g. the tenant of the request
+func WithRequestAttributes(ctx context.Context, attrs Attributes) context.Context {
+	return context.WithValue(ctx, requestAttributesKey{}, attrs)
+}
+
+// WithConditionTime returns a context whose permission checks evaluate conditions
+// as of t instead of the current time
+func WithConditionTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, conditionTimeKey{}, t)
+}
+
+// WithConditionLocation returns a context whose permission checks evaluate now.hour,
+// now.minute and now.weekday in loc instead of UTC, e.g. the time zone of the office
+// a business hours condition is meant for
+func WithConditionLocation(ctx context.Context, loc *time.Location) context.Context {
+	return context.WithValue(ctx, conditionLocationKey{}, loc)
+}
+
+// conditionProbe records whether a permission check evaluated conditions, whose
+// outcome depends on more than the graph and must not be cached
+type conditionProbe struct {
+	evaluated int32
+}
+
+type conditionProbeKey struct{}
+
+// withConditionProbe returns a context that records condition evaluations in the returned probe
+func withConditionProbe(ctx context.Context) (context.Context, *conditionProbe) {
+	probe := &conditionProbe{}
+	return context.WithValue(ctx, conditionProbeKey{}, probe), probe
+}
+
+// used reports whether conditions were evaluated
+func (p *conditionProbe) used() bool {
+	return atomic.LoadInt32(&p.evaluated) != 0
+}
+
+// evaluateConditions reports whether any of the conditional grants that apply to a
+// check of sourceUserID on a target holds. It loads the attributes a condition
+// needs once, with load, and reads the request attributes and time from ctx.
+func evaluateConditions(ctx context.Context, conditions []*Condition, sourceUserID int, targetType string, targetID int,
+	load func(ctx context.Context, subjectType string, subjectID int) (Attributes, error)) (bool, error) {
+	if len(conditions) == 0 {
+		return false, nil
+	}
+	if probe, ok := ctx.Value(conditionProbeKey{}).(*conditionProbe); ok {
+		atomic.StoreInt32(&probe.evaluated, 1)
+	}
+
+	input := ConditionInput{Now: time.Now()}
+	input.Request, _ = ctx.Value(requestAttributesKey{}).(Attributes)
+	if t, ok := ctx.Value(conditionTimeKey{}).(time.Time); ok {
+		input.Now = t
+	}
+	input.Location, _ = ctx.Value(conditionLocationKey{}).(*time.Location)
+	// A subject that does not exist has no attributes
+	loadAttributes := func(subjectType string, subjectID int) (Attributes, error) {
+		attrs, err := load(ctx, subjectType, subjectID)
+		if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrUserGroupNotFound) {
+			return Attributes{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load condition attributes: %w", err)
+		}
+		return attrs, nil
+	}
+	for _, c := range conditions {
+		var err error
+		if c.usesSource && input.Source == nil {
+			if input.Source, err = loadAttributes("user", sourceUserID); err != nil {
+				return false, err
+			}
+		}
+		if c.usesTarget && input.Target == nil {
+			if input.Target, err = loadAttributes(targetType, targetID); err != nil {
+				return false, err
+			}
+		}
+		if c.Evaluate(input) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseConditions parses stored conditions, which were validated when they were granted
+func parseConditions(exprs []string) ([]*Condition, error) {
+	conditions := make([]*Condition, 0, len(exprs))
+	for _, expr := range exprs {
+		c, err := ParseCondition(expr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored condition: %w", err)
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokInt
+	tokOp
+)
+
+type condToken struct {
+	kind  tokenKind
+	text  string
+	value interface{} // decoded string or int literal
+	pos   int
+}
+
+func (t condToken) describe() string {
+	if t.kind == tokEOF {
+		return "end of condition"
+	}
+	return strconv.Quote(t.text)
+}
+
+// conditionOperators are the operator tokens, longest first
+var conditionOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", ".", "-"}
+
+func lexCondition(expr string) ([]condToken, error) {
+	var tokens []condToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && (isIdentStart(expr[i]) || isDigit(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, condToken{kind: tokIdent, text: expr[start:i], pos: start})
+		case isDigit(c):
+			start := i
+			for i < len(expr) && isDigit(expr[i]) {
+				i++
+			}
+			n, err := strconv.Atoi(expr[start:i])
+			if err != nil {
+				return nil, &ConditionError{Condition: expr, Pos: start, Reason: "integer out of range"}
+			}
+			tokens = append(tokens, condToken{kind: tokInt, text: expr[start:i], value: n, pos: start})
+		case c == '"':
+			start := i
+			for i++; i < len(expr) && expr[i] != '"'; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(expr) {
+				return nil, &ConditionError{Condition: expr, Pos: start, Reason: "unterminated string"}
+			}
+			i++
+			s, err := strconv.Unquote(expr[start:i])
+			if err != nil {
+				return nil, &ConditionError{Condition: expr, Pos: start, Reason: "invalid string literal"}
+			}
+			tokens = append(tokens, condToken{kind: tokString, text: expr[start:i], value: s, pos: start})
+		default:
+			op := ""
+			for _, candidate := range conditionOperators {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &ConditionError{Condition: expr, Pos: i, Reason: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, condToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, condToken{kind: tokEOF, pos: len(expr)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Parser
+
+// valueKind is the static type of an expression, checked at parse time
+type valueKind int
+
+const (
+	kindAny valueKind = iota // a path, whose type is only known at evaluation
+	kindBool
+	kindInt
+	kindString
+	kindList
+)
+
+func (k valueKind) String() string {
+	return [...]string{"value", "boolean", "integer", "string", "list"}[k]
+}
+
+// pathRoots are the path roots an expression may use, and how to list them in errors
+type pathRoots struct {
+	names map[string]bool
+	hint  string
+}
+
+// conditionRoots are the path roots of permission conditions, and nowFields the fields of now
+var (
+	conditionRoots = pathRoots{
+		names: map[string]bool{"source": true, "target": true, "request": true, "now": true},
+		hint:  "source, target, request or now",
+	}
+	nowFields = map[string]bool{"hour": true, "minute": true, "weekday": true}
+)
+
+type conditionParser struct {
+	expr   string
+	tokens []condToken
+	next   int
+	roots  pathRoots
+
+	usesSource, usesTarget bool
+}
+
+func (p *conditionParser) peek() condToken {
+	return p.tokens[p.next]
+}
+
+func (p *conditionParser) take() condToken {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *conditionParser) isOp(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == text
+}
+
+func (p *conditionParser) expect(text string) error {
+	if tok := p.take(); tok.kind != tokOp || tok.text != text {
+		return p.errorAt(tok, fmt.Sprintf("expected %q, got %s", text, tok.describe()))
+	}
+	return nil
+}
+
+func (p *conditionParser) errorAt(tok condToken, reason string) error {
+	return &ConditionError{Condition: p.expr, Pos: tok.pos, Reason: reason}
+}
+
+// checkDepth rejects expressions nested deeper than maxConditionDepth
+func (p *conditionParser) checkDepth(depth int) error {
+	if depth > maxConditionDepth {
+		return p.errorAt(p.peek(), fmt.Sprintf("nested deeper than %d levels", maxConditionDepth))
+	}
+	return nil
+}
+
+// requireBool rejects operands of logical operators that cannot be boolean
+func (p *conditionParser) requireBool(tok condToken, kind valueKind, op string) error {
+	if kind != kindBool && kind != kindAny {
+		return p.errorAt(tok, fmt.Sprintf("%s needs boolean operands, got a %s", op, kind))
+	}
+	return nil
+}
+
+func (p *conditionParser) parseOr(depth int) (condNode, valueKind, error) {
+	return p.parseLogic(depth, "||", p.parseAnd)
+}
+
+func (p *conditionParser) parseAnd(depth int) (condNode, valueKind, error) {
+	return p.parseLogic(depth, "&&", p.parseNot)
+}
+
+// parseLogic parses a chain of operands joined by op
+func (p *conditionParser) parseLogic(depth int, op string, operand func(int) (condNode, valueKind, error)) (condNode, valueKind, error) {
+	if err := p.checkDepth(depth); err != nil {
+		return nil, 0, err
+	}
+	start := p.peek()
+	left, kind, err := operand(depth + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	for p.isOp(op) {
+		if err := p.requireBool(start, kind, op); err != nil {
+			return nil, 0, err
+		}
+		p.take()
+		start = p.peek()
+		right, rightKind, err := operand(depth + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := p.requireBool(start, rightKind, op); err != nil {
+			return nil, 0, err
+		}
+		left, kind = &logicNode{and: op == "&&", left: left, right: right}, kindBool
+	}
+	return left, kind, nil
+}
+
+func (p *conditionParser) parseNot(depth int) (condNode, valueKind, error) {
+	if err := p.checkDepth(depth); err != nil {
+		return nil, 0, err
+	}
+	if !p.isOp("!") {
+		return p.parseComparison(depth + 1)
+	}
+	p.take()
+	start := p.peek()
+	operand, kind, err := p.parseNot(depth + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := p.requireBool(start, kind, "!"); err != nil {
+		return nil, 0, err
+	}
+	return &notNode{operand: operand}, kindBool, nil
+}
+
+// comparisonOperators are the binary operators that yield a boolean
+var comparisonOperators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true}
+
+func (p *conditionParser) parseComparison(depth int) (condNode, valueKind, error) {
+	start := p.peek()
+	left, leftKind, err := p.parsePrimary(depth + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	tok := p.peek()
+	op := tok.text
+	if (tok.kind != tokOp && !(tok.kind == tokIdent && op == "in")) || !comparisonOperators[op] {
+		return left, leftKind, nil
+	}
+	p.take()
+	rightStart := p.peek()
+	right, rightKind, err := p.parsePrimary(depth + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch op {
+	case "in":
+		if leftKind == kindList || leftKind == kindBool {
+			return nil, 0, p.errorAt(start, fmt.Sprintf("in needs a string or integer on the left, got a %s", leftKind))
+		}
+		if rightKind != kindList && rightKind != kindAny {
+			return nil, 0, p.errorAt(rightStart, fmt.Sprintf("in needs a list on the right, got a %s", rightKind))
+		}
+	case "<", "<=", ">", ">=":
+		for _, operand := range []struct {
+			tok  condToken
+			kind valueKind
+		}{{start, leftKind}, {rightStart, rightKind}} {
+			if operand.kind != kindInt && operand.kind != kindAny {
+				return nil, 0, p.errorAt(operand.tok, fmt.Sprintf("%s compares integers, got a %s", op, operand.kind))
+			}
+		}
+	default:
+		if leftKind != kindAny && rightKind != kindAny && leftKind != rightKind {
+			return nil, 0, p.errorAt(start, fmt.Sprintf("%s compares a %s with a %s", op, leftKind, rightKind))
+		}
+	}
+	return &compareNode{op: op, left: left, right: right}, kindBool, nil
+}
+
+func (p *conditionParser) parsePrimary(depth int) (condNode, valueKind, error) {
+	if err := p.checkDepth(depth); err != nil {
+		return nil, 0, err
+	}
+	tok := p.take()
+	switch {
+	case tok.kind == tokString:
+		return &literalNode{value: tok.value}, kindString, nil
+	case tok.kind == tokInt:
+		return &literalNode{value: tok.value}, kindInt, nil
+	case tok.kind == tokOp && tok.text == "-":
+		n := p.take()
+		if n.kind != tokInt {
+			return nil, 0, p.errorAt(n, "expected an integer after -")
+		}
+		return &literalNode{value: -n.value.(int)}, kindInt, nil
+	case tok.kind == tokOp && tok.text == "(":
+		node, kind, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, 0, err
+		}
+		return node, kind, nil
+	case tok.kind == tokOp && tok.text == "[":
+		return p.parseList(tok)
+	case tok.kind == tokIdent && (tok.text == "true" || tok.text == "false"):
+		return &literalNode{value: tok.text == "true"}, kindBool, nil
+	case tok.kind == tokIdent:
+		return p.parsePath(tok)
+	}
+	return nil, 0, p.errorAt(tok, "unexpected "+tok.describe())
+}
+
+// parseList parses a list literal of strings or of integers after its opening bracket
+func (p *conditionParser) parseList(open condToken) (condNode, valueKind, error) {
+	var strs []string
+	var ints []int
+	for !p.isOp("]") {
+		if len(strs)+len(ints) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, 0, err
+			}
+		}
+		tok := p.take()
+		negative := tok.kind == tokOp && tok.text == "-"
+		if negative {
+			tok = p.take()
+		}
+		switch {
+		case tok.kind == tokString && !negative && ints == nil:
+			strs = append(strs, tok.value.(string))
+		case tok.kind == tokInt && strs == nil:
+			n := tok.value.(int)
+			if negative {
+				n = -n
+			}
+			ints = append(ints, n)
+		default:
+			return nil, 0, p.errorAt(tok, "lists hold either strings or integers, got "+tok.describe())
+		}
+	}
+	p.take()
+	if ints != nil {
+		return &literalNode{value: ints}, kindList, nil
+	}
+	if strs == nil {
+		strs = []string{}
+	}
+	return &literalNode{value: strs}, kindList, nil
+}
+
+// parsePath parses root.name after its root
+func (p *conditionParser) parsePath(root condToken) (condNode, valueKind, error) {
+	if !p.roots.names[root.text] {
+		return nil, 0, p.errorAt(root, fmt.Sprintf("unknown name %q, paths start with %s", root.text, p.roots.hint))
+	}
+	if err := p.expect("."); err != nil {
+		return nil, 0, err
+	}
+	name := p.take()
+	if name.kind != tokIdent {
+		return nil, 0, p.errorAt(name, "expected a name after "+root.text+".")
+	}
+
+	switch root.text {
+	case "now":
+		if !nowFields[name.text] {
+			return nil, 0, p.errorAt(name, fmt.Sprintf("unknown field now.%s, use hour, minute or weekday", name.text))
+		}
+		return &pathNode{root: root.text, name: name.text}, kindInt, nil
+	case "source", "user":
+		p.usesSource = true
+	case "target":
+		p.usesTarget = true
+	}
+	return &pathNode{root: root.text, name: name.text}, kindAny, nil
+}
+
+// Evaluation. eval returns nil for unknown: a missing attribute, or a
+// comparison of values of different types.
+
+type condNode interface {
+	eval(input *ConditionInput) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(*ConditionInput) interface{} {
+	return n.value
+}
+
+type pathNode struct {
+	root, name string
+}
+
+func (n *pathNode) eval(input *ConditionInput) interface{} {
+	switch n.root {
+	case "source", "user":
+		return input.Source[n.name]
+	case "target":
+		return input.Target[n.name]
+	case "request":
+		return input.Request[n.name]
+	}
+	now := input.Now.UTC()
+	if input.Location != nil {
+		now = input.Now.In(input.Location)
+	}
+	switch n.name {
+	case "hour":
+		return now.Hour()
+	case "minute":
+		return now.Minute()
+	}
+	return int(now.Weekday())
+}
+
+type notNode struct {
+	operand condNode
+}
+
+func (n *notNode) eval(input *ConditionInput) interface{} {
+	if v, ok := n.operand.eval(input).(bool); ok {
+		return !v
+	}
+	return nil
+}
+
+// logicNode is && or || in three-valued logic
+type logicNode struct {
+	and         bool
+	left, right condNode
+}
+
+func (n *logicNode) eval(input *ConditionInput) interface{} {
+	left, leftOK := n.left.eval(input).(bool)
+	if leftOK && left != n.and {
+		return left // false && x, true || x
+	}
+	right, rightOK := n.right.eval(input).(bool)
+	switch {
+	case rightOK && right != n.and:
+		return right
+	case leftOK && rightOK:
+		return n.and
+	}
+	return nil
+}
+
+type compareNode struct {
+	op          string
+	left, right condNode
+}
+
+func (n *compareNode) eval(input *ConditionInput) interface{} {
+	left, right := n.left.eval(input), n.right.eval(input)
+	if left == nil || right == nil {
+		return nil
+	}
+	switch n.op {
+	case "==", "!=":
+		if reflect.TypeOf(left) != reflect.TypeOf(right) {
+			return nil
+		}
+		return reflect.DeepEqual(left, right) == (n.op == "==")
+	case "in":
+		switch list := right.(type) {
+		case []string:
+			s, ok := left.(string)
+			if !ok {
+				return nil
+			}
+			for _, item := range list {
+				if item == s {
+					return true
+				}
+			}
+			return false
+		case []int:
+			i, ok := left.(int)
+			if !ok {
+				return nil
+			}
+			for _, item := range list {
+				if item == i {
+					return true
+				}
+			}
+			return false
+		}
+		return nil
+	}
+
+	l, lok := left.(int)
+	r, rok := right.(int)
+	if !lok || !rok {
+		return nil
+	}
+	switch n.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Condition_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{"equality", "source.department == target.department", false},
+		{"membership", `"admin" in source.roles`, false},
+		{"integer list", "now.weekday in [1, 2, 3, 4, 5]", false},
+		{"negative integer", "target.balance > -100", false},
+		{"precedence and parentheses", `!(source.level < 3) && (request.tenant == "acme" || source.admin)`, false},
+		{"bare path", "source.admin", false},
+		{"escaped string", `request.note == "a \"quoted\" word"`, false},
+		{"empty", "", true},
+		{"unknown root", "user.department == 1", true},
+		{"unknown now field", "now.year == 2024", true},
+		{"missing operand", "source.level >", true},
+		{"trailing tokens", "source.admin source.admin", true},
+		{"unterminated string", `request.tenant == "acme`, true},
+		{"ordering strings", `source.name < "m"`, true},
+		{"mixed literal types", `1 == "1"`, true},
+		{"in without list", `"a" in "abc"`, true},
+		{"mixed list", `source.x in ["a", 1]`, true},
+		{"logical operand", `source.admin && "yes"`, true},
+		{"literal not a boolean", "42", true},
+		{"unexpected character", "source.level == 1 ; true", true},
+		{"too deep", strings.Repeat("(", 40) + "true" + strings.Repeat(")", 40), true},
+		{"too long", "source.a == " + `"` + strings.Repeat("x", MaxConditionLength) + `"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCondition(tt.expr)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("ParseCondition(%q) = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if err != nil {
+				var condErr *ConditionError
+				if !errors.As(err, &condErr) || !errors.Is(err, ErrInvalidCondition) {
+					t.Errorf("Expected a ConditionError, got %v", err)
+				}
+				return
+			}
+			if c.String() != tt.expr {
+				t.Errorf("String() = %q, want %q", c.String(), tt.expr)
+			}
+		})
+	}
+}
+
+func Test_Condition_Evaluate(t *testing.T) {
+	input := ConditionInput{
+		Source:  Attributes{"department": "sales", "level": 4, "roles": []string{"admin", "auditor"}, "contractor": false},
+		Target:  Attributes{"department": "sales", "level": 2},
+		Request: Attributes{"tenant": "acme"},
+		Now:     time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC), // a Tuesday
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"source.department == target.department", true},
+		{"source.level > target.level", true},
+		{"source.level <= 3", false},
+		{`"admin" in source.roles`, true},
+		{`"owner" in source.roles`, false},
+		{`request.tenant in ["acme", "globex"]`, true},
+		{"!source.contractor", true},
+		{"now.weekday in [1, 2, 3, 4, 5] && now.hour >= 9 && now.hour < 17", true},
+		{"now.minute == 30", true},
+
+		// Missing attributes and type mismatches are unknown, and unknown denies
+		{"source.team == target.team", false},
+		{"source.team != target.team", false},
+		{"!(source.team == 1)", false},
+		{"source.department == 1", false},
+		{"source.department > 1", false},
+		{"source.level in source.roles", false},
+
+		// Unknown is resolved only by a deciding operand
+		{"source.team == 1 || true", true},
+		{"source.team == 1 && false || source.level == 4", true},
+		{"source.team == 1 && true", false},
+		{"!(source.team == 1 && false)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := ParseCondition(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCondition failed: %v", err)
+			}
+			if got := c.Evaluate(input); got != tt.want {
+				t.Errorf("Evaluate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A weekend afternoon is outside business hours
+	c, _ := ParseCondition("now.weekday in [1, 2, 3, 4, 5] && now.hour >= 9 && now.hour < 17")
+	input.Now = time.Date(2024, 3, 9, 14, 30, 0, 0, time.UTC)
+	if c.Evaluate(input) {
+		t.Error("Expected the condition to deny on a Saturday")
+	}
+
+	// Late Tuesday in UTC is early Wednesday two hours east
+	c, _ = ParseCondition("now.weekday == 3 && now.hour == 1 && now.minute == 30")
+	input.Now = time.Date(2024, 3, 5, 23, 30, 0, 0, time.UTC)
+	if c.Evaluate(input) {
+		t.Error("Expected the condition to deny in UTC")
+	}
+	input.Location = time.FixedZone("UTC+2", 2*60*60)
+	if !c.Evaluate(input) {
+		t.Error("Expected the condition to hold in the given location")
+	}
+}
+
+func Test_Condition_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithAttributeSchema(AttributeSchema{Users: map[string]AttributeType{"department": AttributeString}}),
+		WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	_ = s.SetUserAttribute(ctx, alice, "department", "sales")
+	_ = s.SetUserAttribute(ctx, bob, "department", "sales")
+
+	if _, err := s.AddConditionalPermission(ctx, "user", "user", alice, bob, "source.department == target.department"); err != nil {
+		t.Fatalf("AddConditionalPermission failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "AddConditionalPermission")
+	if !ok || entry["condition"] != "source.department == target.department" {
+		t.Errorf("Expected the condition in the log entry, got %v", entry)
+	}
+	if name, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v; want Bob", name, err)
+	}
+	_ = s.SetUserAttribute(ctx, bob, "department", "legal")
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied once the departments differ, got %v", err)
+	}
+
+	if _, err := s.AddConditionalPermission(ctx, "user", "user", alice, bob, "source.department = target.department"); !errors.Is(err, ErrInvalidCondition) {
+		t.Errorf("Expected ErrInvalidCondition, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "AddConditionalPermission"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the invalid condition to be logged as rejected, got %v", logs.entries(t))
+	}
+	if _, err := s.AddConditionalPermission(ctx, "role", "user", alice, bob, ""); err == nil {
+		t.Error("Expected an invalid subject type to be rejected")
+	}
+
+	// Business hours are checked in the time zone of the context
+	carol, _ := s.CreateUser(ctx, "Carol")
+	if _, err := s.AddConditionalPermission(ctx, "user", "user", alice, carol, "now.hour >= 9 && now.hour < 17"); err != nil {
+		t.Fatalf("AddConditionalPermission failed: %v", err)
+	}
+	early := WithConditionTime(ctx, time.Date(2024, 3, 5, 7, 30, 0, 0, time.UTC))
+	if _, err := s.GetUserNameWithPermissionCheck(early, alice, carol); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied before 9 in UTC, got %v", err)
+	}
+	east := WithConditionLocation(early, time.FixedZone("UTC+2", 2*60*60))
+	if name, err := s.GetUserNameWithPermissionCheck(east, alice, carol); err != nil || name != "Carol" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v; want Carol after 9 in UTC+2", name, err)
+	}
+}
+
+func Test_Condition_CachingRepository(t *testing.T) {
+	fake := newFakeRepository()
+	repo := NewCachingRepository(fake, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := repo.CreateUser(ctx, "Alice")
+	bob, _ := repo.CreateUser(ctx, "Bob")
+	carol, _ := repo.CreateUser(ctx, "Carol")
+	_, _ = repo.AddPermission(ctx, "user", "user", alice, carol)
+	_, _ = repo.AddConditionalPermission(ctx, "user", "user", alice, bob, `request.tenant == "acme"`)
+
+	// Decisions that evaluated a condition are recomputed on every check
+	acme := WithRequestAttributes(ctx, Attributes{"tenant": "acme"})
+	for i, check := range []struct {
+		ctx  context.Context
+		want bool
+	}{{acme, true}, {ctx, false}, {acme, true}} {
+		if got, err := repo.HasUserPermissionOnUser(check.ctx, alice, bob); err != nil || got != check.want {
+			t.Errorf("check %d: HasUserPermissionOnUser = %v, %v; want %v", i, got, err, check.want)
+		}
+	}
+	if n := fake.checkCount(); n != 3 {
+		t.Errorf("Expected 3 checks to reach the repository, got %d", n)
+	}
+
+	// Unconditional decisions are still cached
+	for i := 0; i < 2; i++ {
+		if got, _ := repo.HasUserPermissionOnUser(ctx, alice, carol); !got {
+			t.Error("Expected alice to access carol")
+		}
+	}
+	if n := fake.checkCount(); n != 4 {
+		t.Errorf("Expected the second unconditional check to be cached, got %d checks", n)
+	}
+
+	// Making a cached grant conditional invalidates the allowed decision
+	_, _ = repo.AddConditionalPermission(ctx, "user", "user", alice, carol, "false")
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, carol); got {
+		t.Error("Expected the conditional grant to replace the cached decision")
+	}
+}
+
+func Test_Condition_IndexedRepository(t *testing.T) {
+	ctx := context.Background()
+	file := openFileRepository(t, t.TempDir())
+	defer file.Close()
+
+	user, _ := file.CreateUser(ctx, "Sam")
+	team, _ := file.CreateUserGroup(ctx, "Team")
+	_, _ = file.AddUserToGroup(ctx, user, team)
+	_, _ = file.AddConditionalPermission(ctx, "group", "group", team, team, "target.open")
+
+	repo, err := NewIndexedRepository(ctx, file)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	if got, err := repo.HasUserPermissionOnGroup(ctx, user, team); err != nil || got {
+		t.Errorf("HasUserPermissionOnGroup = %v, %v; want false", got, err)
+	}
+	_, _ = file.SetAttribute(ctx, "group", team, "open", true)
+	if got, err := repo.HasUserPermissionOnGroup(ctx, user, team); err != nil || !got {
+		t.Errorf("HasUserPermissionOnGroup = %v, %v; want true from the loaded condition", got, err)
+	}
+
+	// Writes through the index update its conditions
+	if _, err := repo.AddConditionalPermission(ctx, "group", "group", team, team, "!target.open"); err != nil {
+		t.Fatalf("AddConditionalPermission failed: %v", err)
+	}
+	if got, _ := repo.HasUserPermissionOnGroup(ctx, user, team); got {
+		t.Error("Expected the replaced condition to deny")
+	}
+}
+
+func Test_Condition_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	alice, _ := r.CreateUser(ctx, "Alice")
+	bob, _ := r.CreateUser(ctx, "Bob")
+	carol, _ := r.CreateUser(ctx, "Carol")
+	_, _ = r.AddConditionalPermission(ctx, "user", "user", alice, bob, `request.tenant == "acme"`)
+	_, _ = r.AddConditionalPermission(ctx, "user", "user", alice, carol, "false")
+	_, _ = r.AddPermission(ctx, "user", "user", alice, carol)
+	crash(t, r)
+
+	acme := WithRequestAttributes(ctx, Attributes{"tenant": "acme"})
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if got, err := r.HasUserPermissionOnUser(ctx, alice, bob); err != nil || got {
+			t.Errorf("HasUserPermissionOnUser without tenant = %v, %v; want false", got, err)
+		}
+		if got, err := r.HasUserPermissionOnUser(acme, alice, bob); err != nil || !got {
+			t.Errorf("HasUserPermissionOnUser with tenant = %v, %v; want true", got, err)
+		}
+		if got, err := r.HasUserPermissionOnUser(ctx, alice, carol); err != nil || !got {
+			t.Errorf("Expected the later unconditional grant to win, got %v, %v", got, err)
+		}
+	}
+
+	// The conditions are replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+}
@@ -2,15 +2,22 @@ package server
 
 import (
 	"os"
+	"strings"
 	"time"
 )
 
-// Config holds the configuration for the server and database connection
+// Config holds the configuration for the server and database connection. The
+// repository settings from Retry on are applied with WithMySQLConfig, WithSQLConfig
+// or WithFileConfig.
 type Config struct {
 	// DatabaseDSN is the data source name for the database connection
 	// Example: "user:password@tcp(host:port)/dbname"
 	DatabaseDSN string
 
+	// ReplicaDSNs are the data source names of read replicas of DatabaseDSN. Reads
+	// that tolerate replication lag, such as permission checks, are spread across them.
+	ReplicaDSNs []string
+
 	// MaxOpenConns sets the maximum number of open connections to the database
 	MaxOpenConns int
 
@@ -19,20 +26,51 @@ type Config struct {
 
 	// ConnMaxLifetime sets the maximum amount of time a connection may be reused
 	ConnMaxLifetime time.Duration
+
+	// Retry controls how deadlocks, lock wait timeouts and dropped connections are
+	// retried, see WithMySQLRetryPolicy
+	Retry RetryPolicy
+
+	// IdempotencyTTL is how long idempotency keys of creates are remembered, see
+	// WithIdempotencyKey and WithMySQLIdempotencyTTL
+	IdempotencyTTL time.Duration
+
+	// UniqueNames rejects creating a user whose name another user has, and likewise
+	// for groups, see WithMySQLUniqueNames
+	UniqueNames bool
+
+	// HierarchyLimits bounds the nesting depth and the direct children and parents of
+	// groups, see WithMySQLHierarchyLimits. The zero value sets no limits.
+	HierarchyLimits HierarchyLimits
+
+	// NestingPolicy declares which group types may contain which, see
+	// WithMySQLNestingPolicy. The nil policy allows every nesting.
+	NestingPolicy NestingPolicy
 }
 
 // DefaultConfig returns a Config with sensible defaults
-// Reads DatabaseDSN from MYSQL_DSN environment variable if set
+// Reads DatabaseDSN from MYSQL_DSN environment variable if set, and ReplicaDSNs from
+// the comma-separated MYSQL_REPLICA_DSNS
 func DefaultConfig() Config {
 	dsn := os.Getenv("MYSQL_DSN")
 	if dsn == "" {
 		dsn = "blp:password@tcp(localhost:3306)/blp-coding-challenge?parseTime=true"
 	}
 
+	var replicas []string
+	for _, replica := range strings.Split(os.Getenv("MYSQL_REPLICA_DSNS"), ",") {
+		if replica = strings.TrimSpace(replica); replica != "" {
+			replicas = append(replicas, replica)
+		}
+	}
+
 	return Config{
 		DatabaseDSN:     dsn,
+		ReplicaDSNs:     replicas,
 		MaxOpenConns:    25,
 		MaxIdleConns:    5,
 		ConnMaxLifetime: 5 * time.Minute,
+		Retry:           DefaultRetryPolicy(),
+		IdempotencyTTL:  DefaultIdempotencyTTL,
 	}
 }
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// ruleRoots are the path roots of membership rules
+var ruleRoots = pathRoots{names: map[string]bool{"user": true}, hint: "user"}
+
+// ParseMembershipRule parses and validates the membership rule of a dynamic group: a
+// boolean expression over user.<attribute>, the attributes of a user, in the
+// language of Condition. For example:
+//
+//	user.department == "eng" && user.status == "active"
+//	"oncall" in user.roles || user.level >= 3
+//
+// A user belongs to the group while the rule is true for their attributes. Rules
+// cannot read the request or the time, so membership only changes when rules or
+// attributes do. A rule that holds for a user without attributes, such as true, is
+// rejected: new users would have to be matched against every rule. Invalid rules fail
+// with a ConditionError.
+func ParseMembershipRule(rule string) (*Condition, error) {
+	c, err := parseExpression(rule, ruleRoots)
+	if err != nil {
+		return nil, err
+	}
+	if ruleMatches(c, Attributes{}) {
+		return nil, &ConditionError{Condition: rule, Reason: "the rule matches users without attributes"}
+	}
+	return c, nil
+}
+
+// ruleMatches reports whether a user with attrs satisfies rule
+func ruleMatches(rule *Condition, attrs Attributes) bool {
+	return rule.Evaluate(ConditionInput{Source: attrs})
+}
+
+// ruleString returns the canonical form of a parsed rule, "" for a static group
+func ruleString(rule *Condition) string {
+	if rule == nil {
+		return ""
+	}
+	return rule.String()
+}
+
+// parseRules parses stored membership rules by group, which were validated when they were set
+func parseRules(stored map[int]string) (map[int]*Condition, error) {
+	rules := make(map[int]*Condition, len(stored))
+	for groupID, rule := range stored {
+		c, err := ParseMembershipRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored rule of group %d: %w", groupID, err)
+		}
+		rules[groupID] = c
+	}
+	return rules, nil
+}
+
+// userRuleChanges returns the dynamic groups a user with attrs must join and leave,
+// given the groups they are directly in, in ascending order
+func userRuleChanges(rules map[int]*Condition, groups map[int]bool, attrs Attributes) (join, leave []int) {
+	for groupID, rule := range rules {
+		switch matches := ruleMatches(rule, attrs); {
+		case matches && !groups[groupID]:
+			join = append(join, groupID)
+		case !matches && groups[groupID]:
+			leave = append(leave, groupID)
+		}
+	}
+	sort.Ints(join)
+	sort.Ints(leave)
+	return join, leave
+}
+
+// groupRuleChanges returns the users a group with rule must gain and lose, given its
+// current members and the attributes of every user that has any, in ascending order.
+// Users without attributes never match.
+func groupRuleChanges(rule *Condition, members map[int]bool, attrs map[int]Attributes) (add, remove []int) {
+	for userID, userAttrs := range attrs {
+		if !members[userID] && ruleMatches(rule, userAttrs) {
+			add = append(add, userID)
+		}
+	}
+	for userID := range members {
+		if userAttrs, ok := attrs[userID]; !ok || !ruleMatches(rule, userAttrs) {
+			remove = append(remove, userID)
+		}
+	}
+	sort.Ints(add)
+	sort.Ints(remove)
+	return add, remove
+}
+
+// ruleMembershipEvents returns the change events of users joining and leaving groups
+func ruleMembershipEvents(userID int, join, leave []int) []ChangeEvent {
+	events := make([]ChangeEvent, 0, len(join)+len(leave))
+	for _, groupID := range join {
+		events = append(events, membershipAddedEvent(userID, groupID))
+	}
+	for _, groupID := range leave {
+		events = append(events, membershipRemovedEvent(userID, groupID))
+	}
+	return events
+}
+
+// groupMembershipEvents returns the change events of users joining and leaving a group
+func groupMembershipEvents(groupID int, add, remove []int) []ChangeEvent {
+	events := make([]ChangeEvent, 0, len(add)+len(remove))
+	for _, userID := range add {
+		events = append(events, membershipAddedEvent(userID, groupID))
+	}
+	for _, userID := range remove {
+		events = append(events, membershipRemovedEvent(userID, groupID))
+	}
+	return events
+}
+
+// SetUserGroupRule makes a user group dynamic: its direct users become the users whose
+// attributes satisfy rule (see ParseMembershipRule), and they are kept up to date as
+// user attributes change. Replacing the rule re-evaluates every user. An empty rule
+// makes the group static again and keeps its current users. Dynamic groups nest and
+// take part in permission checks like static ones, but AddUserToGroup rejects them.
+func (s *Server) SetUserGroupRule(ctx context.Context, userGroupID int, rule string) error {
+	_, err := s.SetUserGroupRuleWithRevision(ctx, userGroupID, rule)
+	return err
+}
+
+// SetUserGroupRuleWithRevision sets the membership rule of a user group and returns the
+// revision at which its new members are visible
+func (s *Server) SetUserGroupRuleWithRevision(ctx context.Context, userGroupID int, rule string) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "SetUserGroupRule", IntAttr("group.id", userGroupID), StringAttr("rule", rule))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
+	if rule != "" {
+		if _, err := ParseMembershipRule(rule); err != nil {
+			return 0, err
+		}
+	}
+	return s.repo.SetGroupRule(ctx, userGroupID, rule)
+}
+
+// GetUserGroupRule returns the membership rule of a user group, "" for static groups
+func (s *Server) GetUserGroupRule(ctx context.Context, userGroupID int) (rule string, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupRule", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err) }()
+
+	return s.repo.GetGroupRule(ctx, userGroupID)
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func Test_MembershipRule_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr bool
+	}{
+		{"equality", `user.department == "eng"`, false},
+		{"conjunction", `user.department == "eng" && user.status == "active"`, false},
+		{"membership", `"oncall" in user.roles || user.level >= 3`, false},
+		{"bare path", "user.admin", false},
+		{"source root", `source.department == "eng"`, true},
+		{"request root", `request.tenant == "acme"`, true},
+		{"time", "now.hour < 12", true},
+		{"matches everyone", "true", true},
+		{"matches users without attributes", "user.admin || !false", true},
+		{"negation of a missing attribute", `!(user.department == "eng")`, false},
+		{"missing operand", "user.level >", true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseMembershipRule(tt.rule)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("ParseMembershipRule(%q) = %v, wantErr %v", tt.rule, err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidCondition) {
+					t.Errorf("Expected ErrInvalidCondition, got %v", err)
+				}
+				return
+			}
+			if c.String() != tt.rule {
+				t.Errorf("String() = %q, want %q", c.String(), tt.rule)
+			}
+		})
+	}
+
+	// Rules are evaluated with the three-valued logic of conditions
+	c, _ := ParseMembershipRule(`user.department == "eng" || user.level >= 3`)
+	for _, tt := range []struct {
+		attrs Attributes
+		want  bool
+	}{
+		{Attributes{"department": "eng"}, true},
+		{Attributes{"department": "ops", "level": 4}, true},
+		{Attributes{"department": "ops", "level": 2}, false},
+		{Attributes{"level": "high"}, false},
+	} {
+		if got := ruleMatches(c, tt.attrs); got != tt.want {
+			t.Errorf("ruleMatches(%v) = %v, want %v", tt.attrs, got, tt.want)
+		}
+	}
+}
+
+func Test_DynamicGroup_Server(t *testing.T) {
+	var logs logBuffer
+	repo := newFakeRepository()
+	s := New(repo, WithAttributeSchema(AttributeSchema{Users: map[string]AttributeType{"department": AttributeString}}),
+		WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	engineers, _ := s.CreateUserGroup(ctx, "Engineers")
+	staff, _ := s.CreateUserGroup(ctx, "Staff")
+	_ = s.AddUserGroupToGroup(ctx, engineers, staff)
+	_ = s.AddUserGroupToUserPermission(ctx, staff, bob)
+	_ = s.SetUserAttribute(ctx, alice, "department", "eng")
+
+	if err := s.SetUserGroupRule(ctx, engineers, `user.department == "eng"`); err != nil {
+		t.Fatalf("SetUserGroupRule failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "SetUserGroupRule")
+	if !ok || entry["rule"] != `user.department == "eng"` {
+		t.Errorf("Expected the rule in the log entry, got %v", entry)
+	}
+	if rule, err := s.GetUserGroupRule(ctx, engineers); err != nil || rule != `user.department == "eng"` {
+		t.Errorf("GetUserGroupRule = %q, %v", rule, err)
+	}
+
+	// Members of a dynamic group take part in transitive membership and permissions
+	if users, err := s.GetUsersInGroupTransitive(ctx, staff); err != nil || !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroupTransitive = %v, %v; want [%d]", users, err, alice)
+	}
+	if name, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v; want Bob", name, err)
+	}
+	rev, err := s.SetUserAttributeWithRevision(ctx, alice, "department", "sales")
+	if err != nil {
+		t.Fatalf("SetUserAttributeWithRevision failed: %v", err)
+	}
+	if events, _ := repo.ListChanges(ctx, rev-1, 1); len(events) != 1 || events[0].Type != EventMembershipRemoved || events[0].SubjectID != alice {
+		t.Errorf("Expected revision %s to remove alice from the group, got %v", rev, events)
+	}
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied after leaving the group, got %v", err)
+	}
+
+	if err := s.AddUserToGroup(ctx, bob, engineers); !errors.Is(err, ErrDynamicGroup) {
+		t.Errorf("Expected ErrDynamicGroup, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "AddUserToGroup"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the manual membership to be logged as rejected, got %v", logs.entries(t))
+	}
+	if err := s.SetUserGroupRule(ctx, engineers, "source.admin"); !errors.Is(err, ErrInvalidCondition) {
+		t.Errorf("Expected ErrInvalidCondition, got %v", err)
+	}
+}
+
+func Test_DynamicGroup_CachingRepository(t *testing.T) {
+	fake := newFakeRepository()
+	repo := NewCachingRepository(fake, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := repo.CreateUser(ctx, "Alice")
+	bob, _ := repo.CreateUser(ctx, "Bob")
+	oncall, _ := repo.CreateUserGroup(ctx, "On-call")
+	_, _ = repo.AddPermission(ctx, "group", "user", oncall, bob)
+	_, _ = repo.SetGroupRule(ctx, oncall, "user.oncall")
+
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); got {
+		t.Fatal("Expected alice to be denied before joining the group")
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, oncall); len(users) != 0 {
+		t.Fatalf("Expected an empty group, got %v", users)
+	}
+
+	// A user attribute that moves alice into the group invalidates her entries
+	_, _ = repo.SetAttribute(ctx, "user", alice, "oncall", true)
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); !got {
+		t.Error("Expected the cached denial to be invalidated by the attribute change")
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, oncall); !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroupTransitive = %v, want [%d]", users, alice)
+	}
+
+	// Replacing the rule removes her again
+	_, _ = repo.SetGroupRule(ctx, oncall, "user.primary")
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); got {
+		t.Error("Expected the cached decision to be invalidated by the rule change")
+	}
+
+	// Attribute changes that do not move a user keep the cache
+	checks := fake.checkCount()
+	_, _ = repo.SetAttribute(ctx, "user", alice, "nickname", "al")
+	_, _ = repo.HasUserPermissionOnUser(ctx, alice, bob)
+	if n := fake.checkCount(); n != checks {
+		t.Errorf("Expected the decision to stay cached, got %d new checks", n-checks)
+	}
+}
+
+func Test_DynamicGroup_IndexedRepository(t *testing.T) {
+	ctx := context.Background()
+	file := openFileRepository(t, t.TempDir())
+	defer file.Close()
+
+	alice, _ := file.CreateUser(ctx, "Alice")
+	bob, _ := file.CreateUser(ctx, "Bob")
+	admins, _ := file.CreateUserGroup(ctx, "Admins")
+	_, _ = file.AddPermission(ctx, "group", "user", admins, bob)
+	_, _ = file.SetAttribute(ctx, "user", alice, "role", "admin")
+	_, _ = file.SetGroupRule(ctx, admins, `user.role == "admin"`)
+
+	repo, err := NewIndexedRepository(ctx, file)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	if got, err := repo.HasUserPermissionOnUser(ctx, alice, bob); err != nil || !got {
+		t.Errorf("HasUserPermissionOnUser = %v, %v; want true from the loaded members", got, err)
+	}
+
+	// Attribute writes through the index re-apply the loaded rules
+	if _, err := repo.SetAttribute(ctx, "user", alice, "role", "guest"); err != nil {
+		t.Fatalf("SetAttribute failed: %v", err)
+	}
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); got {
+		t.Error("Expected alice to leave the group in the index")
+	}
+	if rev, _ := repo.CurrentRevision(ctx); rev != mustRevision(t, file) {
+		t.Errorf("Index revision %s does not match the repository", rev)
+	}
+
+	// and rule writes load the new members
+	if _, err := repo.SetGroupRule(ctx, admins, `user.role == "guest"`); err != nil {
+		t.Fatalf("SetGroupRule failed: %v", err)
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, admins); !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroupTransitive = %v, want [%d]", users, alice)
+	}
+}
+
+func Test_DynamicGroup_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	alice, _ := r.CreateUser(ctx, "Alice")
+	bob, _ := r.CreateUser(ctx, "Bob")
+	group, _ := r.CreateUserGroup(ctx, "Europe")
+	_, _ = r.SetAttribute(ctx, "user", alice, "region", "eu")
+	_, _ = r.SetGroupRule(ctx, group, `user.region == "eu"`)
+	_, _ = r.SetAttribute(ctx, "user", bob, "region", "eu")
+	_, _ = r.SetAttribute(ctx, "user", alice, "region", "us")
+	rev := mustRevision(t, r)
+	crash(t, r)
+
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if users, _ := r.GetUsersInGroup(ctx, group); !reflect.DeepEqual(users, []int{bob}) {
+			t.Errorf("GetUsersInGroup = %v, want [%d]", users, bob)
+		}
+		if got := mustRevision(t, r); got != rev {
+			t.Errorf("Revision = %s, want %s", got, rev)
+		}
+		events, _ := r.ListChanges(ctx, 0, 100)
+		if n := len(events); n != 4 || events[0].Type != EventRuleChanged || events[n-1].Type != EventMembershipRemoved {
+			t.Errorf("Expected a rule change and three membership events ending in a removal, got %v", events)
+		}
+		if _, err := r.AddUserToGroup(ctx, alice, group); !errors.Is(err, ErrDynamicGroup) {
+			t.Errorf("Expected ErrDynamicGroup, got %v", err)
+		}
+	}
+
+	// The derived memberships are replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and the rule is restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+	_, _ = r.SetAttribute(ctx, "user", alice, "region", "eu")
+	if users, _ := r.GetUsersInGroup(ctx, group); !reflect.DeepEqual(users, []int{alice, bob}) {
+		t.Errorf("GetUsersInGroup = %v, want [%d %d]", users, alice, bob)
+	}
+}
+
+func mustRevision(t *testing.T, repo Repository) Revision {
+	t.Helper()
+	rev, err := repo.CurrentRevision(context.Background())
+	if err != nil {
+		t.Fatalf("CurrentRevision failed: %v", err)
+	}
+	return rev
+}
+
+// runConcurrentRules races setting a rule against the attribute write that makes a
+// user match it and against a static membership, and checks that the group ends up
+// with exactly the matching user
+func runConcurrentRules(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	for round := 0; round < 20; round++ {
+		user, err := repo.CreateUser(ctx, "Racer")
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		static, _ := repo.CreateUser(ctx, "Static")
+		group, err := repo.CreateUserGroup(ctx, "Race")
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		team := fmt.Sprintf("race-%d", group)
+
+		errs := make([]error, 3)
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, errs[0] = repo.SetGroupRule(ctx, group, fmt.Sprintf("user.dyn_team == %q", team))
+		}()
+		go func() {
+			defer wg.Done()
+			_, errs[1] = repo.SetAttribute(ctx, "user", user, "dyn_team", team)
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := repo.AddUserToGroup(ctx, static, group); !errors.Is(err, ErrDynamicGroup) {
+				errs[2] = err
+			}
+		}()
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatalf("Round %d failed: %v", round, err)
+			}
+		}
+
+		users, err := repo.GetUsersInGroup(ctx, group)
+		if err != nil || !reflect.DeepEqual(users, []int{user}) {
+			t.Fatalf("Round %d: GetUsersInGroup = %v, %v; want only the matching user %d", round, users, err, user)
+		}
+	}
+}
+
+func Test_DynamicGroup_ConcurrentWrites(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		repo := openFileRepository(t, t.TempDir())
+		defer repo.Close()
+		runConcurrentRules(t, repo)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		repo := NewSQLRepository(sqliteTestDB(t), SQLiteDialect{})
+		defer repo.Close()
+		runConcurrentRules(t, repo)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		repo := NewMySQLRepository(db)
+		defer repo.Close()
+		runConcurrentRules(t, repo)
+	})
+}
@@ -16,8 +16,59 @@ var (
 	// ErrCycleDetected indicates that an operation would create a cycle in the group hierarchy
 	ErrCycleDetected = errors.New("operation would create a cycle in group hierarchy")
 
+	// ErrHierarchyLimitExceeded indicates that an operation would break a configured HierarchyLimits limit
+	ErrHierarchyLimitExceeded = errors.New("operation would exceed a group hierarchy limit")
+
+	// ErrNestingNotAllowed indicates that the nesting policy does not allow a group of one type in another
+	ErrNestingNotAllowed = errors.New("group nesting not allowed by policy")
+
+	// ErrInvalidGroupType indicates that a group type is too long to be stored
+	ErrInvalidGroupType = errors.New("invalid group type")
+
+	// ErrEdgeNotFound indicates that a group is not directly nested in the given parent group
+	ErrEdgeNotFound = errors.New("group is not in parent group")
+
 	// ErrPermissionDenied indicates that the user does not have permission to perform the action
 	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrStaleRevision indicates that the store has not yet reached the revision required by the caller
+	ErrStaleRevision = errors.New("store is older than the required revision")
+
+	// ErrWebhookDeliveryNotFound indicates that the requested webhook delivery does not exist
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+	// ErrExternalIDConflict indicates that an external ID already belongs to another user or group
+	ErrExternalIDConflict = errors.New("external ID already in use")
+
+	// ErrNameConflict indicates that a name is already taken while unique names are enforced
+	ErrNameConflict = errors.New("name already in use")
+
+	// ErrInvalidExternalID indicates that an external ID is too long to be stored
+	ErrInvalidExternalID = errors.New("invalid external ID")
+
+	// ErrInvalidAttribute indicates that an attribute name or value is not allowed by the schema
+	ErrInvalidAttribute = errors.New("invalid attribute")
+
+	// ErrAttributeNotFound indicates that a user or group does not have the requested attribute
+	ErrAttributeNotFound = errors.New("attribute not found")
+
+	// ErrInvalidCondition indicates that a permission condition does not parse or type-check
+	ErrInvalidCondition = errors.New("invalid condition")
+
+	// ErrDynamicGroup indicates that users cannot be added to a group whose members come from a rule
+	ErrDynamicGroup = errors.New("group membership is defined by a rule")
+
+	// ErrInvalidUserStatus indicates that a user status is not one of the lifecycle statuses
+	ErrInvalidUserStatus = errors.New("invalid user status")
+
+	// ErrInvalidListOptions indicates that a page size, sort order or cursor is not valid
+	ErrInvalidListOptions = errors.New("invalid list options")
+
+	// ErrInvalidIdempotencyKey indicates that an idempotency key is too long to be stored
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+	// ErrIdempotencyKeyReused indicates that an idempotency key was already used for a different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused for a different request")
 )
 
 // UserNotFoundError wraps user ID information
@@ -60,6 +111,55 @@ func (e *CycleDetectedError) Is(target error) bool {
 	return target == ErrCycleDetected
 }
 
+// HierarchyLimitError wraps the edge and the limit it would break, one of
+// LimitDepth, LimitChildren and LimitParents
+type HierarchyLimitError struct {
+	ChildGroupID  int
+	ParentGroupID int
+	Limit         string
+	Max           int
+}
+
+func (e *HierarchyLimitError) Error() string {
+	return fmt.Sprintf("adding group %d to group %d would exceed the %s limit of %d", e.ChildGroupID, e.ParentGroupID, e.Limit, e.Max)
+}
+
+func (e *HierarchyLimitError) Is(target error) bool {
+	return target == ErrHierarchyLimitExceeded
+}
+
+// NestingNotAllowedError wraps an edge and the group types the nesting policy does
+// not allow together
+type NestingNotAllowedError struct {
+	ChildGroupID  int
+	ParentGroupID int
+	ChildType     string
+	ParentType    string
+}
+
+func (e *NestingNotAllowedError) Error() string {
+	return fmt.Sprintf("adding group %d of type %q to group %d of type %q is not allowed by the nesting policy",
+		e.ChildGroupID, e.ChildType, e.ParentGroupID, e.ParentType)
+}
+
+func (e *NestingNotAllowedError) Is(target error) bool {
+	return target == ErrNestingNotAllowed
+}
+
+// EdgeNotFoundError wraps a child and parent group that are not directly nested
+type EdgeNotFoundError struct {
+	ChildGroupID  int
+	ParentGroupID int
+}
+
+func (e *EdgeNotFoundError) Error() string {
+	return fmt.Sprintf("user group %d is not in user group %d", e.ChildGroupID, e.ParentGroupID)
+}
+
+func (e *EdgeNotFoundError) Is(target error) bool {
+	return target == ErrEdgeNotFound
+}
+
 // PermissionDeniedError wraps permission denial information
 type PermissionDeniedError struct {
 	TargetType   string // "user" or "group"
@@ -74,3 +174,186 @@ func (e *PermissionDeniedError) Error() string {
 func (e *PermissionDeniedError) Is(target error) bool {
 	return target == ErrPermissionDenied
 }
+
+// StaleRevisionError wraps the required and observed revisions
+type StaleRevisionError struct {
+	Required Revision
+	Current  Revision
+}
+
+func (e *StaleRevisionError) Error() string {
+	return fmt.Sprintf("store is at revision %s, but %s is required", e.Current, e.Required)
+}
+
+func (e *StaleRevisionError) Is(target error) bool {
+	return target == ErrStaleRevision
+}
+
+// WebhookDeliveryNotFoundError wraps webhook delivery ID information
+type WebhookDeliveryNotFoundError struct {
+	DeliveryID int
+}
+
+func (e *WebhookDeliveryNotFoundError) Error() string {
+	return fmt.Sprintf("webhook delivery not found: %d", e.DeliveryID)
+}
+
+func (e *WebhookDeliveryNotFoundError) Is(target error) bool {
+	return target == ErrWebhookDeliveryNotFound
+}
+
+// ExternalIDNotFoundError wraps an external ID that matches no user or group
+type ExternalIDNotFoundError struct {
+	Type       string // "user" or "group"
+	ExternalID string
+}
+
+func (e *ExternalIDNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found: external ID %q", typeLabel(e.Type), e.ExternalID)
+}
+
+func (e *ExternalIDNotFoundError) Is(target error) bool {
+	if e.Type == "group" {
+		return target == ErrUserGroupNotFound
+	}
+	return target == ErrUserNotFound
+}
+
+// ExternalIDConflictError wraps an external ID and the user or group that already has it
+type ExternalIDConflictError struct {
+	Type       string // "user" or "group"
+	ExternalID string
+	ExistingID int
+}
+
+func (e *ExternalIDConflictError) Error() string {
+	return fmt.Sprintf("external ID %q already belongs to %s %d", e.ExternalID, typeLabel(e.Type), e.ExistingID)
+}
+
+func (e *ExternalIDConflictError) Is(target error) bool {
+	return target == ErrExternalIDConflict
+}
+
+// NameConflictError wraps a name and the user or group that already has it
+type NameConflictError struct {
+	Type       string // "user" or "group"
+	Name       string
+	ExistingID int
+}
+
+func (e *NameConflictError) Error() string {
+	return fmt.Sprintf("name %q already belongs to %s %d", e.Name, typeLabel(e.Type), e.ExistingID)
+}
+
+func (e *NameConflictError) Is(target error) bool {
+	return target == ErrNameConflict
+}
+
+// AttributeError wraps an attribute that was rejected and the reason
+type AttributeError struct {
+	SubjectType string // "user" or "group"
+	Name        string
+	Reason      string
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("invalid %s attribute %q: %s", typeLabel(e.SubjectType), e.Name, e.Reason)
+}
+
+func (e *AttributeError) Is(target error) bool {
+	return target == ErrInvalidAttribute
+}
+
+// AttributeNotFoundError wraps the subject and the name of a missing attribute
+type AttributeNotFoundError struct {
+	SubjectType string // "user" or "group"
+	SubjectID   int
+	Name        string
+}
+
+func (e *AttributeNotFoundError) Error() string {
+	return fmt.Sprintf("attribute not found: %s %d has no attribute %q", typeLabel(e.SubjectType), e.SubjectID, e.Name)
+}
+
+func (e *AttributeNotFoundError) Is(target error) bool {
+	return target == ErrAttributeNotFound
+}
+
+// ConditionError wraps a rejected permission condition, the byte offset of the
+// problem and the reason
+type ConditionError struct {
+	Condition string
+	Pos       int
+	Reason    string
+}
+
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("invalid condition %q at offset %d: %s", e.Condition, e.Pos, e.Reason)
+}
+
+func (e *ConditionError) Is(target error) bool {
+	return target == ErrInvalidCondition
+}
+
+// DynamicGroupError wraps a user that cannot be added to a dynamic group
+type DynamicGroupError struct {
+	UserID      int
+	UserGroupID int
+}
+
+func (e *DynamicGroupError) Error() string {
+	return fmt.Sprintf("cannot add user %d to user group %d: its members are defined by a rule", e.UserID, e.UserGroupID)
+}
+
+func (e *DynamicGroupError) Is(target error) bool {
+	return target == ErrDynamicGroup
+}
+
+// InvalidUserStatusError wraps a status that is not a lifecycle status
+type InvalidUserStatusError struct {
+	Status UserStatus
+}
+
+func (e *InvalidUserStatusError) Error() string {
+	return fmt.Sprintf("invalid user status %q: want active, suspended or deprovisioned", e.Status)
+}
+
+func (e *InvalidUserStatusError) Is(target error) bool {
+	return target == ErrInvalidUserStatus
+}
+
+// ListOptionsError wraps the list option that is not valid
+type ListOptionsError struct {
+	Field  string // "limit", "sort" or "cursor"
+	Reason string
+}
+
+func (e *ListOptionsError) Error() string {
+	return fmt.Sprintf("invalid list options: %s %s", e.Field, e.Reason)
+}
+
+func (e *ListOptionsError) Is(target error) bool {
+	return target == ErrInvalidListOptions
+}
+
+// typeLabel names a "user" or "group" type in error messages
+func typeLabel(t string) string {
+	if t == "group" {
+		return "user group"
+	}
+	return "user"
+}
+
+// IdempotencyKeyReusedError wraps the reused key and the operation it was first used for
+type IdempotencyKeyReusedError struct {
+	Key       string
+	Operation string
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("idempotency key %q was already used for a different %s request", e.Key, e.Operation)
+}
+
+func (e *IdempotencyKeyReusedError) Is(target error) bool {
+	return target == ErrIdempotencyKeyReused
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MaxExternalIDLength is the longest accepted external ID in bytes
+const MaxExternalIDLength = 255
+
+// validateExternalID rejects external IDs that repositories cannot store
+func validateExternalID(externalID string) error {
+	if len(externalID) > MaxExternalIDLength {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrInvalidExternalID, len(externalID), MaxExternalIDLength)
+	}
+	return nil
+}
+
+// nullString returns nil for an empty s, so it is stored as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// externalIDIndex maps IDs to external IDs and back, for in-memory repositories
+type externalIDIndex struct {
+	typ          string // "user" or "group"
+	byID         map[int]string
+	byExternalID map[string]int
+}
+
+func newExternalIDIndex(typ string) *externalIDIndex {
+	return &externalIDIndex{typ: typ, byID: make(map[int]string), byExternalID: make(map[string]int)}
+}
+
+// set assigns externalID to id, replacing its previous external ID. An empty
+// externalID removes it.
+func (x *externalIDIndex) set(id int, externalID string) {
+	if old, ok := x.byID[id]; ok {
+		delete(x.byExternalID, old)
+		delete(x.byID, id)
+	}
+	if externalID != "" {
+		x.byID[id] = externalID
+		x.byExternalID[externalID] = id
+	}
+}
+
+// conflict returns an ExternalIDConflictError if externalID belongs to another ID than self
+func (x *externalIDIndex) conflict(externalID string, self int) error {
+	if existing, ok := x.byExternalID[externalID]; ok && externalID != "" && existing != self {
+		return &ExternalIDConflictError{Type: x.typ, ExternalID: externalID, ExistingID: existing}
+	}
+	return nil
+}
+
+// lookup returns the ID with externalID
+func (x *externalIDIndex) lookup(externalID string) (int, error) {
+	id, ok := x.byExternalID[externalID]
+	if !ok || externalID == "" {
+		return 0, &ExternalIDNotFoundError{Type: x.typ, ExternalID: externalID}
+	}
+	return id, nil
+}
+
+// idsByName returns the sorted IDs in names that have name
+func idsByName(names map[int]string, name string) []int {
+	ids := make([]int, 0)
+	for id, n := range names {
+		if n == name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
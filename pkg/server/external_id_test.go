@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ExternalID_UniqueNames(t *testing.T) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	mysql := NewMySQLRepository(db, WithMySQLUniqueNames(true))
+	defer mysql.Close()
+	file := openFileRepository(t, t.TempDir(), WithFileUniqueNames(true))
+	defer file.Close()
+
+	for name, repo := range map[string]Repository{"mysql": mysql, "file": file} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			unique := fmt.Sprintf("Unique-%d", time.Now().UnixNano())
+
+			user, err := repo.CreateUser(ctx, unique)
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			var conflict *NameConflictError
+			_, err = repo.CreateUserWithExternalID(ctx, unique, "idp|"+unique)
+			if !errors.As(err, &conflict) || conflict.ExistingID != user || conflict.Type != "user" {
+				t.Errorf("Expected a NameConflictError for user %d, got %v", user, err)
+			}
+			if _, err := repo.GetUserByExternalID(ctx, "idp|"+unique); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Expected the rejected user not to be created, got %v", err)
+			}
+
+			// Users and groups may share a name
+			group, err := repo.CreateUserGroup(ctx, unique)
+			if err != nil {
+				t.Fatalf("CreateUserGroup failed: %v", err)
+			}
+			if _, err := repo.CreateUserGroup(ctx, unique); !errors.As(err, &conflict) || conflict.ExistingID != group {
+				t.Errorf("Expected a NameConflictError for group %d, got %v", group, err)
+			}
+
+			// A retried create under an idempotency key replays instead of conflicting
+			keyed := WithIdempotencyKey(ctx, uniqueKey("unique-names"))
+			first, err := repo.CreateUser(keyed, unique+"-keyed")
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			if again, err := repo.CreateUser(keyed, unique+"-keyed"); err != nil || again != first {
+				t.Errorf("Expected the retry to return %d, got %d, %v", first, again, err)
+			}
+		})
+	}
+}
+
+func Test_ExternalID_Validation(t *testing.T) {
+	repo := openFileRepository(t, t.TempDir())
+	defer repo.Close()
+	ctx := context.Background()
+	long := strings.Repeat("x", MaxExternalIDLength+1)
+
+	if _, err := repo.CreateUserWithExternalID(ctx, "Long", long); !errors.Is(err, ErrInvalidExternalID) {
+		t.Errorf("Expected ErrInvalidExternalID, got %v", err)
+	}
+	group, err := repo.CreateUserGroup(ctx, "Team")
+	if err != nil {
+		t.Fatalf("CreateUserGroup failed: %v", err)
+	}
+	if err := repo.SetUserGroupExternalID(ctx, group, long); !errors.Is(err, ErrInvalidExternalID) {
+		t.Errorf("Expected ErrInvalidExternalID, got %v", err)
+	}
+	if _, err := repo.GetUserByExternalID(ctx, ""); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for an empty external ID, got %v", err)
+	}
+}
+
+func Test_ExternalID_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	user, err := r.CreateUserWithExternalID(ctx, "Lena", "idp|lena")
+	if err != nil {
+		t.Fatalf("CreateUserWithExternalID failed: %v", err)
+	}
+	group, err := r.CreateUserGroup(ctx, "Ops")
+	if err != nil {
+		t.Fatalf("CreateUserGroup failed: %v", err)
+	}
+	if err := r.SetUserGroupExternalID(ctx, group, "idp|ops"); err != nil {
+		t.Fatalf("SetUserGroupExternalID failed: %v", err)
+	}
+	crash(t, r)
+
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if got, err := r.GetUserByExternalID(ctx, "idp|lena"); err != nil || got != user {
+			t.Errorf("GetUserByExternalID = %d, %v; want %d", got, err, user)
+		}
+		if got, err := r.GetUserGroupByExternalID(ctx, "idp|ops"); err != nil || got != group {
+			t.Errorf("GetUserGroupByExternalID = %d, %v; want %d", got, err, group)
+		}
+		if _, err := r.CreateUserWithExternalID(ctx, "Other", "idp|lena"); !errors.Is(err, ErrExternalIDConflict) {
+			t.Errorf("Expected ErrExternalIDConflict, got %v", err)
+		}
+	}
+
+	// The external IDs are replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+}
+
+func Test_ExternalID_Server(t *testing.T) {
+	var logs logBuffer
+	repo := openFileRepository(t, t.TempDir())
+	defer repo.Close()
+	s := New(repo, WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	user, err := s.CreateUserWithExternalID(ctx, "Mona", "idp|mona")
+	if err != nil {
+		t.Fatalf("CreateUserWithExternalID failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "CreateUserWithExternalID")
+	if !ok || entry["external_id"] != "idp|mona" {
+		t.Errorf("Expected the external ID in the log entry, got %v", entry)
+	}
+	if got, err := s.GetUserByExternalID(ctx, "idp|mona"); err != nil || got != user {
+		t.Errorf("GetUserByExternalID = %d, %v; want %d", got, err, user)
+	}
+
+	_, err = s.CreateUserWithExternalID(ctx, "Mona", "idp|mona")
+	if !errors.Is(err, ErrExternalIDConflict) {
+		t.Errorf("Expected ErrExternalIDConflict, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "CreateUserWithExternalID"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the conflict to be logged as rejected, got %v", logs.entries(t))
+	}
+	if ids, err := s.FindUsersByName(ctx, "Mona"); err != nil || len(ids) != 1 || ids[0] != user {
+		t.Errorf("FindUsersByName = %v, %v; want [%d]", ids, err, user)
+	}
+}
@@ -0,0 +1,821 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeRepository is a small in-memory Repository for tests that must run without MySQL.
+// It favors obviously-correct graph walks over speed and counts permission checks so
+// decorators can assert when they hit the wrapped repository.
+type fakeRepository struct {
+	Repository // unimplemented methods panic
+
+	mu          sync.Mutex
+	nextID      int
+	users       map[int]string
+	groups      map[int]string
+	members     map[int]map[int]bool     // group -> users
+	children    map[int]map[int]bool     // parent -> child groups
+	permissions map[permissionKey]string // grant -> condition, "" if unconditional
+	revision    Revision
+	events      []ChangeEvent
+	idempotency map[string]idempotencyRecord
+	userExtIDs  *externalIDIndex
+	groupExtIDs *externalIDIndex
+	attributes  map[permissionKey]Attributes // by subject, target fields unused
+	rules       map[int]*Condition           // dynamic group -> membership rule
+	statuses    map[int]UserStatus           // users that are not active
+	groupTypes  map[int]string
+	checks      int
+}
+
+type permissionKey struct {
+	sourceType string
+	sourceID   int
+	targetType string
+	targetID   int
+}
+
+func newFakeRepository() *fakeRepository {
+	return &fakeRepository{
+		users:       make(map[int]string),
+		groups:      make(map[int]string),
+		members:     make(map[int]map[int]bool),
+		children:    make(map[int]map[int]bool),
+		permissions: make(map[permissionKey]string),
+		idempotency: make(map[string]idempotencyRecord),
+		userExtIDs:  newExternalIDIndex("user"),
+		groupExtIDs: newExternalIDIndex("group"),
+		attributes:  make(map[permissionKey]Attributes),
+		rules:       make(map[int]*Condition),
+		statuses:    make(map[int]UserStatus),
+		groupTypes:  make(map[int]string),
+	}
+}
+
+func (f *fakeRepository) checkCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks
+}
+
+// create replays or remembers the idempotency key of ctx, which never expires here.
+// The caller must hold the lock.
+func (f *fakeRepository) create(ctx context.Context, op, name string, names map[int]string) (int, error) {
+	key, keyed := IdempotencyKeyFromContext(ctx)
+	if rec, ok := f.idempotency[key]; keyed && ok {
+		return rec.replay(op, name)
+	}
+	f.nextID++
+	names[f.nextID] = name
+	if keyed {
+		f.idempotency[key] = idempotencyRecord{Key: key, Operation: op, Name: name, ID: f.nextID}
+	}
+	return f.nextID, nil
+}
+
+func (f *fakeRepository) CreateUser(ctx context.Context, name string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.create(ctx, "CreateUser", name, f.users)
+}
+
+func (f *fakeRepository) GetUserByID(_ context.Context, userID int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, ok := f.users[userID]
+	if !ok {
+		return "", &UserNotFoundError{UserID: userID}
+	}
+	return name, nil
+}
+
+func (f *fakeRepository) CreateUserGroup(ctx context.Context, name string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.create(ctx, "CreateUserGroup", name, f.groups)
+}
+
+func (f *fakeRepository) GetUserGroupByID(_ context.Context, groupID int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, ok := f.groups[groupID]
+	if !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	return name, nil
+}
+
+// createWithExternalID creates a user or group after checking externalID.
+// The caller must hold the lock.
+func (f *fakeRepository) createWithExternalID(ctx context.Context, op, name, externalID string, names map[int]string, index *externalIDIndex) (int, error) {
+	if err := validateExternalID(externalID); err != nil {
+		return 0, err
+	}
+	if err := index.conflict(externalID, 0); err != nil {
+		return 0, err
+	}
+	id, err := f.create(ctx, op, name, names)
+	if err == nil {
+		index.set(id, externalID)
+	}
+	return id, err
+}
+
+func (f *fakeRepository) CreateUserWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createWithExternalID(ctx, "CreateUser", name, externalID, f.users, f.userExtIDs)
+}
+
+func (f *fakeRepository) CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createWithExternalID(ctx, "CreateUserGroup", name, externalID, f.groups, f.groupExtIDs)
+}
+
+func (f *fakeRepository) SetUserExternalID(_ context.Context, userID int, externalID string) error {
+	if err := validateExternalID(externalID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[userID]; !ok {
+		return &UserNotFoundError{UserID: userID}
+	}
+	if err := f.userExtIDs.conflict(externalID, userID); err != nil {
+		return err
+	}
+	f.userExtIDs.set(userID, externalID)
+	return nil
+}
+
+func (f *fakeRepository) SetUserGroupExternalID(_ context.Context, groupID int, externalID string) error {
+	if err := validateExternalID(externalID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if err := f.groupExtIDs.conflict(externalID, groupID); err != nil {
+		return err
+	}
+	f.groupExtIDs.set(groupID, externalID)
+	return nil
+}
+
+func (f *fakeRepository) GetUserByExternalID(_ context.Context, externalID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.userExtIDs.lookup(externalID)
+}
+
+func (f *fakeRepository) GetUserGroupByExternalID(_ context.Context, externalID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.groupExtIDs.lookup(externalID)
+}
+
+func (f *fakeRepository) FindUsersByName(_ context.Context, name string) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return idsByName(f.users, name), nil
+}
+
+func (f *fakeRepository) FindUserGroupsByName(_ context.Context, name string) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return idsByName(f.groups, name), nil
+}
+
+func (f *fakeRepository) SetAttribute(_ context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.subjectExistsLocked(subjectType, subjectID); err != nil {
+		return 0, err
+	}
+	key := permissionKey{sourceType: subjectType, sourceID: subjectID}
+	if value == nil {
+		if err := validateAttributeName(subjectType, name); err != nil {
+			return 0, err
+		}
+		delete(f.attributes[key], name)
+	} else {
+		_, v, err := normalizeAttribute(subjectType, name, value)
+		if err != nil {
+			return 0, err
+		}
+		if f.attributes[key] == nil {
+			f.attributes[key] = make(Attributes)
+		}
+		f.attributes[key][name] = v
+	}
+	if subjectType == "user" {
+		for _, groupID := range sortedRuleGroups(f.rules) {
+			f.applyRuleLocked(groupID, subjectID)
+		}
+	}
+	return f.revision, nil
+}
+
+// applyRuleLocked adds or removes a user from a dynamic group as its rule requires
+func (f *fakeRepository) applyRuleLocked(groupID, userID int) {
+	attrs, ok := f.attributes[permissionKey{sourceType: "user", sourceID: userID}]
+	matches := ok && len(attrs) > 0 && ruleMatches(f.rules[groupID], attrs)
+	switch {
+	case matches && !f.members[groupID][userID]:
+		if f.members[groupID] == nil {
+			f.members[groupID] = make(map[int]bool)
+		}
+		f.members[groupID][userID] = true
+		f.recordLocked(membershipAddedEvent(userID, groupID))
+	case !matches && f.members[groupID][userID]:
+		delete(f.members[groupID], userID)
+		f.recordLocked(membershipRemovedEvent(userID, groupID))
+	}
+}
+
+func (f *fakeRepository) ListUsers(_ context.Context, opts ListOptions) (Page, error) {
+	return f.listPage(opts, f.users, func() []int { return mapKeys(f.users) })
+}
+
+func (f *fakeRepository) ListUserGroups(_ context.Context, opts ListOptions) (Page, error) {
+	return f.listPage(opts, f.groups, func() []int { return mapKeys(f.groups) })
+}
+
+func (f *fakeRepository) ListUsersInGroup(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return f.listPage(opts, f.users, func() []int { return sortedKeys(f.members[groupID]) })
+}
+
+func (f *fakeRepository) ListGroupsInGroup(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return f.listPage(opts, f.groups, func() []int { return sortedKeys(f.children[groupID]) })
+}
+
+func (f *fakeRepository) ListUsersInGroupTransitive(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return f.listPage(opts, f.users, func() []int { return f.usersInGroupTransitiveLocked(groupID) })
+}
+
+func (f *fakeRepository) listPage(opts ListOptions, names map[int]string, ids func() []int) (Page, error) {
+	q, err := newListQuery(opts)
+	if err != nil {
+		return Page{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return q.paginate(pageItems(ids(), names)), nil
+}
+
+func (f *fakeRepository) SetUserStatus(_ context.Context, userID int, status UserStatus) (Revision, error) {
+	if err := status.validate(); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[userID]; !ok {
+		return 0, &UserNotFoundError{UserID: userID}
+	}
+	if f.statusLocked(userID) == status {
+		return f.revision, nil
+	}
+	if status == UserActive {
+		delete(f.statuses, userID)
+	} else {
+		f.statuses[userID] = status
+	}
+	return f.recordLocked(userStatusChangedEvent(userID, status)), nil
+}
+
+func (f *fakeRepository) GetUserStatus(_ context.Context, userID int) (UserStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[userID]; !ok {
+		return "", &UserNotFoundError{UserID: userID}
+	}
+	return f.statusLocked(userID), nil
+}
+
+func (f *fakeRepository) GetUserStatuses(_ context.Context, userIDs []int) (map[int]UserStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make(map[int]UserStatus, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := f.users[userID]; ok {
+			statuses[userID] = f.statusLocked(userID)
+		}
+	}
+	return statuses, nil
+}
+
+func (f *fakeRepository) statusLocked(userID int) UserStatus {
+	if status, ok := f.statuses[userID]; ok {
+		return status
+	}
+	return UserActive
+}
+
+func (f *fakeRepository) SetGroupRule(_ context.Context, groupID int, rule string) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return 0, &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if rule == "" {
+		if f.rules[groupID] != nil {
+			f.recordLocked(ruleChangedEvent(groupID))
+		}
+		delete(f.rules, groupID)
+		return f.revision, nil
+	}
+	c, err := ParseMembershipRule(rule)
+	if err != nil {
+		return 0, err
+	}
+	if ruleString(f.rules[groupID]) != ruleString(c) {
+		f.recordLocked(ruleChangedEvent(groupID))
+	}
+	f.rules[groupID] = c
+	users := make(map[int]bool)
+	for u := range f.users {
+		users[u] = true
+	}
+	for _, u := range sortedKeys(users) {
+		f.applyRuleLocked(groupID, u)
+	}
+	return f.revision, nil
+}
+
+func (f *fakeRepository) GetGroupRule(_ context.Context, groupID int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if c, ok := f.rules[groupID]; ok {
+		return c.String(), nil
+	}
+	return "", nil
+}
+
+func (f *fakeRepository) GetAttributes(_ context.Context, subjectType string, subjectID int) (Attributes, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.subjectExistsLocked(subjectType, subjectID); err != nil {
+		return nil, err
+	}
+	attrs := make(Attributes)
+	for name, v := range f.attributes[permissionKey{sourceType: subjectType, sourceID: subjectID}] {
+		attrs[name] = v
+	}
+	return attrs, nil
+}
+
+func (f *fakeRepository) subjectExistsLocked(subjectType string, id int) error {
+	if subjectType == "group" {
+		if _, ok := f.groups[id]; !ok {
+			return &UserGroupNotFoundError{UserGroupID: id}
+		}
+		return nil
+	}
+	if _, ok := f.users[id]; !ok {
+		return &UserNotFoundError{UserID: id}
+	}
+	return nil
+}
+
+func (f *fakeRepository) AddUserToGroup(_ context.Context, userID, groupID int) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.rules[groupID]; ok {
+		return 0, &DynamicGroupError{UserID: userID, UserGroupID: groupID}
+	}
+	if f.members[groupID][userID] {
+		return f.revision, nil
+	}
+	if f.members[groupID] == nil {
+		f.members[groupID] = make(map[int]bool)
+	}
+	f.members[groupID][userID] = true
+	return f.recordLocked(membershipAddedEvent(userID, groupID)), nil
+}
+
+func (f *fakeRepository) GetUsersInGroup(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.members[groupID]), nil
+}
+
+func (f *fakeRepository) GetUsersInGroupTransitive(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.usersInGroupTransitiveLocked(groupID), nil
+}
+
+func (f *fakeRepository) usersInGroupTransitiveLocked(groupID int) []int {
+	users := make(map[int]bool)
+	for g := range f.descendantsLocked(groupID) {
+		for u := range f.members[g] {
+			users[u] = true
+		}
+	}
+	return sortedKeys(users)
+}
+
+func (f *fakeRepository) GetGroupsForUser(_ context.Context, userID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	groups := make(map[int]bool)
+	for g, users := range f.members {
+		if users[userID] {
+			groups[g] = true
+		}
+	}
+	return sortedKeys(groups), nil
+}
+
+func (f *fakeRepository) GetGroupsForUserTransitive(_ context.Context, userID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.userGroupsLocked(userID)), nil
+}
+
+func (f *fakeRepository) AddGroupToGroup(_ context.Context, childID, parentID int) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.descendantsLocked(childID)[parentID] {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: parentID}
+	}
+	if f.children[parentID][childID] {
+		return f.revision, nil
+	}
+	if f.children[parentID] == nil {
+		f.children[parentID] = make(map[int]bool)
+	}
+	f.children[parentID][childID] = true
+	return f.recordLocked(edgeAddedEvent(childID, parentID)), nil
+}
+
+func (f *fakeRepository) MoveGroup(_ context.Context, childID, fromParentID, toParentID int) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if childID == toParentID {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+	for _, g := range []int{childID, fromParentID, toParentID} {
+		if _, ok := f.groups[g]; !ok {
+			return 0, &UserGroupNotFoundError{UserGroupID: g}
+		}
+	}
+	if !f.children[fromParentID][childID] {
+		return 0, &EdgeNotFoundError{ChildGroupID: childID, ParentGroupID: fromParentID}
+	}
+	if fromParentID == toParentID {
+		return f.revision, nil
+	}
+	if f.descendantsLocked(childID)[toParentID] {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+	delete(f.children[fromParentID], childID)
+	if f.children[toParentID] == nil {
+		f.children[toParentID] = make(map[int]bool)
+	}
+	f.children[toParentID][childID] = true
+	return f.recordLocked(edgeMovedEvent(childID, fromParentID, toParentID)), nil
+}
+
+func (f *fakeRepository) GetGroupsInGroup(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.children[groupID]), nil
+}
+
+func (f *fakeRepository) GetAncestorGroups(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ancestors := f.ancestorsLocked(groupID)
+	delete(ancestors, groupID)
+	return sortedKeys(ancestors), nil
+}
+
+func (f *fakeRepository) GetParentGroups(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.parentsLocked(groupID)), nil
+}
+
+func (f *fakeRepository) GetAncestorEdges(_ context.Context, subjectType string, subjectID int) ([]GroupEdge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reach := f.ancestorsLocked(subjectID)
+	if subjectType != "group" {
+		reach = f.userGroupsLocked(subjectID)
+	}
+	edges := make([]GroupEdge, 0)
+	for _, child := range sortedKeys(reach) {
+		for _, parent := range sortedKeys(f.parentsLocked(child)) {
+			edges = append(edges, GroupEdge{ChildID: child, ParentID: parent})
+		}
+	}
+	return edges, nil
+}
+
+func (f *fakeRepository) GetDescendantGroups(_ context.Context, groupID int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	descendants := f.descendantsLocked(groupID)
+	delete(descendants, groupID)
+	return sortedKeys(descendants), nil
+}
+
+func (f *fakeRepository) GetGroupSubtree(_ context.Context, groupID int) (*GroupSubtree, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return nil, &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	subtree := &GroupSubtree{RootID: groupID, Names: make(map[int]string)}
+	for _, g := range sortedKeys(f.descendantsLocked(groupID)) {
+		subtree.Names[g] = f.groups[g]
+		for _, child := range sortedKeys(f.children[g]) {
+			subtree.Edges = append(subtree.Edges, GroupEdge{ChildID: child, ParentID: g})
+		}
+		for _, user := range sortedKeys(f.members[g]) {
+			subtree.Memberships = append(subtree.Memberships, Membership{UserID: user, GroupID: g})
+		}
+	}
+	return subtree, nil
+}
+
+func (f *fakeRepository) GetHierarchyViolations(_ context.Context, limits HierarchyLimits) ([]HierarchyViolation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var edges []GroupEdge
+	for parent, children := range f.children {
+		for child := range children {
+			edges = append(edges, GroupEdge{ChildID: child, ParentID: parent})
+		}
+	}
+	return hierarchyViolations(edges, limits), nil
+}
+
+func (f *fakeRepository) SetGroupType(_ context.Context, groupID int, groupType string) error {
+	if err := validateGroupType(groupType); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	f.groupTypes[groupID] = groupType
+	return nil
+}
+
+func (f *fakeRepository) GetGroupType(_ context.Context, groupID int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.groups[groupID]; !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	return f.groupTypes[groupID], nil
+}
+
+func (f *fakeRepository) GetNestingViolations(_ context.Context, policy NestingPolicy) ([]NestingViolation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var typed []NestingViolation
+	for parent, children := range f.children {
+		for child := range children {
+			typed = append(typed, NestingViolation{ChildGroupID: child, ParentGroupID: parent,
+				ChildType: f.groupTypes[child], ParentType: f.groupTypes[parent]})
+		}
+	}
+	return nestingViolations(typed, policy), nil
+}
+
+func (f *fakeRepository) WouldCreateCycle(_ context.Context, childID, parentID int) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.descendantsLocked(childID)[parentID], nil
+}
+
+func (f *fakeRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	return f.AddConditionalPermission(ctx, sourceType, targetType, sourceID, targetID, "")
+}
+
+func (f *fakeRepository) AddConditionalPermission(_ context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	if condition != "" {
+		if _, err := ParseCondition(condition); err != nil {
+			return 0, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := permissionKey{sourceType, sourceID, targetType, targetID}
+	if current, ok := f.permissions[key]; ok && current == condition {
+		return f.revision, nil
+	}
+	f.permissions[key] = condition
+	return f.recordLocked(permissionGrantedEvent(sourceType, targetType, sourceID, targetID)), nil
+}
+
+func (f *fakeRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	f.mu.Lock()
+	f.checks++
+	grants := f.grantsLocked(sourceUserID, "user", targetUserID, f.userGroupsLocked(targetUserID))
+	f.mu.Unlock()
+	return f.evaluateGrants(ctx, grants, sourceUserID, "user", targetUserID)
+}
+
+func (f *fakeRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	f.mu.Lock()
+	f.checks++
+	grants := f.grantsLocked(sourceUserID, "group", targetGroupID, f.ancestorsLocked(targetGroupID))
+	f.mu.Unlock()
+	return f.evaluateGrants(ctx, grants, sourceUserID, "group", targetGroupID)
+}
+
+// evaluateGrants allows if one of the applicable grants is unconditional or its condition holds
+func (f *fakeRepository) evaluateGrants(ctx context.Context, grants []string, sourceUserID int, targetType string, targetID int) (bool, error) {
+	var exprs []string
+	for _, condition := range grants {
+		if condition == "" {
+			return true, nil
+		}
+		exprs = append(exprs, condition)
+	}
+	conditions, err := parseConditions(exprs)
+	if err != nil {
+		return false, err
+	}
+	return evaluateConditions(ctx, conditions, sourceUserID, targetType, targetID, f.GetAttributes)
+}
+
+func (f *fakeRepository) CurrentRevision(context.Context) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revision, nil
+}
+
+func (f *fakeRepository) ListChanges(_ context.Context, afterRevision Revision, limit int) ([]ChangeEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := make([]ChangeEvent, 0)
+	for _, e := range f.events {
+		if e.Revision > afterRevision && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// recordLocked assigns the next revision to event and appends it to the change feed
+func (f *fakeRepository) recordLocked(event ChangeEvent) Revision {
+	f.revision++
+	event.Revision = f.revision
+	event.CreatedAt = time.Now()
+	f.events = append(f.events, event)
+	return f.revision
+}
+
+func (f *fakeRepository) LoadGraphSnapshot(context.Context) (*GraphSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	snapshot := &GraphSnapshot{Revision: f.revision}
+	for g, users := range f.members {
+		for u := range users {
+			snapshot.Memberships = append(snapshot.Memberships, Membership{UserID: u, GroupID: g})
+		}
+	}
+	for parent, children := range f.children {
+		for child := range children {
+			snapshot.Edges = append(snapshot.Edges, GroupEdge{ChildID: child, ParentID: parent})
+		}
+	}
+	for g, rule := range f.rules {
+		snapshot.Rules = append(snapshot.Rules, GroupRule{GroupID: g, Rule: rule.String()})
+	}
+	for u := range f.statuses {
+		snapshot.InactiveUsers = append(snapshot.InactiveUsers, u)
+	}
+	for p, condition := range f.permissions {
+		snapshot.Permissions = append(snapshot.Permissions, Permission{
+			SourceType: p.sourceType, SourceID: p.sourceID, TargetType: p.targetType, TargetID: p.targetID,
+			Condition: condition,
+		})
+	}
+	return snapshot, nil
+}
+
+func (f *fakeRepository) Close() error {
+	return nil
+}
+
+// grantsLocked returns the conditions of the grants that apply in the four
+// permission scenarios, "" for unconditional grants
+func (f *fakeRepository) grantsLocked(sourceUserID int, targetType string, targetID int, targetGroups map[int]bool) []string {
+	if _, inactive := f.statuses[sourceUserID]; inactive {
+		return nil
+	}
+	var grants []string
+	grant := func(k permissionKey) {
+		if condition, ok := f.permissions[k]; ok {
+			grants = append(grants, condition)
+		}
+	}
+
+	sourceGroups := f.userGroupsLocked(sourceUserID)
+	if targetType == "user" {
+		grant(permissionKey{"user", sourceUserID, "user", targetID})
+		for sg := range sourceGroups {
+			grant(permissionKey{"group", sg, "user", targetID})
+		}
+	}
+	for tg := range targetGroups {
+		grant(permissionKey{"user", sourceUserID, "group", tg})
+		for sg := range sourceGroups {
+			grant(permissionKey{"group", sg, "group", tg})
+		}
+	}
+	return grants
+}
+
+// descendantsLocked returns groupID and all groups transitively inside it
+func (f *fakeRepository) descendantsLocked(groupID int) map[int]bool {
+	seen := map[int]bool{groupID: true}
+	queue := []int{groupID}
+	for len(queue) > 0 {
+		g := queue[0]
+		queue = queue[1:]
+		for child := range f.children[g] {
+			if !seen[child] {
+				seen[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return seen
+}
+
+// ancestorsLocked returns groupID and all groups that transitively contain it
+func (f *fakeRepository) ancestorsLocked(groupID int) map[int]bool {
+	seen := map[int]bool{groupID: true}
+	queue := []int{groupID}
+	for len(queue) > 0 {
+		g := queue[0]
+		queue = queue[1:]
+		for parent, children := range f.children {
+			if children[g] && !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return seen
+}
+
+// parentsLocked returns the groups that directly contain groupID
+func (f *fakeRepository) parentsLocked(groupID int) map[int]bool {
+	parents := make(map[int]bool)
+	for parent, children := range f.children {
+		if children[groupID] {
+			parents[parent] = true
+		}
+	}
+	return parents
+}
+
+// userGroupsLocked returns all groups the user belongs to directly or transitively
+func (f *fakeRepository) userGroupsLocked(userID int) map[int]bool {
+	groups := make(map[int]bool)
+	for g, users := range f.members {
+		if users[userID] {
+			for a := range f.ancestorsLocked(g) {
+				groups[a] = true
+			}
+		}
+	}
+	return groups
+}
+
+// sortedRuleGroups returns the dynamic groups of rules in ascending order
+func sortedRuleGroups(rules map[int]*Condition) []int {
+	groups := make(map[int]bool, len(rules))
+	for g := range rules {
+		groups[g] = true
+	}
+	return sortedKeys(groups)
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,1594 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy controls when FileRepository flushes its write-ahead log to stable storage
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs the log before a mutation returns. Acknowledged writes
+	// survive a power loss.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs the log in the background. A power loss can lose the
+	// writes of the last interval; a process crash loses nothing.
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+// FileRepository defaults
+const (
+	defaultFsyncInterval = time.Second
+	defaultSnapshotEvery = 10000
+)
+
+// File names inside the repository directory
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// WAL framing: every record is a 4-byte big-endian payload length, a 4-byte CRC-32C
+// of the payload and the JSON-encoded walRecord. A frame that is cut short or fails
+// its checksum marks the end of the log.
+const (
+	walHeaderSize      = 8
+	walMaxRecordSize   = 1 << 20
+	fileSnapshotFormat = 1
+)
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errFileRepositoryClosed is returned by mutations after Close
+var errFileRepositoryClosed = errors.New("file repository is closed")
+
+// WAL operations
+const (
+	walCreateUser    = "create_user"
+	walCreateGroup   = "create_group"
+	walAddMembership = "add_membership"
+	walAddEdge       = "add_edge"
+	walMoveEdge      = "move_edge"
+	walAddPermission = "add_permission"
+	walSetExternalID = "set_external_id"
+	walSetAttribute  = "set_attribute"
+	walSetGroupRule  = "set_group_rule"
+	walSetUserStatus = "set_user_status"
+	walSetGroupType  = "set_group_type"
+)
+
+// walRecord is one logged mutation. Membership records use SourceID for the user and
+// TargetID for the group, edge records SourceID for the child and TargetID for the parent,
+// and move records also ID for the parent the child leaves.
+// External ID and attribute records use SourceType "user" or "group" and ID, and
+// attribute records Name for the attribute name. Permission records carry the
+// condition of the grant, empty for unconditional grants, group rule records ID
+// for the group and Condition for its membership rule, and user status records ID
+// for the user and Status for the new status, and group type records ID for the
+// group and Name for its type. The membership changes that
+// user attribute and group rule records cause are derived again when they are applied.
+type walRecord struct {
+	LSN        uint64     `json:"lsn"`
+	Op         string     `json:"op"`
+	ID         int        `json:"id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	ExternalID string     `json:"external_id,omitempty"`
+	SourceType string     `json:"source_type,omitempty"`
+	SourceID   int        `json:"source_id,omitempty"`
+	TargetType string     `json:"target_type,omitempty"`
+	TargetID   int        `json:"target_id,omitempty"`
+	Condition  string     `json:"condition,omitempty"`
+	Status     UserStatus `json:"status,omitempty"`
+	Revision   Revision   `json:"revision,omitempty"`
+	Time       time.Time  `json:"time"`
+
+	// Idempotency is set for creates under an idempotency key
+	Idempotency *idempotencyRecord `json:"idempotency,omitempty"`
+
+	// Attribute is the new value of an attribute record, nil to remove it
+	Attribute *storedAttribute `json:"attribute,omitempty"`
+}
+
+// event returns the change event of a revisioned record
+func (rec walRecord) event() ChangeEvent {
+	var e ChangeEvent
+	switch rec.Op {
+	case walAddMembership:
+		e = membershipAddedEvent(rec.SourceID, rec.TargetID)
+	case walAddEdge:
+		e = edgeAddedEvent(rec.SourceID, rec.TargetID)
+	case walMoveEdge:
+		e = edgeMovedEvent(rec.SourceID, rec.ID, rec.TargetID)
+	case walAddPermission:
+		e = permissionGrantedEvent(rec.SourceType, rec.TargetType, rec.SourceID, rec.TargetID)
+	case walSetUserStatus:
+		e = userStatusChangedEvent(rec.ID, rec.Status)
+	case walSetGroupRule:
+		e = ruleChangedEvent(rec.ID)
+	}
+	e.Revision = rec.Revision
+	e.CreatedAt = rec.Time
+	return e
+}
+
+// fileSnapshot is the full repository state as of LSN
+type fileSnapshot struct {
+	Format      int            `json:"format"`
+	LSN         uint64         `json:"lsn"`
+	Revision    Revision       `json:"revision"`
+	LastUserID  int            `json:"last_user_id"`
+	LastGroupID int            `json:"last_group_id"`
+	Users       map[int]string `json:"users"`
+	Groups      map[int]string `json:"groups"`
+	Memberships []Membership   `json:"memberships"`
+	Edges       []GroupEdge    `json:"edges"`
+	Permissions []Permission   `json:"permissions"`
+	Rules       []GroupRule    `json:"rules,omitempty"`
+	Events      []ChangeEvent  `json:"events"`
+
+	IdempotencyKeys  []idempotencyRecord `json:"idempotency_keys,omitempty"`
+	UserExternalIDs  map[int]string      `json:"user_external_ids,omitempty"`
+	GroupExternalIDs map[int]string      `json:"group_external_ids,omitempty"`
+
+	// Attributes holds the attributes by subject type and ID
+	Attributes map[string]map[int]map[string]storedAttribute `json:"attributes,omitempty"`
+
+	// UserStatuses holds the status of every user that is not active
+	UserStatuses map[int]UserStatus `json:"user_statuses,omitempty"`
+
+	// GroupTypes holds the type of every group that has one
+	GroupTypes map[int]string `json:"group_types,omitempty"`
+}
+
+// FileRepository implements the Repository interface on a local directory, for edge
+// deployments and single-binary tools. Every mutation is appended to a write-ahead log
+// before it is applied to the in-memory state, which serves all reads through the same
+// permission graph as IndexedRepository. Every snapshotEvery records the state is
+// written to a snapshot and the log is truncated. Opening the repository loads the
+// snapshot and replays the log, discarding a torn last record left by a crash.
+//
+// A directory must only be opened by one FileRepository at a time.
+type FileRepository struct {
+	dir           string
+	fsync         FsyncPolicy
+	fsyncInterval time.Duration
+	snapshotEvery int
+	logger        Logger
+
+	idempotencyTTL  time.Duration
+	uniqueNames     bool
+	hierarchyLimits HierarchyLimits
+	nestingPolicy   NestingPolicy
+
+	mu         sync.RWMutex
+	wal        *os.File
+	walSize    int64
+	walRecords int    // records appended since the last snapshot
+	lsn        uint64 // last applied record
+	dirty      bool   // appended but not yet synced
+	failed     error  // set when the log may no longer match the in-memory state
+	closed     bool
+
+	users       map[int]string
+	groups      map[int]string
+	lastUserID  int
+	lastGroupID int
+	graph       *permissionGraph
+	revision    Revision
+	events      []ChangeEvent
+	idempotency map[string]idempotencyRecord
+
+	userExternalIDs  *externalIDIndex
+	groupExternalIDs *externalIDIndex
+	attributes       map[string]map[int]map[string]storedAttribute // by subject type and ID
+	statuses         map[int]UserStatus                            // users that are not active
+	groupTypes       map[int]string                                // groups that have a type
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// FileOption configures optional FileRepository settings
+type FileOption func(*FileRepository)
+
+// WithFsyncPolicy sets when the write-ahead log is synced. The default is FsyncAlways.
+func WithFsyncPolicy(policy FsyncPolicy) FileOption {
+	return func(r *FileRepository) {
+		r.fsync = policy
+	}
+}
+
+// WithFsyncInterval sets how often FsyncInterval syncs the log. The default is one second.
+func WithFsyncInterval(interval time.Duration) FileOption {
+	return func(r *FileRepository) {
+		if interval > 0 {
+			r.fsyncInterval = interval
+		}
+	}
+}
+
+// WithSnapshotEvery sets after how many logged records a snapshot is taken
+func WithSnapshotEvery(records int) FileOption {
+	return func(r *FileRepository) {
+		if records > 0 {
+			r.snapshotEvery = records
+		}
+	}
+}
+
+// WithFileLogger sets the logger for recovery and snapshot messages. A nil logger disables logging.
+func WithFileLogger(logger Logger) FileOption {
+	return func(r *FileRepository) {
+		if logger != nil {
+			r.logger = logger
+		}
+	}
+}
+
+// WithFileIdempotencyTTL sets how long idempotency keys are remembered. The default
+// is DefaultIdempotencyTTL.
+func WithFileIdempotencyTTL(ttl time.Duration) FileOption {
+	return func(r *FileRepository) {
+		if ttl > 0 {
+			r.idempotencyTTL = ttl
+		}
+	}
+}
+
+// WithFileUniqueNames enforces unique user names and unique group names. Names
+// that were duplicated before enforcement was turned on stay as they are.
+func WithFileUniqueNames(enforce bool) FileOption {
+	return func(r *FileRepository) {
+		r.uniqueNames = enforce
+	}
+}
+
+// WithFileHierarchyLimits rejects hierarchy edges that break limits with a
+// HierarchyLimitError, see GetHierarchyViolations for the groups that already do
+func WithFileHierarchyLimits(limits HierarchyLimits) FileOption {
+	return func(r *FileRepository) {
+		r.hierarchyLimits = limits
+	}
+}
+
+// WithFileNestingPolicy rejects hierarchy edges and group types that policy does
+// not allow with a NestingNotAllowedError, see GetNestingViolations for the edges
+// that already break it
+func WithFileNestingPolicy(policy NestingPolicy) FileOption {
+	return func(r *FileRepository) {
+		r.nestingPolicy = policy
+	}
+}
+
+// WithFileConfig applies the repository settings of config: IdempotencyTTL,
+// UniqueNames, HierarchyLimits and NestingPolicy. The file repository does not retry,
+// so config.Retry is ignored.
+func WithFileConfig(config Config) FileOption {
+	return func(r *FileRepository) {
+		WithFileIdempotencyTTL(config.IdempotencyTTL)(r)
+		WithFileUniqueNames(config.UniqueNames)(r)
+		WithFileHierarchyLimits(config.HierarchyLimits)(r)
+		WithFileNestingPolicy(config.NestingPolicy)(r)
+	}
+}
+
+// OpenFileRepository opens or creates a file-backed repository in dir and recovers its
+// state from the snapshot and the write-ahead log
+func OpenFileRepository(dir string, opts ...FileOption) (*FileRepository, error) {
+	r := &FileRepository{
+		dir:           dir,
+		fsync:         FsyncAlways,
+		fsyncInterval: defaultFsyncInterval,
+		snapshotEvery: defaultSnapshotEvery,
+		logger:        noopLogger{},
+		users:         make(map[int]string),
+		groups:        make(map[int]string),
+		graph:         newPermissionGraph(),
+		idempotency:   make(map[string]idempotencyRecord),
+
+		idempotencyTTL:   DefaultIdempotencyTTL,
+		userExternalIDs:  newExternalIDIndex("user"),
+		groupExternalIDs: newExternalIDIndex("group"),
+		attributes:       map[string]map[int]map[string]storedAttribute{"user": {}, "group": {}},
+		statuses:         make(map[int]UserStatus),
+		groupTypes:       make(map[int]string),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create repository directory: %w", err)
+	}
+	if err := r.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := r.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	if r.fsync == FsyncInterval {
+		r.stop = make(chan struct{})
+		r.done = make(chan struct{})
+		go r.syncLoop()
+	}
+	return r, nil
+}
+
+// loadSnapshot restores the state from the snapshot file, if there is one
+func (r *FileRepository) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(r.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var s fileSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if s.Format != fileSnapshotFormat {
+		return fmt.Errorf("unsupported snapshot format %d", s.Format)
+	}
+
+	graph, err := buildPermissionGraph(&GraphSnapshot{Memberships: s.Memberships, Edges: s.Edges, Rules: s.Rules, Permissions: s.Permissions})
+	if err != nil {
+		return fmt.Errorf("failed to rebuild graph from snapshot: %w", err)
+	}
+
+	r.graph = graph
+	r.lsn = s.LSN
+	r.revision = s.Revision
+	r.lastUserID = s.LastUserID
+	r.lastGroupID = s.LastGroupID
+	if s.Users != nil {
+		r.users = s.Users
+	}
+	if s.Groups != nil {
+		r.groups = s.Groups
+	}
+	r.events = s.Events
+	for _, rec := range s.IdempotencyKeys {
+		r.idempotency[rec.Key] = rec
+	}
+	for id, externalID := range s.UserExternalIDs {
+		r.userExternalIDs.set(id, externalID)
+	}
+	for id, externalID := range s.GroupExternalIDs {
+		r.groupExternalIDs.set(id, externalID)
+	}
+	for typ, subjects := range s.Attributes {
+		if _, ok := r.attributes[typ]; ok && subjects != nil {
+			r.attributes[typ] = subjects
+		}
+	}
+	for id, status := range s.UserStatuses {
+		r.statuses[id] = status
+		r.graph.setUserStatus(id, status)
+	}
+	for id, groupType := range s.GroupTypes {
+		r.groupTypes[id] = groupType
+	}
+	return nil
+}
+
+// replayWAL applies every logged record newer than the snapshot and truncates a torn
+// or corrupt tail, then leaves the log open for appending
+func (r *FileRepository) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(r.dir, walFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	var replayed int
+	for {
+		rec, size, err := readWALRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if terr := r.truncateTail(f, offset, err); terr != nil {
+				f.Close()
+				return terr
+			}
+			break
+		}
+		offset += size
+		r.walRecords++
+
+		if rec.LSN <= r.lsn {
+			continue // already contained in the snapshot
+		}
+		if rec.LSN != r.lsn+1 {
+			f.Close()
+			return fmt.Errorf("write-ahead log is missing records %d to %d", r.lsn+1, rec.LSN-1)
+		}
+		if err := r.apply(rec); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to replay record %d: %w", rec.LSN, err)
+		}
+		replayed++
+	}
+
+	r.wal = f
+	r.walSize = offset
+	if replayed > 0 {
+		r.logger.Log(context.Background(), LevelInfo, "write-ahead log replayed",
+			IntAttr("records", replayed), StringAttr("revision", r.revision.String()))
+	}
+	return nil
+}
+
+// truncateTail cuts the log at offset, the end of the last intact record
+func (r *FileRepository) truncateTail(f *os.File, offset int64, cause error) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat write-ahead log: %w", err)
+	}
+	r.logger.Log(context.Background(), LevelWarn, "truncating damaged write-ahead log tail",
+		StringAttr("error", cause.Error()), IntAttr("offset", int(offset)), IntAttr("discarded_bytes", int(info.Size()-offset)))
+
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// readWALRecord reads one frame. It returns io.EOF at a clean end of the log and
+// another error for a torn or corrupt frame.
+func readWALRecord(reader io.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return rec, 0, io.EOF
+		}
+		return rec, 0, fmt.Errorf("torn record header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length == 0 || length > walMaxRecordSize {
+		return rec, 0, fmt.Errorf("invalid record length %d", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return rec, 0, fmt.Errorf("torn record payload: %w", err)
+	}
+	if crc32.Checksum(payload, walChecksumTable) != checksum {
+		return rec, 0, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, fmt.Errorf("failed to decode record: %w", err)
+	}
+	return rec, int64(walHeaderSize) + int64(length), nil
+}
+
+// encodeWALRecord frames rec for the log
+func encodeWALRecord(rec walRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, walChecksumTable))
+	return append(frame, payload...), nil
+}
+
+// apply applies a record to the in-memory state. It is shared by live writes and
+// replay, so recovery rebuilds exactly the state the writes produced.
+func (r *FileRepository) apply(rec walRecord) error {
+	var derived []ChangeEvent
+	switch rec.Op {
+	case walCreateUser:
+		r.users[rec.ID] = rec.Name
+		r.userExternalIDs.set(rec.ID, rec.ExternalID)
+		if rec.ID > r.lastUserID {
+			r.lastUserID = rec.ID
+		}
+	case walCreateGroup:
+		r.groups[rec.ID] = rec.Name
+		r.groupExternalIDs.set(rec.ID, rec.ExternalID)
+		if rec.ID > r.lastGroupID {
+			r.lastGroupID = rec.ID
+		}
+	case walAddMembership:
+		r.graph.addMembership(rec.SourceID, rec.TargetID)
+	case walAddEdge:
+		if err := r.graph.addEdge(rec.SourceID, rec.TargetID); err != nil {
+			return err
+		}
+	case walMoveEdge:
+		if err := r.graph.moveEdge(rec.SourceID, rec.ID, rec.TargetID); err != nil {
+			return err
+		}
+	case walAddPermission:
+		var cond *Condition
+		if rec.Condition != "" {
+			var err error
+			if cond, err = ParseCondition(rec.Condition); err != nil {
+				return err
+			}
+		}
+		r.graph.setPermission(rec.SourceType, rec.TargetType, rec.SourceID, rec.TargetID, cond)
+	case walSetExternalID:
+		_, index := r.entity(rec.SourceType)
+		index.set(rec.ID, rec.ExternalID)
+	case walSetAttribute:
+		r.setAttribute(rec.SourceType, rec.ID, rec.Name, rec.Attribute)
+		if rec.SourceType == "user" && len(r.graph.rules) > 0 {
+			attrs, err := decodeAttributes(r.attributes["user"][rec.ID])
+			if err != nil {
+				return err
+			}
+			derived = r.graph.applyUserRules(rec.ID, attrs)
+		}
+	case walSetGroupRule:
+		var rule *Condition
+		if rec.Condition != "" {
+			var err error
+			if rule, err = ParseMembershipRule(rec.Condition); err != nil {
+				return err
+			}
+		}
+		r.graph.setRule(rec.ID, rule)
+		if rule != nil {
+			attrs, err := r.userAttributes()
+			if err != nil {
+				return err
+			}
+			derived = r.graph.applyGroupRule(rec.ID, attrs)
+		}
+	case walSetUserStatus:
+		if rec.Status == UserActive {
+			delete(r.statuses, rec.ID)
+		} else {
+			r.statuses[rec.ID] = rec.Status
+		}
+		r.graph.setUserStatus(rec.ID, rec.Status)
+	case walSetGroupType:
+		if rec.Name == "" {
+			delete(r.groupTypes, rec.ID)
+		} else {
+			r.groupTypes[rec.ID] = rec.Name
+		}
+	default:
+		return fmt.Errorf("unknown write-ahead log operation %q", rec.Op)
+	}
+
+	if rec.Idempotency != nil {
+		r.idempotency[rec.Idempotency.Key] = *rec.Idempotency
+	}
+	if rec.Revision > 0 {
+		r.revision = rec.Revision
+		r.events = append(r.events, rec.event())
+	}
+	for _, e := range derived {
+		r.revision++
+		e.Revision = r.revision
+		e.CreatedAt = rec.Time
+		r.events = append(r.events, e)
+	}
+	r.lsn = rec.LSN
+	return nil
+}
+
+// commit logs rec and applies it. Revisioned operations get the next revision.
+// The caller must hold the write lock and have validated the mutation.
+func (r *FileRepository) commit(ctx context.Context, rec walRecord, revisioned bool) (walRecord, error) {
+	if r.closed {
+		return rec, errFileRepositoryClosed
+	}
+	if r.failed != nil {
+		return rec, fmt.Errorf("write-ahead log is unusable, reopen the repository: %w", r.failed)
+	}
+	if err := ctx.Err(); err != nil {
+		return rec, err
+	}
+
+	rec.LSN = r.lsn + 1
+	rec.Time = time.Now().UTC()
+	if revisioned {
+		rec.Revision = r.revision + 1
+	}
+
+	if err := r.appendWAL(rec); err != nil {
+		return rec, err
+	}
+	if err := r.apply(rec); err != nil {
+		// The record is durable but could not be applied; only a replay can tell
+		r.failed = err
+		return rec, err
+	}
+
+	r.walRecords++
+	if r.walRecords >= r.snapshotEvery {
+		if err := r.snapshotLocked(); err != nil {
+			// The write is already durable in the log, so it still succeeds
+			r.logger.Log(ctx, LevelError, "failed to write snapshot", StringAttr("error", err.Error()))
+		}
+	}
+	return rec, nil
+}
+
+// appendWAL writes rec to the log and syncs it according to the fsync policy.
+// A failed write is cut off again so the log never holds a record that was not applied.
+func (r *FileRepository) appendWAL(rec walRecord) error {
+	frame, err := encodeWALRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.wal.Write(frame); err != nil {
+		if terr := r.wal.Truncate(r.walSize); terr != nil {
+			r.failed = terr
+		}
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+
+	if r.fsync == FsyncAlways {
+		if err := r.wal.Sync(); err != nil {
+			// After a failed fsync the state of the written data is unknown
+			r.failed = err
+			return fmt.Errorf("failed to sync write-ahead log: %w", err)
+		}
+	} else {
+		r.dirty = true
+	}
+	r.walSize += int64(len(frame))
+	return nil
+}
+
+// syncLoop syncs the log every fsyncInterval for FsyncInterval
+func (r *FileRepository) syncLoop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.fsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.Sync(); err != nil {
+				r.logger.Log(context.Background(), LevelError, "failed to sync write-ahead log", StringAttr("error", err.Error()))
+			}
+		}
+	}
+}
+
+// Sync flushes the write-ahead log to stable storage
+func (r *FileRepository) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.syncLocked()
+}
+
+func (r *FileRepository) syncLocked() error {
+	if r.closed || !r.dirty {
+		return nil
+	}
+	if err := r.wal.Sync(); err != nil {
+		r.failed = err
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	r.dirty = false
+	return nil
+}
+
+// Snapshot writes the current state to the snapshot file and truncates the log
+func (r *FileRepository) Snapshot() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errFileRepositoryClosed
+	}
+	return r.snapshotLocked()
+}
+
+// snapshotLocked writes the snapshot atomically, then truncates the log. A crash
+// between the two steps is harmless: replay skips records the snapshot contains.
+func (r *FileRepository) snapshotLocked() error {
+	graph := r.graph.snapshot(r.revision)
+	now := time.Now()
+	keys := make([]idempotencyRecord, 0, len(r.idempotency))
+	for key, rec := range r.idempotency {
+		if !now.Before(rec.ExpiresAt) {
+			delete(r.idempotency, key)
+			continue
+		}
+		keys = append(keys, rec)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	data, err := json.Marshal(fileSnapshot{
+		Format:      fileSnapshotFormat,
+		LSN:         r.lsn,
+		Revision:    r.revision,
+		LastUserID:  r.lastUserID,
+		LastGroupID: r.lastGroupID,
+		Users:       r.users,
+		Groups:      r.groups,
+		Memberships: graph.Memberships,
+		Edges:       graph.Edges,
+		Permissions: graph.Permissions,
+		Rules:       graph.Rules,
+		Events:      r.events,
+
+		IdempotencyKeys:  keys,
+		UserExternalIDs:  r.userExternalIDs.byID,
+		GroupExternalIDs: r.groupExternalIDs.byID,
+		Attributes:       r.attributes,
+		UserStatuses:     r.statuses,
+		GroupTypes:       r.groupTypes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	path := filepath.Join(r.dir, snapshotFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(r.dir); err != nil {
+		return err
+	}
+
+	if err := r.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := r.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	r.walSize = 0
+	r.walRecords = 0
+	r.dirty = false
+	return nil
+}
+
+// writeFileSync writes data to a new file at path and syncs it
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", filepath.Base(path), err)
+	}
+	return f.Close()
+}
+
+// syncDir syncs a directory so that a rename inside it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// entity returns the names and the external ID index of "user" or "group"
+func (r *FileRepository) entity(typ string) (map[int]string, *externalIDIndex) {
+	if typ == "group" {
+		return r.groups, r.groupExternalIDs
+	}
+	return r.users, r.userExternalIDs
+}
+
+// create commits the create record rec of operation op and returns its ID. Under an
+// idempotency key it returns the ID of an earlier create with the same key instead,
+// and otherwise logs the key with the record so it survives a restart.
+// The caller must hold the write lock.
+func (r *FileRepository) create(ctx context.Context, op, typ string, rec walRecord) (int, error) {
+	if err := validateExternalID(rec.ExternalID); err != nil {
+		return 0, err
+	}
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+		now := time.Now().UTC()
+		if prev, ok := r.idempotency[key]; ok && now.Before(prev.ExpiresAt) {
+			return prev.replay(op, rec.Name)
+		}
+		rec.Idempotency = &idempotencyRecord{Key: key, Operation: op, Name: rec.Name, ID: rec.ID, ExpiresAt: now.Add(r.idempotencyTTL)}
+	}
+
+	names, index := r.entity(typ)
+	if err := index.conflict(rec.ExternalID, 0); err != nil {
+		return 0, err
+	}
+	if r.uniqueNames {
+		if ids := idsByName(names, rec.Name); len(ids) > 0 {
+			return 0, &NameConflictError{Type: typ, Name: rec.Name, ExistingID: ids[0]}
+		}
+	}
+
+	rec, err := r.commit(ctx, rec, false)
+	if err != nil {
+		return 0, err
+	}
+	return rec.ID, nil
+}
+
+// CreateUser creates a new user and returns their ID
+func (r *FileRepository) CreateUser(ctx context.Context, name string) (int, error) {
+	return r.CreateUserWithExternalID(ctx, name, "")
+}
+
+// GetUserByID retrieves a user's name by their ID
+func (r *FileRepository) GetUserByID(_ context.Context, userID int) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, ok := r.users[userID]
+	if !ok {
+		return "", &UserNotFoundError{UserID: userID}
+	}
+	return name, nil
+}
+
+// CreateUserGroup creates a new user group and returns its ID
+func (r *FileRepository) CreateUserGroup(ctx context.Context, name string) (int, error) {
+	return r.CreateUserGroupWithExternalID(ctx, name, "")
+}
+
+// GetUserGroupByID retrieves a user group's name by its ID
+func (r *FileRepository) GetUserGroupByID(_ context.Context, groupID int) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, ok := r.groups[groupID]
+	if !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	return name, nil
+}
+
+// CreateUserWithExternalID creates a new user with an external ID and returns their ID
+func (r *FileRepository) CreateUserWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, err := r.create(ctx, "CreateUser", "user", walRecord{Op: walCreateUser, ID: r.lastUserID + 1, Name: name, ExternalID: externalID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	return id, nil
+}
+
+// CreateUserGroupWithExternalID creates a new user group with an external ID and returns its ID
+func (r *FileRepository) CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, err := r.create(ctx, "CreateUserGroup", "group", walRecord{Op: walCreateGroup, ID: r.lastGroupID + 1, Name: name, ExternalID: externalID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create user group: %w", err)
+	}
+	return id, nil
+}
+
+// SetUserExternalID sets or clears the external ID of a user
+func (r *FileRepository) SetUserExternalID(ctx context.Context, userID int, externalID string) error {
+	if err := r.setExternalID(ctx, "user", userID, externalID); err != nil {
+		return fmt.Errorf("failed to set external ID: %w", err)
+	}
+	return nil
+}
+
+// SetUserGroupExternalID sets or clears the external ID of a user group
+func (r *FileRepository) SetUserGroupExternalID(ctx context.Context, groupID int, externalID string) error {
+	if err := r.setExternalID(ctx, "group", groupID, externalID); err != nil {
+		return fmt.Errorf("failed to set external ID: %w", err)
+	}
+	return nil
+}
+
+// setExternalID logs and applies a new external ID for the user or group id
+func (r *FileRepository) setExternalID(ctx context.Context, typ string, id int, externalID string) error {
+	if err := validateExternalID(externalID); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.subjectExists(typ, id); err != nil {
+		return err
+	}
+	_, index := r.entity(typ)
+	if err := index.conflict(externalID, id); err != nil {
+		return err
+	}
+	if index.byID[id] == externalID {
+		return nil
+	}
+	_, err := r.commit(ctx, walRecord{Op: walSetExternalID, SourceType: typ, ID: id, ExternalID: externalID}, false)
+	return err
+}
+
+// GetUserByExternalID returns the ID of the user with the given external ID
+func (r *FileRepository) GetUserByExternalID(_ context.Context, externalID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.userExternalIDs.lookup(externalID)
+}
+
+// GetUserGroupByExternalID returns the ID of the user group with the given external ID
+func (r *FileRepository) GetUserGroupByExternalID(_ context.Context, externalID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.groupExternalIDs.lookup(externalID)
+}
+
+// FindUsersByName returns the IDs of all users with the given name
+func (r *FileRepository) FindUsersByName(_ context.Context, name string) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return idsByName(r.users, name), nil
+}
+
+// FindUserGroupsByName returns the IDs of all user groups with the given name
+func (r *FileRepository) FindUserGroupsByName(_ context.Context, name string) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return idsByName(r.groups, name), nil
+}
+
+// SetAttribute sets or, for a nil value, removes an attribute of a user or group and
+// returns the revision of the last membership change it caused, or the current
+// revision if it caused none
+func (r *FileRepository) SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error) {
+	if subjectType != "user" && subjectType != "group" {
+		return 0, fmt.Errorf("invalid subject type %q", subjectType)
+	}
+	rec := walRecord{Op: walSetAttribute, SourceType: subjectType, ID: subjectID, Name: name}
+	if value == nil {
+		if err := validateAttributeName(subjectType, name); err != nil {
+			return 0, err
+		}
+	} else {
+		stored, err := encodeAttribute(subjectType, name, value)
+		if err != nil {
+			return 0, err
+		}
+		rec.Attribute = &stored
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.subjectExists(subjectType, subjectID); err != nil {
+		return 0, err
+	}
+	if _, err := r.commit(ctx, rec, false); err != nil {
+		return 0, fmt.Errorf("failed to set attribute: %w", err)
+	}
+	return r.revision, nil
+}
+
+// GetAttributes returns all attributes of a user or group
+func (r *FileRepository) GetAttributes(_ context.Context, subjectType string, subjectID int) (Attributes, error) {
+	if subjectType != "user" && subjectType != "group" {
+		return nil, fmt.Errorf("invalid subject type %q", subjectType)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.subjectExists(subjectType, subjectID); err != nil {
+		return nil, err
+	}
+	return decodeAttributes(r.attributes[subjectType][subjectID])
+}
+
+// subjectExists returns a not found error if the user or group id does not exist.
+// The caller must hold the lock.
+func (r *FileRepository) subjectExists(subjectType string, id int) error {
+	names, _ := r.entity(subjectType)
+	if _, ok := names[id]; ok {
+		return nil
+	}
+	if subjectType == "group" {
+		return &UserGroupNotFoundError{UserGroupID: id}
+	}
+	return &UserNotFoundError{UserID: id}
+}
+
+// setAttribute applies an attribute record
+func (r *FileRepository) setAttribute(subjectType string, id int, name string, value *storedAttribute) {
+	subjects := r.attributes[subjectType]
+	if value == nil {
+		delete(subjects[id], name)
+		if len(subjects[id]) == 0 {
+			delete(subjects, id)
+		}
+		return
+	}
+	if subjects[id] == nil {
+		subjects[id] = make(map[string]storedAttribute)
+	}
+	subjects[id][name] = *value
+}
+
+// userAttributes decodes the attributes of every user that has any. The caller must
+// hold the lock.
+func (r *FileRepository) userAttributes() (map[int]Attributes, error) {
+	attrs := make(map[int]Attributes, len(r.attributes["user"]))
+	for id, stored := range r.attributes["user"] {
+		var err error
+		if attrs[id], err = decodeAttributes(stored); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// AddUserToGroup adds a user to a group. Both must exist, as with the foreign keys
+// of the SQL repositories, and the group must not be dynamic. Adding an existing
+// membership records nothing.
+func (r *FileRepository) AddUserToGroup(ctx context.Context, userID, groupID int) (Revision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return 0, &UserNotFoundError{UserID: userID}
+	}
+	if _, ok := r.groups[groupID]; !ok {
+		return 0, &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if _, ok := r.graph.rules[groupID]; ok {
+		return 0, &DynamicGroupError{UserID: userID, UserGroupID: groupID}
+	}
+	if r.graph.members[groupID].has(userID) {
+		return r.revision, nil
+	}
+
+	rec, err := r.commit(ctx, walRecord{Op: walAddMembership, SourceID: userID, TargetID: groupID}, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add user to group: %w", err)
+	}
+	return rec.Revision, nil
+}
+
+// SetUserStatus sets the lifecycle status of a user and records a revision unless the
+// user already has it
+func (r *FileRepository) SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error) {
+	if err := status.validate(); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[userID]; !ok {
+		return 0, &UserNotFoundError{UserID: userID}
+	}
+	if r.userStatus(userID) == status {
+		return r.revision, nil
+	}
+	rec, err := r.commit(ctx, walRecord{Op: walSetUserStatus, ID: userID, Status: status}, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set user status: %w", err)
+	}
+	return rec.Revision, nil
+}
+
+// GetUserStatus returns the lifecycle status of a user
+func (r *FileRepository) GetUserStatus(_ context.Context, userID int) (UserStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.users[userID]; !ok {
+		return "", &UserNotFoundError{UserID: userID}
+	}
+	return r.userStatus(userID), nil
+}
+
+// GetUserStatuses returns the lifecycle statuses of users, omitting unknown IDs
+func (r *FileRepository) GetUserStatuses(_ context.Context, userIDs []int) (map[int]UserStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make(map[int]UserStatus, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := r.users[userID]; ok {
+			statuses[userID] = r.userStatus(userID)
+		}
+	}
+	return statuses, nil
+}
+
+// userStatus returns the status of an existing user. The caller must hold the lock.
+func (r *FileRepository) userStatus(userID int) UserStatus {
+	if status, ok := r.statuses[userID]; ok {
+		return status
+	}
+	return UserActive
+}
+
+// SetGroupRule sets or, for an empty rule, clears the membership rule of a group and
+// updates its members. A changed rule records a rule_changed event ahead of the
+// membership events it causes.
+func (r *FileRepository) SetGroupRule(ctx context.Context, groupID int, rule string) (Revision, error) {
+	var parsed *Condition
+	if rule != "" {
+		var err error
+		if parsed, err = ParseMembershipRule(rule); err != nil {
+			return 0, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[groupID]; !ok {
+		return 0, &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	changed := ruleString(r.graph.rules[groupID]) != ruleString(parsed)
+	if _, err := r.commit(ctx, walRecord{Op: walSetGroupRule, ID: groupID, Condition: rule}, changed); err != nil {
+		return 0, fmt.Errorf("failed to set membership rule: %w", err)
+	}
+	return r.revision, nil
+}
+
+// GetGroupRule returns the membership rule of a group, "" for static groups
+func (r *FileRepository) GetGroupRule(_ context.Context, groupID int) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.groups[groupID]; !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if rule, ok := r.graph.rules[groupID]; ok {
+		return rule.String(), nil
+	}
+	return "", nil
+}
+
+// ListUsers returns a page of all users
+func (r *FileRepository) ListUsers(_ context.Context, opts ListOptions) (Page, error) {
+	return r.listPage(opts, r.users, func() []int { return mapKeys(r.users) })
+}
+
+// ListUserGroups returns a page of all user groups
+func (r *FileRepository) ListUserGroups(_ context.Context, opts ListOptions) (Page, error) {
+	return r.listPage(opts, r.groups, func() []int { return mapKeys(r.groups) })
+}
+
+// ListUsersInGroup returns a page of the users directly in a group
+func (r *FileRepository) ListUsersInGroup(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.listPage(opts, r.users, func() []int { return r.graph.members[groupID].ids() })
+}
+
+// ListGroupsInGroup returns a page of the direct child groups of a group
+func (r *FileRepository) ListGroupsInGroup(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.listPage(opts, r.groups, func() []int { return r.graph.children[groupID].ids() })
+}
+
+// ListUsersInGroupTransitive returns a page of the users in a group and all nested subgroups
+func (r *FileRepository) ListUsersInGroupTransitive(_ context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.listPage(opts, r.users, func() []int { return r.graph.usersInGroupTransitive(groupID) })
+}
+
+// listPage returns the page of the IDs returned by ids, named from names, under the read lock
+func (r *FileRepository) listPage(opts ListOptions, names map[int]string, ids func() []int) (Page, error) {
+	q, err := newListQuery(opts)
+	if err != nil {
+		return Page{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return q.paginate(pageItems(ids(), names)), nil
+}
+
+// GetUsersInGroup returns all users directly in the specified group
+func (r *FileRepository) GetUsersInGroup(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.members[groupID].ids(), nil
+}
+
+// GetUsersInGroupTransitive returns all users in the group and all nested subgroups
+func (r *FileRepository) GetUsersInGroupTransitive(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.usersInGroupTransitive(groupID), nil
+}
+
+// GetGroupsForUser returns the groups the user belongs to directly
+func (r *FileRepository) GetGroupsForUser(_ context.Context, userID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.userGroups[userID].ids(), nil
+}
+
+// GetGroupsForUserTransitive returns all groups the user belongs to directly or through nested groups
+func (r *FileRepository) GetGroupsForUserTransitive(_ context.Context, userID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.userAncestors(userID).ids(), nil
+}
+
+// AddGroupToGroup adds a child group to a parent group with cycle detection.
+// The check and the write happen under the same lock, so they are atomic. Adding an
+// existing edge records nothing.
+func (r *FileRepository) AddGroupToGroup(ctx context.Context, childID, parentID int) (Revision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.graph.wouldCreateCycle(childID, parentID) {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: parentID}
+	}
+	for _, groupID := range []int{childID, parentID} {
+		if _, ok := r.groups[groupID]; !ok {
+			return 0, &UserGroupNotFoundError{UserGroupID: groupID}
+		}
+	}
+	if err := r.checkNewEdge(childID, parentID, false); err != nil {
+		return 0, err
+	}
+	if r.graph.parents[childID].has(parentID) {
+		return r.revision, nil
+	}
+
+	rec, err := r.commit(ctx, walRecord{Op: walAddEdge, SourceID: childID, TargetID: parentID}, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add group to group: %w", err)
+	}
+	return rec.Revision, nil
+}
+
+// MoveGroup moves a child group from one parent group to another. The checks and
+// the write happen under the same lock, so they are atomic.
+func (r *FileRepository) MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (Revision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if childID == toParentID {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+	for _, groupID := range []int{childID, fromParentID, toParentID} {
+		if _, ok := r.groups[groupID]; !ok {
+			return 0, &UserGroupNotFoundError{UserGroupID: groupID}
+		}
+	}
+	if !r.graph.children[fromParentID].has(childID) {
+		return 0, &EdgeNotFoundError{ChildGroupID: childID, ParentGroupID: fromParentID}
+	}
+	if fromParentID == toParentID {
+		return r.revision, nil
+	}
+	if r.graph.wouldCreateCycle(childID, toParentID) {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+	if err := r.checkNewEdge(childID, toParentID, true); err != nil {
+		return 0, err
+	}
+
+	rec, err := r.commit(ctx, walRecord{Op: walMoveEdge, ID: fromParentID, SourceID: childID, TargetID: toParentID}, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move group: %w", err)
+	}
+	return rec.Revision, nil
+}
+
+// checkNewEdge returns a NestingNotAllowedError or a HierarchyLimitError if the
+// nesting policy does not allow childID in parentID or the edge breaks the hierarchy
+// limits. Existing edges are never rejected. The caller must hold the lock.
+func (r *FileRepository) checkNewEdge(childID, parentID int, moving bool) error {
+	if r.graph.children[parentID].has(childID) {
+		return nil
+	}
+	if err := r.nestingPolicy.checkEdge(r.typedEdge(childID, parentID)); err != nil {
+		return err
+	}
+	if !r.hierarchyLimits.enabled() {
+		return nil
+	}
+	shape := r.graph.edgeShape(childID, parentID)
+	if moving {
+		// A move never adds a parent to the child, as it leaves the old one
+		shape.childParents = 0
+	}
+	return r.hierarchyLimits.checkEdge(childID, parentID, shape)
+}
+
+// GetGroupsInGroup returns all groups directly in the specified group
+func (r *FileRepository) GetGroupsInGroup(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.children[groupID].ids(), nil
+}
+
+// GetParentGroups returns the groups that directly contain the specified group
+func (r *FileRepository) GetParentGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.parents[groupID].ids(), nil
+}
+
+// GetAncestorGroups returns all groups that transitively contain the specified group
+func (r *FileRepository) GetAncestorGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.ancestorGroups(groupID), nil
+}
+
+// GetDescendantGroups returns all groups that the specified group transitively contains
+func (r *FileRepository) GetDescendantGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.descendantGroups(groupID), nil
+}
+
+// GetAncestorEdges returns the hierarchy edges above a "user" or "group"
+func (r *FileRepository) GetAncestorEdges(_ context.Context, subjectType string, subjectID int) ([]GroupEdge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if subjectType == "group" {
+		return r.graph.ancestorEdges([]int{subjectID}), nil
+	}
+	return r.graph.ancestorEdges(r.graph.userGroups[subjectID].ids()), nil
+}
+
+// GetGroupSubtree returns a group and every group below it
+func (r *FileRepository) GetGroupSubtree(_ context.Context, groupID int) (*GroupSubtree, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.groups[groupID]; !ok {
+		return nil, &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	groups, edges, memberships := r.graph.subtree(groupID)
+	subtree := &GroupSubtree{RootID: groupID, Names: make(map[int]string, len(groups)), Edges: edges, Memberships: memberships}
+	for _, id := range groups {
+		subtree.Names[id] = r.groups[id]
+	}
+	return subtree, nil
+}
+
+// WouldCreateCycle checks if adding child to parent would create a cycle
+func (r *FileRepository) WouldCreateCycle(_ context.Context, childID, parentID int) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.wouldCreateCycle(childID, parentID), nil
+}
+
+// AddPermission adds a permission record, or makes an existing conditional one unconditional
+func (r *FileRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	return r.addPermission(ctx, sourceType, targetType, sourceID, targetID, "")
+}
+
+// AddConditionalPermission adds a permission record that only applies while
+// condition holds, or replaces the condition of an existing one
+func (r *FileRepository) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	if condition != "" {
+		if _, err := ParseCondition(condition); err != nil {
+			return 0, err
+		}
+	}
+	return r.addPermission(ctx, sourceType, targetType, sourceID, targetID, condition)
+}
+
+func (r *FileRepository) addPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	for _, t := range []string{sourceType, targetType} {
+		if t != "user" && t != "group" {
+			return 0, fmt.Errorf("failed to add permission: invalid subject type %q", t)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Granting an existing permission with the same condition records nothing
+	if current, ok := r.graph.grant(sourceType, targetType, sourceID, targetID); ok && current == condition {
+		return r.revision, nil
+	}
+
+	rec, err := r.commit(ctx, walRecord{
+		Op:         walAddPermission,
+		SourceType: sourceType,
+		SourceID:   sourceID,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Condition:  condition,
+	}, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add permission: %w", err)
+	}
+	return rec.Revision, nil
+}
+
+// HasUserPermissionOnUser checks if a user has permission to access another user
+func (r *FileRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	r.mu.RLock()
+	allowed := r.graph.hasUserPermissionOnUser(sourceUserID, targetUserID)
+	var conditions []*Condition
+	if !allowed {
+		conditions = r.graph.conditionsOnUser(sourceUserID, targetUserID)
+	}
+	r.mu.RUnlock()
+
+	if allowed {
+		return true, nil
+	}
+	// Conditions are evaluated without the lock, GetAttributes takes it again
+	return evaluateConditions(ctx, conditions, sourceUserID, "user", targetUserID, r.GetAttributes)
+}
+
+// HasUserPermissionOnGroup checks if a user has permission to access a group
+func (r *FileRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	r.mu.RLock()
+	allowed := r.graph.hasUserPermissionOnGroup(sourceUserID, targetGroupID)
+	var conditions []*Condition
+	if !allowed {
+		conditions = r.graph.conditionsOnGroup(sourceUserID, targetGroupID)
+	}
+	r.mu.RUnlock()
+
+	if allowed {
+		return true, nil
+	}
+	return evaluateConditions(ctx, conditions, sourceUserID, "group", targetGroupID, r.GetAttributes)
+}
+
+// CurrentRevision returns the latest committed revision
+func (r *FileRepository) CurrentRevision(context.Context) (Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.revision, nil
+}
+
+// ListChanges returns up to limit change events with a revision greater than afterRevision, in revision order
+func (r *FileRepository) ListChanges(_ context.Context, afterRevision Revision, limit int) ([]ChangeEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	start := sort.Search(len(r.events), func(i int) bool { return r.events[i].Revision > afterRevision })
+	end := len(r.events)
+	if limit >= 0 && start+limit < end {
+		end = start + limit
+	}
+	return append([]ChangeEvent{}, r.events[start:end]...), nil
+}
+
+// GetHierarchyViolations returns the groups that break limits
+func (r *FileRepository) GetHierarchyViolations(_ context.Context, limits HierarchyLimits) ([]HierarchyViolation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return hierarchyViolations(r.graph.edges(), limits), nil
+}
+
+// SetGroupType sets or, for an empty type, clears the type of a group. With a
+// nesting policy the edges of the group are checked under the same lock.
+func (r *FileRepository) SetGroupType(ctx context.Context, groupID int, groupType string) error {
+	if err := validateGroupType(groupType); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.groups[groupID]; !ok {
+		return &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	if r.groupTypes[groupID] == groupType {
+		return nil
+	}
+	if r.nestingPolicy != nil {
+		for _, parentID := range r.graph.parents[groupID].ids() {
+			e := r.typedEdge(groupID, parentID)
+			e.ChildType = groupType
+			if err := r.nestingPolicy.checkEdge(e); err != nil {
+				return err
+			}
+		}
+		for _, childID := range r.graph.children[groupID].ids() {
+			e := r.typedEdge(childID, groupID)
+			e.ParentType = groupType
+			if err := r.nestingPolicy.checkEdge(e); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := r.commit(ctx, walRecord{Op: walSetGroupType, ID: groupID, Name: groupType}, false); err != nil {
+		return fmt.Errorf("failed to set group type: %w", err)
+	}
+	return nil
+}
+
+// GetGroupType returns the type of a group, "" for groups without one
+func (r *FileRepository) GetGroupType(_ context.Context, groupID int) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.groups[groupID]; !ok {
+		return "", &UserGroupNotFoundError{UserGroupID: groupID}
+	}
+	return r.groupTypes[groupID], nil
+}
+
+// GetNestingViolations returns the edges policy does not allow
+func (r *FileRepository) GetNestingViolations(_ context.Context, policy NestingPolicy) ([]NestingViolation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	edges := r.graph.edges()
+	typed := make([]NestingViolation, 0, len(edges))
+	for _, e := range edges {
+		typed = append(typed, r.typedEdge(e.ChildID, e.ParentID))
+	}
+	return nestingViolations(typed, policy), nil
+}
+
+// typedEdge returns the edge from childID to parentID with the types of both groups.
+// The caller must hold the lock.
+func (r *FileRepository) typedEdge(childID, parentID int) NestingViolation {
+	return NestingViolation{
+		ChildGroupID: childID, ParentGroupID: parentID,
+		ChildType: r.groupTypes[childID], ParentType: r.groupTypes[parentID],
+	}
+}
+
+// LoadGraphSnapshot returns a copy of the current graph
+func (r *FileRepository) LoadGraphSnapshot(context.Context) (*GraphSnapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.snapshot(r.revision), nil
+}
+
+// Close syncs the log, writes a final snapshot if there are records since the last
+// one, and closes the log file
+func (r *FileRepository) Close() error {
+	if r.stop != nil {
+		r.stopOnce.Do(func() {
+			close(r.stop)
+			<-r.done
+		})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+
+	var err error
+	if r.failed == nil {
+		err = r.syncLocked()
+		if err == nil && r.walRecords > 0 {
+			err = r.snapshotLocked()
+		}
+	}
+	r.closed = true
+	if cerr := r.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
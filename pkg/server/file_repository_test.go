@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// crash abandons r like a killed process would: no final sync or snapshot
+func crash(t *testing.T, r *FileRepository) {
+	t.Helper()
+	if r.stop != nil {
+		r.stopOnce.Do(func() {
+			close(r.stop)
+			<-r.done
+		})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if err := r.wal.Close(); err != nil {
+		t.Fatalf("Failed to close log: %v", err)
+	}
+}
+
+func openFileRepository(t *testing.T, dir string, opts ...FileOption) *FileRepository {
+	t.Helper()
+	r, err := OpenFileRepository(dir, opts...)
+	if err != nil {
+		t.Fatalf("OpenFileRepository failed: %v", err)
+	}
+	return r
+}
+
+// populate writes a small graph: alice in team, team in org, a grant from org to bob
+func populate(t *testing.T, r Repository) (alice, bob, team, org int) {
+	t.Helper()
+	ctx := context.Background()
+	alice, _ = r.CreateUser(ctx, "Alice")
+	bob, _ = r.CreateUser(ctx, "Bob")
+	team, _ = r.CreateUserGroup(ctx, "Team")
+	org, _ = r.CreateUserGroup(ctx, "Org")
+	for _, step := range []func() (Revision, error){
+		func() (Revision, error) { return r.AddUserToGroup(ctx, alice, team) },
+		func() (Revision, error) { return r.AddGroupToGroup(ctx, team, org) },
+		func() (Revision, error) { return r.AddPermission(ctx, "group", "user", org, bob) },
+	} {
+		if _, err := step(); err != nil {
+			t.Fatalf("Failed to populate repository: %v", err)
+		}
+	}
+	return alice, bob, team, org
+}
+
+// assertPopulated checks the graph written by populate
+func assertPopulated(t *testing.T, r Repository, alice, bob, team, org int) {
+	t.Helper()
+	ctx := context.Background()
+	if name, err := r.GetUserByID(ctx, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserByID = %q, %v", name, err)
+	}
+	if ancestors, _ := r.GetAncestorGroups(ctx, team); !reflect.DeepEqual(ancestors, []int{org}) {
+		t.Errorf("Expected team nested in org, got %v", ancestors)
+	}
+	if ok, _ := r.HasUserPermissionOnUser(ctx, alice, bob); !ok {
+		t.Error("Expected alice to reach bob through team and org")
+	}
+	if rev, _ := r.CurrentRevision(ctx); rev != 3 {
+		t.Errorf("Expected revision 3, got %d", rev)
+	}
+	if events, _ := r.ListChanges(ctx, 0, 10); len(events) != 3 {
+		t.Errorf("Expected 3 change events, got %d", len(events))
+	}
+}
+
+func Test_Conformance_FileRepository(t *testing.T) {
+	r := openFileRepository(t, t.TempDir())
+	defer r.Close()
+
+	runRepositoryConformance(t, r)
+}
+
+func Test_FileRepository_RecoversByReplayingLog(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepository(t, dir)
+	alice, bob, team, org := populate(t, r)
+	crash(t, r)
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no snapshot before the crash, got %v", err)
+	}
+
+	recovered := openFileRepository(t, dir)
+	defer recovered.Close()
+	assertPopulated(t, recovered, alice, bob, team, org)
+
+	// IDs continue after the recovered ones
+	if id, _ := recovered.CreateUser(context.Background(), "Carol"); id != bob+1 {
+		t.Errorf("Expected next user ID %d, got %d", bob+1, id)
+	}
+}
+
+func Test_FileRepository_SnapshotsTruncateLog(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepository(t, dir, WithSnapshotEvery(5))
+	alice, bob, team, org := populate(t, r) // 7 records: snapshot after 5, 2 left in the log
+	crash(t, r)
+
+	if r.walRecords != 2 {
+		t.Errorf("Expected 2 records after the snapshot, got %d", r.walRecords)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatalf("Expected a snapshot: %v", err)
+	}
+
+	recovered := openFileRepository(t, dir)
+	assertPopulated(t, recovered, alice, bob, team, org)
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Close leaves everything in the snapshot and an empty log
+	if info, err := os.Stat(filepath.Join(dir, walFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty log after Close, got %v, %v", info, err)
+	}
+	reopened := openFileRepository(t, dir)
+	defer reopened.Close()
+	assertPopulated(t, reopened, alice, bob, team, org)
+}
+
+func Test_FileRepository_DiscardsDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string, size int64)
+	}{
+		{
+			name: "torn record",
+			damage: func(t *testing.T, path string, _ int64) {
+				frame, _ := encodeWALRecord(walRecord{LSN: 8, Op: walCreateUser, ID: 3, Name: "Torn"})
+				appendBytes(t, path, frame[:len(frame)-3])
+			},
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(t *testing.T, path string, _ int64) {
+				frame, _ := encodeWALRecord(walRecord{LSN: 8, Op: walCreateUser, ID: 3, Name: "Flipped"})
+				frame[len(frame)-2] ^= 0xff
+				appendBytes(t, path, frame)
+			},
+		},
+		{
+			name: "garbage header",
+			damage: func(t *testing.T, path string, _ int64) {
+				appendBytes(t, path, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, walFileName)
+			r := openFileRepository(t, dir)
+			alice, bob, team, org := populate(t, r)
+			crash(t, r)
+
+			info, _ := os.Stat(path)
+			tt.damage(t, path, info.Size())
+
+			recovered := openFileRepository(t, dir)
+			defer recovered.Close()
+			assertPopulated(t, recovered, alice, bob, team, org)
+			if after, _ := os.Stat(path); after.Size() != info.Size() {
+				t.Errorf("Expected the log truncated to %d bytes, got %d", info.Size(), after.Size())
+			}
+			if _, err := recovered.GetUserByID(context.Background(), 3); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Expected the damaged record to be discarded, got %v", err)
+			}
+			if id, err := recovered.CreateUser(context.Background(), "Carol"); err != nil || id != 3 {
+				t.Errorf("Expected writes to continue with ID 3, got %d, %v", id, err)
+			}
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Failed to damage log: %v", err)
+	}
+}
+
+func Test_FileRepository_FsyncPolicies(t *testing.T) {
+	for name, policy := range map[string]FsyncPolicy{"always": FsyncAlways, "interval": FsyncInterval, "never": FsyncNever} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := openFileRepository(t, dir, WithFsyncPolicy(policy), WithFsyncInterval(5*time.Millisecond))
+			alice, bob, team, org := populate(t, r)
+
+			if policy == FsyncInterval {
+				deadline := time.Now().Add(2 * time.Second)
+				for {
+					r.mu.RLock()
+					dirty := r.dirty
+					r.mu.RUnlock()
+					if !dirty {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("Expected the background sync to flush the log")
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+			crash(t, r)
+
+			recovered := openFileRepository(t, dir)
+			defer recovered.Close()
+			assertPopulated(t, recovered, alice, bob, team, org)
+		})
+	}
+}
+
+func Test_FileRepository_RejectsInvalidWrites(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepository(t, dir)
+	ctx := context.Background()
+	alice, _, team, org := populate(t, r)
+
+	if _, err := r.AddUserToGroup(ctx, 999, team); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := r.AddGroupToGroup(ctx, team, 999); !errors.Is(err, ErrUserGroupNotFound) {
+		t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+	}
+	if _, err := r.AddGroupToGroup(ctx, org, team); !errors.Is(err, ErrCycleDetected) {
+		t.Errorf("Expected ErrCycleDetected, got %v", err)
+	}
+	if _, err := r.AddPermission(ctx, "role", "user", 1, alice); err == nil {
+		t.Error("Expected invalid subject type to be rejected")
+	}
+
+	// Rejected writes are not logged, so the revision is unchanged after recovery
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := r.CreateUser(ctx, "Late"); err == nil {
+		t.Error("Expected writes after Close to fail")
+	}
+	reopened := openFileRepository(t, dir)
+	defer reopened.Close()
+	if rev, _ := reopened.CurrentRevision(ctx); rev != 3 {
+		t.Errorf("Expected revision 3, got %d", rev)
+	}
+}
+
+func Test_FileRepository_ServesServer(t *testing.T) {
+	r := openFileRepository(t, t.TempDir())
+	s := New(r)
+	defer s.Close()
+	alice, bob, _, _ := populate(t, r)
+
+	if name, err := s.GetUserNameWithPermissionCheck(context.Background(), alice, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v", name, err)
+	}
+	if _, err := s.GetUserNameWithPermissionCheck(context.Background(), bob, alice); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied, got %v", err)
+	}
+}
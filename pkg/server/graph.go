@@ -0,0 +1,625 @@
+package server
+
+import "sort"
+
+// Membership is a direct user-in-group relation
+type Membership struct {
+	UserID  int
+	GroupID int
+}
+
+// GroupEdge is a direct child-in-parent group relation
+type GroupEdge struct {
+	ChildID  int
+	ParentID int
+}
+
+// Permission is a permission record; SourceType and TargetType are "user" or "group".
+// Condition is empty for unconditional grants.
+type Permission struct {
+	SourceType string
+	SourceID   int
+	TargetType string
+	TargetID   int
+	Condition  string
+}
+
+// GroupRule is the membership rule of a dynamic group
+type GroupRule struct {
+	GroupID int
+	Rule    string
+}
+
+// GraphSnapshot is a consistent copy of all memberships, hierarchy edges, membership
+// rules, permissions and users that are not active at a given revision
+type GraphSnapshot struct {
+	Memberships   []Membership
+	Edges         []GroupEdge
+	Rules         []GroupRule
+	Permissions   []Permission
+	InactiveUsers []int
+	Revision      Revision
+}
+
+// permissionGraph is an in-memory model of memberships, the group hierarchy and
+// permissions. Every group's ancestor set (including the group itself) is kept
+// precomputed as a bitset so that permission checks reduce to set intersections.
+// permissionGraph is not safe for concurrent use.
+type permissionGraph struct {
+	userGroups map[int]*bitset // user -> direct groups
+	members    map[int]*bitset // group -> direct users
+	children   map[int]*bitset // group -> direct child groups
+	parents    map[int]*bitset // group -> direct parent groups
+	ancestors  map[int]*bitset // group -> itself and all transitive parents
+
+	userToUser   map[int]*bitset // source user -> target users
+	userToGroup  map[int]*bitset // source user -> target groups
+	groupToUser  map[int]*bitset // target user -> source groups
+	groupToGroup map[int]*bitset // source group -> target groups
+
+	// conditional holds the grants that only apply while their condition holds,
+	// keyed by the grant without its condition. They are not in the bitsets.
+	conditional map[Permission]*Condition
+
+	rules    map[int]*Condition // dynamic group -> membership rule
+	inactive *bitset            // users that are not active, denied as source
+}
+
+func newPermissionGraph() *permissionGraph {
+	return &permissionGraph{
+		userGroups:   make(map[int]*bitset),
+		members:      make(map[int]*bitset),
+		children:     make(map[int]*bitset),
+		parents:      make(map[int]*bitset),
+		ancestors:    make(map[int]*bitset),
+		userToUser:   make(map[int]*bitset),
+		userToGroup:  make(map[int]*bitset),
+		groupToUser:  make(map[int]*bitset),
+		groupToGroup: make(map[int]*bitset),
+		conditional:  make(map[Permission]*Condition),
+		rules:        make(map[int]*Condition),
+		inactive:     &bitset{},
+	}
+}
+
+// buildPermissionGraph creates a graph from a snapshot
+func buildPermissionGraph(snapshot *GraphSnapshot) (*permissionGraph, error) {
+	g := newPermissionGraph()
+	for _, m := range snapshot.Memberships {
+		g.addMembership(m.UserID, m.GroupID)
+	}
+	for _, e := range snapshot.Edges {
+		if err := g.addEdge(e.ChildID, e.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range snapshot.Rules {
+		rule, err := ParseMembershipRule(r.Rule)
+		if err != nil {
+			return nil, err
+		}
+		g.setRule(r.GroupID, rule)
+	}
+	for _, userID := range snapshot.InactiveUsers {
+		g.inactive.add(userID)
+	}
+	for _, p := range snapshot.Permissions {
+		var cond *Condition
+		if p.Condition != "" {
+			var err error
+			if cond, err = ParseCondition(p.Condition); err != nil {
+				return nil, err
+			}
+		}
+		g.setPermission(p.SourceType, p.TargetType, p.SourceID, p.TargetID, cond)
+	}
+	return g, nil
+}
+
+// setFor returns the bitset stored under id, creating it if needed
+func setFor(m map[int]*bitset, id int) *bitset {
+	set, ok := m[id]
+	if !ok {
+		set = &bitset{}
+		m[id] = set
+	}
+	return set
+}
+
+// ancestorsOf returns the ancestor set of a group, which always contains the group itself.
+// It does not modify the graph, so it is safe to call from concurrent readers.
+func (g *permissionGraph) ancestorsOf(groupID int) *bitset {
+	if set, ok := g.ancestors[groupID]; ok {
+		return set
+	}
+	return newBitset(groupID)
+}
+
+// ensureAncestors returns the stored ancestor set of a group, creating it if needed
+func (g *permissionGraph) ensureAncestors(groupID int) *bitset {
+	set, ok := g.ancestors[groupID]
+	if !ok {
+		set = newBitset(groupID)
+		g.ancestors[groupID] = set
+	}
+	return set
+}
+
+func (g *permissionGraph) addMembership(userID, groupID int) {
+	setFor(g.userGroups, userID).add(groupID)
+	setFor(g.members, groupID).add(userID)
+	g.ensureAncestors(groupID)
+}
+
+func (g *permissionGraph) removeMembership(userID, groupID int) {
+	g.userGroups[userID].remove(groupID)
+	g.members[groupID].remove(userID)
+}
+
+// setMembers replaces the direct users of a group with userIDs
+func (g *permissionGraph) setMembers(groupID int, userIDs []int) {
+	keep := newBitset(userIDs...)
+	for _, userID := range g.members[groupID].ids() {
+		if !keep.has(userID) {
+			g.removeMembership(userID, groupID)
+		}
+	}
+	for _, userID := range userIDs {
+		g.addMembership(userID, groupID)
+	}
+}
+
+// setRule sets the membership rule of a group; a nil rule makes it static
+func (g *permissionGraph) setRule(groupID int, rule *Condition) {
+	if rule == nil {
+		delete(g.rules, groupID)
+		return
+	}
+	g.rules[groupID] = rule
+	g.ensureAncestors(groupID)
+}
+
+// setUserStatus records the lifecycle status of a user
+func (g *permissionGraph) setUserStatus(userID int, status UserStatus) {
+	if status == UserActive {
+		g.inactive.remove(userID)
+	} else {
+		g.inactive.add(userID)
+	}
+}
+
+// applyUserRules adds and removes the memberships of a user with attrs that the
+// membership rules require and returns the change events of the changes
+func (g *permissionGraph) applyUserRules(userID int, attrs Attributes) []ChangeEvent {
+	if len(g.rules) == 0 {
+		return nil
+	}
+	join, leave := userRuleChanges(g.rules, bitsetMap(g.userGroups[userID]), attrs)
+	return g.applyMembershipEvents(ruleMembershipEvents(userID, join, leave))
+}
+
+// applyGroupRule adds and removes the users of a dynamic group as its rule requires,
+// given the attributes of every user that has any, and returns the change events
+func (g *permissionGraph) applyGroupRule(groupID int, attrs map[int]Attributes) []ChangeEvent {
+	rule, ok := g.rules[groupID]
+	if !ok {
+		return nil
+	}
+	add, remove := groupRuleChanges(rule, bitsetMap(g.members[groupID]), attrs)
+	return g.applyMembershipEvents(groupMembershipEvents(groupID, add, remove))
+}
+
+// applyMembershipEvents adds and removes the memberships described by events
+func (g *permissionGraph) applyMembershipEvents(events []ChangeEvent) []ChangeEvent {
+	for _, event := range events {
+		if event.Type == EventMembershipRemoved {
+			g.removeMembership(event.SubjectID, event.ObjectID)
+		} else {
+			g.addMembership(event.SubjectID, event.ObjectID)
+		}
+	}
+	return events
+}
+
+// addEdge nests childID in parentID, rejecting edges that would create a cycle
+func (g *permissionGraph) addEdge(childID, parentID int) error {
+	if g.wouldCreateCycle(childID, parentID) {
+		return &CycleDetectedError{ChildGroupID: childID, ParentGroupID: parentID}
+	}
+	if g.children[parentID].has(childID) {
+		return nil
+	}
+	setFor(g.children, parentID).add(childID)
+	setFor(g.parents, childID).add(parentID)
+
+	// Every group at or below the child gains the parent's ancestors
+	parentAncestors := g.ensureAncestors(parentID)
+	for _, id := range g.descendants(childID).ids() {
+		g.ensureAncestors(id).unionWith(parentAncestors)
+	}
+	return nil
+}
+
+// removeEdge removes childID from parentID and recomputes the ancestor sets of the
+// groups at or below the child, which are the only ones that can shrink
+func (g *permissionGraph) removeEdge(childID, parentID int) {
+	if !g.children[parentID].has(childID) {
+		return
+	}
+	g.children[parentID].remove(childID)
+	g.parents[childID].remove(parentID)
+
+	affected := g.descendants(childID)
+	done := &bitset{}
+	var recompute func(id int) *bitset
+	recompute = func(id int) *bitset {
+		if !affected.has(id) || done.has(id) {
+			return g.ensureAncestors(id)
+		}
+		set := newBitset(id)
+		for _, p := range g.parents[id].ids() {
+			set.unionWith(recompute(p))
+		}
+		g.ancestors[id] = set
+		done.add(id)
+		return set
+	}
+	for _, id := range affected.ids() {
+		recompute(id)
+	}
+}
+
+// moveEdge moves childID from fromParentID to toParentID, rejecting moves that would
+// create a cycle. Moving a group to the parent it is in leaves the graph unchanged.
+func (g *permissionGraph) moveEdge(childID, fromParentID, toParentID int) error {
+	if fromParentID == toParentID {
+		return nil
+	}
+	if g.wouldCreateCycle(childID, toParentID) {
+		return &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+	g.removeEdge(childID, fromParentID)
+	return g.addEdge(childID, toParentID)
+}
+
+func (g *permissionGraph) addPermission(sourceType, targetType string, sourceID, targetID int) {
+	g.setPermission(sourceType, targetType, sourceID, targetID, nil)
+}
+
+// setPermission adds a grant or replaces its condition; a nil condition makes it unconditional
+func (g *permissionGraph) setPermission(sourceType, targetType string, sourceID, targetID int, cond *Condition) {
+	var grants *bitset
+	id := targetID
+	switch {
+	case sourceType == "user" && targetType == "user":
+		grants = setFor(g.userToUser, sourceID)
+	case sourceType == "user" && targetType == "group":
+		grants = setFor(g.userToGroup, sourceID)
+	case sourceType == "group" && targetType == "user":
+		grants = setFor(g.groupToUser, targetID) // keyed by target user
+		id = sourceID
+	case sourceType == "group" && targetType == "group":
+		grants = setFor(g.groupToGroup, sourceID)
+	default:
+		return
+	}
+
+	p := Permission{SourceType: sourceType, SourceID: sourceID, TargetType: targetType, TargetID: targetID}
+	if cond == nil {
+		grants.add(id)
+		delete(g.conditional, p)
+		return
+	}
+	grants.remove(id)
+	g.conditional[p] = cond
+}
+
+// grant returns the condition of a grant, "" for an unconditional one, and whether
+// the grant exists
+func (g *permissionGraph) grant(sourceType, targetType string, sourceID, targetID int) (string, bool) {
+	p := Permission{SourceType: sourceType, SourceID: sourceID, TargetType: targetType, TargetID: targetID}
+	if cond, ok := g.conditional[p]; ok {
+		return cond.String(), true
+	}
+	switch {
+	case sourceType == "user" && targetType == "user":
+		return "", g.userToUser[sourceID].has(targetID)
+	case sourceType == "user" && targetType == "group":
+		return "", g.userToGroup[sourceID].has(targetID)
+	case sourceType == "group" && targetType == "user":
+		return "", g.groupToUser[targetID].has(sourceID)
+	case sourceType == "group" && targetType == "group":
+		return "", g.groupToGroup[sourceID].has(targetID)
+	}
+	return "", false
+}
+
+// wouldCreateCycle reports whether nesting childID in parentID would create a cycle
+func (g *permissionGraph) wouldCreateCycle(childID, parentID int) bool {
+	return childID == parentID || g.ancestorsOf(parentID).has(childID)
+}
+
+// edgeShape returns the shape of the hierarchy around nesting childID in parentID
+func (g *permissionGraph) edgeShape(childID, parentID int) edgeShape {
+	return edgeShape{
+		parentDepth:    longestChain(g.parents, parentID),
+		childHeight:    longestChain(g.children, childID),
+		parentChildren: g.children[parentID].len(),
+		childParents:   g.parents[childID].len(),
+	}
+}
+
+// longestChain returns the number of edges on the longest chain from groupID through
+// next, which maps a group to its parents or to its children
+func longestChain(next map[int]*bitset, groupID int) int {
+	lengths := make(map[int]int)
+	var walk func(id int) int
+	walk = func(id int) int {
+		if n, ok := lengths[id]; ok {
+			return n
+		}
+		n := 0
+		for _, p := range next[id].ids() {
+			if l := walk(p) + 1; l > n {
+				n = l
+			}
+		}
+		lengths[id] = n
+		return n
+	}
+	return walk(groupID)
+}
+
+// descendants returns groupID and every group transitively nested in it
+func (g *permissionGraph) descendants(groupID int) *bitset {
+	seen := newBitset(groupID)
+	stack := []int{groupID}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, child := range g.children[current].ids() {
+			if !seen.has(child) {
+				seen.add(child)
+				stack = append(stack, child)
+			}
+		}
+	}
+	return seen
+}
+
+// userAncestors returns every group the user belongs to directly or transitively
+func (g *permissionGraph) userAncestors(userID int) *bitset {
+	set := &bitset{}
+	for _, groupID := range g.userGroups[userID].ids() {
+		set.unionWith(g.ancestorsOf(groupID))
+	}
+	return set
+}
+
+// usersInGroupTransitive returns the users of groupID and all nested groups in ascending order
+func (g *permissionGraph) usersInGroupTransitive(groupID int) []int {
+	users := &bitset{}
+	for _, id := range g.descendants(groupID).ids() {
+		users.unionWith(g.members[id])
+	}
+	return users.ids()
+}
+
+// ancestorGroups returns the groups that transitively contain groupID, excluding itself
+func (g *permissionGraph) ancestorGroups(groupID int) []int {
+	ids := g.ancestorsOf(groupID).ids()
+	i := sort.SearchInts(ids, groupID)
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// descendantGroups returns the groups that groupID transitively contains, excluding itself
+func (g *permissionGraph) descendantGroups(groupID int) []int {
+	ids := g.descendants(groupID).ids()
+	i := sort.SearchInts(ids, groupID)
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// subtree returns the groups at or below groupID, the edges out of them to their
+// children and their direct memberships
+func (g *permissionGraph) subtree(groupID int) (groups []int, edges []GroupEdge, memberships []Membership) {
+	groups = g.descendants(groupID).ids()
+	for _, parentID := range groups {
+		for _, childID := range g.children[parentID].ids() {
+			edges = append(edges, GroupEdge{ChildID: childID, ParentID: parentID})
+		}
+		for _, userID := range g.members[parentID].ids() {
+			memberships = append(memberships, Membership{UserID: userID, GroupID: parentID})
+		}
+	}
+	return groups, edges, memberships
+}
+
+// ancestorEdges returns the edges out of the given groups and every group above them,
+// ordered by child and parent
+func (g *permissionGraph) ancestorEdges(groupIDs []int) []GroupEdge {
+	reach := &bitset{}
+	for _, id := range groupIDs {
+		reach.unionWith(g.ancestorsOf(id))
+	}
+	edges := make([]GroupEdge, 0)
+	for _, childID := range reach.ids() {
+		for _, parentID := range g.parents[childID].ids() {
+			edges = append(edges, GroupEdge{ChildID: childID, ParentID: parentID})
+		}
+	}
+	return edges
+}
+
+// groupGrantsReach reports whether any group in sourceGroups has a permission on a group in targetGroups
+func (g *permissionGraph) groupGrantsReach(sourceGroups, targetGroups *bitset) bool {
+	for _, sourceGroup := range sourceGroups.ids() {
+		if g.groupToGroup[sourceGroup].intersects(targetGroups) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUserPermissionOnUser evaluates the four permission scenarios for a user target
+func (g *permissionGraph) hasUserPermissionOnUser(sourceUserID, targetUserID int) bool {
+	if g.inactive.has(sourceUserID) {
+		return false
+	}
+
+	// Scenario 1: direct user-to-user permission
+	if g.userToUser[sourceUserID].has(targetUserID) {
+		return true
+	}
+
+	sourceGroups := g.userAncestors(sourceUserID)
+	targetGroups := g.userAncestors(targetUserID)
+
+	// Scenario 2: a group containing the source has permission on the target
+	// Scenario 3: the source has permission on a group containing the target
+	// Scenario 4: a group containing the source has permission on a group containing the target
+	return g.groupToUser[targetUserID].intersects(sourceGroups) ||
+		g.userToGroup[sourceUserID].intersects(targetGroups) ||
+		g.groupGrantsReach(sourceGroups, targetGroups)
+}
+
+// hasUserPermissionOnGroup evaluates the permission scenarios for a group target.
+// The target's ancestor set contains the target itself, so direct grants and
+// grants on containing groups are covered by the same intersection.
+func (g *permissionGraph) hasUserPermissionOnGroup(sourceUserID, targetGroupID int) bool {
+	if g.inactive.has(sourceUserID) {
+		return false
+	}
+	targetGroups := g.ancestorsOf(targetGroupID)
+	return g.userToGroup[sourceUserID].intersects(targetGroups) ||
+		g.groupGrantsReach(g.userAncestors(sourceUserID), targetGroups)
+}
+
+// conditionsOnUser returns the conditions of the conditional grants that would give
+// sourceUserID permission on targetUserID, in any of the four scenarios
+func (g *permissionGraph) conditionsOnUser(sourceUserID, targetUserID int) []*Condition {
+	if len(g.conditional) == 0 {
+		return nil
+	}
+	targetGroups := g.userAncestors(targetUserID)
+	return g.conditionsFor(sourceUserID, func(p Permission) bool {
+		return (p.TargetType == "user" && p.TargetID == targetUserID) ||
+			(p.TargetType == "group" && targetGroups.has(p.TargetID))
+	})
+}
+
+// conditionsOnGroup returns the conditions of the conditional grants that would give
+// sourceUserID permission on targetGroupID
+func (g *permissionGraph) conditionsOnGroup(sourceUserID, targetGroupID int) []*Condition {
+	if len(g.conditional) == 0 {
+		return nil
+	}
+	targetGroups := g.ancestorsOf(targetGroupID)
+	return g.conditionsFor(sourceUserID, func(p Permission) bool {
+		return p.TargetType == "group" && targetGroups.has(p.TargetID)
+	})
+}
+
+// conditionsFor returns the conditions of the conditional grants whose source is
+// sourceUserID or one of their groups and whose target matches
+func (g *permissionGraph) conditionsFor(sourceUserID int, targetMatches func(Permission) bool) []*Condition {
+	if g.inactive.has(sourceUserID) {
+		return nil
+	}
+	sourceGroups := g.userAncestors(sourceUserID)
+	var conditions []*Condition
+	for p, cond := range g.conditional {
+		sourceMatches := (p.SourceType == "user" && p.SourceID == sourceUserID) ||
+			(p.SourceType == "group" && sourceGroups.has(p.SourceID))
+		if sourceMatches && targetMatches(p) {
+			conditions = append(conditions, cond)
+		}
+	}
+	return conditions
+}
+
+// bitsetMap returns the IDs of a possibly nil bitset as a set
+func bitsetMap(b *bitset) map[int]bool {
+	ids := b.ids()
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// bitsetKeys returns the keys of m in ascending order
+func bitsetKeys(m map[int]*bitset) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// edges returns every hierarchy edge ordered by parent and child
+func (g *permissionGraph) edges() []GroupEdge {
+	var edges []GroupEdge
+	for _, parentID := range bitsetKeys(g.children) {
+		for _, childID := range g.children[parentID].ids() {
+			edges = append(edges, GroupEdge{ChildID: childID, ParentID: parentID})
+		}
+	}
+	return edges
+}
+
+// snapshot exports the relations of the graph, sorted, as a GraphSnapshot at rev
+func (g *permissionGraph) snapshot(rev Revision) *GraphSnapshot {
+	s := &GraphSnapshot{Revision: rev}
+	for _, groupID := range bitsetKeys(g.members) {
+		for _, userID := range g.members[groupID].ids() {
+			s.Memberships = append(s.Memberships, Membership{UserID: userID, GroupID: groupID})
+		}
+	}
+	s.Edges = g.edges()
+
+	for groupID, rule := range g.rules {
+		s.Rules = append(s.Rules, GroupRule{GroupID: groupID, Rule: rule.String()})
+	}
+	sort.Slice(s.Rules, func(i, j int) bool { return s.Rules[i].GroupID < s.Rules[j].GroupID })
+	if g.inactive.len() > 0 {
+		s.InactiveUsers = g.inactive.ids()
+	}
+
+	grants := func(m map[int]*bitset, sourceType, targetType string, keyIsSource bool) {
+		for _, key := range bitsetKeys(m) {
+			for _, id := range m[key].ids() {
+				p := Permission{SourceType: sourceType, SourceID: key, TargetType: targetType, TargetID: id}
+				if !keyIsSource {
+					p.SourceID, p.TargetID = id, key
+				}
+				s.Permissions = append(s.Permissions, p)
+			}
+		}
+	}
+	grants(g.userToUser, "user", "user", true)
+	grants(g.userToGroup, "user", "group", true)
+	grants(g.groupToUser, "group", "user", false) // keyed by target user
+	grants(g.groupToGroup, "group", "group", true)
+
+	conditional := make([]Permission, 0, len(g.conditional))
+	for p, cond := range g.conditional {
+		p.Condition = cond.String()
+		conditional = append(conditional, p)
+	}
+	sort.Slice(conditional, func(i, j int) bool {
+		a, b := conditional[i], conditional[j]
+		if a.SourceType != b.SourceType {
+			return a.SourceType > b.SourceType // "user" first, like the unconditional grants
+		}
+		if a.TargetType != b.TargetType {
+			return a.TargetType > b.TargetType
+		}
+		if a.SourceID != b.SourceID {
+			return a.SourceID < b.SourceID
+		}
+		return a.TargetID < b.TargetID
+	})
+	s.Permissions = append(s.Permissions, conditional...)
+	return s
+}
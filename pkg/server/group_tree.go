@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"sort"
+)
+
+// GroupSubtree is a group and every group below it: Names holds their names, Edges
+// the edges from them to their child groups ordered by parent and child, and
+// Memberships their direct users ordered by group and user
+type GroupSubtree struct {
+	RootID      int
+	Names       map[int]string
+	Edges       []GroupEdge
+	Memberships []Membership
+}
+
+// GroupTree is a group in the hierarchy below the root of a tree. A group nested in
+// several groups of the tree appears under each of them, but its children are only
+// listed where it appears first in breadth-first order, which is closest to the
+// root; its other nodes are marked Repeated. The tree therefore has at most one node
+// per group and edge of the hierarchy. ChildCount is the number of direct child
+// groups even where maxDepth or a repetition cuts Children off, so that a client
+// knows which nodes to expand with another call.
+type GroupTree struct {
+	ID                int          `json:"id"`
+	Name              string       `json:"name"`
+	DirectMembers     int          `json:"direct_members"`
+	TransitiveMembers int          `json:"transitive_members"` // distinct users at or below the group
+	ChildCount        int          `json:"child_count"`
+	Repeated          bool         `json:"repeated,omitempty"` // the group has an earlier node, which lists its children
+	Children          []*GroupTree `json:"children,omitempty"`
+}
+
+// buildGroupTree builds the tree of subtree down to maxDepth levels below the root,
+// or all levels if maxDepth is negative. Children are in ascending ID order.
+func buildGroupTree(subtree *GroupSubtree, maxDepth int) *GroupTree {
+	children := make(map[int][]int)
+	for _, e := range subtree.Edges {
+		children[e.ParentID] = append(children[e.ParentID], e.ChildID)
+	}
+	for _, ids := range children {
+		sort.Ints(ids)
+	}
+	members := make(map[int]*bitset)
+	for _, m := range subtree.Memberships {
+		setFor(members, m.GroupID).add(m.UserID)
+	}
+
+	// The users at or below each group, computed once per group of the DAG
+	below := make(map[int]*bitset)
+	var usersBelow func(id int) *bitset
+	usersBelow = func(id int) *bitset {
+		if set, ok := below[id]; ok {
+			return set
+		}
+		set := members[id].clone()
+		below[id] = set
+		for _, child := range children[id] {
+			set.unionWith(usersBelow(child))
+		}
+		return set
+	}
+
+	node := func(id int) *GroupTree {
+		return &GroupTree{
+			ID:                id,
+			Name:              subtree.Names[id],
+			DirectMembers:     members[id].len(),
+			TransitiveMembers: usersBelow(id).len(),
+			ChildCount:        len(children[id]),
+		}
+	}
+
+	// Expand breadth-first, so that each group is expanded at its shallowest node
+	root := node(subtree.RootID)
+	expanded := map[int]bool{subtree.RootID: true}
+	level := []*GroupTree{root}
+	for depth := 0; len(level) > 0 && (maxDepth < 0 || depth < maxDepth); depth++ {
+		var next []*GroupTree
+		for _, parent := range level {
+			for _, id := range children[parent.ID] {
+				child := node(id)
+				parent.Children = append(parent.Children, child)
+				if expanded[id] {
+					child.Repeated = true
+					continue
+				}
+				expanded[id] = true
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	return root
+}
+
+// GetUserGroupsInGroupTransitive returns all groups nested in the group directly or transitively
+func (s *Server) GetUserGroupsInGroupTransitive(ctx context.Context, userGroupID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupsInGroupTransitive", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetDescendantGroups(ctx, userGroupID)
+}
+
+// GetGroupTree returns the hierarchy below a group with names and member counts,
+// down to maxDepth levels below it: 0 returns the group alone and a negative
+// maxDepth returns every level
+func (s *Server) GetGroupTree(ctx context.Context, rootID, maxDepth int) (tree *GroupTree, err error) {
+	ctx, c := s.begin(ctx, "GetGroupTree", IntAttr("group.id", rootID), IntAttr("max_depth", maxDepth))
+	defer func() { c.end(err) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	subtree, err := s.repo.GetGroupSubtree(ctx, rootID)
+	if err != nil {
+		return nil, err
+	}
+	return buildGroupTree(subtree, maxDepth), nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_GroupTree_Build(t *testing.T) {
+	// 4 is nested in both 2 and 3; user 10 is in 1 and 4
+	subtree := &GroupSubtree{
+		RootID:      1,
+		Names:       map[int]string{1: "Org", 2: "Sales", 3: "Support", 4: "Field"},
+		Edges:       []GroupEdge{{3, 1}, {2, 1}, {4, 2}, {4, 3}},
+		Memberships: []Membership{{10, 1}, {10, 4}, {11, 4}, {12, 3}},
+	}
+	field := func(repeated bool) *GroupTree {
+		return &GroupTree{ID: 4, Name: "Field", DirectMembers: 2, TransitiveMembers: 2, Repeated: repeated}
+	}
+	want := &GroupTree{
+		ID: 1, Name: "Org", DirectMembers: 1, TransitiveMembers: 3, ChildCount: 2,
+		Children: []*GroupTree{
+			{ID: 2, Name: "Sales", TransitiveMembers: 2, ChildCount: 1, Children: []*GroupTree{field(false)}},
+			{ID: 3, Name: "Support", DirectMembers: 1, TransitiveMembers: 3, ChildCount: 1, Children: []*GroupTree{field(true)}},
+		},
+	}
+	if got := buildGroupTree(subtree, -1); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildGroupTree(-1) = %s, want %s", dumpTree(got), dumpTree(want))
+	}
+
+	// Counts still cover the levels below maxDepth
+	for _, child := range want.Children {
+		child.Children = nil
+	}
+	if got := buildGroupTree(subtree, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildGroupTree(1) = %s, want %s", dumpTree(got), dumpTree(want))
+	}
+	if got := buildGroupTree(subtree, 0); got.Children != nil || got.ChildCount != 2 || got.TransitiveMembers != 3 {
+		t.Errorf("buildGroupTree(0) = %s, want the root alone", dumpTree(got))
+	}
+}
+
+func Test_GroupTree_RepeatedGroups(t *testing.T) {
+	// A chain of diamonds: group 3k+1 contains 3k+2 and 3k+3, which both contain
+	// 3k+4. Expanding every path would take 2^k nodes.
+	const diamonds = 40
+	subtree := &GroupSubtree{RootID: 1, Names: make(map[int]string)}
+	for k := 0; k < diamonds; k++ {
+		top := 3*k + 1
+		subtree.Edges = append(subtree.Edges,
+			GroupEdge{top + 1, top}, GroupEdge{top + 2, top}, GroupEdge{top + 3, top + 1}, GroupEdge{top + 3, top + 2})
+	}
+
+	nodes, repeated := 0, 0
+	var walk func(n *GroupTree)
+	walk = func(n *GroupTree) {
+		nodes++
+		if n.Repeated {
+			repeated++
+			if n.Children != nil {
+				t.Errorf("Repeated node %d lists children %v", n.ID, n.Children)
+			}
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(buildGroupTree(subtree, -1))
+	if want := 1 + len(subtree.Edges); nodes != want || repeated != diamonds {
+		t.Errorf("Expected %d nodes with %d repeated, got %d with %d repeated", want, diamonds, nodes, repeated)
+	}
+
+	// The group is expanded at its shallowest node: 4 is below 1 directly and
+	// through 2, and only the direct node lists 5
+	subtree = &GroupSubtree{RootID: 1, Edges: []GroupEdge{{2, 1}, {4, 1}, {4, 2}, {5, 4}}}
+	tree := buildGroupTree(subtree, -1)
+	if direct, nested := tree.Children[1], tree.Children[0].Children[0]; direct.Repeated || len(direct.Children) != 1 || !nested.Repeated {
+		t.Errorf("Expected group 4 to be expanded directly below the root, got %s", dumpTree(tree))
+	}
+}
+
+// dumpTree formats a tree with its children for failure messages
+func dumpTree(t *GroupTree) string {
+	s := "{"
+	s += t.Name
+	for _, child := range t.Children {
+		s += " " + dumpTree(child)
+	}
+	return s + "}"
+}
+
+func Test_GroupTree_Server(t *testing.T) {
+	s := New(newFakeRepository())
+	ctx := context.Background()
+
+	org, _ := s.CreateUserGroup(ctx, "Org")
+	eng, _ := s.CreateUserGroup(ctx, "Engineering")
+	backend, _ := s.CreateUserGroup(ctx, "Backend")
+	_ = s.AddUserGroupToGroup(ctx, eng, org)
+	_ = s.AddUserGroupToGroup(ctx, backend, eng)
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	_ = s.AddUserToGroup(ctx, alice, eng)
+	_ = s.AddUserToGroup(ctx, bob, backend)
+
+	if groups, err := s.GetUserGroupsInGroupTransitive(ctx, org); err != nil || !reflect.DeepEqual(groups, []int{eng, backend}) {
+		t.Errorf("GetUserGroupsInGroupTransitive = %v, %v; want [%d %d]", groups, err, eng, backend)
+	}
+
+	tree, err := s.GetGroupTree(ctx, org, 1)
+	if err != nil {
+		t.Fatalf("GetGroupTree failed: %v", err)
+	}
+	want := &GroupTree{
+		ID: org, Name: "Org", TransitiveMembers: 2, ChildCount: 1,
+		Children: []*GroupTree{{ID: eng, Name: "Engineering", DirectMembers: 1, TransitiveMembers: 2, ChildCount: 1}},
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("GetGroupTree = %s, want %s", dumpTree(tree), dumpTree(want))
+	}
+
+	if _, err := s.GetGroupTree(ctx, 1<<30, -1); !errors.Is(err, ErrUserGroupNotFound) {
+		t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// MaxGroupTypeLength is the longest accepted group type in bytes
+const MaxGroupTypeLength = 64
+
+// validateGroupType rejects group types that are too long to be stored
+func validateGroupType(groupType string) error {
+	if len(groupType) > MaxGroupTypeLength {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrInvalidGroupType, len(groupType), MaxGroupTypeLength)
+	}
+	return nil
+}
+
+// NestingPolicy declares which types of groups may contain which: it maps a parent
+// type to the child types allowed in it. A type the policy does not mention may
+// contain any group, so the nil policy allows every nesting, and a type mapped to no
+// child types may contain none. Groups without a type have the type "", which the
+// policy lists like any other.
+//
+//	NestingPolicy{
+//		"department": {"department", "team"},
+//		"team":       {"team", "role"},
+//		"role":       nil,
+//	}
+type NestingPolicy map[string][]string
+
+// allows reports whether a group of parentType may contain a group of childType
+func (p NestingPolicy) allows(parentType, childType string) bool {
+	allowed, ok := p[parentType]
+	if !ok {
+		return true
+	}
+	for _, t := range allowed {
+		if t == childType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEdge returns a NestingNotAllowedError if the policy does not allow the edge
+func (p NestingPolicy) checkEdge(e NestingViolation) error {
+	if p.allows(e.ParentType, e.ChildType) {
+		return nil
+	}
+	return &NestingNotAllowedError{
+		ChildGroupID: e.ChildGroupID, ParentGroupID: e.ParentGroupID,
+		ChildType: e.ChildType, ParentType: e.ParentType,
+	}
+}
+
+// NestingViolation is a hierarchy edge with the types of both groups that a nesting
+// policy does not allow, e.g. because it was added before the policy was configured
+type NestingViolation struct {
+	ChildGroupID  int    `json:"child_group_id"`
+	ParentGroupID int    `json:"parent_group_id"`
+	ChildType     string `json:"child_type"`
+	ParentType    string `json:"parent_type"`
+}
+
+// nestingViolations returns the edges of typed that policy does not allow, ordered by
+// parent and child
+func nestingViolations(typed []NestingViolation, policy NestingPolicy) []NestingViolation {
+	violations := make([]NestingViolation, 0)
+	for _, e := range typed {
+		if !policy.allows(e.ParentType, e.ChildType) {
+			violations = append(violations, e)
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].ParentGroupID != violations[j].ParentGroupID {
+			return violations[i].ParentGroupID < violations[j].ParentGroupID
+		}
+		return violations[i].ChildGroupID < violations[j].ChildGroupID
+	})
+	return violations
+}
+
+// SetUserGroupType sets the type of a user group, e.g. "department", "team" or
+// "role"; an empty type clears it. The type must fit the nesting policy of the
+// repository with every parent and child group.
+func (s *Server) SetUserGroupType(ctx context.Context, userGroupID int, groupType string) (err error) {
+	ctx, c := s.beginMutation(ctx, "SetUserGroupType", IntAttr("group.id", userGroupID), StringAttr("group.type", groupType))
+	defer func() { c.end(err) }()
+
+	return s.repo.SetGroupType(ctx, userGroupID, groupType)
+}
+
+// GetUserGroupType returns the type of a user group, "" for groups without one
+func (s *Server) GetUserGroupType(ctx context.Context, userGroupID int) (groupType string, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupType", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err) }()
+
+	return s.repo.GetGroupType(ctx, userGroupID)
+}
+
+// GetNestingViolations reports the hierarchy edges that policy does not allow, such
+// as edges added before the repository enforced it. Pass the configured policy to
+// audit the hierarchy, or a stricter one to see what it would reject.
+func (s *Server) GetNestingViolations(ctx context.Context, policy NestingPolicy) (violations []NestingViolation, err error) {
+	ctx, c := s.begin(ctx, "GetNestingViolations")
+	defer func() { c.end(err, IntAttr("result.count", len(violations))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetNestingViolations(ctx, policy)
+}
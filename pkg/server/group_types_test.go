@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNestingPolicy lets departments contain departments and teams, teams contain
+// roles, and roles contain nothing
+var testNestingPolicy = NestingPolicy{
+	"department": {"department", "team"},
+	"team":       {"role"},
+	"role":       nil,
+}
+
+func Test_GroupTypes_Policy(t *testing.T) {
+	for _, tt := range []struct {
+		parent, child string
+		want          bool
+	}{
+		{"department", "team", true},
+		{"team", "department", false},
+		{"team", "role", true},
+		{"role", "role", false},
+		{"department", "", false}, // untyped groups must be listed like any type
+		{"", "department", true},  // types the policy does not mention contain anything
+		{"project", "role", true},
+	} {
+		if got := testNestingPolicy.allows(tt.parent, tt.child); got != tt.want {
+			t.Errorf("allows(%q, %q) = %v, want %v", tt.parent, tt.child, got, tt.want)
+		}
+	}
+	if !NestingPolicy(nil).allows("role", "department") {
+		t.Error("Expected the nil policy to allow every nesting")
+	}
+}
+
+// runNestingPolicy checks that repo enforces testNestingPolicy in AddGroupToGroup,
+// MoveGroup and SetGroupType
+func runNestingPolicy(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	group := func(name, groupType string) int {
+		t.Helper()
+		id, err := repo.CreateUserGroup(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		if err := repo.SetGroupType(ctx, id, groupType); err != nil {
+			t.Fatalf("SetGroupType failed: %v", err)
+		}
+		return id
+	}
+	sales := group("Sales", "department")
+	emea := group("Sales EMEA", "team")
+	admin := group("Admin", "role")
+	misc := group("Misc", "")
+
+	for _, edge := range [][2]int{{emea, sales}, {admin, emea}, {sales, misc}} {
+		if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+			t.Fatalf("AddGroupToGroup(%d, %d) failed: %v", edge[0], edge[1], err)
+		}
+	}
+
+	var notAllowed *NestingNotAllowedError
+	_, err := repo.AddGroupToGroup(ctx, group("Support", "department"), emea)
+	if !errors.As(err, &notAllowed) || notAllowed.ChildType != "department" || notAllowed.ParentType != "team" {
+		t.Errorf("Expected a department in a team to be rejected, got %v", err)
+	}
+	for _, edge := range [][2]int{{group("Sales APAC", "team"), admin}, {group("Other", ""), sales}} {
+		if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); !errors.Is(err, ErrNestingNotAllowed) {
+			t.Errorf("AddGroupToGroup(%d, %d): expected ErrNestingNotAllowed, got %v", edge[0], edge[1], err)
+		}
+	}
+	if _, err := repo.MoveGroup(ctx, admin, emea, sales); !errors.Is(err, ErrNestingNotAllowed) {
+		t.Errorf("Expected moving a role into a department to be rejected, got %v", err)
+	}
+
+	// A new type must fit every parent and child of the group
+	if err := repo.SetGroupType(ctx, admin, "department"); !errors.Is(err, ErrNestingNotAllowed) {
+		t.Errorf("Expected retyping a role in a team to be rejected, got %v", err)
+	}
+	if err := repo.SetGroupType(ctx, emea, "role"); !errors.Is(err, ErrNestingNotAllowed) {
+		t.Errorf("Expected retyping a team in a department to a role to be rejected, got %v", err)
+	}
+	if err := repo.SetGroupType(ctx, misc, "role"); !errors.Is(err, ErrNestingNotAllowed) {
+		t.Errorf("Expected retyping a group with a child to a role to be rejected, got %v", err)
+	}
+	if groupType, err := repo.GetGroupType(ctx, admin); err != nil || groupType != "role" {
+		t.Errorf("GetGroupType = %q, %v; want the type kept", groupType, err)
+	}
+	if err := repo.SetGroupType(ctx, misc, "project"); err != nil {
+		t.Errorf("Expected a type the policy does not mention to be allowed, got %v", err)
+	}
+}
+
+// runConcurrentNesting races retyping a role into a department against nesting it in
+// a team, and checks that both cannot succeed
+func runConcurrentNesting(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	for round := 0; round < 10; round++ {
+		team, err := repo.CreateUserGroup(ctx, "Team")
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		role, _ := repo.CreateUserGroup(ctx, "Role")
+		_ = repo.SetGroupType(ctx, team, "team")
+		_ = repo.SetGroupType(ctx, role, "role")
+
+		var typeErr, edgeErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			typeErr = repo.SetGroupType(ctx, role, "department")
+		}()
+		go func() {
+			defer wg.Done()
+			_, edgeErr = repo.AddGroupToGroup(ctx, role, team)
+		}()
+		wg.Wait()
+
+		for _, err := range []error{typeErr, edgeErr} {
+			if err != nil && !errors.Is(err, ErrNestingNotAllowed) {
+				t.Fatalf("Round %d failed: %v", round, err)
+			}
+		}
+		if typeErr == nil && edgeErr == nil {
+			t.Fatalf("Round %d: both the department type and the edge into a team were accepted", round)
+		}
+	}
+}
+
+func Test_GroupTypes_Repositories(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		repo := openFileRepository(t, t.TempDir(), WithFileNestingPolicy(testNestingPolicy))
+		defer repo.Close()
+		runNestingPolicy(t, repo)
+		runConcurrentNesting(t, repo)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		repo := NewSQLRepository(sqliteTestDB(t), SQLiteDialect{}, WithSQLNestingPolicy(testNestingPolicy))
+		defer repo.Close()
+		runNestingPolicy(t, repo)
+		runConcurrentNesting(t, repo)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		repo := NewMySQLRepository(db, WithMySQLNestingPolicy(testNestingPolicy))
+		defer repo.Close()
+		runNestingPolicy(t, repo)
+		runConcurrentNesting(t, repo)
+	})
+}
+
+func Test_GroupTypes_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Nest a department in a team before the policy is configured
+	r := openFileRepository(t, dir)
+	team, _ := r.CreateUserGroup(ctx, "Sales EMEA")
+	dept, _ := r.CreateUserGroup(ctx, "Sales")
+	_ = r.SetGroupType(ctx, team, "team")
+	_ = r.SetGroupType(ctx, dept, "department")
+	_, _ = r.AddGroupToGroup(ctx, dept, team)
+	crash(t, r)
+
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if groupType, err := r.GetGroupType(ctx, dept); err != nil || groupType != "department" {
+			t.Errorf("GetGroupType = %q, %v; want department", groupType, err)
+		}
+		violations, err := r.GetNestingViolations(ctx, testNestingPolicy)
+		want := []NestingViolation{{ChildGroupID: dept, ParentGroupID: team, ChildType: "department", ParentType: "team"}}
+		if err != nil || !reflect.DeepEqual(violations, want) {
+			t.Errorf("GetNestingViolations = %+v, %v; want %+v", violations, err, want)
+		}
+	}
+
+	// The types are replayed from the log, and the existing edge can be added again
+	r = openFileRepository(t, dir, WithFileNestingPolicy(testNestingPolicy))
+	check(t, r)
+	if _, err := r.AddGroupToGroup(ctx, dept, team); err != nil {
+		t.Errorf("Expected re-adding the edge to succeed, got %v", err)
+	}
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+}
+
+func Test_GroupTypes_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	dept, _ := s.CreateUserGroup(ctx, "Sales")
+	role, _ := s.CreateUserGroup(ctx, "Admin")
+	if err := s.SetUserGroupType(ctx, dept, "department"); err != nil {
+		t.Fatalf("SetUserGroupType failed: %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "mutation applied", "SetUserGroupType"); !ok || entry["group.type"] != "department" {
+		t.Errorf("Expected the type in the log entry, got %v", entry)
+	}
+	_ = s.SetUserGroupType(ctx, role, "role")
+	_ = s.AddUserGroupToGroup(ctx, dept, role)
+
+	if groupType, err := s.GetUserGroupType(ctx, role); err != nil || groupType != "role" {
+		t.Errorf("GetUserGroupType = %q, %v; want role", groupType, err)
+	}
+	violations, err := s.GetNestingViolations(ctx, testNestingPolicy)
+	want := []NestingViolation{{ChildGroupID: dept, ParentGroupID: role, ChildType: "department", ParentType: "role"}}
+	if err != nil || !reflect.DeepEqual(violations, want) {
+		t.Errorf("GetNestingViolations = %+v, %v; want %+v", violations, err, want)
+	}
+
+	if err := s.SetUserGroupType(ctx, dept, strings.Repeat("x", MaxGroupTypeLength+1)); !errors.Is(err, ErrInvalidGroupType) {
+		t.Errorf("Expected ErrInvalidGroupType, got %v", err)
+	}
+}
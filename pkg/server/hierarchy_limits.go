@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"sort"
+)
+
+// Hierarchy limit names, used in HierarchyLimitError and HierarchyViolation
+const (
+	LimitDepth    = "depth"
+	LimitChildren = "children"
+	LimitParents  = "parents"
+)
+
+// HierarchyLimits bounds the shape of the group hierarchy. A zero field means no
+// limit. Depth counts edges: a group nested in nothing has depth 0 and a group in
+// it depth 1. Keep MaxDepth well below MySQL's cte_max_recursion_depth (1000 by
+// default), which the recursive hierarchy queries must not reach.
+type HierarchyLimits struct {
+	MaxDepth    int // longest chain of groups above any group
+	MaxChildren int // direct child groups of a group
+	MaxParents  int // direct parent groups of a group
+}
+
+// enabled reports whether any limit is set
+func (l HierarchyLimits) enabled() bool {
+	return l.MaxDepth > 0 || l.MaxChildren > 0 || l.MaxParents > 0
+}
+
+// edgeShape describes the hierarchy around a new edge before it is added: the depth
+// of the parent, the longest chain below the child, the direct child groups of the
+// parent and the direct parent groups of the child
+type edgeShape struct {
+	parentDepth, childHeight     int
+	parentChildren, childParents int
+}
+
+// checkEdge returns a HierarchyLimitError if nesting childID in parentID breaks a
+// limit, given the shape of the hierarchy around the edge
+func (l HierarchyLimits) checkEdge(childID, parentID int, s edgeShape) error {
+	fail := func(limit string, max int) error {
+		return &HierarchyLimitError{ChildGroupID: childID, ParentGroupID: parentID, Limit: limit, Max: max}
+	}
+	switch {
+	case l.MaxChildren > 0 && s.parentChildren >= l.MaxChildren:
+		return fail(LimitChildren, l.MaxChildren)
+	case l.MaxParents > 0 && s.childParents >= l.MaxParents:
+		return fail(LimitParents, l.MaxParents)
+	case l.MaxDepth > 0 && s.parentDepth+1+s.childHeight > l.MaxDepth:
+		return fail(LimitDepth, l.MaxDepth)
+	}
+	return nil
+}
+
+// HierarchyViolation is a group that breaks a hierarchy limit, e.g. because it was
+// nested before the limit was configured
+type HierarchyViolation struct {
+	GroupID int    `json:"group_id"`
+	Limit   string `json:"limit"`
+	Max     int    `json:"max"`
+	Actual  int    `json:"actual"`
+}
+
+// hierarchyViolations returns every group of edges that breaks limits, ordered by
+// group and limit name
+func hierarchyViolations(edges []GroupEdge, limits HierarchyLimits) []HierarchyViolation {
+	children := make(map[int]int)
+	parents := make(map[int][]int)
+	for _, e := range edges {
+		children[e.ParentID]++
+		parents[e.ChildID] = append(parents[e.ChildID], e.ParentID)
+	}
+
+	// The depth of each group is one more than the depth of its deepest parent. The
+	// hierarchy is acyclic, but a group still being visited counts as depth 0 so
+	// that corrupt data cannot recurse forever.
+	depths := make(map[int]int)
+	var depth func(id int) int
+	depth = func(id int) int {
+		if d, ok := depths[id]; ok {
+			return d
+		}
+		depths[id] = 0
+		d := 0
+		for _, p := range parents[id] {
+			if pd := depth(p) + 1; pd > d {
+				d = pd
+			}
+		}
+		depths[id] = d
+		return d
+	}
+
+	violations := make([]HierarchyViolation, 0)
+	add := func(id int, limit string, max, actual int) {
+		if max > 0 && actual > max {
+			violations = append(violations, HierarchyViolation{GroupID: id, Limit: limit, Max: max, Actual: actual})
+		}
+	}
+	for id, n := range children {
+		add(id, LimitChildren, limits.MaxChildren, n)
+	}
+	for id, ps := range parents {
+		add(id, LimitParents, limits.MaxParents, len(ps))
+		if limits.MaxDepth > 0 {
+			add(id, LimitDepth, limits.MaxDepth, depth(id))
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].GroupID != violations[j].GroupID {
+			return violations[i].GroupID < violations[j].GroupID
+		}
+		return violations[i].Limit < violations[j].Limit
+	})
+	return violations
+}
+
+// GetHierarchyViolations reports the groups that break limits, such as groups nested
+// before the repository enforced them. Pass the configured limits to audit the
+// hierarchy, or stricter ones to see what tightening them would reject.
+func (s *Server) GetHierarchyViolations(ctx context.Context, limits HierarchyLimits) (violations []HierarchyViolation, err error) {
+	ctx, c := s.begin(ctx, "GetHierarchyViolations",
+		IntAttr("limits.max_depth", limits.MaxDepth),
+		IntAttr("limits.max_children", limits.MaxChildren),
+		IntAttr("limits.max_parents", limits.MaxParents))
+	defer func() { c.end(err, IntAttr("result.count", len(violations))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetHierarchyViolations(ctx, limits)
+}
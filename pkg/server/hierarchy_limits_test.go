@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func Test_HierarchyLimits_Violations(t *testing.T) {
+	// 1 -> 2 -> 3 -> 4 is a chain; 5 is nested in 1, 2 and 3
+	edges := []GroupEdge{{2, 1}, {3, 2}, {4, 3}, {5, 1}, {5, 2}, {5, 3}}
+
+	got := hierarchyViolations(edges, HierarchyLimits{MaxDepth: 2, MaxChildren: 2, MaxParents: 2})
+	want := []HierarchyViolation{
+		{GroupID: 4, Limit: LimitDepth, Max: 2, Actual: 3},
+		{GroupID: 5, Limit: LimitDepth, Max: 2, Actual: 3},
+		{GroupID: 5, Limit: LimitParents, Max: 2, Actual: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hierarchyViolations = %+v, want %+v", got, want)
+	}
+
+	if got := hierarchyViolations(edges, HierarchyLimits{}); len(got) != 0 {
+		t.Errorf("Expected no violations without limits, got %+v", got)
+	}
+}
+
+// runHierarchyLimits checks that repo enforces MaxDepth 2, MaxChildren 2 and
+// MaxParents 2 in AddGroupToGroup and MoveGroup
+func runHierarchyLimits(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	group := func(name string) int {
+		t.Helper()
+		id, err := repo.CreateUserGroup(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		return id
+	}
+	org, eng, backend, sales := group("Org"), group("Engineering"), group("Backend"), group("Sales")
+	ops, oncall, shared := group("Operations"), group("On-call"), group("Shared")
+	edges := [][2]int{{eng, org}, {sales, org}, {backend, eng}, {oncall, ops}, {shared, eng}, {shared, ops}}
+	for _, edge := range edges {
+		if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+			t.Fatalf("AddGroupToGroup(%d, %d) failed: %v", edge[0], edge[1], err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name          string
+		child, parent int
+		limit         string
+	}{
+		{"deeper than the parent allows", group("Team"), backend, LimitDepth},
+		{"subtree too deep below the parent", ops, sales, LimitDepth},
+		{"too many children", group("Mobile"), eng, LimitChildren},
+		{"too many parents", shared, sales, LimitParents},
+	} {
+		var limitErr *HierarchyLimitError
+		_, err := repo.AddGroupToGroup(ctx, tt.child, tt.parent)
+		if !errors.Is(err, ErrHierarchyLimitExceeded) || !errors.As(err, &limitErr) || limitErr.Limit != tt.limit {
+			t.Errorf("%s: expected the %s limit, got %v", tt.name, tt.limit, err)
+		}
+	}
+
+	// Existing edges can be added again, and the subtree of ops fits below a root
+	if _, err := repo.AddGroupToGroup(ctx, shared, eng); err != nil {
+		t.Errorf("Expected re-adding an edge to succeed, got %v", err)
+	}
+	if _, err := repo.AddGroupToGroup(ctx, ops, group("Platform")); err != nil {
+		t.Errorf("Expected ops to fit below a root, got %v", err)
+	}
+
+	// Moves check the new parent, but never add a parent to the child
+	if _, err := repo.MoveGroup(ctx, shared, ops, backend); !errors.Is(err, ErrHierarchyLimitExceeded) {
+		t.Errorf("Expected the move below backend to exceed the depth, got %v", err)
+	}
+	if _, err := repo.MoveGroup(ctx, oncall, ops, org); !errors.Is(err, ErrHierarchyLimitExceeded) {
+		t.Errorf("Expected the move into org to exceed its children, got %v", err)
+	}
+	if _, err := repo.MoveGroup(ctx, shared, eng, sales); err != nil {
+		t.Errorf("Expected the move into sales to succeed, got %v", err)
+	}
+}
+
+// runConcurrentLimits checks that concurrent AddGroupToGroup calls that each fit the
+// limits of runHierarchyLimits, but not together, cannot all succeed
+func runConcurrentLimits(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	group := func(name string) int {
+		t.Helper()
+		id, err := repo.CreateUserGroup(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		return id
+	}
+	// addAll adds the edges concurrently and returns how many were added
+	addAll := func(edges [][2]int) int {
+		t.Helper()
+		errs := make([]error, len(edges))
+		var wg sync.WaitGroup
+		for i, edge := range edges {
+			wg.Add(1)
+			go func(i, child, parent int) {
+				defer wg.Done()
+				_, errs[i] = repo.AddGroupToGroup(ctx, child, parent)
+			}(i, edge[0], edge[1])
+		}
+		wg.Wait()
+		added := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				added++
+			case !errors.Is(err, ErrHierarchyLimitExceeded):
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+		return added
+	}
+
+	for round := 0; round < 5; round++ {
+		parent := group("Parent")
+		var edges [][2]int
+		for i := 0; i < 6; i++ {
+			edges = append(edges, [2]int{group("Child"), parent})
+		}
+		if added := addAll(edges); added != 2 {
+			t.Fatalf("Round %d: expected 2 children to be added, got %d", round, added)
+		}
+
+		// w -> x -> y -> z is too deep, either half alone is not
+		w, x, y, z := group("W"), group("X"), group("Y"), group("Z")
+		if _, err := repo.AddGroupToGroup(ctx, y, x); err != nil {
+			t.Fatalf("AddGroupToGroup failed: %v", err)
+		}
+		if added := addAll([][2]int{{x, w}, {z, y}}); added != 1 {
+			t.Fatalf("Round %d: expected one of the edges to be added, got %d", round, added)
+		}
+	}
+}
+
+func Test_HierarchyLimits_Repositories(t *testing.T) {
+	limits := HierarchyLimits{MaxDepth: 2, MaxChildren: 2, MaxParents: 2}
+
+	t.Run("file", func(t *testing.T) {
+		repo := openFileRepository(t, t.TempDir(), WithFileHierarchyLimits(limits))
+		defer repo.Close()
+		runHierarchyLimits(t, repo)
+		runConcurrentLimits(t, repo)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		repo := NewSQLRepository(sqliteTestDB(t), SQLiteDialect{}, WithSQLHierarchyLimits(limits))
+		defer repo.Close()
+		runHierarchyLimits(t, repo)
+		runConcurrentLimits(t, repo)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		repo := NewMySQLRepository(db, WithMySQLHierarchyLimits(limits))
+		defer repo.Close()
+		runHierarchyLimits(t, repo)
+		runConcurrentLimits(t, repo)
+	})
+}
+
+func Test_HierarchyLimits_Server(t *testing.T) {
+	var logs logBuffer
+	repo := openFileRepository(t, t.TempDir(), WithFileHierarchyLimits(HierarchyLimits{MaxChildren: 1}))
+	defer repo.Close()
+	s := New(repo, WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	org, _ := s.CreateUserGroup(ctx, "Org")
+	eng, _ := s.CreateUserGroup(ctx, "Engineering")
+	sales, _ := s.CreateUserGroup(ctx, "Sales")
+	_ = s.AddUserGroupToGroup(ctx, eng, org)
+
+	if err := s.AddUserGroupToGroup(ctx, sales, org); !errors.Is(err, ErrHierarchyLimitExceeded) {
+		t.Fatalf("Expected ErrHierarchyLimitExceeded, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "AddUserGroupToGroup"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the limit to be logged as rejected, got %v", logs.entries(t))
+	}
+
+	violations, err := s.GetHierarchyViolations(ctx, HierarchyLimits{MaxChildren: 1})
+	if err != nil || len(violations) != 0 {
+		t.Errorf("GetHierarchyViolations = %+v, %v; want none", violations, err)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultIdempotencyTTL is how long an idempotency key is remembered unless
+// configured otherwise
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// MaxIdempotencyKeyLength is the longest accepted idempotency key in bytes
+const MaxIdempotencyKeyLength = 255
+
+// IdempotencyKeyHeader is the HTTP request header read by IdempotencyMiddleware
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyKey is the context key for the idempotency key of a create
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey returns a context under which CreateUser and CreateUserGroup are
+// idempotent: the first create with key is applied and its ID remembered for the
+// repository's TTL, and a retry with the same key and name returns that ID instead of
+// creating a duplicate. Reusing the key for another operation or name fails with an
+// IdempotencyKeyReusedError. An empty key disables idempotency.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key of the context, if any
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key, key != ""
+}
+
+// idempotencyAttrs returns the log and span attributes for the idempotency key of ctx
+func idempotencyAttrs(ctx context.Context) []Attribute {
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		return []Attribute{StringAttr("idempotency_key", key)}
+	}
+	return nil
+}
+
+// validateIdempotencyKey rejects keys that repositories cannot store
+func validateIdempotencyKey(key string) error {
+	if len(key) > MaxIdempotencyKeyLength {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrInvalidIdempotencyKey, len(key), MaxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+// idempotencyRecord is a remembered create: the operation and name it was made with
+// and the ID it returned
+type idempotencyRecord struct {
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Name      string    `json:"name"`
+	ID        int       `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// replay returns the remembered ID for a retried create, or an
+// IdempotencyKeyReusedError if the key was used for a different request
+func (rec idempotencyRecord) replay(operation, name string) (int, error) {
+	if rec.Operation != operation || rec.Name != name {
+		return 0, &IdempotencyKeyReusedError{Key: rec.Key, Operation: rec.Operation}
+	}
+	return rec.ID, nil
+}
+
+// IdempotencyMiddleware moves the Idempotency-Key header of each request into its
+// context with WithIdempotencyKey, so handlers that create users or groups with the
+// request context become safe to retry. Keys longer than MaxIdempotencyKeyLength are
+// rejected with 400 Bad Request.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := validateIdempotencyKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithIdempotencyKey(r.Context(), key)))
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uniqueKey returns an idempotency key that no earlier test run has used
+func uniqueKey(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+}
+
+func Test_Idempotency_Middleware(t *testing.T) {
+	var got string
+	var keyed bool
+	handler := IdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, keyed = IdempotencyKeyFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+		keyed  bool
+	}{
+		{"no header", "", http.StatusOK, false},
+		{"key", "order-42", http.StatusOK, true},
+		{"too long", strings.Repeat("k", MaxIdempotencyKeyLength+1), http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, keyed = "", false
+			req := httptest.NewRequest(http.MethodPost, "/users", nil)
+			if tt.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if keyed != tt.keyed || (tt.keyed && got != tt.key) {
+				t.Errorf("Expected key %q in the context, got %q, %v", tt.key, got, keyed)
+			}
+		})
+	}
+}
+
+func Test_Idempotency_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := WithIdempotencyKey(context.Background(), "signup-7")
+
+	first, err := s.CreateUser(ctx, "Alice")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if again, err := s.CreateUser(ctx, "Alice"); err != nil || again != first {
+		t.Errorf("Expected the retried create to return %d, got %d, %v", first, again, err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "CreateUser")
+	if !ok || entry["idempotency_key"] != "signup-7" {
+		t.Errorf("Expected the key in the log entry, got %v", entry)
+	}
+
+	_, err = s.CreateUser(ctx, "Mallory")
+	var reused *IdempotencyKeyReusedError
+	if !errors.As(err, &reused) || reused.Operation != "CreateUser" {
+		t.Errorf("Expected an IdempotencyKeyReusedError, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "CreateUser"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the reused key to be logged as rejected, got %v", logs.entries(t))
+	}
+
+	long := WithIdempotencyKey(context.Background(), strings.Repeat("k", MaxIdempotencyKeyLength+1))
+	if _, err := s.CreateUserGroup(long, "Team"); !errors.Is(err, ErrInvalidIdempotencyKey) {
+		t.Errorf("Expected ErrInvalidIdempotencyKey, got %v", err)
+	}
+}
+
+func Test_Idempotency_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := WithIdempotencyKey(context.Background(), "import-1")
+
+	r := openFileRepository(t, dir)
+	first, err := r.CreateUserGroup(ctx, "Imported")
+	if err != nil {
+		t.Fatalf("CreateUserGroup failed: %v", err)
+	}
+	crash(t, r)
+
+	// The key is replayed from the log
+	r = openFileRepository(t, dir)
+	if again, err := r.CreateUserGroup(ctx, "Imported"); err != nil || again != first {
+		t.Errorf("Expected %d after replaying the log, got %d, %v", first, again, err)
+	}
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	if again, err := r.CreateUserGroup(ctx, "Imported"); err != nil || again != first {
+		t.Errorf("Expected %d after loading the snapshot, got %d, %v", first, again, err)
+	}
+}
+
+func Test_Idempotency_Expiry(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	mysql := NewMySQLRepository(db, WithMySQLIdempotencyTTL(ttl))
+	defer mysql.Close()
+	file := openFileRepository(t, t.TempDir(), WithFileIdempotencyTTL(ttl))
+	defer file.Close()
+
+	for name, repo := range map[string]Repository{"mysql": mysql, "file": file} {
+		t.Run(name, func(t *testing.T) {
+			ctx := WithIdempotencyKey(context.Background(), uniqueKey("expiry"))
+			first, err := repo.CreateUser(ctx, "Eve")
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			time.Sleep(2 * ttl)
+
+			// An expired key is free again, even for a different name
+			second, err := repo.CreateUser(ctx, "Frank")
+			if err != nil || second == first {
+				t.Errorf("Expected a new user after the key expired, got %d, %v", second, err)
+			}
+			if again, err := repo.CreateUser(ctx, "Frank"); err != nil || again != second {
+				t.Errorf("Expected the key to be remembered again, got %d, %v", again, err)
+			}
+		})
+	}
+}
+
+func Test_Idempotency_ConcurrentRetries(t *testing.T) {
+	repo := openFileRepository(t, t.TempDir())
+	defer repo.Close()
+	ctx := WithIdempotencyKey(context.Background(), uniqueKey("concurrent"))
+
+	const retries = 8
+	ids := make([]int, retries)
+	errs := make([]error, retries)
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = repo.CreateUser(ctx, "Grace")
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range ids {
+		if errs[i] != nil || ids[i] != ids[0] {
+			t.Errorf("Expected every retry to return %d, got %d, %v", ids[0], ids[i], errs[i])
+		}
+	}
+}
+
+func Test_Idempotency_HTTPHeader(t *testing.T) {
+	httpServer, _ := setupHTTPTestServer(t)
+	defer httpServer.Close()
+
+	post := func(name, key string) (int, int) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL+"/users", strings.NewReader(fmt.Sprintf(`{"name":%q}`, name)))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body CreateUserResponse
+		if resp.StatusCode == http.StatusCreated {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return resp.StatusCode, body.ID
+	}
+
+	key := uniqueKey("http")
+	status, first := post("Heidi", key)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", status)
+	}
+	if status, again := post("Heidi", key); status != http.StatusCreated || again != first {
+		t.Errorf("Expected the retry to return user %d, got %d (status %d)", first, again, status)
+	}
+	if status, _ := post("Ivan", key); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a reused key, got %d", status)
+	}
+}
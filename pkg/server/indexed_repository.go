@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// GraphSource is a Repository that can export a consistent snapshot of its graph
+type GraphSource interface {
+	Repository
+	LoadGraphSnapshot(ctx context.Context) (*GraphSnapshot, error)
+}
+
+// IndexedRepository decorates a Repository with an in-memory graph index that
+// answers permission checks and transitive membership queries without touching
+// the database. Writes go to the wrapped repository first and are then applied
+// to the index. Writes through the index are serialized, so they reach the index
+// in revision order. Changes made by other processes become visible after Rebuild.
+type IndexedRepository struct {
+	GraphSource
+
+	writeMu    sync.Mutex // serializes writes with their index updates
+	rebuildMu  sync.Mutex // serializes rebuilds
+	mu         sync.RWMutex
+	graph      *permissionGraph
+	revision   Revision
+	rebuilding bool
+	pending    []indexedWrite // writes applied while a rebuild is loading its snapshot
+}
+
+// indexedWrite is a write applied to the index, kept for replay during rebuilds
+type indexedWrite struct {
+	revision Revision
+	apply    func(g *permissionGraph) error
+}
+
+// NewIndexedRepository loads the full graph from source and returns the indexed repository
+func NewIndexedRepository(ctx context.Context, source GraphSource) (*IndexedRepository, error) {
+	r := &IndexedRepository{GraphSource: source}
+	if err := r.Rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rebuild reloads the whole index from the wrapped repository
+func (r *IndexedRepository) Rebuild(ctx context.Context) error {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+
+	r.mu.Lock()
+	r.rebuilding = true
+	r.pending = nil
+	r.mu.Unlock()
+
+	snapshot, err := r.GraphSource.LoadGraphSnapshot(ctx)
+	var graph *permissionGraph
+	if err == nil {
+		graph, err = buildPermissionGraph(snapshot)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := r.pending
+	r.rebuilding = false
+	r.pending = nil
+	if err != nil {
+		return fmt.Errorf("failed to rebuild graph index: %w", err)
+	}
+
+	// Replay the writes that raced with the snapshot and committed after it. Writes
+	// the snapshot already contains are skipped: moves and edge adds are not
+	// idempotent, and replaying them could detach live edges or find false cycles.
+	revision := snapshot.Revision
+	for _, w := range pending {
+		if w.revision <= snapshot.Revision {
+			continue
+		}
+		if err := w.apply(graph); err != nil {
+			return fmt.Errorf("failed to replay write at revision %s: %w", w.revision, err)
+		}
+		if w.revision > revision {
+			revision = w.revision
+		}
+	}
+
+	r.graph = graph
+	r.revision = revision
+	return nil
+}
+
+// applyWrite applies a committed write to the index
+func (r *IndexedRepository) applyWrite(rev Revision, apply func(g *permissionGraph) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rebuilding {
+		r.pending = append(r.pending, indexedWrite{revision: rev, apply: apply})
+	}
+	if err := apply(r.graph); err != nil {
+		return fmt.Errorf("failed to update graph index: %w", err)
+	}
+	if rev > r.revision {
+		r.revision = rev
+	}
+	return nil
+}
+
+// AddUserToGroup adds a user to a group and updates the index
+func (r *IndexedRepository) AddUserToGroup(ctx context.Context, userID, groupID int) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.AddUserToGroup(ctx, userID, groupID)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		g.addMembership(userID, groupID)
+		return nil
+	})
+}
+
+// AddGroupToGroup adds a child group to a parent group and updates the index.
+// Cycle detection stays with the wrapped repository, which holds the authoritative data.
+func (r *IndexedRepository) AddGroupToGroup(ctx context.Context, childID, parentID int) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.AddGroupToGroup(ctx, childID, parentID)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		return g.addEdge(childID, parentID)
+	})
+}
+
+// MoveGroup moves a child group from one parent group to another and updates the index
+func (r *IndexedRepository) MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.MoveGroup(ctx, childID, fromParentID, toParentID)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		return g.moveEdge(childID, fromParentID, toParentID)
+	})
+}
+
+// AddPermission adds a permission record and updates the index
+func (r *IndexedRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.AddPermission(ctx, sourceType, targetType, sourceID, targetID)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		g.addPermission(sourceType, targetType, sourceID, targetID)
+		return nil
+	})
+}
+
+// AddConditionalPermission adds a conditional permission record and updates the index
+func (r *IndexedRepository) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.AddConditionalPermission(ctx, sourceType, targetType, sourceID, targetID, condition)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		var cond *Condition
+		if condition != "" {
+			var err error
+			if cond, err = ParseCondition(condition); err != nil {
+				return err
+			}
+		}
+		g.setPermission(sourceType, targetType, sourceID, targetID, cond)
+		return nil
+	})
+}
+
+// SetAttribute sets an attribute. The wrapped repository moves a user in or out of
+// dynamic groups as their attributes change; the index applies the same rules to the
+// user's new attributes.
+func (r *IndexedRepository) SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.SetAttribute(ctx, subjectType, subjectID, name, value)
+	if err != nil {
+		return rev, err
+	}
+	r.mu.RLock()
+	dynamic := len(r.graph.rules) > 0
+	r.mu.RUnlock()
+	if subjectType != "user" || !dynamic {
+		return rev, nil
+	}
+
+	attrs, err := r.GraphSource.GetAttributes(WithPrimaryReads(ctx), subjectType, subjectID)
+	if err != nil {
+		return rev, fmt.Errorf("failed to update graph index: %w", err)
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		g.applyUserRules(subjectID, attrs)
+		return nil
+	})
+}
+
+// SetUserStatus sets the status of a user and applies it to the index
+func (r *IndexedRepository) SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.SetUserStatus(ctx, userID, status)
+	if err != nil {
+		return rev, err
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		g.setUserStatus(userID, status)
+		return nil
+	})
+}
+
+// SetGroupRule sets the membership rule of a group and loads its resulting members
+// into the index
+func (r *IndexedRepository) SetGroupRule(ctx context.Context, groupID int, rule string) (Revision, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	rev, err := r.GraphSource.SetGroupRule(ctx, groupID, rule)
+	if err != nil {
+		return rev, err
+	}
+	var parsed *Condition
+	if rule != "" {
+		if parsed, err = ParseMembershipRule(rule); err != nil {
+			return rev, err
+		}
+	}
+	members, err := r.GraphSource.GetUsersInGroup(WithPrimaryReads(ctx), groupID)
+	if err != nil {
+		return rev, fmt.Errorf("failed to update graph index: %w", err)
+	}
+	return rev, r.applyWrite(rev, func(g *permissionGraph) error {
+		g.setRule(groupID, parsed)
+		g.setMembers(groupID, members)
+		return nil
+	})
+}
+
+// GetUsersInGroupTransitive returns all users in the group and all nested subgroups
+func (r *IndexedRepository) GetUsersInGroupTransitive(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.usersInGroupTransitive(groupID), nil
+}
+
+// GetGroupsForUser returns the groups the user belongs to directly
+func (r *IndexedRepository) GetGroupsForUser(_ context.Context, userID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.userGroups[userID].ids(), nil
+}
+
+// GetGroupsForUserTransitive returns all groups the user belongs to directly or through nested groups
+func (r *IndexedRepository) GetGroupsForUserTransitive(_ context.Context, userID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.userAncestors(userID).ids(), nil
+}
+
+// GetParentGroups returns the groups that directly contain the specified group
+func (r *IndexedRepository) GetParentGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.parents[groupID].ids(), nil
+}
+
+// GetAncestorGroups returns all groups that transitively contain the specified group
+func (r *IndexedRepository) GetAncestorGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.ancestorGroups(groupID), nil
+}
+
+// GetDescendantGroups returns all groups that the specified group transitively contains
+func (r *IndexedRepository) GetDescendantGroups(_ context.Context, groupID int) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.graph.descendantGroups(groupID), nil
+}
+
+// GetAncestorEdges returns the hierarchy edges above a "user" or "group"
+func (r *IndexedRepository) GetAncestorEdges(_ context.Context, subjectType string, subjectID int) ([]GroupEdge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if subjectType == "group" {
+		return r.graph.ancestorEdges([]int{subjectID}), nil
+	}
+	return r.graph.ancestorEdges(r.graph.userGroups[subjectID].ids()), nil
+}
+
+// HasUserPermissionOnUser checks if a user has permission to access another user.
+// Conditions are evaluated against attributes from the wrapped repository.
+func (r *IndexedRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	r.mu.RLock()
+	allowed := r.graph.hasUserPermissionOnUser(sourceUserID, targetUserID)
+	var conditions []*Condition
+	if !allowed {
+		conditions = r.graph.conditionsOnUser(sourceUserID, targetUserID)
+	}
+	r.mu.RUnlock()
+
+	if allowed {
+		return true, nil
+	}
+	return evaluateConditions(ctx, conditions, sourceUserID, "user", targetUserID, r.GraphSource.GetAttributes)
+}
+
+// HasUserPermissionOnGroup checks if a user has permission to access a group
+func (r *IndexedRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	r.mu.RLock()
+	allowed := r.graph.hasUserPermissionOnGroup(sourceUserID, targetGroupID)
+	var conditions []*Condition
+	if !allowed {
+		conditions = r.graph.conditionsOnGroup(sourceUserID, targetGroupID)
+	}
+	r.mu.RUnlock()
+
+	if allowed {
+		return true, nil
+	}
+	return evaluateConditions(ctx, conditions, sourceUserID, "group", targetGroupID, r.GraphSource.GetAttributes)
+}
+
+// CurrentRevision returns the latest revision reflected in the index
+func (r *IndexedRepository) CurrentRevision(context.Context) (Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.revision, nil
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Index_Bitset(t *testing.T) {
+	a := newBitset(1, 64, 65, 1000, 1<<20)
+	b := newBitset(2, 63, 4096)
+
+	if !a.has(65) || a.has(66) || a.has(-1) {
+		t.Error("Unexpected membership results")
+	}
+	if a.intersects(b) {
+		t.Error("Expected disjoint sets not to intersect")
+	}
+
+	b.unionWith(newBitset(1000))
+	if !a.intersects(b) {
+		t.Error("Expected sets sharing 1000 to intersect")
+	}
+
+	want := []int{2, 63, 1000, 4096}
+	if got := b.ids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected ids %v, got %v", want, got)
+	}
+	if got := a.len(); got != 5 {
+		t.Errorf("Expected 5 members, got %d", got)
+	}
+}
+
+// populateRandomGraph creates users, a random acyclic hierarchy, memberships and
+// permissions in repo and returns the created user and group IDs
+func populateRandomGraph(ctx context.Context, t testing.TB, repo Repository, seed int64, users, groups int) (userIDs, groupIDs []int) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < users; i++ {
+		id, err := repo.CreateUser(ctx, fmt.Sprintf("user-%d", i))
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		userIDs = append(userIDs, id)
+	}
+	for i := 0; i < groups; i++ {
+		id, err := repo.CreateUserGroup(ctx, fmt.Sprintf("group-%d", i))
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		groupIDs = append(groupIDs, id)
+	}
+
+	// Edges only point from later to earlier groups, so the hierarchy stays acyclic
+	for i := 1; i < groups; i++ {
+		for j := 0; j < 2; j++ {
+			parent := groupIDs[rng.Intn(i)]
+			if _, err := repo.AddGroupToGroup(ctx, groupIDs[i], parent); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+	}
+	for _, u := range userIDs {
+		if _, err := repo.AddUserToGroup(ctx, u, groupIDs[rng.Intn(groups)]); err != nil {
+			t.Fatalf("AddUserToGroup failed: %v", err)
+		}
+	}
+
+	pick := func(kind string) int {
+		if kind == "user" {
+			return userIDs[rng.Intn(users)]
+		}
+		return groupIDs[rng.Intn(groups)]
+	}
+	kinds := []string{"user", "group"}
+	for i := 0; i < users/2; i++ {
+		sourceType, targetType := kinds[rng.Intn(2)], kinds[rng.Intn(2)]
+		if _, err := repo.AddPermission(ctx, sourceType, targetType, pick(sourceType), pick(targetType)); err != nil {
+			t.Fatalf("AddPermission failed: %v", err)
+		}
+	}
+
+	return userIDs, groupIDs
+}
+
+func Test_Index_MatchesReferenceRepository(t *testing.T) {
+	ctx := context.Background()
+	reference := newFakeRepository()
+	users, groups := populateRandomGraph(ctx, t, reference, 1, 40, 15)
+
+	index, err := NewIndexedRepository(ctx, reference)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+
+	for _, source := range users {
+		for _, target := range users {
+			want, _ := reference.HasUserPermissionOnUser(ctx, source, target)
+			got, _ := index.HasUserPermissionOnUser(ctx, source, target)
+			if got != want {
+				t.Errorf("HasUserPermissionOnUser(%d, %d): expected %v, got %v", source, target, want, got)
+			}
+		}
+		for _, target := range groups {
+			want, _ := reference.HasUserPermissionOnGroup(ctx, source, target)
+			got, _ := index.HasUserPermissionOnGroup(ctx, source, target)
+			if got != want {
+				t.Errorf("HasUserPermissionOnGroup(%d, %d): expected %v, got %v", source, target, want, got)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		want, _ := reference.GetUsersInGroupTransitive(ctx, g)
+		got, _ := index.GetUsersInGroupTransitive(ctx, g)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetUsersInGroupTransitive(%d): expected %v, got %v", g, want, got)
+		}
+		wantAncestors, _ := reference.GetAncestorGroups(ctx, g)
+		gotAncestors, _ := index.GetAncestorGroups(ctx, g)
+		if !reflect.DeepEqual(gotAncestors, wantAncestors) {
+			t.Errorf("GetAncestorGroups(%d): expected %v, got %v", g, wantAncestors, gotAncestors)
+		}
+	}
+}
+
+func Test_Index_WritesAndRebuild(t *testing.T) {
+	ctx := context.Background()
+	inner := newFakeRepository()
+	index, err := NewIndexedRepository(ctx, inner)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	s := New(index)
+	defer s.Close()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	company, _ := s.CreateUserGroup(ctx, "Company")
+	team, _ := s.CreateUserGroup(ctx, "Team")
+
+	t.Run("writes through server keep the index in sync", func(t *testing.T) {
+		if err := s.AddUserToGroup(ctx, bob, team); err != nil {
+			t.Fatalf("AddUserToGroup failed: %v", err)
+		}
+		if err := s.AddUserGroupToGroup(ctx, team, company); err != nil {
+			t.Fatalf("AddUserGroupToGroup failed: %v", err)
+		}
+		rev, err := s.AddUserToUserGroupPermissionWithRevision(ctx, alice, company)
+		if err != nil {
+			t.Fatalf("AddUserToUserGroupPermissionWithRevision failed: %v", err)
+		}
+
+		name, err := s.GetUserNameWithPermissionCheck(WithMinRevision(ctx, rev), alice, bob)
+		if err != nil {
+			t.Fatalf("GetUserNameWithPermissionCheck failed: %v", err)
+		}
+		if name != "Bob" {
+			t.Errorf("Expected name 'Bob', got %q", name)
+		}
+	})
+
+	t.Run("external writes appear after rebuild", func(t *testing.T) {
+		carol, _ := inner.CreateUser(ctx, "Carol")
+		rev, _ := inner.AddUserToGroup(ctx, carol, team)
+
+		if _, err := s.GetUsersInGroupTransitive(WithMinRevision(ctx, rev), company); err == nil {
+			t.Fatal("Expected stale revision error before rebuild")
+		}
+
+		if err := index.Rebuild(ctx); err != nil {
+			t.Fatalf("Rebuild failed: %v", err)
+		}
+		users, err := s.GetUsersInGroupTransitive(WithMinRevision(ctx, rev), company)
+		if err != nil {
+			t.Fatalf("GetUsersInGroupTransitive failed: %v", err)
+		}
+		if want := []int{bob, carol}; !reflect.DeepEqual(users, want) {
+			t.Errorf("Expected users %v, got %v", want, users)
+		}
+	})
+}
+
+// reorderingSource holds the first SetUserStatus back after it committed until the
+// next one has started, so that unserialized writes reach the index out of order
+type reorderingSource struct {
+	*fakeRepository
+	calls     int32
+	committed chan struct{}
+	started   chan struct{}
+}
+
+func (s *reorderingSource) SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error) {
+	call := atomic.AddInt32(&s.calls, 1)
+	if call == 2 {
+		close(s.started)
+	}
+	rev, err := s.fakeRepository.SetUserStatus(ctx, userID, status)
+	if call == 1 {
+		close(s.committed)
+		select {
+		case <-s.started:
+			time.Sleep(20 * time.Millisecond)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return rev, err
+}
+
+func Test_Index_WritesApplyInRevisionOrder(t *testing.T) {
+	ctx := context.Background()
+	source := &reorderingSource{
+		fakeRepository: newFakeRepository(),
+		committed:      make(chan struct{}),
+		started:        make(chan struct{}),
+	}
+	alice, _ := source.CreateUser(ctx, "Alice")
+	index, err := NewIndexedRepository(ctx, source)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := index.SetUserStatus(ctx, alice, UserSuspended)
+		done <- err
+	}()
+	<-source.committed
+	rev, err := index.SetUserStatus(ctx, alice, UserActive)
+	if err != nil {
+		t.Fatalf("SetUserStatus failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SetUserStatus failed: %v", err)
+	}
+
+	if status, _ := source.GetUserStatus(ctx, alice); status != UserActive {
+		t.Fatalf("Expected the later write to win in the source, got %q", status)
+	}
+	if index.graph.inactive.has(alice) {
+		t.Error("Expected the index to apply the later write last")
+	}
+	if got, _ := index.CurrentRevision(ctx); got != rev {
+		t.Errorf("Expected revision %s, got %s", rev, got)
+	}
+}
+
+// blockingSnapshotSource holds LoadGraphSnapshot back once block is set, until
+// release is closed, so that writes race with a rebuild
+type blockingSnapshotSource struct {
+	*fakeRepository
+	block   bool
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSnapshotSource) LoadGraphSnapshot(ctx context.Context) (*GraphSnapshot, error) {
+	if s.block {
+		close(s.loading)
+		<-s.release
+	}
+	return s.fakeRepository.LoadGraphSnapshot(ctx)
+}
+
+func Test_Index_RebuildDuringMove(t *testing.T) {
+	ctx := context.Background()
+	source := &blockingSnapshotSource{
+		fakeRepository: newFakeRepository(),
+		loading:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	x, _ := source.CreateUserGroup(ctx, "X")
+	y, _ := source.CreateUserGroup(ctx, "Y")
+	z, _ := source.CreateUserGroup(ctx, "Z")
+	index, err := NewIndexedRepository(ctx, source)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+
+	source.block = true
+	done := make(chan error)
+	go func() { done <- index.Rebuild(ctx) }()
+	<-source.loading
+
+	// The snapshot is loaded after these writes and contains all of them; replaying
+	// the first edge onto it would find a cycle through the last one
+	if _, err := index.AddGroupToGroup(ctx, x, y); err != nil {
+		t.Fatalf("AddGroupToGroup failed: %v", err)
+	}
+	if _, err := index.MoveGroup(ctx, x, y, z); err != nil {
+		t.Fatalf("MoveGroup failed: %v", err)
+	}
+	last, err := index.AddGroupToGroup(ctx, y, x)
+	if err != nil {
+		t.Fatalf("AddGroupToGroup failed: %v", err)
+	}
+	close(source.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+
+	if parents, err := index.GetParentGroups(ctx, x); err != nil || !reflect.DeepEqual(parents, []int{z}) {
+		t.Errorf("GetParentGroups(x) = %v, %v; want [%d]", parents, err, z)
+	}
+	if parents, err := index.GetParentGroups(ctx, y); err != nil || !reflect.DeepEqual(parents, []int{x}) {
+		t.Errorf("GetParentGroups(y) = %v, %v; want [%d]", parents, err, x)
+	}
+	if rev, _ := index.CurrentRevision(ctx); rev != last {
+		t.Errorf("Expected revision %s, got %s", last, rev)
+	}
+}
+
+func Test_Index_OverMySQLRepository(t *testing.T) {
+	config := DefaultConfig()
+	db, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	ctx := context.Background()
+	mysqlRepo := NewMySQLRepository(db)
+	defer mysqlRepo.Close()
+
+	users, groups := populateRandomGraph(ctx, t, mysqlRepo, 2, 20, 8)
+	index, err := NewIndexedRepository(ctx, mysqlRepo)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+
+	for _, source := range users {
+		for _, target := range users {
+			want, err := mysqlRepo.HasUserPermissionOnUser(ctx, source, target)
+			if err != nil {
+				t.Fatalf("HasUserPermissionOnUser failed: %v", err)
+			}
+			got, _ := index.HasUserPermissionOnUser(ctx, source, target)
+			if got != want {
+				t.Errorf("HasUserPermissionOnUser(%d, %d): expected %v, got %v", source, target, want, got)
+			}
+		}
+		for _, target := range groups {
+			want, err := mysqlRepo.HasUserPermissionOnGroup(ctx, source, target)
+			if err != nil {
+				t.Fatalf("HasUserPermissionOnGroup failed: %v", err)
+			}
+			got, _ := index.HasUserPermissionOnGroup(ctx, source, target)
+			if got != want {
+				t.Errorf("HasUserPermissionOnGroup(%d, %d): expected %v, got %v", source, target, want, got)
+			}
+		}
+	}
+}
+
+// Benchmarks comparing the graph index with MySQLRepository on the same data
+
+func benchmarkPermissionChecks(b *testing.B, repo Repository, users []int) {
+	b.Helper()
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source, target := users[i%len(users)], users[(i*7+3)%len(users)]
+		if _, err := repo.HasUserPermissionOnUser(ctx, source, target); err != nil {
+			b.Fatalf("HasUserPermissionOnUser failed: %v", err)
+		}
+	}
+}
+
+func Benchmark_Index_HasUserPermissionOnUser(b *testing.B) {
+	ctx := context.Background()
+	reference := newFakeRepository()
+	users, _ := populateRandomGraph(ctx, b, reference, 3, 2000, 200)
+	index, err := NewIndexedRepository(ctx, reference)
+	if err != nil {
+		b.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	benchmarkPermissionChecks(b, index, users)
+}
+
+func Benchmark_Index_GetUsersInGroupTransitive(b *testing.B) {
+	ctx := context.Background()
+	reference := newFakeRepository()
+	_, groups := populateRandomGraph(ctx, b, reference, 3, 2000, 200)
+	index, err := NewIndexedRepository(ctx, reference)
+	if err != nil {
+		b.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.GetUsersInGroupTransitive(ctx, groups[i%len(groups)]); err != nil {
+			b.Fatalf("GetUsersInGroupTransitive failed: %v", err)
+		}
+	}
+}
+
+func Benchmark_MySQL_HasUserPermissionOnUser(b *testing.B) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		b.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+	repo := NewMySQLRepository(db)
+	defer repo.Close()
+	users, _ := populateRandomGraph(ctx, b, repo, 3, 200, 20)
+	benchmarkPermissionChecks(b, repo, users)
+}
+
+func Benchmark_MySQLIndexed_HasUserPermissionOnUser(b *testing.B) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		b.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+	repo := NewMySQLRepository(db)
+	defer repo.Close()
+	users, _ := populateRandomGraph(ctx, b, repo, 3, 200, 20)
+	index, err := NewIndexedRepository(ctx, repo)
+	if err != nil {
+		b.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	benchmarkPermissionChecks(b, index, users)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -68,7 +69,7 @@ func NewHTTPHandler(server *Server) *HTTPHandler {
 
 func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := h.enrichContext(r)
-	h.route(w, r.WithContext(ctx))
+	IdempotencyMiddleware(http.HandlerFunc(h.route)).ServeHTTP(w, r.WithContext(ctx))
 }
 
 // enrichContext adds authentication context from headers
@@ -100,6 +101,8 @@ func (h *HTTPHandler) route(w http.ResponseWriter, r *http.Request) {
 		h.handleAddUserToGroup(w, r)
 	case method == "POST" && path == "/permissions":
 		h.handleAddPermission(w, r)
+	case method == "GET" && path == "/changes":
+		NewChangeFeedHandler(h.server).ServeHTTP(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -114,7 +117,7 @@ func (h *HTTPHandler) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 
 	id, err := h.server.CreateUser(r.Context(), req.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), createErrorStatus(err))
 		return
 	}
 
@@ -126,6 +129,18 @@ func (h *HTTPHandler) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// createErrorStatus maps a failed create to its HTTP status. A key reused for a
+// different request is a client error that retrying cannot fix.
+func createErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidIdempotencyKey):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *HTTPHandler) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	// Extract user ID from path /users/{id}
 	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
@@ -173,7 +188,7 @@ func (h *HTTPHandler) handleCreateGroup(w http.ResponseWriter, r *http.Request)
 
 	id, err := h.server.CreateUserGroup(r.Context(), req.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), createErrorStatus(err))
 		return
 	}
 
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Page sizes of listings
+const (
+	// DefaultPageSize is the page size of listings that do not set a limit
+	DefaultPageSize = 100
+
+	// MaxPageSize is the largest page a listing returns; larger limits are capped
+	MaxPageSize = 1000
+)
+
+// ListSort is the order of a listing
+type ListSort string
+
+// Listing orders. Names are compared as the store compares them, and IDs break ties.
+const (
+	SortByID   ListSort = "id"
+	SortByName ListSort = "name"
+)
+
+// ListOptions selects one page of a listing. Pages are keyset paginated: the
+// cursor remembers the last item returned, so writes between two calls neither skip
+// nor repeat the items that stay in the listing.
+type ListOptions struct {
+	Limit      int      // page size, DefaultPageSize if 0 and at most MaxPageSize
+	Cursor     string   // NextCursor of the previous page, "" for the first page
+	NamePrefix string   // only items whose name starts with the prefix
+	Sort       ListSort // SortByID if empty
+	Descending bool
+}
+
+// PageItem is a user or group in a listing
+type PageItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Page is one page of a listing. NextCursor is empty on the last page, and Total
+// counts the items of all pages that match the name prefix.
+type Page struct {
+	Items      []PageItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	Total      int        `json:"total"`
+}
+
+// IDs returns the IDs of the items in page order
+func (p Page) IDs() []int {
+	ids := make([]int, len(p.Items))
+	for i, item := range p.Items {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+// listCursor is the decoded form of a cursor: the order it was issued for and the
+// last item of its page
+type listCursor struct {
+	Sort       ListSort `json:"s"`
+	Descending bool     `json:"d,omitempty"`
+	ID         int      `json:"i"`
+	Name       string   `json:"n,omitempty"`
+}
+
+// listQuery is a validated ListOptions with its decoded cursor
+type listQuery struct {
+	ListOptions
+	after *listCursor // nil for the first page
+}
+
+// newListQuery validates opts and fills in the defaults
+func newListQuery(opts ListOptions) (listQuery, error) {
+	switch {
+	case opts.Limit < 0:
+		return listQuery{}, &ListOptionsError{Field: "limit", Reason: "must not be negative"}
+	case opts.Limit == 0:
+		opts.Limit = DefaultPageSize
+	case opts.Limit > MaxPageSize:
+		opts.Limit = MaxPageSize
+	}
+	switch opts.Sort {
+	case "":
+		opts.Sort = SortByID
+	case SortByID, SortByName:
+	default:
+		return listQuery{}, &ListOptionsError{Field: "sort", Reason: "must be id or name"}
+	}
+
+	q := listQuery{ListOptions: opts}
+	if opts.Cursor == "" {
+		return q, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return listQuery{}, &ListOptionsError{Field: "cursor", Reason: "malformed"}
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return listQuery{}, &ListOptionsError{Field: "cursor", Reason: "malformed"}
+	}
+	if c.Sort != opts.Sort || c.Descending != opts.Descending {
+		return listQuery{}, &ListOptionsError{Field: "cursor", Reason: "was issued for a different order"}
+	}
+	q.after = &c
+	return q, nil
+}
+
+// cursorAfter returns the cursor of a page ending with last
+func (q listQuery) cursorAfter(last PageItem) string {
+	c := listCursor{Sort: q.Sort, Descending: q.Descending, ID: last.ID}
+	if q.Sort == SortByName {
+		c.Name = last.Name
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// less reports whether a comes before b in the order of q
+func (q listQuery) less(a, b PageItem) bool {
+	if q.Descending {
+		a, b = b, a
+	}
+	if q.Sort == SortByName && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+// page builds the page from up to Limit+1 items that follow the cursor in order;
+// the extra item only tells that there is a next page
+func (q listQuery) page(items []PageItem, total int) Page {
+	p := Page{Items: items, Total: total}
+	if len(items) > q.Limit {
+		p.Items = items[:q.Limit]
+		p.NextCursor = q.cursorAfter(p.Items[q.Limit-1])
+	}
+	if p.Items == nil {
+		p.Items = make([]PageItem, 0)
+	}
+	return p
+}
+
+// paginate returns the page of items selected by q, for stores that hold the whole
+// listing in memory
+func (q listQuery) paginate(items []PageItem) Page {
+	matching := make([]PageItem, 0, len(items))
+	for _, item := range items {
+		if strings.HasPrefix(item.Name, q.NamePrefix) {
+			matching = append(matching, item)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return q.less(matching[i], matching[j]) })
+
+	start := 0
+	if q.after != nil {
+		last := PageItem{ID: q.after.ID, Name: q.after.Name}
+		start = sort.Search(len(matching), func(i int) bool { return q.less(last, matching[i]) })
+	}
+	end := start + q.Limit + 1
+	if end > len(matching) {
+		end = len(matching)
+	}
+	return q.page(matching[start:end], len(matching))
+}
+
+// pageItems returns the items of ids with their names from names
+func pageItems(ids []int, names map[int]string) []PageItem {
+	items := make([]PageItem, 0, len(ids))
+	for _, id := range ids {
+		items = append(items, PageItem{ID: id, Name: names[id]})
+	}
+	return items
+}
+
+// mapKeys returns the IDs of names in no particular order
+func mapKeys(names map[int]string) []int {
+	ids := make([]int, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ListUsers returns a page of all users
+func (s *Server) ListUsers(ctx context.Context, opts ListOptions) (page Page, err error) {
+	ctx, c := s.begin(ctx, "ListUsers", StringAttr("prefix", opts.NamePrefix))
+	defer func() { c.end(err, IntAttr("result.count", len(page.Items))) }()
+
+	return s.listPage(ctx, opts, s.repo.ListUsers)
+}
+
+// ListUserGroups returns a page of all user groups
+func (s *Server) ListUserGroups(ctx context.Context, opts ListOptions) (page Page, err error) {
+	ctx, c := s.begin(ctx, "ListUserGroups", StringAttr("prefix", opts.NamePrefix))
+	defer func() { c.end(err, IntAttr("result.count", len(page.Items))) }()
+
+	return s.listPage(ctx, opts, s.repo.ListUserGroups)
+}
+
+// GetUsersInGroupPage returns a page of the users directly in a group
+func (s *Server) GetUsersInGroupPage(ctx context.Context, userGroupID int, opts ListOptions) (page Page, err error) {
+	ctx, c := s.begin(ctx, "GetUsersInGroupPage", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(page.Items))) }()
+
+	return s.listPage(ctx, opts, func(ctx context.Context, opts ListOptions) (Page, error) {
+		return s.repo.ListUsersInGroup(ctx, userGroupID, opts)
+	})
+}
+
+// GetUserGroupsInGroupPage returns a page of the direct child groups of a group
+func (s *Server) GetUserGroupsInGroupPage(ctx context.Context, userGroupID int, opts ListOptions) (page Page, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupsInGroupPage", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(page.Items))) }()
+
+	return s.listPage(ctx, opts, func(ctx context.Context, opts ListOptions) (Page, error) {
+		return s.repo.ListGroupsInGroup(ctx, userGroupID, opts)
+	})
+}
+
+// GetUsersInGroupTransitivePage returns a page of the users in a group and all nested subgroups
+func (s *Server) GetUsersInGroupTransitivePage(ctx context.Context, userGroupID int, opts ListOptions) (page Page, err error) {
+	ctx, c := s.begin(ctx, "GetUsersInGroupTransitivePage", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(page.Items))) }()
+
+	return s.listPage(ctx, opts, func(ctx context.Context, opts ListOptions) (Page, error) {
+		return s.repo.ListUsersInGroupTransitive(ctx, userGroupID, opts)
+	})
+}
+
+// listPage validates opts before waiting for the required revision and listing
+func (s *Server) listPage(ctx context.Context, opts ListOptions, list func(context.Context, ListOptions) (Page, error)) (Page, error) {
+	if _, err := newListQuery(opts); err != nil {
+		return Page{}, err
+	}
+	if err := s.awaitRevision(ctx); err != nil {
+		return Page{}, err
+	}
+	return list(ctx, opts)
+}
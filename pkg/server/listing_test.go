@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Listing_Options(t *testing.T) {
+	q, err := newListQuery(ListOptions{})
+	if err != nil || q.Limit != DefaultPageSize || q.Sort != SortByID {
+		t.Errorf("newListQuery({}) = %+v, %v; want the defaults", q, err)
+	}
+	if q, _ := newListQuery(ListOptions{Limit: MaxPageSize + 1}); q.Limit != MaxPageSize {
+		t.Errorf("Limit = %d, want it capped at %d", q.Limit, MaxPageSize)
+	}
+
+	// Cursors round-trip and remember the order they were issued for
+	byName := listQuery{ListOptions: ListOptions{Limit: 1, Sort: SortByName, Descending: true}}
+	cursor := byName.cursorAfter(PageItem{ID: 7, Name: "Gil"})
+	q, err = newListQuery(ListOptions{Sort: SortByName, Descending: true, Cursor: cursor})
+	if err != nil || q.after == nil || *q.after != (listCursor{Sort: SortByName, Descending: true, ID: 7, Name: "Gil"}) {
+		t.Errorf("newListQuery(cursor) = %+v, %v", q.after, err)
+	}
+
+	tests := []struct {
+		name  string
+		opts  ListOptions
+		field string
+	}{
+		{"negative limit", ListOptions{Limit: -1}, "limit"},
+		{"unknown sort", ListOptions{Sort: "created"}, "sort"},
+		{"malformed cursor", ListOptions{Cursor: "%%%"}, "cursor"},
+		{"cursor of another sort", ListOptions{Sort: SortByID, Descending: true, Cursor: cursor}, "cursor"},
+		{"cursor of another direction", ListOptions{Sort: SortByName, Cursor: cursor}, "cursor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newListQuery(tt.opts)
+			var optsErr *ListOptionsError
+			if !errors.As(err, &optsErr) || optsErr.Field != tt.field || !errors.Is(err, ErrInvalidListOptions) {
+				t.Errorf("newListQuery(%+v) = %v, want a ListOptionsError for %s", tt.opts, err, tt.field)
+			}
+		})
+	}
+}
+
+func Test_Listing_Paginate(t *testing.T) {
+	items := []PageItem{{4, "Dan"}, {1, "Cy"}, {3, "Ann"}, {2, "Cy"}, {5, "Bo"}}
+
+	q, _ := newListQuery(ListOptions{Limit: 2, Sort: SortByName})
+	var names []string
+	for {
+		page := q.paginate(items)
+		if page.Total != 5 {
+			t.Fatalf("Total = %d, want 5", page.Total)
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q, _ = newListQuery(ListOptions{Limit: 2, Sort: SortByName, Cursor: page.NextCursor})
+	}
+	if want := []string{"Ann", "Bo", "Cy", "Cy", "Dan"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+
+	// The cursor keeps its place when the item it names is removed
+	q, _ = newListQuery(ListOptions{Limit: 2})
+	page := q.paginate(items)
+	q, _ = newListQuery(ListOptions{Limit: 2, Cursor: page.NextCursor})
+	remaining := []PageItem{{4, "Dan"}, {1, "Cy"}, {3, "Ann"}, {5, "Bo"}}
+	if got := q.paginate(remaining).IDs(); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("IDs after a removal = %v, want [3 4]", got)
+	}
+
+	q, _ = newListQuery(ListOptions{NamePrefix: "Z"})
+	if page := q.paginate(items); page.Items == nil || len(page.Items) != 0 || page.Total != 0 {
+		t.Errorf("Expected an empty page, got %+v", page)
+	}
+}
+
+func Test_Listing_SQL(t *testing.T) {
+	cursor := listQuery{ListOptions: ListOptions{Sort: SortByName}}.cursorAfter(PageItem{ID: 9, Name: "Mo"})
+	q, _ := newListQuery(ListOptions{Limit: 10, Sort: SortByName, NamePrefix: "50%_off!", Cursor: cursor})
+	count, query, countArgs, queryArgs := listSQL(queryListUsersInGroup, q, []interface{}{42})
+
+	if want := []interface{}{42, "50!%!_off!!%"}; !reflect.DeepEqual(countArgs, want) {
+		t.Errorf("count arguments = %v, want %v", countArgs, want)
+	}
+	if want := []interface{}{42, "50!%!_off!!%", "Mo", 9, 11}; !reflect.DeepEqual(queryArgs, want) {
+		t.Errorf("query arguments = %v, want %v", queryArgs, want)
+	}
+	if !strings.HasPrefix(count, "SELECT COUNT(*) FROM users u") || strings.Contains(count, "ORDER BY") {
+		t.Errorf("unexpected count query: %s", count)
+	}
+	if !strings.HasSuffix(query, "ORDER BY u.name ASC, u.id ASC LIMIT $5") {
+		t.Errorf("unexpected page query: %s", query)
+	}
+
+	// MySQL repeats the cursor name for its second reference
+	mysql := bindQuery(MySQLDialect{}, query)
+	if args := mysql.args(queryArgs); !reflect.DeepEqual(args, []interface{}{42, "50!%!_off!!%", "Mo", "Mo", 9, 11}) {
+		t.Errorf("MySQL arguments = %v", args)
+	}
+
+	// The transitive row set selects its columns after the CTE
+	count, query, _, _ = listSQL(queryListUsersInGroupTransitive, q, []interface{}{42})
+	if strings.Contains(count+query, "{{columns}}") || !strings.Contains(count, "SELECT COUNT(*)\n\t\tFROM users u") {
+		t.Errorf("unexpected transitive queries: %s\n%s", count, query)
+	}
+}
+
+func Test_Listing_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	eng, _ := s.CreateUserGroup(ctx, "Engineering")
+	team, _ := s.CreateUserGroup(ctx, "Team")
+	_ = s.AddUserGroupToGroup(ctx, team, eng)
+	var users []int
+	for _, name := range []string{"Ana", "Ben", "Ada", "Cal"} {
+		id, _ := s.CreateUser(ctx, name)
+		users = append(users, id)
+	}
+	_ = s.AddUserToGroup(ctx, users[0], eng)
+	_ = s.AddUserToGroup(ctx, users[1], eng)
+	_ = s.AddUserToGroup(ctx, users[2], team)
+
+	page, err := s.ListUsers(ctx, ListOptions{NamePrefix: "A", Sort: SortByName})
+	if want := []PageItem{{users[2], "Ada"}, {users[0], "Ana"}}; err != nil || !reflect.DeepEqual(page.Items, want) || page.Total != 2 {
+		t.Errorf("ListUsers = %+v, %v; want %v", page, err, want)
+	}
+	if page, err := s.ListUserGroups(ctx, ListOptions{Limit: 1}); err != nil || page.Total != 2 || page.NextCursor == "" {
+		t.Errorf("ListUserGroups = %+v, %v; want one of two groups", page, err)
+	}
+	if page, err := s.GetUsersInGroupPage(ctx, eng, ListOptions{}); err != nil || !reflect.DeepEqual(page.IDs(), users[:2]) {
+		t.Errorf("GetUsersInGroupPage = %v, %v; want %v", page.IDs(), err, users[:2])
+	}
+	if page, err := s.GetUserGroupsInGroupPage(ctx, eng, ListOptions{}); err != nil || !reflect.DeepEqual(page.IDs(), []int{team}) {
+		t.Errorf("GetUserGroupsInGroupPage = %v, %v; want [%d]", page.IDs(), err, team)
+	}
+	if page, err := s.GetUsersInGroupTransitivePage(ctx, eng, ListOptions{Descending: true}); err != nil || !reflect.DeepEqual(page.IDs(), []int{users[2], users[1], users[0]}) {
+		t.Errorf("GetUsersInGroupTransitivePage = %v, %v", page.IDs(), err)
+	}
+
+	if _, err := s.ListUsers(ctx, ListOptions{Cursor: "bogus"}); !errors.Is(err, ErrInvalidListOptions) {
+		t.Errorf("Expected ErrInvalidListOptions, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "ListUsers"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the invalid cursor to be logged as rejected, got %v", logs.entries(t))
+	}
+}
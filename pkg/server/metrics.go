@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names
+const (
+	metricRepositoryDuration  = "permissions_repository_duration_seconds"
+	metricRepositoryErrors    = "permissions_repository_errors_total"
+	metricRepositoryChecks    = "permissions_repository_checks_total"
+	metricServerDuration      = "permissions_server_duration_seconds"
+	metricServerErrors        = "permissions_server_errors_total"
+	metricServerDecisions     = "permissions_server_decisions_total"
+	metricDBOpenConnections   = "permissions_db_open_connections"
+	metricDBInUseConnections  = "permissions_db_in_use_connections"
+	metricDBIdleConnections   = "permissions_db_idle_connections"
+	metricDBMaxOpen           = "permissions_db_max_open_connections"
+	metricDBWaitCount         = "permissions_db_wait_count_total"
+	metricDBWaitDuration      = "permissions_db_wait_duration_seconds_total"
+	metricDBMaxIdleClosed     = "permissions_db_max_idle_closed_total"
+	metricDBMaxLifetimeClosed = "permissions_db_max_lifetime_closed_total"
+	metricDBRetries           = "permissions_db_retries_total"
+)
+
+// metricHelp holds the HELP text for every metric family
+var metricHelp = map[string]string{
+	metricRepositoryDuration:  "Latency of Repository calls by method.",
+	metricRepositoryErrors:    "Repository call errors by method and error kind.",
+	metricRepositoryChecks:    "Repository permission checks by method and result.",
+	metricServerDuration:      "Latency of Server calls by method.",
+	metricServerErrors:        "Server call errors by method and error kind.",
+	metricServerDecisions:     "Server access decisions by method and decision.",
+	metricDBOpenConnections:   "Established connections, in use and idle.",
+	metricDBInUseConnections:  "Connections currently in use.",
+	metricDBIdleConnections:   "Idle connections.",
+	metricDBMaxOpen:           "Maximum number of open connections.",
+	metricDBWaitCount:         "Connections waited for.",
+	metricDBWaitDuration:      "Time spent waiting for connections.",
+	metricDBMaxIdleClosed:     "Connections closed due to the idle limit.",
+	metricDBMaxLifetimeClosed: "Connections closed due to the lifetime limit.",
+	metricDBRetries:           "Retried database operations by operation and reason.",
+}
+
+// latencyBuckets are the histogram upper bounds in seconds, from sub-millisecond
+// cache hits to multi-second recursive queries
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// errorKinds maps sentinel errors to the label used in error counters.
+// Errors matching none of them are counted as "other".
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{ErrUserNotFound, "user_not_found"},
+	{ErrUserGroupNotFound, "group_not_found"},
+	{ErrCycleDetected, "cycle_detected"},
+	{ErrHierarchyLimitExceeded, "hierarchy_limit_exceeded"},
+	{ErrNestingNotAllowed, "nesting_not_allowed"},
+	{ErrEdgeNotFound, "edge_not_found"},
+	{ErrPermissionDenied, "permission_denied"},
+	{ErrStaleRevision, "stale_revision"},
+	{ErrExternalIDConflict, "external_id_conflict"},
+	{ErrNameConflict, "name_conflict"},
+	{ErrInvalidExternalID, "invalid_external_id"},
+	{ErrInvalidGroupType, "invalid_group_type"},
+	{ErrInvalidAttribute, "invalid_attribute"},
+	{ErrAttributeNotFound, "attribute_not_found"},
+	{ErrInvalidCondition, "invalid_condition"},
+	{ErrDynamicGroup, "dynamic_group"},
+	{ErrInvalidUserStatus, "invalid_user_status"},
+	{ErrInvalidListOptions, "invalid_list_options"},
+	{ErrInvalidIdempotencyKey, "invalid_idempotency_key"},
+	{ErrIdempotencyKeyReused, "idempotency_key_reused"},
+	{context.Canceled, "canceled"},
+	{context.DeadlineExceeded, "deadline_exceeded"},
+}
+
+// errorKind returns the error counter label for err
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "other"
+}
+
+// Metrics collects counters and latency histograms and exposes them, together with
+// connection pool statistics, in the Prometheus text exposition format.
+// It is safe for concurrent use and serves the exposition as an http.Handler.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	pools    map[string]*sql.DB
+}
+
+// metricFamily holds all series of one metric name
+type metricFamily struct {
+	name   string
+	kind   string // "counter", "gauge" or "histogram"
+	series map[string]*metricSeries
+}
+
+// metricSeries is one labeled time series. Counters and gauges use value;
+// histograms use counts (per bucket, not cumulative), sum and count.
+type metricSeries struct {
+	labels string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		families: make(map[string]*metricFamily),
+		pools:    make(map[string]*sql.DB),
+	}
+}
+
+// RegisterDB exposes the connection pool statistics of db under the given pool label
+func (m *Metrics) RegisterDB(pool string, db *sql.DB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pools[pool] = db
+}
+
+// inc adds one to a counter
+func (m *Metrics) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// add adds delta to a counter
+func (m *Metrics) add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesLocked(name, "counter", labels).value += delta
+}
+
+// observe records a latency in a histogram
+func (m *Metrics) observe(name string, d time.Duration, labels ...string) {
+	seconds := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesLocked(name, "histogram", labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(latencyBuckets))
+	}
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		s.counts[i]++
+	}
+	s.sum += seconds
+	s.count++
+}
+
+// seriesLocked returns the series for name and labels, creating it if needed
+func (m *Metrics) seriesLocked(name, kind string, labels []string) *metricSeries {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, kind: kind, series: make(map[string]*metricSeries)}
+		m.families[name] = f
+	}
+	key := formatLabels(labels...)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f.snapshot())
+	}
+	families = append(families, m.poolFamiliesLocked()...)
+	m.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics for a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// poolFamiliesLocked reads sql.DB.Stats for every registered pool
+func (m *Metrics) poolFamiliesLocked() []*metricFamily {
+	if len(m.pools) == 0 {
+		return nil
+	}
+
+	gauge := func(name string) *metricFamily {
+		return &metricFamily{name: name, kind: "gauge", series: make(map[string]*metricSeries)}
+	}
+	counter := func(name string) *metricFamily {
+		return &metricFamily{name: name, kind: "counter", series: make(map[string]*metricSeries)}
+	}
+	families := []*metricFamily{
+		gauge(metricDBOpenConnections),
+		gauge(metricDBInUseConnections),
+		gauge(metricDBIdleConnections),
+		gauge(metricDBMaxOpen),
+		counter(metricDBWaitCount),
+		counter(metricDBWaitDuration),
+		counter(metricDBMaxIdleClosed),
+		counter(metricDBMaxLifetimeClosed),
+	}
+
+	for pool, db := range m.pools {
+		stats := db.Stats()
+		labels := formatLabels("pool", pool)
+		values := []float64{
+			float64(stats.OpenConnections),
+			float64(stats.InUse),
+			float64(stats.Idle),
+			float64(stats.MaxOpenConnections),
+			float64(stats.WaitCount),
+			stats.WaitDuration.Seconds(),
+			float64(stats.MaxIdleClosed),
+			float64(stats.MaxLifetimeClosed),
+		}
+		for i, f := range families {
+			f.series[labels] = &metricSeries{labels: labels, value: values[i]}
+		}
+	}
+	return families
+}
+
+// snapshot copies the family so it can be written without holding the registry lock
+func (f *metricFamily) snapshot() *metricFamily {
+	c := &metricFamily{name: f.name, kind: f.kind, series: make(map[string]*metricSeries, len(f.series))}
+	for key, s := range f.series {
+		copied := *s
+		copied.counts = append([]uint64(nil), s.counts...)
+		c.series[key] = &copied
+	}
+	return c
+}
+
+// write renders the family in the text exposition format
+func (f *metricFamily) write(w *bufio.Writer) {
+	if help, ok := metricHelp[f.name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, braces(s.labels), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, formatLabels("le", formatFloat(bound)))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, braces(s.labels), s.count)
+	}
+}
+
+// formatLabels renders name/value pairs as name="value",... with escaped values
+func formatLabels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+escapeLabelValue(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsRepository is a Repository decorator that records per-method latency,
+// errors by kind and the outcome of permission checks
+type MetricsRepository struct {
+	Repository
+	metrics *Metrics
+}
+
+// NewMetricsRepository wraps repo so that every call is recorded in metrics
+func NewMetricsRepository(repo Repository, metrics *Metrics) *MetricsRepository {
+	return &MetricsRepository{Repository: repo, metrics: metrics}
+}
+
+// record observes the latency and, on failure, the error kind of one call
+func (r *MetricsRepository) record(method string, start time.Time, err error) {
+	r.metrics.observe(metricRepositoryDuration, time.Since(start), "method", method)
+	if err != nil {
+		r.metrics.inc(metricRepositoryErrors, "method", method, "error", errorKind(err))
+	}
+}
+
+// recordCheck records a permission check and its result
+func (r *MetricsRepository) recordCheck(method string, start time.Time, allowed bool, err error) {
+	r.record(method, start, err)
+	if err != nil {
+		return
+	}
+	result := "deny"
+	if allowed {
+		result = "allow"
+	}
+	r.metrics.inc(metricRepositoryChecks, "method", method, "result", result)
+}
+
+// CreateUser records the call and delegates to the wrapped repository
+func (r *MetricsRepository) CreateUser(ctx context.Context, name string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.CreateUser(ctx, name)
+	r.record("CreateUser", start, err)
+	return id, err
+}
+
+// GetUserByID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserByID(ctx context.Context, userID int) (string, error) {
+	start := time.Now()
+	name, err := r.Repository.GetUserByID(ctx, userID)
+	r.record("GetUserByID", start, err)
+	return name, err
+}
+
+// CreateUserGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) CreateUserGroup(ctx context.Context, name string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.CreateUserGroup(ctx, name)
+	r.record("CreateUserGroup", start, err)
+	return id, err
+}
+
+// GetUserGroupByID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserGroupByID(ctx context.Context, groupID int) (string, error) {
+	start := time.Now()
+	name, err := r.Repository.GetUserGroupByID(ctx, groupID)
+	r.record("GetUserGroupByID", start, err)
+	return name, err
+}
+
+// CreateUserWithExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) CreateUserWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.CreateUserWithExternalID(ctx, name, externalID)
+	r.record("CreateUserWithExternalID", start, err)
+	return id, err
+}
+
+// CreateUserGroupWithExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.CreateUserGroupWithExternalID(ctx, name, externalID)
+	r.record("CreateUserGroupWithExternalID", start, err)
+	return id, err
+}
+
+// SetUserExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetUserExternalID(ctx context.Context, userID int, externalID string) error {
+	start := time.Now()
+	err := r.Repository.SetUserExternalID(ctx, userID, externalID)
+	r.record("SetUserExternalID", start, err)
+	return err
+}
+
+// SetUserGroupExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetUserGroupExternalID(ctx context.Context, groupID int, externalID string) error {
+	start := time.Now()
+	err := r.Repository.SetUserGroupExternalID(ctx, groupID, externalID)
+	r.record("SetUserGroupExternalID", start, err)
+	return err
+}
+
+// GetUserByExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserByExternalID(ctx context.Context, externalID string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.GetUserByExternalID(ctx, externalID)
+	r.record("GetUserByExternalID", start, err)
+	return id, err
+}
+
+// GetUserGroupByExternalID records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserGroupByExternalID(ctx context.Context, externalID string) (int, error) {
+	start := time.Now()
+	id, err := r.Repository.GetUserGroupByExternalID(ctx, externalID)
+	r.record("GetUserGroupByExternalID", start, err)
+	return id, err
+}
+
+// FindUsersByName records the call and delegates to the wrapped repository
+func (r *MetricsRepository) FindUsersByName(ctx context.Context, name string) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.FindUsersByName(ctx, name)
+	r.record("FindUsersByName", start, err)
+	return ids, err
+}
+
+// FindUserGroupsByName records the call and delegates to the wrapped repository
+func (r *MetricsRepository) FindUserGroupsByName(ctx context.Context, name string) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.FindUserGroupsByName(ctx, name)
+	r.record("FindUserGroupsByName", start, err)
+	return ids, err
+}
+
+// SetAttribute records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.SetAttribute(ctx, subjectType, subjectID, name, value)
+	r.record("SetAttribute", start, err)
+	return rev, err
+}
+
+// GetAttributes records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetAttributes(ctx context.Context, subjectType string, subjectID int) (Attributes, error) {
+	start := time.Now()
+	attrs, err := r.Repository.GetAttributes(ctx, subjectType, subjectID)
+	r.record("GetAttributes", start, err)
+	return attrs, err
+}
+
+// ListUsers records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListUsers(ctx context.Context, opts ListOptions) (Page, error) {
+	start := time.Now()
+	page, err := r.Repository.ListUsers(ctx, opts)
+	r.record("ListUsers", start, err)
+	return page, err
+}
+
+// ListUserGroups records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListUserGroups(ctx context.Context, opts ListOptions) (Page, error) {
+	start := time.Now()
+	page, err := r.Repository.ListUserGroups(ctx, opts)
+	r.record("ListUserGroups", start, err)
+	return page, err
+}
+
+// ListUsersInGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListUsersInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	start := time.Now()
+	page, err := r.Repository.ListUsersInGroup(ctx, groupID, opts)
+	r.record("ListUsersInGroup", start, err)
+	return page, err
+}
+
+// ListGroupsInGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListGroupsInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	start := time.Now()
+	page, err := r.Repository.ListGroupsInGroup(ctx, groupID, opts)
+	r.record("ListGroupsInGroup", start, err)
+	return page, err
+}
+
+// ListUsersInGroupTransitive records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListUsersInGroupTransitive(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	start := time.Now()
+	page, err := r.Repository.ListUsersInGroupTransitive(ctx, groupID, opts)
+	r.record("ListUsersInGroupTransitive", start, err)
+	return page, err
+}
+
+// SetUserStatus records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.SetUserStatus(ctx, userID, status)
+	r.record("SetUserStatus", start, err)
+	return rev, err
+}
+
+// GetUserStatus records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserStatus(ctx context.Context, userID int) (UserStatus, error) {
+	start := time.Now()
+	status, err := r.Repository.GetUserStatus(ctx, userID)
+	r.record("GetUserStatus", start, err)
+	return status, err
+}
+
+// GetUserStatuses records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUserStatuses(ctx context.Context, userIDs []int) (map[int]UserStatus, error) {
+	start := time.Now()
+	statuses, err := r.Repository.GetUserStatuses(ctx, userIDs)
+	r.record("GetUserStatuses", start, err)
+	return statuses, err
+}
+
+// SetGroupRule records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetGroupRule(ctx context.Context, groupID int, rule string) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.SetGroupRule(ctx, groupID, rule)
+	r.record("SetGroupRule", start, err)
+	return rev, err
+}
+
+// GetGroupRule records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupRule(ctx context.Context, groupID int) (string, error) {
+	start := time.Now()
+	rule, err := r.Repository.GetGroupRule(ctx, groupID)
+	r.record("GetGroupRule", start, err)
+	return rule, err
+}
+
+// AddUserToGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) AddUserToGroup(ctx context.Context, userID, groupID int) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.AddUserToGroup(ctx, userID, groupID)
+	r.record("AddUserToGroup", start, err)
+	return rev, err
+}
+
+// GetUsersInGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUsersInGroup(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetUsersInGroup(ctx, groupID)
+	r.record("GetUsersInGroup", start, err)
+	return ids, err
+}
+
+// GetUsersInGroupTransitive records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetUsersInGroupTransitive(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetUsersInGroupTransitive(ctx, groupID)
+	r.record("GetUsersInGroupTransitive", start, err)
+	return ids, err
+}
+
+// GetGroupsForUser records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupsForUser(ctx context.Context, userID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetGroupsForUser(ctx, userID)
+	r.record("GetGroupsForUser", start, err)
+	return ids, err
+}
+
+// GetGroupsForUserTransitive records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupsForUserTransitive(ctx context.Context, userID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetGroupsForUserTransitive(ctx, userID)
+	r.record("GetGroupsForUserTransitive", start, err)
+	return ids, err
+}
+
+// AddGroupToGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) AddGroupToGroup(ctx context.Context, childID, parentID int) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.AddGroupToGroup(ctx, childID, parentID)
+	r.record("AddGroupToGroup", start, err)
+	return rev, err
+}
+
+// MoveGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.MoveGroup(ctx, childID, fromParentID, toParentID)
+	r.record("MoveGroup", start, err)
+	return rev, err
+}
+
+// GetGroupsInGroup records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupsInGroup(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetGroupsInGroup(ctx, groupID)
+	r.record("GetGroupsInGroup", start, err)
+	return ids, err
+}
+
+// GetParentGroups records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetParentGroups(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetParentGroups(ctx, groupID)
+	r.record("GetParentGroups", start, err)
+	return ids, err
+}
+
+// GetAncestorGroups records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetAncestorGroups(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetAncestorGroups(ctx, groupID)
+	r.record("GetAncestorGroups", start, err)
+	return ids, err
+}
+
+// GetDescendantGroups records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetDescendantGroups(ctx context.Context, groupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := r.Repository.GetDescendantGroups(ctx, groupID)
+	r.record("GetDescendantGroups", start, err)
+	return ids, err
+}
+
+// GetAncestorEdges records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetAncestorEdges(ctx context.Context, subjectType string, subjectID int) ([]GroupEdge, error) {
+	start := time.Now()
+	edges, err := r.Repository.GetAncestorEdges(ctx, subjectType, subjectID)
+	r.record("GetAncestorEdges", start, err)
+	return edges, err
+}
+
+// GetGroupSubtree records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupSubtree(ctx context.Context, groupID int) (*GroupSubtree, error) {
+	start := time.Now()
+	subtree, err := r.Repository.GetGroupSubtree(ctx, groupID)
+	r.record("GetGroupSubtree", start, err)
+	return subtree, err
+}
+
+// GetHierarchyViolations records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetHierarchyViolations(ctx context.Context, limits HierarchyLimits) ([]HierarchyViolation, error) {
+	start := time.Now()
+	violations, err := r.Repository.GetHierarchyViolations(ctx, limits)
+	r.record("GetHierarchyViolations", start, err)
+	return violations, err
+}
+
+// SetGroupType records the call and delegates to the wrapped repository
+func (r *MetricsRepository) SetGroupType(ctx context.Context, groupID int, groupType string) error {
+	start := time.Now()
+	err := r.Repository.SetGroupType(ctx, groupID, groupType)
+	r.record("SetGroupType", start, err)
+	return err
+}
+
+// GetGroupType records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetGroupType(ctx context.Context, groupID int) (string, error) {
+	start := time.Now()
+	groupType, err := r.Repository.GetGroupType(ctx, groupID)
+	r.record("GetGroupType", start, err)
+	return groupType, err
+}
+
+// GetNestingViolations records the call and delegates to the wrapped repository
+func (r *MetricsRepository) GetNestingViolations(ctx context.Context, policy NestingPolicy) ([]NestingViolation, error) {
+	start := time.Now()
+	violations, err := r.Repository.GetNestingViolations(ctx, policy)
+	r.record("GetNestingViolations", start, err)
+	return violations, err
+}
+
+// WouldCreateCycle records the call and delegates to the wrapped repository
+func (r *MetricsRepository) WouldCreateCycle(ctx context.Context, childID, parentID int) (bool, error) {
+	start := time.Now()
+	cycle, err := r.Repository.WouldCreateCycle(ctx, childID, parentID)
+	r.record("WouldCreateCycle", start, err)
+	return cycle, err
+}
+
+// AddPermission records the call and delegates to the wrapped repository
+func (r *MetricsRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.AddPermission(ctx, sourceType, targetType, sourceID, targetID)
+	r.record("AddPermission", start, err)
+	return rev, err
+}
+
+// AddConditionalPermission records the call and delegates to the wrapped repository
+func (r *MetricsRepository) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.AddConditionalPermission(ctx, sourceType, targetType, sourceID, targetID, condition)
+	r.record("AddConditionalPermission", start, err)
+	return rev, err
+}
+
+// HasUserPermissionOnUser records the check and its result
+func (r *MetricsRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	start := time.Now()
+	allowed, err := r.Repository.HasUserPermissionOnUser(ctx, sourceUserID, targetUserID)
+	r.recordCheck("HasUserPermissionOnUser", start, allowed, err)
+	return allowed, err
+}
+
+// HasUserPermissionOnGroup records the check and its result
+func (r *MetricsRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	start := time.Now()
+	allowed, err := r.Repository.HasUserPermissionOnGroup(ctx, sourceUserID, targetGroupID)
+	r.recordCheck("HasUserPermissionOnGroup", start, allowed, err)
+	return allowed, err
+}
+
+// CurrentRevision records the call and delegates to the wrapped repository
+func (r *MetricsRepository) CurrentRevision(ctx context.Context) (Revision, error) {
+	start := time.Now()
+	rev, err := r.Repository.CurrentRevision(ctx)
+	r.record("CurrentRevision", start, err)
+	return rev, err
+}
+
+// ListChanges records the call and delegates to the wrapped repository
+func (r *MetricsRepository) ListChanges(ctx context.Context, afterRevision Revision, limit int) ([]ChangeEvent, error) {
+	start := time.Now()
+	events, err := r.Repository.ListChanges(ctx, afterRevision, limit)
+	r.record("ListChanges", start, err)
+	return events, err
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// enforce interface compliance
+var _ Stage5 = (*MetricsServer)(nil)
+
+// MetricsServer is a Stage5 decorator that records per-method latency, errors by
+// kind and allow/deny decisions of the permission-checked reads. A denied access
+// is counted as a decision, not as an error.
+type MetricsServer struct {
+	inner   Stage5
+	metrics *Metrics
+}
+
+// NewMetricsServer wraps inner so that every call is recorded in metrics
+func NewMetricsServer(inner Stage5, metrics *Metrics) *MetricsServer {
+	return &MetricsServer{inner: inner, metrics: metrics}
+}
+
+// record observes the latency and, on failure, the error kind of one call
+func (s *MetricsServer) record(method string, start time.Time, err error) {
+	s.metrics.observe(metricServerDuration, time.Since(start), "method", method)
+	if err != nil {
+		s.metrics.inc(metricServerErrors, "method", method, "error", errorKind(err))
+	}
+}
+
+// recordDecision records a permission-checked read, splitting denials from failures
+func (s *MetricsServer) recordDecision(method string, start time.Time, err error) {
+	s.metrics.observe(metricServerDuration, time.Since(start), "method", method)
+	switch {
+	case err == nil:
+		s.metrics.inc(metricServerDecisions, "method", method, "decision", "allow")
+	case errors.Is(err, ErrPermissionDenied):
+		s.metrics.inc(metricServerDecisions, "method", method, "decision", "deny")
+	default:
+		s.metrics.inc(metricServerErrors, "method", method, "error", errorKind(err))
+	}
+}
+
+// CreateUser records the call and delegates to the wrapped server
+func (s *MetricsServer) CreateUser(ctx context.Context, name string) (int, error) {
+	start := time.Now()
+	id, err := s.inner.CreateUser(ctx, name)
+	s.record("CreateUser", start, err)
+	return id, err
+}
+
+// GetUserName records the call and delegates to the wrapped server
+func (s *MetricsServer) GetUserName(ctx context.Context, userID int) (string, error) {
+	start := time.Now()
+	name, err := s.inner.GetUserName(ctx, userID)
+	s.record("GetUserName", start, err)
+	return name, err
+}
+
+// CreateUserGroup records the call and delegates to the wrapped server
+func (s *MetricsServer) CreateUserGroup(ctx context.Context, name string) (int, error) {
+	start := time.Now()
+	id, err := s.inner.CreateUserGroup(ctx, name)
+	s.record("CreateUserGroup", start, err)
+	return id, err
+}
+
+// GetUserGroupName records the call and delegates to the wrapped server
+func (s *MetricsServer) GetUserGroupName(ctx context.Context, userGroupID int) (string, error) {
+	start := time.Now()
+	name, err := s.inner.GetUserGroupName(ctx, userGroupID)
+	s.record("GetUserGroupName", start, err)
+	return name, err
+}
+
+// AddUserToGroup records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserToGroup(ctx context.Context, userID, userGroupID int) error {
+	start := time.Now()
+	err := s.inner.AddUserToGroup(ctx, userID, userGroupID)
+	s.record("AddUserToGroup", start, err)
+	return err
+}
+
+// GetUsersInGroup records the call and delegates to the wrapped server
+func (s *MetricsServer) GetUsersInGroup(ctx context.Context, userGroupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := s.inner.GetUsersInGroup(ctx, userGroupID)
+	s.record("GetUsersInGroup", start, err)
+	return ids, err
+}
+
+// AddUserGroupToGroup records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserGroupToGroup(ctx context.Context, childUserGroupID, parentUserGroupID int) error {
+	start := time.Now()
+	err := s.inner.AddUserGroupToGroup(ctx, childUserGroupID, parentUserGroupID)
+	s.record("AddUserGroupToGroup", start, err)
+	return err
+}
+
+// GetUserGroupsInGroup records the call and delegates to the wrapped server
+func (s *MetricsServer) GetUserGroupsInGroup(ctx context.Context, userGroupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := s.inner.GetUserGroupsInGroup(ctx, userGroupID)
+	s.record("GetUserGroupsInGroup", start, err)
+	return ids, err
+}
+
+// GetUsersInGroupTransitive records the call and delegates to the wrapped server
+func (s *MetricsServer) GetUsersInGroupTransitive(ctx context.Context, userGroupID int) ([]int, error) {
+	start := time.Now()
+	ids, err := s.inner.GetUsersInGroupTransitive(ctx, userGroupID)
+	s.record("GetUsersInGroupTransitive", start, err)
+	return ids, err
+}
+
+// AddUserToUserPermission records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserToUserPermission(ctx context.Context, sourceUserID, targetUserID int) error {
+	start := time.Now()
+	err := s.inner.AddUserToUserPermission(ctx, sourceUserID, targetUserID)
+	s.record("AddUserToUserPermission", start, err)
+	return err
+}
+
+// AddUserToUserGroupPermission records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserToUserGroupPermission(ctx context.Context, sourceUserID, targetUserGroupID int) error {
+	start := time.Now()
+	err := s.inner.AddUserToUserGroupPermission(ctx, sourceUserID, targetUserGroupID)
+	s.record("AddUserToUserGroupPermission", start, err)
+	return err
+}
+
+// AddUserGroupToUserPermission records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserGroupToUserPermission(ctx context.Context, sourceUserGroupID, targetUserID int) error {
+	start := time.Now()
+	err := s.inner.AddUserGroupToUserPermission(ctx, sourceUserGroupID, targetUserID)
+	s.record("AddUserGroupToUserPermission", start, err)
+	return err
+}
+
+// AddUserGroupToUserGroupPermission records the call and delegates to the wrapped server
+func (s *MetricsServer) AddUserGroupToUserGroupPermission(ctx context.Context, sourceUserGroupID, targetUserGroupID int) error {
+	start := time.Now()
+	err := s.inner.AddUserGroupToUserGroupPermission(ctx, sourceUserGroupID, targetUserGroupID)
+	s.record("AddUserGroupToUserGroupPermission", start, err)
+	return err
+}
+
+// GetUserNameWithPermissionCheck records the access decision and delegates to the wrapped server
+func (s *MetricsServer) GetUserNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserID int) (string, error) {
+	start := time.Now()
+	name, err := s.inner.GetUserNameWithPermissionCheck(ctx, contextUserID, targetUserID)
+	s.recordDecision("GetUserNameWithPermissionCheck", start, err)
+	return name, err
+}
+
+// GetUserGroupNameWithPermissionCheck records the access decision and delegates to the wrapped server
+func (s *MetricsServer) GetUserGroupNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserGroupID int) (string, error) {
+	start := time.Now()
+	name, err := s.inner.GetUserGroupNameWithPermissionCheck(ctx, contextUserID, targetUserGroupID)
+	s.recordDecision("GetUserGroupNameWithPermissionCheck", start, err)
+	return name, err
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the exposition served by metrics
+func scrape(t *testing.T, metrics *Metrics) string {
+	t.Helper()
+
+	httpServer := httptest.NewServer(metrics)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// assertLines fails for every expected line missing from the exposition
+func assertLines(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("Expected line %q in exposition:\n%s", line, exposition)
+		}
+	}
+}
+
+func Test_Metrics_Exposition(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.observe(metricRepositoryDuration, 3*time.Millisecond, "method", "GetUserByID")
+	metrics.observe(metricRepositoryDuration, 20*time.Millisecond, "method", "GetUserByID")
+	metrics.observe(metricRepositoryDuration, 30*time.Second, "method", "GetUserByID")
+	metrics.inc(metricRepositoryErrors, "method", "GetUserByID", "error", `odd "kind"`)
+
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+
+	assertLines(t, buf.String(),
+		"# TYPE permissions_repository_duration_seconds histogram",
+		`permissions_repository_duration_seconds_bucket{method="GetUserByID",le="0.0025"} 0`,
+		`permissions_repository_duration_seconds_bucket{method="GetUserByID",le="0.005"} 1`,
+		`permissions_repository_duration_seconds_bucket{method="GetUserByID",le="0.025"} 2`,
+		`permissions_repository_duration_seconds_bucket{method="GetUserByID",le="10"} 2`,
+		`permissions_repository_duration_seconds_bucket{method="GetUserByID",le="+Inf"} 3`,
+		`permissions_repository_duration_seconds_count{method="GetUserByID"} 3`,
+		"# TYPE permissions_repository_errors_total counter",
+		`permissions_repository_errors_total{method="GetUserByID",error="odd \"kind\""} 1`,
+	)
+}
+
+func Test_Metrics_RepositoryAndServerDecorators(t *testing.T) {
+	metrics := NewMetrics()
+	s := NewMetricsServer(New(NewMetricsRepository(newFakeRepository(), metrics)), metrics)
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	parent, _ := s.CreateUserGroup(ctx, "Parent")
+	child, _ := s.CreateUserGroup(ctx, "Child")
+	_ = s.AddUserGroupToGroup(ctx, child, parent)
+	_ = s.AddUserToUserPermission(ctx, alice, bob)
+
+	if err := s.AddUserGroupToGroup(ctx, parent, child); err == nil {
+		t.Fatal("Expected cycle error")
+	}
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil {
+		t.Fatalf("Expected access, got %v", err)
+	}
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, bob, alice); err == nil {
+		t.Fatal("Expected permission denied")
+	}
+	if _, err := s.GetUserName(ctx, 999); err == nil {
+		t.Fatal("Expected user not found")
+	}
+
+	exposition := scrape(t, metrics)
+	assertLines(t, exposition,
+		`permissions_repository_checks_total{method="HasUserPermissionOnUser",result="allow"} 1`,
+		`permissions_repository_checks_total{method="HasUserPermissionOnUser",result="deny"} 1`,
+		`permissions_repository_errors_total{method="AddGroupToGroup",error="cycle_detected"} 1`,
+		`permissions_repository_errors_total{method="GetUserByID",error="user_not_found"} 1`,
+		`permissions_repository_duration_seconds_count{method="CreateUser"} 2`,
+		`permissions_server_decisions_total{method="GetUserNameWithPermissionCheck",decision="allow"} 1`,
+		`permissions_server_decisions_total{method="GetUserNameWithPermissionCheck",decision="deny"} 1`,
+		`permissions_server_errors_total{method="AddUserGroupToGroup",error="cycle_detected"} 1`,
+		`permissions_server_errors_total{method="GetUserName",error="user_not_found"} 1`,
+		`permissions_server_duration_seconds_count{method="GetUserNameWithPermissionCheck"} 2`,
+	)
+	if strings.Contains(exposition, `error="permission_denied"`) {
+		t.Error("Denied access must be counted as a decision, not as an error")
+	}
+}
+
+func Test_Metrics_DatabasePoolStats(t *testing.T) {
+	config := DefaultConfig()
+	db, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	metrics := NewMetrics()
+	metrics.RegisterDB("primary", db)
+
+	exposition := scrape(t, metrics)
+	assertLines(t, exposition,
+		"# TYPE permissions_db_open_connections gauge",
+		`permissions_db_max_open_connections{pool="primary"} 25`,
+		"# TYPE permissions_db_wait_count_total counter",
+	)
+}
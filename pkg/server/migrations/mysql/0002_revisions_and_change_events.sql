@@ -0,0 +1,17 @@
+-- Revisions table (one row per committed mutation, used as consistency token)
+CREATE TABLE IF NOT EXISTS revisions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Change events table (transactional outbox, written in the same transaction as each mutation)
+CREATE TABLE IF NOT EXISTS change_events (
+    revision BIGINT PRIMARY KEY,
+    event_type VARCHAR(32) NOT NULL,
+    subject_type ENUM('user', 'group') NOT NULL,
+    subject_id INT NOT NULL,
+    object_type ENUM('user', 'group') NOT NULL,
+    object_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (revision) REFERENCES revisions(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
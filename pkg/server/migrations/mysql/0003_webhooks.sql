@@ -0,0 +1,46 @@
+-- Webhook subscriptions (filters are comma-separated lists, empty matches everything)
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(255) NOT NULL DEFAULT '',
+    group_ids VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook deliveries (one row per change event and matching subscription)
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    revision BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    status ENUM('pending', 'succeeded', 'dead_lettered') NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(3) NOT NULL,
+    last_error VARCHAR(1024) NOT NULL DEFAULT '',
+    last_status_code INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_subscription_revision (subscription_id, revision),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    INDEX idx_status_next_attempt (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook dead letters (deliveries that exhausted their attempts)
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    delivery_id INT PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    revision BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error VARCHAR(1024) NOT NULL,
+    last_status_code INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Webhook dispatcher cursor (single row, last change event revision processed)
+CREATE TABLE IF NOT EXISTS webhook_cursor (
+    id TINYINT PRIMARY KEY,
+    revision BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,10 @@
+-- Idempotency keys (remembered creates, so a retried create returns the original ID)
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    operation VARCHAR(32) NOT NULL,
+    request_name VARCHAR(255) NOT NULL,
+    resource_id INT NOT NULL DEFAULT 0,
+    expires_at DATETIME(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,16 @@
+-- External IDs (the optional ID in an identity provider) and name lookup. unique_name
+-- is set to name only while unique names are enforced. Unique keys allow any number
+-- of NULLs.
+ALTER TABLE users
+    ADD COLUMN external_id VARCHAR(255) NULL,
+    ADD COLUMN unique_name VARCHAR(255) NULL,
+    ADD UNIQUE KEY uq_external_id (external_id),
+    ADD UNIQUE KEY uq_unique_name (unique_name),
+    ADD INDEX idx_name (name);
+
+ALTER TABLE user_groups
+    ADD COLUMN external_id VARCHAR(255) NULL,
+    ADD COLUMN unique_name VARCHAR(255) NULL,
+    ADD UNIQUE KEY uq_external_id (external_id),
+    ADD UNIQUE KEY uq_unique_name (unique_name),
+    ADD INDEX idx_name (name);
@@ -0,0 +1,2 @@
+-- Conditions on permission grants (NULL for unconditional grants)
+ALTER TABLE permissions ADD COLUMN condition_expr TEXT NULL;
@@ -0,0 +1,3 @@
+-- Lifecycle status of users and the new status of user_status_changed events
+ALTER TABLE users ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active';
+ALTER TABLE change_events ADD COLUMN user_status VARCHAR(32) NULL;
@@ -0,0 +1,4 @@
+-- Named transaction-scoped locks, one row per lock, see MySQLDialect.LockQuery
+CREATE TABLE IF NOT EXISTS locks (
+    name VARCHAR(64) PRIMARY KEY
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
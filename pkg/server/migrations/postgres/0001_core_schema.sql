@@ -0,0 +1,43 @@
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- User groups table
+CREATE TABLE IF NOT EXISTS user_groups (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- User to group membership (direct membership only)
+CREATE TABLE IF NOT EXISTS user_group_members (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_group_id INT NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, user_group_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_group_members_group ON user_group_members (user_group_id);
+
+-- User group hierarchy (groups within groups)
+CREATE TABLE IF NOT EXISTS user_group_hierarchy (
+    child_group_id INT NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    parent_group_id INT NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (child_group_id, parent_group_id),
+    CHECK (child_group_id <> parent_group_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_group_hierarchy_parent ON user_group_hierarchy (parent_group_id);
+
+-- Permissions table (CHECK constraints take the place of MySQL ENUM columns)
+CREATE TABLE IF NOT EXISTS permissions (
+    source_type VARCHAR(8) NOT NULL CHECK (source_type IN ('user', 'group')),
+    source_id INT NOT NULL,
+    target_type VARCHAR(8) NOT NULL CHECK (target_type IN ('user', 'group')),
+    target_id INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (source_type, source_id, target_type, target_id)
+);
+CREATE INDEX IF NOT EXISTS idx_permissions_target ON permissions (target_type, target_id);
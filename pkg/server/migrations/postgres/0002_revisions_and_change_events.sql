@@ -0,0 +1,16 @@
+-- Revisions table (one row per committed mutation, used as consistency token)
+CREATE TABLE IF NOT EXISTS revisions (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Change events table (transactional outbox, written in the same transaction as each mutation)
+CREATE TABLE IF NOT EXISTS change_events (
+    revision BIGINT PRIMARY KEY REFERENCES revisions(id),
+    event_type VARCHAR(32) NOT NULL,
+    subject_type VARCHAR(8) NOT NULL CHECK (subject_type IN ('user', 'group')),
+    subject_id INT NOT NULL,
+    object_type VARCHAR(8) NOT NULL CHECK (object_type IN ('user', 'group')),
+    object_id INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
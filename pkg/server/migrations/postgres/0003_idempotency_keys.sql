@@ -0,0 +1,10 @@
+-- Idempotency keys (remembered creates, so a retried create returns the original ID)
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    operation VARCHAR(32) NOT NULL,
+    request_name VARCHAR(255) NOT NULL,
+    resource_id INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
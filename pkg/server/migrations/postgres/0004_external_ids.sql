@@ -0,0 +1,14 @@
+-- External IDs (the optional ID in an identity provider) and name lookup. unique_name
+-- is set to name only while unique names are enforced. Unique indexes allow any
+-- number of NULLs.
+ALTER TABLE users ADD COLUMN external_id VARCHAR(255);
+ALTER TABLE users ADD COLUMN unique_name VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS uq_users_external_id ON users (external_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uq_users_unique_name ON users (unique_name);
+CREATE INDEX IF NOT EXISTS idx_users_name ON users (name);
+
+ALTER TABLE user_groups ADD COLUMN external_id VARCHAR(255);
+ALTER TABLE user_groups ADD COLUMN unique_name VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS uq_user_groups_external_id ON user_groups (external_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uq_user_groups_unique_name ON user_groups (unique_name);
+CREATE INDEX IF NOT EXISTS idx_user_groups_name ON user_groups (name);
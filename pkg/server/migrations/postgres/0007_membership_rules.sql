@@ -0,0 +1,2 @@
+-- Membership rules of dynamic groups (NULL for static groups)
+ALTER TABLE user_groups ADD COLUMN membership_rule TEXT;
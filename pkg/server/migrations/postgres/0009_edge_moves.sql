@@ -0,0 +1,2 @@
+-- Previous parent group of edge_moved events
+ALTER TABLE change_events ADD COLUMN previous_object_id INT;
@@ -0,0 +1,61 @@
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- User groups table
+CREATE TABLE IF NOT EXISTS user_groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- User to group membership (direct membership only)
+CREATE TABLE IF NOT EXISTS user_group_members (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, user_group_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_group_members_group ON user_group_members (user_group_id);
+
+-- User group hierarchy (groups within groups)
+CREATE TABLE IF NOT EXISTS user_group_hierarchy (
+    child_group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    parent_group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (child_group_id, parent_group_id),
+    CHECK (child_group_id <> parent_group_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_group_hierarchy_parent ON user_group_hierarchy (parent_group_id);
+
+-- Permissions table (CHECK constraints take the place of MySQL ENUM columns)
+CREATE TABLE IF NOT EXISTS permissions (
+    source_type VARCHAR(8) NOT NULL CHECK (source_type IN ('user', 'group')),
+    source_id INTEGER NOT NULL,
+    target_type VARCHAR(8) NOT NULL CHECK (target_type IN ('user', 'group')),
+    target_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (source_type, source_id, target_type, target_id)
+);
+CREATE INDEX IF NOT EXISTS idx_permissions_target ON permissions (target_type, target_id);
+
+-- Revisions table (one row per committed mutation, used as consistency token).
+-- AUTOINCREMENT keeps revision IDs from being reused after the newest row is deleted.
+CREATE TABLE IF NOT EXISTS revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Change events table (transactional outbox, written in the same transaction as each mutation)
+CREATE TABLE IF NOT EXISTS change_events (
+    revision INTEGER PRIMARY KEY REFERENCES revisions(id),
+    event_type VARCHAR(32) NOT NULL,
+    subject_type VARCHAR(8) NOT NULL CHECK (subject_type IN ('user', 'group')),
+    subject_id INTEGER NOT NULL,
+    object_type VARCHAR(8) NOT NULL CHECK (object_type IN ('user', 'group')),
+    object_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,10 @@
+-- Attributes of users and groups (attr_value is JSON-encoded according to value_type)
+CREATE TABLE IF NOT EXISTS attributes (
+    subject_type VARCHAR(8) NOT NULL CHECK (subject_type IN ('user', 'group')),
+    subject_id INTEGER NOT NULL,
+    attr_name VARCHAR(255) NOT NULL,
+    value_type VARCHAR(8) NOT NULL,
+    attr_value TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (subject_type, subject_id, attr_name)
+);
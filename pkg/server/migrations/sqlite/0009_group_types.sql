@@ -0,0 +1,2 @@
+-- Types of groups for the nesting policy (NULL for groups without a type)
+ALTER TABLE user_groups ADD COLUMN group_type TEXT;
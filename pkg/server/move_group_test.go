@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_MoveGroup_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	from, _ := s.CreateUserGroup(ctx, "Platform")
+	to, _ := s.CreateUserGroup(ctx, "Product")
+	team, _ := s.CreateUserGroup(ctx, "Payments")
+	_ = s.AddUserGroupToGroup(ctx, team, from)
+
+	if err := s.MoveUserGroup(ctx, team, from, to); err != nil {
+		t.Fatalf("MoveUserGroup failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "MoveUserGroup")
+	if !ok || entry["group.from_parent_id"] != float64(from) || entry["group.to_parent_id"] != float64(to) {
+		t.Errorf("Expected both parents in the log entry, got %v", entry)
+	}
+	if parents, err := s.GetParentGroups(ctx, team); err != nil || !reflect.DeepEqual(parents, []int{to}) {
+		t.Errorf("GetParentGroups = %v, %v; want [%d]", parents, err, to)
+	}
+
+	if err := s.MoveUserGroup(ctx, team, from, to); !errors.Is(err, ErrEdgeNotFound) {
+		t.Errorf("Expected ErrEdgeNotFound, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "MoveUserGroup"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the missing edge to be logged as rejected, got %v", logs.entries(t))
+	}
+}
+
+func Test_MoveGroup_CachingRepository(t *testing.T) {
+	fake := newFakeRepository()
+	repo := NewCachingRepository(fake, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := repo.CreateUser(ctx, "Alice")
+	bob, _ := repo.CreateUser(ctx, "Bob")
+	from, _ := repo.CreateUserGroup(ctx, "Platform")
+	to, _ := repo.CreateUserGroup(ctx, "Product")
+	team, _ := repo.CreateUserGroup(ctx, "Payments")
+	_, _ = repo.AddGroupToGroup(ctx, team, from)
+	_, _ = repo.AddUserToGroup(ctx, alice, team)
+	_, _ = repo.AddPermission(ctx, "group", "user", from, bob)
+
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); !got {
+		t.Fatal("Expected alice to be allowed through the old parent")
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, from); !reflect.DeepEqual(users, []int{alice}) {
+		t.Fatalf("GetUsersInGroupTransitive = %v, want [%d]", users, alice)
+	}
+	_, _ = repo.GetUsersInGroupTransitive(ctx, to)
+
+	if _, err := repo.MoveGroup(ctx, team, from, to); err != nil {
+		t.Fatalf("MoveGroup failed: %v", err)
+	}
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); got {
+		t.Error("Expected the cached decision to be invalidated by the move")
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, from); len(users) != 0 {
+		t.Errorf("GetUsersInGroupTransitive(from) = %v, want none", users)
+	}
+	if users, _ := repo.GetUsersInGroupTransitive(ctx, to); !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroupTransitive(to) = %v, want [%d]", users, alice)
+	}
+}
+
+func Test_MoveGroup_IndexedRepository(t *testing.T) {
+	ctx := context.Background()
+	file := openFileRepository(t, t.TempDir())
+	defer file.Close()
+
+	root, _ := file.CreateUserGroup(ctx, "Root")
+	from, _ := file.CreateUserGroup(ctx, "Platform")
+	other, _ := file.CreateUserGroup(ctx, "Guild")
+	to, _ := file.CreateUserGroup(ctx, "Product")
+	team, _ := file.CreateUserGroup(ctx, "Payments")
+	sub, _ := file.CreateUserGroup(ctx, "Payments On-call")
+	_, _ = file.AddGroupToGroup(ctx, from, root)
+	_, _ = file.AddGroupToGroup(ctx, team, from)
+	_, _ = file.AddGroupToGroup(ctx, team, other)
+	_, _ = file.AddGroupToGroup(ctx, sub, team)
+
+	repo, err := NewIndexedRepository(ctx, file)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	if _, err := repo.MoveGroup(ctx, team, from, to); err != nil {
+		t.Fatalf("MoveGroup failed: %v", err)
+	}
+
+	// Groups below the child lose the old parent and its ancestors, but keep the
+	// groups they still reach through the child's other parent
+	if ancestors, _ := repo.GetAncestorGroups(ctx, sub); !reflect.DeepEqual(ancestors, []int{other, to, team}) {
+		t.Errorf("GetAncestorGroups = %v, want [%d %d %d]", ancestors, other, to, team)
+	}
+	if ancestors, _ := repo.GetAncestorGroups(ctx, from); !reflect.DeepEqual(ancestors, []int{root}) {
+		t.Errorf("GetAncestorGroups(from) = %v, want [%d]", ancestors, root)
+	}
+	if rev, _ := repo.CurrentRevision(ctx); rev != mustRevision(t, file) {
+		t.Errorf("Index revision %s does not match the repository", rev)
+	}
+}
+
+func Test_MoveGroup_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	from, _ := r.CreateUserGroup(ctx, "Platform")
+	to, _ := r.CreateUserGroup(ctx, "Product")
+	team, _ := r.CreateUserGroup(ctx, "Payments")
+	_, _ = r.AddGroupToGroup(ctx, team, from)
+	rev, _ := r.MoveGroup(ctx, team, from, to)
+	crash(t, r)
+
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		if parents, _ := r.GetParentGroups(ctx, team); !reflect.DeepEqual(parents, []int{to}) {
+			t.Errorf("GetParentGroups = %v, want [%d]", parents, to)
+		}
+		if got := mustRevision(t, r); got != rev {
+			t.Errorf("Revision = %s, want %s", got, rev)
+		}
+		events, _ := r.ListChanges(ctx, rev-1, 10)
+		if len(events) != 1 || events[0].Type != EventEdgeMoved || events[0].PreviousObjectID != from {
+			t.Errorf("Expected the move as the last event, got %+v", events)
+		}
+	}
+
+	// The move is replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+}
+
+func Test_MoveGroup_WebhookGroups(t *testing.T) {
+	s := New(newFakeRepository())
+	ctx := context.Background()
+
+	fromRoot, _ := s.CreateUserGroup(ctx, "Engineering")
+	from, _ := s.CreateUserGroup(ctx, "Platform")
+	to, _ := s.CreateUserGroup(ctx, "Product")
+	team, _ := s.CreateUserGroup(ctx, "Payments")
+	_ = s.AddUserGroupToGroup(ctx, from, fromRoot)
+	_ = s.AddUserGroupToGroup(ctx, team, from)
+	_ = s.MoveUserGroup(ctx, team, from, to)
+
+	// Subscribers above the old parent hear about the team leaving
+	d := NewWebhookDispatcher(s, &fakeWebhookStore{}, testWebhookConfig())
+	groups, err := d.eventGroups(ctx, edgeMovedEvent(team, from, to))
+	if want := map[int]bool{fromRoot: true, from: true, to: true}; err != nil || !reflect.DeepEqual(groups, want) {
+		t.Errorf("eventGroups = %v, %v; want %v", groups, err, want)
+	}
+}
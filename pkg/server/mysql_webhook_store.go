@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook queries
+const (
+	queryInsertWebhookSubscription = `
+		INSERT INTO webhook_subscriptions (url, secret, event_types, group_ids)
+		VALUES (?, ?, ?, ?)`
+
+	querySelectWebhookSubscriptions = `
+		SELECT id, url, secret, event_types, group_ids, created_at
+		FROM webhook_subscriptions
+		ORDER BY id`
+
+	querySelectWebhookCursor = "SELECT COALESCE((SELECT revision FROM webhook_cursor WHERE id = 1), 0)"
+
+	queryUpsertWebhookCursor = `
+		INSERT INTO webhook_cursor (id, revision)
+		VALUES (1, ?)
+		ON DUPLICATE KEY UPDATE revision = GREATEST(revision, VALUES(revision))`
+
+	queryInsertWebhookDelivery = `
+		INSERT INTO webhook_deliveries (subscription_id, revision, payload, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = id`
+
+	webhookDeliveryColumns = `
+		id, subscription_id, payload, status, attempts, next_attempt_at,
+		last_error, last_status_code, created_at, updated_at`
+
+	querySelectDueWebhookDeliveries = "SELECT " + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id
+		LIMIT ?`
+
+	querySelectWebhookDelivery = "SELECT " + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE id = ?`
+
+	querySelectWebhookDeliveries = "SELECT " + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE subscription_id = ?
+		ORDER BY id`
+
+	querySelectWebhookDeadLetters = "SELECT " + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE id IN (SELECT delivery_id FROM webhook_dead_letters)
+		ORDER BY id`
+
+	queryUpdateWebhookDelivery = `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, last_status_code = ?,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`
+
+	queryInsertWebhookDeadLetter = `
+		INSERT INTO webhook_dead_letters (delivery_id, subscription_id, revision, payload, attempts, last_error, last_status_code)
+		SELECT id, subscription_id, revision, payload, ?, ?, ?
+		FROM webhook_deliveries
+		WHERE id = ?`
+)
+
+// maxWebhookErrorLength matches the width of the last_error columns
+const maxWebhookErrorLength = 1024
+
+// CreateWebhookSubscription stores a new webhook subscription
+func (r *MySQLRepository) CreateWebhookSubscription(ctx context.Context, sub WebhookSubscription) (int, error) {
+	eventTypes := make([]string, len(sub.EventTypes))
+	for i, t := range sub.EventTypes {
+		eventTypes[i] = string(t)
+	}
+	return r.execInsert(ctx, "CreateWebhookSubscription", rawQuery(queryInsertWebhookSubscription), "failed to create webhook subscription",
+		sub.URL, sub.Secret, strings.Join(eventTypes, ","), joinIDs(sub.GroupIDs))
+}
+
+// ListWebhookSubscriptions returns all webhook subscriptions
+func (r *MySQLRepository) ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := r.db.QueryContext(ctx, querySelectWebhookSubscriptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subs := make([]WebhookSubscription, 0)
+	for rows.Next() {
+		var sub WebhookSubscription
+		var eventTypes, groupIDs string
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.Secret, &eventTypes, &groupIDs, &sub.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook subscription: %w", err)
+		}
+		for _, t := range splitList(eventTypes) {
+			sub.EventTypes = append(sub.EventTypes, ChangeEventType(t))
+		}
+		if sub.GroupIDs, err = splitIDs(groupIDs); err != nil {
+			return nil, fmt.Errorf("invalid group filter for webhook subscription %d: %w", sub.ID, err)
+		}
+		subs = append(subs, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return subs, nil
+}
+
+// WebhookCursor returns the revision of the last change event the dispatcher processed
+func (r *MySQLRepository) WebhookCursor(ctx context.Context) (Revision, error) {
+	var rev uint64
+	if err := r.db.QueryRowContext(ctx, querySelectWebhookCursor).Scan(&rev); err != nil {
+		return 0, fmt.Errorf("failed to get webhook cursor: %w", err)
+	}
+	return Revision(rev), nil
+}
+
+// EnqueueWebhookDeliveries stores deliveries and advances the cursor in one transaction.
+// Deliveries already stored for the same subscription and revision are kept as they are,
+// so replaying an event after a crash does not send it twice.
+func (r *MySQLRepository) EnqueueWebhookDeliveries(ctx context.Context, cursor Revision, deliveries []WebhookDelivery) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+	for _, d := range deliveries {
+		payload, err := json.Marshal(d.Event)
+		if err != nil {
+			return fmt.Errorf("failed to encode change event: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, queryInsertWebhookDelivery,
+			d.SubscriptionID, uint64(d.Event.Revision), payload, d.Status, d.NextAttemptAt.UTC())
+		if err != nil {
+			return fmt.Errorf("failed to enqueue webhook delivery: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, queryUpsertWebhookCursor, uint64(cursor)); err != nil {
+		return fmt.Errorf("failed to advance webhook cursor: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due at now
+func (r *MySQLRepository) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	return r.queryWebhookDeliveries(ctx, querySelectDueWebhookDeliveries, "failed to get due webhook deliveries", now.UTC(), limit)
+}
+
+// UpdateWebhookDelivery records the outcome of a delivery attempt
+func (r *MySQLRepository) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := r.db.ExecContext(ctx, queryUpdateWebhookDelivery,
+		delivery.Status, delivery.Attempts, delivery.NextAttemptAt.UTC(),
+		truncate(delivery.LastError, maxWebhookErrorLength), delivery.LastStatusCode, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// DeadLetterWebhookDelivery marks a delivery as dead-lettered and copies it to the
+// dead-letter table in one transaction
+func (r *MySQLRepository) DeadLetterWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+	lastError := truncate(delivery.LastError, maxWebhookErrorLength)
+	_, err = tx.ExecContext(ctx, queryUpdateWebhookDelivery,
+		WebhookDeliveryDeadLettered, delivery.Attempts, delivery.NextAttemptAt.UTC(),
+		lastError, delivery.LastStatusCode, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, queryInsertWebhookDeadLetter,
+		delivery.Attempts, lastError, delivery.LastStatusCode, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record dead letter: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// GetWebhookDelivery returns a delivery by ID
+func (r *MySQLRepository) GetWebhookDelivery(ctx context.Context, deliveryID int) (*WebhookDelivery, error) {
+	deliveries, err := r.queryWebhookDeliveries(ctx, querySelectWebhookDelivery, "failed to get webhook delivery", deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, &WebhookDeliveryNotFoundError{DeliveryID: deliveryID}
+	}
+	return &deliveries[0], nil
+}
+
+// ListWebhookDeliveries returns all deliveries for a subscription, oldest first
+func (r *MySQLRepository) ListWebhookDeliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	return r.queryWebhookDeliveries(ctx, querySelectWebhookDeliveries, "failed to list webhook deliveries", subscriptionID)
+}
+
+// ListWebhookDeadLetters returns all dead-lettered deliveries, oldest first
+func (r *MySQLRepository) ListWebhookDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	return r.queryWebhookDeliveries(ctx, querySelectWebhookDeadLetters, "failed to list webhook dead letters")
+}
+
+// queryWebhookDeliveries queries deliveries selected with webhookDeliveryColumns
+func (r *MySQLRepository) queryWebhookDeliveries(ctx context.Context, query, errorMsg string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&d.LastError, &d.LastStatusCode, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		if err := json.Unmarshal(payload, &d.Event); err != nil {
+			return nil, fmt.Errorf("failed to decode webhook delivery %d: %w", d.ID, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// joinIDs encodes IDs as a comma-separated list
+func joinIDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitIDs decodes a list produced by joinIDs
+func splitIDs(list string) ([]int, error) {
+	var ids []int
+	for _, part := range splitList(list) {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// splitList splits a comma-separated list, returning nil for an empty string
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,8 @@
+//go:build postgres
+
+package server
+
+// The package itself never imports a PostgreSQL driver. Building the tests with
+// -tags postgres registers lib/pq as "postgres" so Test_Conformance_PostgresRepository
+// can run; add it first with: go get github.com/lib/pq
+import _ "github.com/lib/pq"
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PostgresRepository implements the Repository interface using PostgreSQL.
+// The schema is created by MigratePostgres. The package does not import a PostgreSQL
+// driver; register one, such as github.com/jackc/pgx/v5/stdlib or github.com/lib/pq,
+// and open the database with OpenPostgresDatabase.
+type PostgresRepository struct {
+	*SQLRepository
+}
+
+// PostgresOption configures optional PostgresRepository dependencies
+type PostgresOption func(*PostgresRepository)
+
+// WithPostgresTracer sets the tracer used for SQL spans. A nil tracer disables tracing.
+func WithPostgresTracer(tracer Tracer) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLTracer(tracer)(r.SQLRepository) }
+}
+
+// WithPostgresLogger sets the logger for database errors. A nil logger disables logging.
+func WithPostgresLogger(logger Logger) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLLogger(logger)(r.SQLRepository) }
+}
+
+// WithPostgresReplicas sets read replicas opened with OpenPostgresDatabase. Writes,
+// cycle checks and the change feed stay on the primary.
+func WithPostgresReplicas(replicas ...*sql.DB) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLReplicas(replicas...)(r.SQLRepository) }
+}
+
+// WithPostgresRetryPolicy sets how transient errors are retried, e.g. to
+// Config.Retry. On PostgreSQL only dropped connections are recognized as transient.
+func WithPostgresRetryPolicy(policy RetryPolicy) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLRetryPolicy(policy)(r.SQLRepository) }
+}
+
+// WithPostgresMetrics counts retries in metrics
+func WithPostgresMetrics(metrics *Metrics) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLMetrics(metrics)(r.SQLRepository) }
+}
+
+// WithPostgresIdempotencyTTL sets how long idempotency keys are remembered, e.g. to
+// Config.IdempotencyTTL
+func WithPostgresIdempotencyTTL(ttl time.Duration) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLIdempotencyTTL(ttl)(r.SQLRepository) }
+}
+
+// WithPostgresUniqueNames enforces unique user names and unique group names, e.g.
+// from Config.UniqueNames
+func WithPostgresUniqueNames(enforce bool) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLUniqueNames(enforce)(r.SQLRepository) }
+}
+
+// WithPostgresHierarchyLimits rejects hierarchy edges that break limits, e.g. from
+// Config.HierarchyLimits
+func WithPostgresHierarchyLimits(limits HierarchyLimits) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLHierarchyLimits(limits)(r.SQLRepository) }
+}
+
+// WithPostgresNestingPolicy rejects hierarchy edges and group types that policy
+// does not allow, e.g. from Config.NestingPolicy
+func WithPostgresNestingPolicy(policy NestingPolicy) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLNestingPolicy(policy)(r.SQLRepository) }
+}
+
+// WithPostgresConfig applies the repository settings of config, see WithSQLConfig
+func WithPostgresConfig(config Config) PostgresOption {
+	return func(r *PostgresRepository) { WithSQLConfig(config)(r.SQLRepository) }
+}
+
+// NewPostgresRepository creates a new PostgreSQL repository with the given database connection
+func NewPostgresRepository(db *sql.DB, opts ...PostgresOption) *PostgresRepository {
+	r := &PostgresRepository{SQLRepository: NewSQLRepository(db, PostgresDialect{})}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// OpenPostgresDatabase opens config.DatabaseDSN with the PostgreSQL driver registered
+// under driverName, e.g. "pgx" or "postgres", and configures the connection pool
+// like OpenDatabase
+func OpenPostgresDatabase(driverName string, config Config) (*sql.DB, error) {
+	registered := false
+	for _, name := range sql.Drivers() {
+		if name == driverName {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return nil, fmt.Errorf("failed to open database: driver %q is not registered, import a PostgreSQL driver", driverName)
+	}
+
+	db, err := sql.Open(driverName, config.DatabaseDSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postgresTestDB opens the database named by POSTGRES_DSN with the driver named by
+// POSTGRES_DRIVER (default "postgres"). The package does not import a driver, so the
+// test is skipped unless one is registered, e.g. by building with -tags postgres.
+func postgresTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN is not set")
+	}
+	driver := os.Getenv("POSTGRES_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driver
+	}
+	if !registered {
+		t.Skipf("PostgreSQL driver %q is not registered", driver)
+	}
+
+	config := DefaultConfig()
+	config.DatabaseDSN = dsn
+	db, err := OpenPostgresDatabase(driver, config)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func Test_Postgres_Migrations(t *testing.T) {
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		t.Fatalf("PostgresMigrations failed: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Expected embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected version %d, got %d (%s)", i+1, m.Version, m.Name)
+		}
+		if strings.TrimSpace(m.SQL) == "" {
+			t.Errorf("Migration %d_%s is empty", m.Version, m.Name)
+		}
+	}
+}
+
+func Test_Postgres_NoMySQLSyntax(t *testing.T) {
+	mysqlOnly := regexp.MustCompile(`(?i)\bENUM\s*\(|AUTO_INCREMENT|ON DUPLICATE KEY|ENGINE=|\?`)
+
+	migrations, _ := PostgresMigrations()
+	for _, m := range migrations {
+		if match := mysqlOnly.FindString(m.SQL); match != "" {
+			t.Errorf("Migration %d_%s uses MySQL-only syntax %q", m.Version, m.Name, match)
+		}
+	}
+
+	for name, query := range dialectQueries(PostgresDialect{}) {
+		if match := mysqlOnly.FindString(query.text); match != "" {
+			t.Errorf("%s uses MySQL-only syntax %q", name, match)
+		}
+	}
+}
+
+func Test_Postgres_UnregisteredDriver(t *testing.T) {
+	_, err := OpenPostgresDatabase("no-such-driver", DefaultConfig())
+	if err == nil || !strings.Contains(err.Error(), `driver "no-such-driver" is not registered`) {
+		t.Errorf("Expected unregistered driver error, got %v", err)
+	}
+}
+
+func Test_Conformance_PostgresRepository(t *testing.T) {
+	db := postgresTestDB(t)
+	ctx := context.Background()
+
+	if _, err := MigratePostgres(ctx, db); err != nil {
+		t.Fatalf("MigratePostgres failed: %v", err)
+	}
+	applied, err := MigratePostgres(ctx, db)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Expected a second MigratePostgres to apply nothing, got %v, %v", applied, err)
+	}
+
+	repo := NewPostgresRepository(db)
+	defer repo.Close()
+
+	runRepositoryConformance(t, repo)
+}
+
+func Test_Postgres_Options(t *testing.T) {
+	metrics := NewMetrics()
+	replica := &sql.DB{}
+	limits := HierarchyLimits{MaxDepth: 3}
+	r := NewPostgresRepository(nil,
+		WithPostgresReplicas(replica),
+		WithPostgresRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithPostgresMetrics(metrics),
+		WithPostgresIdempotencyTTL(time.Hour),
+		WithPostgresUniqueNames(true),
+		WithPostgresHierarchyLimits(limits),
+		WithPostgresNestingPolicy(NestingPolicy{"org": {"team"}}))
+
+	if len(r.replicas) != 1 || r.replicas[0] != replica || r.metrics != metrics {
+		t.Errorf("Expected the replica and metrics, got %v %v", r.replicas, r.metrics)
+	}
+	if r.retryPolicy.MaxAttempts != 1 || r.idempotencyTTL != time.Hour || !r.uniqueNames ||
+		r.hierarchyLimits != limits || !r.nestingPolicy.allows("org", "team") || r.nestingPolicy.allows("org", "org") {
+		t.Errorf("Expected the configured settings, got %+v %v %v %+v %v",
+			r.retryPolicy, r.idempotencyTTL, r.uniqueNames, r.hierarchyLimits, r.nestingPolicy)
+	}
+
+	config := DefaultConfig()
+	config.UniqueNames = true
+	if r := NewPostgresRepository(nil, WithPostgresConfig(config)); !r.uniqueNames || r.retryPolicy != config.Retry {
+		t.Errorf("Expected the repository to take the config, got %v %+v", r.uniqueNames, r.retryPolicy)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// primaryReadsKey is the context key that forces reads to the primary
+type primaryReadsKey struct{}
+
+// WithPrimaryReads returns a context whose reads skip the replicas, for callers that
+// must not observe replication lag. Reads with a minimum revision (WithMinRevision)
+// always use the primary, since a replica cannot show that it has caught up.
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// primaryReadsRequired reports whether reads under ctx must use the primary
+func primaryReadsRequired(ctx context.Context) bool {
+	if forced, _ := ctx.Value(primaryReadsKey{}).(bool); forced {
+		return true
+	}
+	_, ok := MinRevisionFromContext(ctx)
+	return ok
+}
+
+// OpenReplicas opens a MySQL connection pool for every DSN in config.ReplicaDSNs,
+// configured like OpenDatabase. It returns no pools if no replicas are configured.
+func OpenReplicas(config Config) ([]*sql.DB, error) {
+	replicas := make([]*sql.DB, 0, len(config.ReplicaDSNs))
+	for i, dsn := range config.ReplicaDSNs {
+		db, err := openMySQL(dsn, config)
+		if err != nil {
+			for _, opened := range replicas {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+		replicas = append(replicas, db)
+	}
+	return replicas, nil
+}
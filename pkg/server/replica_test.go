@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// openReplicaRepository opens a repository whose two "replicas" are separate pools
+// on the test database, so routing is visible in the pool statistics
+func openReplicaRepository(t *testing.T, tracer Tracer) (*MySQLRepository, []*sql.DB) {
+	t.Helper()
+	config := DefaultConfig()
+	config.ReplicaDSNs = []string{config.DatabaseDSN, config.DatabaseDSN}
+
+	primary, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	replicas, err := OpenReplicas(config)
+	if err != nil {
+		t.Fatalf("OpenReplicas failed: %v", err)
+	}
+	return NewMySQLRepository(primary, WithMySQLReplicas(replicas...), WithMySQLTracer(tracer)), replicas
+}
+
+// replicaFlags returns the db.replica attribute of every span named name
+func replicaFlags(tracer *RecordingTracer, name string) []interface{} {
+	var flags []interface{}
+	for _, s := range tracer.Spans() {
+		if s.Name == name {
+			flags = append(flags, s.Attributes["db.replica"])
+		}
+	}
+	return flags
+}
+
+func Test_Replicas_RouteReads(t *testing.T) {
+	tracer := NewRecordingTracer()
+	repo, replicas := openReplicaRepository(t, tracer)
+	defer repo.Close()
+	ctx := context.Background()
+
+	alice, _ := repo.CreateUser(ctx, "Alice")
+	bob, _ := repo.CreateUser(ctx, "Bob")
+	group, _ := repo.CreateUserGroup(ctx, "Team")
+	if _, err := repo.AddUserToGroup(ctx, alice, group); err != nil {
+		t.Fatalf("AddUserToGroup failed: %v", err)
+	}
+	for _, op := range []string{"mysql.CreateUser", "mysql.AddUserToGroup"} {
+		for _, flag := range replicaFlags(tracer, op) {
+			if flag != false {
+				t.Errorf("Expected %s on the primary, got db.replica=%v", op, flag)
+			}
+		}
+	}
+
+	tracer.Reset()
+	for i := 0; i < 2; i++ {
+		if _, err := repo.HasUserPermissionOnUser(ctx, alice, bob); err != nil {
+			t.Fatalf("HasUserPermissionOnUser failed: %v", err)
+		}
+	}
+	if users, err := repo.GetUsersInGroupTransitive(ctx, group); err != nil || len(users) != 1 {
+		t.Fatalf("GetUsersInGroupTransitive = %v, %v", users, err)
+	}
+	for _, op := range []string{"mysql.HasUserPermissionOnUser", "mysql.GetUsersInGroupTransitive"} {
+		for _, flag := range replicaFlags(tracer, op) {
+			if flag != true {
+				t.Errorf("Expected %s on a replica, got db.replica=%v", op, flag)
+			}
+		}
+	}
+
+	// Reads alternate between the replicas
+	for i, replica := range replicas {
+		if replica.Stats().OpenConnections == 0 {
+			t.Errorf("Expected replica %d to serve reads", i)
+		}
+	}
+}
+
+func Test_Replicas_PrimaryReads(t *testing.T) {
+	tracer := NewRecordingTracer()
+	repo, _ := openReplicaRepository(t, tracer)
+	defer repo.Close()
+	ctx := context.Background()
+
+	child, _ := repo.CreateUserGroup(ctx, "Child")
+	parent, _ := repo.CreateUserGroup(ctx, "Parent")
+
+	tests := []struct {
+		name string
+		op   string
+		read func() error
+	}{
+		{"cycle check", "mysql.WouldCreateCycle", func() error {
+			_, err := repo.WouldCreateCycle(ctx, child, parent)
+			return err
+		}},
+		{"forced primary", "mysql.GetGroupsInGroup", func() error {
+			_, err := repo.GetGroupsInGroup(WithPrimaryReads(ctx), parent)
+			return err
+		}},
+		{"minimum revision", "mysql.GetAncestorGroups", func() error {
+			_, err := repo.GetAncestorGroups(WithMinRevision(ctx, 1), child)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer.Reset()
+			if err := tt.read(); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if flags := replicaFlags(tracer, tt.op); len(flags) != 1 || flags[0] != false {
+				t.Errorf("Expected %s on the primary, got db.replica=%v", tt.op, flags)
+			}
+		})
+	}
+}
+
+func Test_Replicas_FallBackToPrimary(t *testing.T) {
+	var logs logBuffer
+	primary, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	replica, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	replica.Close()
+	repo := NewMySQLRepository(primary, WithMySQLReplicas(replica), WithMySQLLogger(NewJSONLogger(&logs, LevelDebug)))
+	defer repo.Close()
+
+	ctx := context.Background()
+	user, _ := repo.CreateUser(ctx, "Dana")
+	if name, err := repo.GetUserByID(ctx, user); err != nil || name != "Dana" {
+		t.Fatalf("Expected the read to fall back to the primary, got %q, %v", name, err)
+	}
+	entry, ok := findEntry(logs.entries(t), "replica unavailable, reading from primary", "")
+	if !ok || entry["level"] != "warn" || entry["operation"] != "GetUserByID" {
+		t.Errorf("Expected a warning about the replica, got %v", logs.entries(t))
+	}
+}
+
+func Test_Replicas_Config(t *testing.T) {
+	t.Setenv("MYSQL_REPLICA_DSNS", "r1@tcp(a:3306)/db, r2@tcp(b:3306)/db,")
+	if got := DefaultConfig().ReplicaDSNs; len(got) != 2 || got[1] != "r2@tcp(b:3306)/db" {
+		t.Errorf("Expected two replica DSNs, got %q", got)
+	}
+
+	config := DefaultConfig()
+	config.ReplicaDSNs = []string{"nobody@tcp(127.0.0.1:1)/none"}
+	if _, err := OpenReplicas(config); err == nil || !strings.Contains(err.Error(), "replica 0") {
+		t.Errorf("Expected an error naming the replica, got %v", err)
+	}
+}
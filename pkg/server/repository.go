@@ -13,21 +13,100 @@ type Repository interface {
 	CreateUserGroup(ctx context.Context, name string) (int, error)
 	GetUserGroupByID(ctx context.Context, groupID int) (string, error)
 
+	// External ID and name operations. External IDs are unique per type; an empty
+	// external ID means none.
+	CreateUserWithExternalID(ctx context.Context, name, externalID string) (int, error)
+	CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (int, error)
+	SetUserExternalID(ctx context.Context, userID int, externalID string) error
+	SetUserGroupExternalID(ctx context.Context, groupID int, externalID string) error
+	GetUserByExternalID(ctx context.Context, externalID string) (int, error)
+	GetUserGroupByExternalID(ctx context.Context, externalID string) (int, error)
+	FindUsersByName(ctx context.Context, name string) ([]int, error)
+	FindUserGroupsByName(ctx context.Context, name string) ([]int, error)
+
+	// Listing operations. Each returns one keyset-paginated page; see ListOptions.
+	ListUsers(ctx context.Context, opts ListOptions) (Page, error)
+	ListUserGroups(ctx context.Context, opts ListOptions) (Page, error)
+	ListUsersInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error)
+	ListGroupsInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error)
+	ListUsersInGroupTransitive(ctx context.Context, groupID int, opts ListOptions) (Page, error)
+
+	// Attribute operations on a "user" or "group". SetAttribute with a nil value
+	// removes the attribute. Values are normalized to the Go types of AttributeType.
+	// SetAttribute returns the revision of the last dynamic membership change it
+	// caused, or the current revision if it caused none.
+	SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (Revision, error)
+	GetAttributes(ctx context.Context, subjectType string, subjectID int) (Attributes, error)
+
 	// Membership operations
-	AddUserToGroup(ctx context.Context, userID, groupID int) error
+	AddUserToGroup(ctx context.Context, userID, groupID int) (Revision, error)
 	GetUsersInGroup(ctx context.Context, groupID int) ([]int, error)
 	GetUsersInGroupTransitive(ctx context.Context, groupID int) ([]int, error)
+	GetGroupsForUser(ctx context.Context, userID int) ([]int, error)
+	GetGroupsForUserTransitive(ctx context.Context, userID int) ([]int, error)
+
+	// User status operations. Permission checks deny users that are not active as
+	// source. SetUserStatus records a user_status_changed event unless the user already
+	// has the status. GetUserStatuses omits IDs that do not exist.
+	SetUserStatus(ctx context.Context, userID int, status UserStatus) (Revision, error)
+	GetUserStatus(ctx context.Context, userID int) (UserStatus, error)
+	GetUserStatuses(ctx context.Context, userIDs []int) (map[int]UserStatus, error)
+
+	// Membership rule operations. A group with a rule is dynamic: its direct users are
+	// the users whose attributes satisfy the rule, kept up to date by SetGroupRule and
+	// SetAttribute, and AddUserToGroup rejects it with a DynamicGroupError. An empty
+	// rule makes the group static again and keeps its users.
+	SetGroupRule(ctx context.Context, groupID int, rule string) (Revision, error)
+	GetGroupRule(ctx context.Context, groupID int) (string, error)
 
-	// Hierarchy operations
-	AddGroupToGroup(ctx context.Context, childID, parentID int) error
+	// Hierarchy operations. MoveGroup moves a child group from one parent to another
+	// in one write with cycle detection and records a single edge_moved event. It
+	// returns EdgeNotFoundError if the child is not directly in fromParentID; moving a
+	// group to the parent it is in changes nothing and returns the current revision.
+	// Both reject edges that break the repository's HierarchyLimits with a
+	// HierarchyLimitError and edges its NestingPolicy does not allow with a
+	// NestingNotAllowedError; re-adding an existing edge is never rejected.
+	AddGroupToGroup(ctx context.Context, childID, parentID int) (Revision, error)
+	MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (Revision, error)
 	GetGroupsInGroup(ctx context.Context, groupID int) ([]int, error)
+	GetParentGroups(ctx context.Context, groupID int) ([]int, error)
+	GetAncestorGroups(ctx context.Context, groupID int) ([]int, error)
+	GetDescendantGroups(ctx context.Context, groupID int) ([]int, error)
 	WouldCreateCycle(ctx context.Context, childID, parentID int) (bool, error)
 
-	// Permission operations
-	AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) error
+	// GetAncestorEdges returns the hierarchy edges above a "user" or "group", ordered
+	// by child and parent: the edges out of its groups (or the group itself) and out
+	// of every group above them
+	GetAncestorEdges(ctx context.Context, subjectType string, subjectID int) ([]GroupEdge, error)
+
+	// GetGroupSubtree returns a group and every group below it with their names,
+	// edges and direct users as of one point in time, or UserGroupNotFoundError
+	GetGroupSubtree(ctx context.Context, groupID int) (*GroupSubtree, error)
+
+	// GetHierarchyViolations returns the groups that break limits, ordered by group
+	// and limit name, regardless of the limits the repository enforces
+	GetHierarchyViolations(ctx context.Context, limits HierarchyLimits) ([]HierarchyViolation, error)
+
+	// SetGroupType sets or, for an empty type, clears the type of a group. It returns
+	// a NestingNotAllowedError if the repository's NestingPolicy does not allow the
+	// new type with a parent or child group. GetNestingViolations returns the edges
+	// policy does not allow, ordered by parent and child.
+	SetGroupType(ctx context.Context, groupID int, groupType string) error
+	GetGroupType(ctx context.Context, groupID int) (string, error)
+	GetNestingViolations(ctx context.Context, policy NestingPolicy) ([]NestingViolation, error)
+
+	// Permission operations. A source has at most one grant per target: AddPermission
+	// makes it unconditional and AddConditionalPermission replaces its condition,
+	// which the checks evaluate against attributes (see Condition).
+	AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error)
+	AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error)
 	HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error)
 	HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error)
 
+	// Revision and change feed operations
+	CurrentRevision(ctx context.Context) (Revision, error)
+	ListChanges(ctx context.Context, afterRevision Revision, limit int) ([]ChangeEvent, error)
+
 	// Close closes the repository and releases any resources
 	Close() error
 }
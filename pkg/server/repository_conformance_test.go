@@ -0,0 +1,965 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runRepositoryConformance checks the behavior every Repository implementation must
+// share. It only creates fresh users and groups, so it can run against a shared database.
+func runRepositoryConformance(t *testing.T, repo Repository) {
+	ctx := context.Background()
+
+	mustUser := func(t *testing.T, name string) int {
+		t.Helper()
+		id, err := repo.CreateUser(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		return id
+	}
+	mustGroup := func(t *testing.T, name string) int {
+		t.Helper()
+		id, err := repo.CreateUserGroup(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		return id
+	}
+	assertIDs := func(t *testing.T, what string, got []int, err error, want ...int) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", what, err)
+		}
+		if want == nil {
+			want = []int{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", what, got, want)
+		}
+	}
+
+	t.Run("users and groups", func(t *testing.T) {
+		alice := mustUser(t, "Alice")
+		group := mustGroup(t, "Engineering")
+
+		if name, err := repo.GetUserByID(ctx, alice); err != nil || name != "Alice" {
+			t.Errorf("GetUserByID = %q, %v", name, err)
+		}
+		if name, err := repo.GetUserGroupByID(ctx, group); err != nil || name != "Engineering" {
+			t.Errorf("GetUserGroupByID = %q, %v", name, err)
+		}
+		if _, err := repo.GetUserByID(ctx, 1<<30); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+		if _, err := repo.GetUserGroupByID(ctx, 1<<30); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+	})
+
+	t.Run("memberships are idempotent and ordered", func(t *testing.T) {
+		bob := mustUser(t, "Bob")
+		alice := mustUser(t, "Alice")
+		group := mustGroup(t, "Team")
+
+		rev1, err := repo.AddUserToGroup(ctx, bob, group)
+		if err != nil {
+			t.Fatalf("AddUserToGroup failed: %v", err)
+		}
+		rev2, err := repo.AddUserToGroup(ctx, alice, group)
+		if err != nil {
+			t.Fatalf("AddUserToGroup failed: %v", err)
+		}
+		if _, err := repo.AddUserToGroup(ctx, alice, group); err != nil {
+			t.Fatalf("Adding an existing member must succeed, got %v", err)
+		}
+		if rev2 <= rev1 {
+			t.Errorf("Expected increasing revisions, got %s then %s", rev1, rev2)
+		}
+
+		users, err := repo.GetUsersInGroup(ctx, group)
+		assertIDs(t, "GetUsersInGroup", users, err, bob, alice)
+	})
+
+	t.Run("hierarchy and cycles", func(t *testing.T) {
+		root := mustGroup(t, "Root")
+		mid := mustGroup(t, "Mid")
+		leaf := mustGroup(t, "Leaf")
+		user := mustUser(t, "Carol")
+		for _, edge := range [][2]int{{mid, root}, {leaf, mid}} {
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+		if _, err := repo.AddUserToGroup(ctx, user, leaf); err != nil {
+			t.Fatalf("AddUserToGroup failed: %v", err)
+		}
+
+		groups, err := repo.GetGroupsInGroup(ctx, root)
+		assertIDs(t, "GetGroupsInGroup", groups, err, mid)
+		ancestors, err := repo.GetAncestorGroups(ctx, leaf)
+		assertIDs(t, "GetAncestorGroups", ancestors, err, root, mid)
+		users, err := repo.GetUsersInGroupTransitive(ctx, root)
+		assertIDs(t, "GetUsersInGroupTransitive", users, err, user)
+		userGroups, err := repo.GetGroupsForUserTransitive(ctx, user)
+		assertIDs(t, "GetGroupsForUserTransitive", userGroups, err, root, mid, leaf)
+
+		for _, edge := range [][2]int{{root, leaf}, {root, mid}, {mid, mid}} {
+			if cycle, err := repo.WouldCreateCycle(ctx, edge[0], edge[1]); err != nil || !cycle {
+				t.Errorf("WouldCreateCycle(%d, %d) = %v, %v; want true", edge[0], edge[1], cycle, err)
+			}
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); !errors.Is(err, ErrCycleDetected) {
+				t.Errorf("AddGroupToGroup(%d, %d): expected ErrCycleDetected, got %v", edge[0], edge[1], err)
+			}
+		}
+		if cycle, err := repo.WouldCreateCycle(ctx, leaf, root); err != nil || cycle {
+			t.Errorf("WouldCreateCycle(leaf, root) = %v, %v; want false", cycle, err)
+		}
+	})
+
+	t.Run("reverse memberships", func(t *testing.T) {
+		top := mustGroup(t, "Top")
+		left := mustGroup(t, "Left")
+		right := mustGroup(t, "Right")
+		bottom := mustGroup(t, "Bottom")
+		user := mustUser(t, "Dana")
+		for _, edge := range [][2]int{{left, top}, {right, top}, {bottom, right}, {bottom, left}} {
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+		for _, group := range []int{bottom, right} {
+			if _, err := repo.AddUserToGroup(ctx, user, group); err != nil {
+				t.Fatalf("AddUserToGroup failed: %v", err)
+			}
+		}
+
+		groups, err := repo.GetGroupsForUser(ctx, user)
+		assertIDs(t, "GetGroupsForUser", groups, err, right, bottom)
+		parents, err := repo.GetParentGroups(ctx, bottom)
+		assertIDs(t, "GetParentGroups", parents, err, left, right)
+		parents, err = repo.GetParentGroups(ctx, top)
+		assertIDs(t, "GetParentGroups(top)", parents, err)
+
+		want := []GroupEdge{{left, top}, {right, top}, {bottom, left}, {bottom, right}}
+		for _, subject := range []struct {
+			typ string
+			id  int
+		}{{"group", bottom}, {"user", user}} {
+			if edges, err := repo.GetAncestorEdges(ctx, subject.typ, subject.id); err != nil || !reflect.DeepEqual(edges, want) {
+				t.Errorf("GetAncestorEdges(%s) = %v, %v; want %v", subject.typ, edges, err, want)
+			}
+		}
+		if edges, err := repo.GetAncestorEdges(ctx, "group", top); err != nil || edges == nil || len(edges) != 0 {
+			t.Errorf("GetAncestorEdges(top) = %v, %v; want no edges", edges, err)
+		}
+	})
+
+	t.Run("subtrees", func(t *testing.T) {
+		root := mustGroup(t, "Org")
+		left := mustGroup(t, "Sales")
+		right := mustGroup(t, "Support")
+		shared := mustGroup(t, "Field")
+		users := []int{mustUser(t, "Eve"), mustUser(t, "Finn")}
+		for _, edge := range [][2]int{{right, root}, {left, root}, {shared, left}, {shared, right}} {
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+		for _, m := range []Membership{{users[1], shared}, {users[0], shared}, {users[0], root}} {
+			if _, err := repo.AddUserToGroup(ctx, m.UserID, m.GroupID); err != nil {
+				t.Fatalf("AddUserToGroup failed: %v", err)
+			}
+		}
+
+		groups, err := repo.GetDescendantGroups(ctx, root)
+		assertIDs(t, "GetDescendantGroups", groups, err, left, right, shared)
+		groups, err = repo.GetDescendantGroups(ctx, shared)
+		assertIDs(t, "GetDescendantGroups(leaf)", groups, err)
+
+		subtree, err := repo.GetGroupSubtree(ctx, left)
+		if err != nil {
+			t.Fatalf("GetGroupSubtree failed: %v", err)
+		}
+		want := &GroupSubtree{
+			RootID:      left,
+			Names:       map[int]string{left: "Sales", shared: "Field"},
+			Edges:       []GroupEdge{{shared, left}},
+			Memberships: []Membership{{users[0], shared}, {users[1], shared}},
+		}
+		if !reflect.DeepEqual(subtree, want) {
+			t.Errorf("GetGroupSubtree = %+v, want %+v", subtree, want)
+		}
+		subtree, err = repo.GetGroupSubtree(ctx, root)
+		if err != nil || len(subtree.Names) != 4 || len(subtree.Edges) != 4 || len(subtree.Memberships) != 3 {
+			t.Errorf("GetGroupSubtree(root) = %+v, %v; want 4 groups, 4 edges and 3 memberships", subtree, err)
+		}
+		if _, err := repo.GetGroupSubtree(ctx, 1<<30); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+	})
+
+	t.Run("moving groups", func(t *testing.T) {
+		from := mustGroup(t, "Platform")
+		to := mustGroup(t, "Product")
+		team := mustGroup(t, "Payments")
+		sub := mustGroup(t, "Payments On-call")
+		user := mustUser(t, "Gus")
+		target := mustUser(t, "Hana")
+		for _, edge := range [][2]int{{team, from}, {sub, team}} {
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+		_, _ = repo.AddUserToGroup(ctx, user, sub)
+		_, _ = repo.AddPermission(ctx, "group", "user", from, target)
+		if got, err := repo.HasUserPermissionOnUser(ctx, user, target); err != nil || !got {
+			t.Fatalf("HasUserPermissionOnUser = %v, %v; want true before the move", got, err)
+		}
+
+		rev, err := repo.MoveGroup(ctx, team, from, to)
+		if err != nil {
+			t.Fatalf("MoveGroup failed: %v", err)
+		}
+		groups, err := repo.GetGroupsInGroup(ctx, from)
+		assertIDs(t, "GetGroupsInGroup(from)", groups, err)
+		groups, err = repo.GetGroupsInGroup(ctx, to)
+		assertIDs(t, "GetGroupsInGroup(to)", groups, err, team)
+		groups, err = repo.GetAncestorGroups(ctx, sub)
+		assertIDs(t, "GetAncestorGroups", groups, err, to, team)
+		if got, err := repo.HasUserPermissionOnUser(ctx, user, target); err != nil || got {
+			t.Errorf("HasUserPermissionOnUser = %v, %v; want the grant of the old parent gone", got, err)
+		}
+
+		events, err := repo.ListChanges(ctx, rev-1, 10)
+		want := ChangeEvent{Revision: rev, Type: EventEdgeMoved, SubjectType: "group", SubjectID: team,
+			ObjectType: "group", ObjectID: to, PreviousObjectID: from}
+		if err != nil || len(events) != 1 {
+			t.Fatalf("ListChanges = %+v, %v; want one event", events, err)
+		}
+		if events[0].CreatedAt = (time.Time{}); events[0] != want {
+			t.Errorf("event = %+v, want %+v", events[0], want)
+		}
+
+		// Moving to the current parent records nothing
+		if same, err := repo.MoveGroup(ctx, team, to, to); err != nil || same != rev {
+			t.Errorf("MoveGroup(to, to) = %s, %v; want %s", same, err, rev)
+		}
+		for _, tt := range []struct {
+			from, to int
+			want     error
+		}{
+			{from, to, ErrEdgeNotFound},
+			{to, sub, ErrCycleDetected},
+			{to, team, ErrCycleDetected},
+			{to, 1 << 30, ErrUserGroupNotFound},
+		} {
+			if _, err := repo.MoveGroup(ctx, team, tt.from, tt.to); !errors.Is(err, tt.want) {
+				t.Errorf("MoveGroup(%d, %d): expected %v, got %v", tt.from, tt.to, tt.want, err)
+			}
+		}
+		if current, _ := repo.CurrentRevision(ctx); current != rev {
+			t.Errorf("CurrentRevision = %s, want %s after rejected moves", current, rev)
+		}
+	})
+
+	t.Run("hierarchy violations", func(t *testing.T) {
+		org := mustGroup(t, "Org")
+		eng := mustGroup(t, "Engineering")
+		sales := mustGroup(t, "Sales")
+		backend := mustGroup(t, "Backend")
+		for _, edge := range [][2]int{{eng, org}, {sales, org}, {backend, eng}} {
+			if _, err := repo.AddGroupToGroup(ctx, edge[0], edge[1]); err != nil {
+				t.Fatalf("AddGroupToGroup failed: %v", err)
+			}
+		}
+
+		// The report covers every group, so keep only the ones created here
+		violations, err := repo.GetHierarchyViolations(ctx, HierarchyLimits{MaxDepth: 1, MaxChildren: 1})
+		if err != nil {
+			t.Fatalf("GetHierarchyViolations failed: %v", err)
+		}
+		var got []HierarchyViolation
+		for _, v := range violations {
+			if v.GroupID == org || v.GroupID == eng || v.GroupID == sales || v.GroupID == backend {
+				got = append(got, v)
+			}
+		}
+		want := []HierarchyViolation{
+			{GroupID: org, Limit: LimitChildren, Max: 1, Actual: 2},
+			{GroupID: backend, Limit: LimitDepth, Max: 1, Actual: 2},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetHierarchyViolations = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("group types", func(t *testing.T) {
+		dept := mustGroup(t, "Sales")
+		team := mustGroup(t, "Sales EMEA")
+		role := mustGroup(t, "Admin")
+		for id, groupType := range map[int]string{dept: "department", team: "team", role: "role"} {
+			if err := repo.SetGroupType(ctx, id, groupType); err != nil {
+				t.Fatalf("SetGroupType failed: %v", err)
+			}
+		}
+		_, _ = repo.AddGroupToGroup(ctx, team, dept)
+		_, _ = repo.AddGroupToGroup(ctx, team, role)
+
+		if groupType, err := repo.GetGroupType(ctx, team); err != nil || groupType != "team" {
+			t.Errorf("GetGroupType = %q, %v; want team", groupType, err)
+		}
+		if _, err := repo.GetGroupType(ctx, 1<<30); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+		if err := repo.SetGroupType(ctx, 1<<30, "team"); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+
+		// The report covers every edge, so keep only the ones created here
+		violations, err := repo.GetNestingViolations(ctx, NestingPolicy{"role": nil})
+		if err != nil {
+			t.Fatalf("GetNestingViolations failed: %v", err)
+		}
+		var got []NestingViolation
+		for _, v := range violations {
+			if v.ChildGroupID == team {
+				got = append(got, v)
+			}
+		}
+		want := []NestingViolation{{ChildGroupID: team, ParentGroupID: role, ChildType: "team", ParentType: "role"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetNestingViolations = %+v, want %+v", got, want)
+		}
+
+		if err := repo.SetGroupType(ctx, role, ""); err != nil {
+			t.Fatalf("SetGroupType failed: %v", err)
+		}
+		if groupType, err := repo.GetGroupType(ctx, role); err != nil || groupType != "" {
+			t.Errorf("GetGroupType = %q, %v; want the type cleared", groupType, err)
+		}
+	})
+
+	t.Run("permission checks", func(t *testing.T) {
+		source := mustUser(t, "Source")
+		target := mustUser(t, "Target")
+		sourceGroup := mustGroup(t, "SourceGroup")
+		sourceParent := mustGroup(t, "SourceParent")
+		targetGroup := mustGroup(t, "TargetGroup")
+		targetParent := mustGroup(t, "TargetParent")
+		outsider := mustUser(t, "Outsider")
+
+		_, _ = repo.AddUserToGroup(ctx, source, sourceGroup)
+		_, _ = repo.AddGroupToGroup(ctx, sourceGroup, sourceParent)
+		_, _ = repo.AddUserToGroup(ctx, target, targetGroup)
+		_, _ = repo.AddGroupToGroup(ctx, targetGroup, targetParent)
+
+		check := func(t *testing.T, user int, wantUser, wantGroup bool) {
+			t.Helper()
+			if got, err := repo.HasUserPermissionOnUser(ctx, user, target); err != nil || got != wantUser {
+				t.Errorf("HasUserPermissionOnUser = %v, %v; want %v", got, err, wantUser)
+			}
+			if got, err := repo.HasUserPermissionOnGroup(ctx, user, targetGroup); err != nil || got != wantGroup {
+				t.Errorf("HasUserPermissionOnGroup = %v, %v; want %v", got, err, wantGroup)
+			}
+		}
+
+		check(t, source, false, false)
+
+		// Granting a group-to-group permission between the two parents covers both
+		// checks through nested membership on both sides
+		if _, err := repo.AddPermission(ctx, "group", "group", sourceParent, targetParent); err != nil {
+			t.Fatalf("AddPermission failed: %v", err)
+		}
+		check(t, source, true, true)
+		check(t, outsider, false, false)
+
+		// Direct grants apply to the outsider only for their target
+		_, _ = repo.AddPermission(ctx, "user", "user", outsider, target)
+		check(t, outsider, true, false)
+		_, _ = repo.AddPermission(ctx, "user", "group", outsider, targetParent)
+		check(t, outsider, true, true)
+		if _, err := repo.AddPermission(ctx, "user", "group", outsider, targetParent); err != nil {
+			t.Errorf("Granting an existing permission must succeed, got %v", err)
+		}
+	})
+
+	t.Run("change feed", func(t *testing.T) {
+		before, err := repo.CurrentRevision(ctx)
+		if err != nil {
+			t.Fatalf("CurrentRevision failed: %v", err)
+		}
+		user := mustUser(t, "Dave")
+		child := mustGroup(t, "Child")
+		parent := mustGroup(t, "Parent")
+		_, _ = repo.AddUserToGroup(ctx, user, child)
+		_, _ = repo.AddGroupToGroup(ctx, child, parent)
+		last, _ := repo.AddPermission(ctx, "user", "group", user, parent)
+
+		if current, err := repo.CurrentRevision(ctx); err != nil || current < last {
+			t.Errorf("CurrentRevision = %s, %v; want at least %s", current, err, last)
+		}
+
+		// Adding again records nothing
+		if again, err := repo.AddUserToGroup(ctx, user, child); err != nil || again != last {
+			t.Errorf("AddUserToGroup again = %s, %v; want the unchanged revision %s", again, err, last)
+		}
+		if again, err := repo.AddGroupToGroup(ctx, child, parent); err != nil || again != last {
+			t.Errorf("AddGroupToGroup again = %s, %v; want the unchanged revision %s", again, err, last)
+		}
+		if again, err := repo.AddPermission(ctx, "user", "group", user, parent); err != nil || again != last {
+			t.Errorf("AddPermission again = %s, %v; want the unchanged revision %s", again, err, last)
+		}
+
+		// but a changed condition is a new grant, and so is dropping it again
+		conditional, err := repo.AddConditionalPermission(ctx, "user", "group", user, parent, "now.hour >= 9")
+		if err != nil || conditional <= last {
+			t.Errorf("AddConditionalPermission = %s, %v; want a revision after %s", conditional, err, last)
+		}
+		if again, err := repo.AddConditionalPermission(ctx, "user", "group", user, parent, "now.hour >= 9"); err != nil || again != conditional {
+			t.Errorf("AddConditionalPermission again = %s, %v; want the unchanged revision %s", again, err, conditional)
+		}
+		if last, err = repo.AddPermission(ctx, "user", "group", user, parent); err != nil || last <= conditional {
+			t.Errorf("AddPermission = %s, %v; want a revision after %s", last, err, conditional)
+		}
+
+		events, err := repo.ListChanges(ctx, before, 100)
+		if err != nil {
+			t.Fatalf("ListChanges failed: %v", err)
+		}
+		var mine []ChangeEventType
+		for i, e := range events {
+			if i > 0 && e.Revision <= events[i-1].Revision {
+				t.Errorf("Events out of order: %s after %s", e.Revision, events[i-1].Revision)
+			}
+			if e.SubjectID == user || e.SubjectID == child && e.Type == EventEdgeAdded {
+				mine = append(mine, e.Type)
+			}
+		}
+		want := []ChangeEventType{EventMembershipAdded, EventEdgeAdded, EventPermissionGranted, EventPermissionGranted, EventPermissionGranted}
+		if !reflect.DeepEqual(mine, want) {
+			t.Errorf("Expected events %v, got %v", want, mine)
+		}
+
+		if limited, err := repo.ListChanges(ctx, before, 1); err != nil || len(limited) != 1 {
+			t.Errorf("ListChanges with limit 1 returned %d events, %v", len(limited), err)
+		}
+	})
+
+	t.Run("idempotency keys", func(t *testing.T) {
+		key := fmt.Sprintf("conformance-%d", time.Now().UnixNano())
+		keyed := WithIdempotencyKey(ctx, key)
+
+		first, err := repo.CreateUser(keyed, "Ivy")
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		if again, err := repo.CreateUser(keyed, "Ivy"); err != nil || again != first {
+			t.Errorf("Expected the retried create to return %d, got %d, %v", first, again, err)
+		}
+		if other := mustUser(t, "Ivy"); other == first {
+			t.Error("Expected a create without a key to add a new user")
+		}
+		if _, err := repo.CreateUser(keyed, "Jack"); !errors.Is(err, ErrIdempotencyKeyReused) {
+			t.Errorf("Expected ErrIdempotencyKeyReused for another name, got %v", err)
+		}
+		if _, err := repo.CreateUserGroup(keyed, "Ivy"); !errors.Is(err, ErrIdempotencyKeyReused) {
+			t.Errorf("Expected ErrIdempotencyKeyReused for another operation, got %v", err)
+		}
+
+		groupKeyed := WithIdempotencyKey(ctx, key+"-group")
+		group, err := repo.CreateUserGroup(groupKeyed, "Retried")
+		if err != nil {
+			t.Fatalf("CreateUserGroup failed: %v", err)
+		}
+		if again, err := repo.CreateUserGroup(groupKeyed, "Retried"); err != nil || again != group {
+			t.Errorf("Expected the retried create to return %d, got %d, %v", group, again, err)
+		}
+	})
+
+	t.Run("external IDs and names", func(t *testing.T) {
+		// The MySQL database is shared between runs, so external IDs and names are unique
+		suffix := fmt.Sprint(time.Now().UnixNano())
+		name := "Kim-" + suffix
+
+		user, err := repo.CreateUserWithExternalID(ctx, name, "idp|"+suffix)
+		if err != nil {
+			t.Fatalf("CreateUserWithExternalID failed: %v", err)
+		}
+		if got, err := repo.GetUserByExternalID(ctx, "idp|"+suffix); err != nil || got != user {
+			t.Errorf("GetUserByExternalID = %d, %v; want %d", got, err, user)
+		}
+		twin := mustUser(t, name)
+		ids, err := repo.FindUsersByName(ctx, name)
+		assertIDs(t, "FindUsersByName", ids, err, user, twin)
+
+		var conflict *ExternalIDConflictError
+		_, err = repo.CreateUserWithExternalID(ctx, "Other", "idp|"+suffix)
+		if !errors.As(err, &conflict) || conflict.ExistingID != user {
+			t.Errorf("Expected an ExternalIDConflictError for user %d, got %v", user, err)
+		}
+		if err := repo.SetUserExternalID(ctx, twin, "idp|"+suffix); !errors.Is(err, ErrExternalIDConflict) {
+			t.Errorf("Expected ErrExternalIDConflict, got %v", err)
+		}
+
+		// Moving the external ID frees the old one
+		if err := repo.SetUserExternalID(ctx, user, "idp|moved-"+suffix); err != nil {
+			t.Fatalf("SetUserExternalID failed: %v", err)
+		}
+		if err := repo.SetUserExternalID(ctx, twin, "idp|"+suffix); err != nil {
+			t.Errorf("Expected the freed external ID to be available, got %v", err)
+		}
+		if err := repo.SetUserExternalID(ctx, user, ""); err != nil {
+			t.Fatalf("Clearing the external ID failed: %v", err)
+		}
+		if _, err := repo.GetUserByExternalID(ctx, "idp|moved-"+suffix); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound for a cleared external ID, got %v", err)
+		}
+		if err := repo.SetUserExternalID(ctx, 99999999, "idp|missing-"+suffix); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound for an unknown user, got %v", err)
+		}
+
+		// Users and groups have separate external IDs
+		group, err := repo.CreateUserGroupWithExternalID(ctx, name, "idp|"+suffix)
+		if err != nil {
+			t.Fatalf("CreateUserGroupWithExternalID failed: %v", err)
+		}
+		if got, err := repo.GetUserGroupByExternalID(ctx, "idp|"+suffix); err != nil || got != group {
+			t.Errorf("GetUserGroupByExternalID = %d, %v; want %d", got, err, group)
+		}
+		ids, err = repo.FindUserGroupsByName(ctx, name)
+		assertIDs(t, "FindUserGroupsByName", ids, err, group)
+		if _, err := repo.GetUserGroupByExternalID(ctx, "idp|none-"+suffix); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+		ids, err = repo.FindUsersByName(ctx, "Nobody-"+suffix)
+		assertIDs(t, "FindUsersByName", ids, err)
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		user := mustUser(t, "Nora")
+		group := mustGroup(t, "Finance")
+
+		sets := []struct {
+			name  string
+			value interface{}
+		}{
+			{"email", "nora@example.com"},
+			{"level", int64(3)},
+			{"contractor", false},
+			{"roles", []string{"admin", "auditor"}},
+		}
+		for _, set := range sets {
+			if _, err := repo.SetAttribute(ctx, "user", user, set.name, set.value); err != nil {
+				t.Fatalf("SetAttribute(%s) failed: %v", set.name, err)
+			}
+		}
+		if _, err := repo.SetAttribute(ctx, "group", group, "cost_center", 4711); err != nil {
+			t.Fatalf("SetAttribute failed: %v", err)
+		}
+
+		attrs, err := repo.GetAttributes(ctx, "user", user)
+		want := Attributes{"email": "nora@example.com", "level": 3, "contractor": false, "roles": []string{"admin", "auditor"}}
+		if err != nil || !reflect.DeepEqual(attrs, want) {
+			t.Errorf("GetAttributes = %v, %v; want %v", attrs, err, want)
+		}
+		attrs, err = repo.GetAttributes(ctx, "group", group)
+		if err != nil || !reflect.DeepEqual(attrs, Attributes{"cost_center": 4711}) {
+			t.Errorf("GetAttributes = %v, %v; want cost_center 4711", attrs, err)
+		}
+
+		// Overwriting replaces the value and nil removes it
+		if _, err := repo.SetAttribute(ctx, "user", user, "email", "nora@example.org"); err != nil {
+			t.Fatalf("SetAttribute failed: %v", err)
+		}
+		if _, err := repo.SetAttribute(ctx, "user", user, "roles", nil); err != nil {
+			t.Fatalf("Removing an attribute failed: %v", err)
+		}
+		attrs, err = repo.GetAttributes(ctx, "user", user)
+		want = Attributes{"email": "nora@example.org", "level": 3, "contractor": false}
+		if err != nil || !reflect.DeepEqual(attrs, want) {
+			t.Errorf("GetAttributes = %v, %v; want %v", attrs, err, want)
+		}
+
+		if _, err := repo.SetAttribute(ctx, "user", 99999999, "email", "x"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+		if _, err := repo.GetAttributes(ctx, "group", 99999999); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+		if _, err := repo.SetAttribute(ctx, "user", user, "weight", 1.5); !errors.Is(err, ErrInvalidAttribute) {
+			t.Errorf("Expected ErrInvalidAttribute for a float, got %v", err)
+		}
+	})
+
+	t.Run("conditional permissions", func(t *testing.T) {
+		source := mustUser(t, "Quinn")
+		target := mustUser(t, "Ravi")
+		team := mustGroup(t, "Support")
+		customers := mustGroup(t, "Customers")
+		_, _ = repo.AddUserToGroup(ctx, source, team)
+		for user, department := range map[int]string{source: "sales", target: "legal"} {
+			if _, err := repo.SetAttribute(ctx, "user", user, "department", department); err != nil {
+				t.Fatalf("SetAttribute failed: %v", err)
+			}
+		}
+		checkUser := func(t *testing.T, ctx context.Context, want bool) {
+			t.Helper()
+			if got, err := repo.HasUserPermissionOnUser(ctx, source, target); err != nil || got != want {
+				t.Errorf("HasUserPermissionOnUser = %v, %v; want %v", got, err, want)
+			}
+		}
+		checkGroup := func(t *testing.T, ctx context.Context, want bool) {
+			t.Helper()
+			if got, err := repo.HasUserPermissionOnGroup(ctx, source, customers); err != nil || got != want {
+				t.Errorf("HasUserPermissionOnGroup = %v, %v; want %v", got, err, want)
+			}
+		}
+
+		// Attribute conditions are evaluated against the current attributes
+		if _, err := repo.AddConditionalPermission(ctx, "user", "user", source, target, "source.department == target.department"); err != nil {
+			t.Fatalf("AddConditionalPermission failed: %v", err)
+		}
+		checkUser(t, ctx, false)
+		_, _ = repo.SetAttribute(ctx, "user", target, "department", "sales")
+		checkUser(t, ctx, true)
+
+		// Request conditions apply through group grants and read the context
+		if _, err := repo.AddConditionalPermission(ctx, "group", "group", team, customers, `request.tenant == "acme"`); err != nil {
+			t.Fatalf("AddConditionalPermission failed: %v", err)
+		}
+		checkGroup(t, ctx, false)
+		checkGroup(t, WithRequestAttributes(ctx, Attributes{"tenant": "acme"}), true)
+		checkGroup(t, WithRequestAttributes(ctx, Attributes{"tenant": "globex"}), false)
+
+		// AddPermission makes the grant unconditional, AddConditionalPermission replaces
+		// the condition again
+		if _, err := repo.AddPermission(ctx, "group", "group", team, customers); err != nil {
+			t.Fatalf("AddPermission failed: %v", err)
+		}
+		checkGroup(t, ctx, true)
+		if _, err := repo.AddConditionalPermission(ctx, "group", "group", team, customers, "now.hour >= 9 && now.hour < 17"); err != nil {
+			t.Fatalf("AddConditionalPermission failed: %v", err)
+		}
+		checkGroup(t, WithConditionTime(ctx, time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)), true)
+		checkGroup(t, WithConditionTime(ctx, time.Date(2024, 3, 4, 20, 0, 0, 0, time.UTC)), false)
+
+		if _, err := repo.AddConditionalPermission(ctx, "user", "user", source, target, "source.department =="); !errors.Is(err, ErrInvalidCondition) {
+			t.Errorf("Expected ErrInvalidCondition, got %v", err)
+		}
+		checkUser(t, ctx, true)
+
+		if graph, ok := repo.(GraphSource); ok {
+			snapshot, err := graph.LoadGraphSnapshot(ctx)
+			if err != nil {
+				t.Fatalf("LoadGraphSnapshot failed: %v", err)
+			}
+			want := Permission{SourceType: "group", SourceID: team, TargetType: "group", TargetID: customers,
+				Condition: "now.hour >= 9 && now.hour < 17"}
+			found := false
+			for _, p := range snapshot.Permissions {
+				found = found || p == want
+			}
+			if !found {
+				t.Errorf("Expected %+v in the snapshot", want)
+			}
+		}
+	})
+
+	t.Run("dynamic groups", func(t *testing.T) {
+		ines := mustUser(t, "Ines")
+		olaf := mustUser(t, "Olaf")
+		group := mustGroup(t, "Dynamic")
+		parent := mustGroup(t, "Dynamic Parent")
+		if _, err := repo.AddGroupToGroup(ctx, group, parent); err != nil {
+			t.Fatalf("AddGroupToGroup failed: %v", err)
+		}
+		// The team is unique to this run, so users of earlier runs never match
+		team := fmt.Sprintf("team-%d", group)
+		if _, err := repo.SetAttribute(ctx, "user", ines, "dyn_team", team); err != nil {
+			t.Fatalf("SetAttribute failed: %v", err)
+		}
+
+		before, _ := repo.CurrentRevision(ctx)
+		rule := fmt.Sprintf("user.dyn_team == %q", team)
+		rev, err := repo.SetGroupRule(ctx, group, rule)
+		if err != nil || rev <= before {
+			t.Fatalf("SetGroupRule = %s, %v; want a revision after %s", rev, err, before)
+		}
+		if got, err := repo.GetGroupRule(ctx, group); err != nil || got != rule {
+			t.Errorf("GetGroupRule = %q, %v; want %q", got, err, rule)
+		}
+		// Setting the same rule again records nothing
+		if again, err := repo.SetGroupRule(ctx, group, rule); err != nil || again != rev {
+			t.Errorf("SetGroupRule again = %s, %v; want %s", again, err, rev)
+		}
+		users, err := repo.GetUsersInGroup(ctx, group)
+		assertIDs(t, "GetUsersInGroup", users, err, ines)
+		users, err = repo.GetUsersInGroupTransitive(ctx, parent)
+		assertIDs(t, "GetUsersInGroupTransitive", users, err, ines)
+
+		// Attribute changes move users in and out of the group
+		joined, err := repo.SetAttribute(ctx, "user", olaf, "dyn_team", team)
+		if err != nil || joined <= rev {
+			t.Fatalf("SetAttribute = %s, %v; want a revision after %s", joined, err, rev)
+		}
+		if _, err := repo.SetAttribute(ctx, "user", ines, "dyn_team", nil); err != nil {
+			t.Fatalf("SetAttribute failed: %v", err)
+		}
+		users, err = repo.GetUsersInGroup(ctx, group)
+		assertIDs(t, "GetUsersInGroup", users, err, olaf)
+		if _, err := repo.AddUserToGroup(ctx, ines, group); !errors.Is(err, ErrDynamicGroup) {
+			t.Errorf("Expected ErrDynamicGroup, got %v", err)
+		}
+
+		events, err := repo.ListChanges(ctx, before, 100)
+		if err != nil {
+			t.Fatalf("ListChanges failed: %v", err)
+		}
+		var mine []ChangeEvent
+		for _, e := range events {
+			if e.ObjectType == "group" && e.ObjectID == group {
+				mine = append(mine, ChangeEvent{Type: e.Type, SubjectID: e.SubjectID})
+			}
+			if e.Type == EventMembershipAdded && e.SubjectID == olaf && e.Revision != joined {
+				t.Errorf("Expected SetAttribute to return revision %s of the membership, got %s", e.Revision, joined)
+			}
+		}
+		want := []ChangeEvent{
+			{Type: EventRuleChanged, SubjectID: group},
+			{Type: EventMembershipAdded, SubjectID: ines},
+			{Type: EventMembershipAdded, SubjectID: olaf},
+			{Type: EventMembershipRemoved, SubjectID: ines},
+		}
+		if !reflect.DeepEqual(mine, want) {
+			t.Errorf("Expected events %v, got %v", want, mine)
+		}
+
+		// Clearing the rule keeps the members and allows manual ones again
+		cleared, err := repo.SetGroupRule(ctx, group, "")
+		if err != nil {
+			t.Fatalf("SetGroupRule failed: %v", err)
+		}
+		if events, err := repo.ListChanges(ctx, cleared-1, 1); err != nil || len(events) != 1 || events[0].Type != EventRuleChanged {
+			t.Errorf("Expected a rule_changed event at revision %s, got %v, %v", cleared, events, err)
+		}
+		if got, err := repo.GetGroupRule(ctx, group); err != nil || got != "" {
+			t.Errorf("GetGroupRule = %q, %v; want a static group", got, err)
+		}
+		if _, err := repo.AddUserToGroup(ctx, ines, group); err != nil {
+			t.Errorf("AddUserToGroup failed: %v", err)
+		}
+		users, err = repo.GetUsersInGroup(ctx, group)
+		assertIDs(t, "GetUsersInGroup", users, err, ines, olaf)
+
+		if _, err := repo.SetGroupRule(ctx, group, "user.level >"); !errors.Is(err, ErrInvalidCondition) {
+			t.Errorf("Expected ErrInvalidCondition, got %v", err)
+		}
+		if _, err := repo.SetGroupRule(ctx, 99999999, rule); !errors.Is(err, ErrUserGroupNotFound) {
+			t.Errorf("Expected ErrUserGroupNotFound, got %v", err)
+		}
+	})
+
+	t.Run("user status", func(t *testing.T) {
+		pia := mustUser(t, "Pia")
+		quinn := mustUser(t, "Quinn")
+		group := mustGroup(t, "Status")
+		_, _ = repo.AddUserToGroup(ctx, pia, group)
+		_, _ = repo.AddPermission(ctx, "group", "user", group, quinn)
+		_, _ = repo.AddPermission(ctx, "group", "group", group, group)
+
+		if status, err := repo.GetUserStatus(ctx, pia); err != nil || status != UserActive {
+			t.Fatalf("GetUserStatus = %q, %v; want active", status, err)
+		}
+		before, _ := repo.CurrentRevision(ctx)
+		rev, err := repo.SetUserStatus(ctx, pia, UserSuspended)
+		if err != nil || rev <= before {
+			t.Fatalf("SetUserStatus = %s, %v; want a revision after %s", rev, err, before)
+		}
+
+		// Suspended users are denied every check but keep their memberships
+		if got, err := repo.HasUserPermissionOnUser(ctx, pia, quinn); err != nil || got {
+			t.Errorf("HasUserPermissionOnUser = %v, %v; want a denial while suspended", got, err)
+		}
+		if got, err := repo.HasUserPermissionOnGroup(ctx, pia, group); err != nil || got {
+			t.Errorf("HasUserPermissionOnGroup = %v, %v; want a denial while suspended", got, err)
+		}
+		users, err := repo.GetUsersInGroup(ctx, group)
+		assertIDs(t, "GetUsersInGroup", users, err, pia)
+		statuses, err := repo.GetUserStatuses(ctx, []int{pia, quinn, 99999999})
+		if want := map[int]UserStatus{pia: UserSuspended, quinn: UserActive}; err != nil || !reflect.DeepEqual(statuses, want) {
+			t.Errorf("GetUserStatuses = %v, %v; want %v", statuses, err, want)
+		}
+
+		// Setting the same status again records nothing
+		if again, err := repo.SetUserStatus(ctx, pia, UserSuspended); err != nil || again != rev {
+			t.Errorf("SetUserStatus = %s, %v; want the unchanged revision %s", again, err, rev)
+		}
+		if _, err := repo.SetUserStatus(ctx, pia, UserActive); err != nil {
+			t.Fatalf("SetUserStatus failed: %v", err)
+		}
+		if got, err := repo.HasUserPermissionOnUser(ctx, pia, quinn); err != nil || !got {
+			t.Errorf("HasUserPermissionOnUser = %v, %v; want access after reinstatement", got, err)
+		}
+
+		events, err := repo.ListChanges(ctx, before, 100)
+		if err != nil {
+			t.Fatalf("ListChanges failed: %v", err)
+		}
+		var mine []UserStatus
+		for _, e := range events {
+			if e.Type == EventUserStatusChanged && e.SubjectID == pia {
+				mine = append(mine, e.Status)
+			}
+		}
+		if want := []UserStatus{UserSuspended, UserActive}; !reflect.DeepEqual(mine, want) {
+			t.Errorf("Expected status events %v, got %v", want, mine)
+		}
+
+		if _, err := repo.SetUserStatus(ctx, pia, "retired"); !errors.Is(err, ErrInvalidUserStatus) {
+			t.Errorf("Expected ErrInvalidUserStatus, got %v", err)
+		}
+		if _, err := repo.SetUserStatus(ctx, 99999999, UserSuspended); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+		if _, err := repo.GetUserStatus(ctx, 99999999); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+	})
+
+	t.Run("listings", func(t *testing.T) {
+		parent := mustGroup(t, "Listing")
+		// The prefix is unique to this run, so users of earlier runs never match
+		prefix := fmt.Sprintf("List%d ", parent)
+		abe1 := mustUser(t, prefix+"Abe")
+		bea := mustUser(t, prefix+"Bea")
+		abe2 := mustUser(t, prefix+"Abe")
+		cid := mustUser(t, prefix+"Cid")
+		odd := mustUser(t, prefix+"x_y")
+		child := mustGroup(t, prefix+"Child")
+		for _, user := range []int{abe1, bea, abe2} {
+			_, _ = repo.AddUserToGroup(ctx, user, parent)
+		}
+		_, _ = repo.AddUserToGroup(ctx, cid, child)
+		_, _ = repo.AddGroupToGroup(ctx, child, parent)
+
+		// all walks every page of a listing with a page size of two
+		all := func(t *testing.T, list func(ListOptions) (Page, error), opts ListOptions) ([]int, int) {
+			t.Helper()
+			var ids []int
+			total := -1
+			opts.Limit = 2
+			for {
+				page, err := list(opts)
+				if err != nil {
+					t.Fatalf("listing failed: %v", err)
+				}
+				if total >= 0 && page.Total != total {
+					t.Errorf("Total changed from %d to %d between pages", total, page.Total)
+				}
+				total = page.Total
+				ids = append(ids, page.IDs()...)
+				if page.NextCursor == "" {
+					return ids, total
+				}
+				opts.Cursor = page.NextCursor
+			}
+		}
+		users := func(opts ListOptions) (Page, error) { return repo.ListUsers(ctx, opts) }
+
+		ids, total := all(t, users, ListOptions{NamePrefix: prefix})
+		if want := []int{abe1, bea, abe2, cid, odd}; !reflect.DeepEqual(ids, want) || total != 5 {
+			t.Errorf("ListUsers by ID = %v (total %d), want %v (total 5)", ids, total, want)
+		}
+		ids, _ = all(t, users, ListOptions{NamePrefix: prefix, Sort: SortByName})
+		if want := []int{abe1, abe2, bea, cid, odd}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("ListUsers by name = %v, want %v", ids, want)
+		}
+		ids, _ = all(t, users, ListOptions{NamePrefix: prefix, Sort: SortByName, Descending: true})
+		if want := []int{odd, cid, bea, abe2, abe1}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("ListUsers by name descending = %v, want %v", ids, want)
+		}
+
+		// Prefixes match literally
+		if page, err := repo.ListUsers(ctx, ListOptions{NamePrefix: prefix + "x_"}); err != nil || !reflect.DeepEqual(page.IDs(), []int{odd}) {
+			t.Errorf("ListUsers(%q) = %v, %v; want [%d]", prefix+"x_", page.IDs(), err, odd)
+		}
+		if page, err := repo.ListUsers(ctx, ListOptions{NamePrefix: prefix + "A_e"}); err != nil || page.Total != 0 || len(page.Items) != 0 {
+			t.Errorf("ListUsers(%q) = %+v, %v; want an empty page", prefix+"A_e", page, err)
+		}
+
+		page, err := repo.ListUserGroups(ctx, ListOptions{NamePrefix: prefix})
+		if want := []PageItem{{ID: child, Name: prefix + "Child"}}; err != nil || !reflect.DeepEqual(page.Items, want) {
+			t.Errorf("ListUserGroups = %+v, %v; want %v", page, err, want)
+		}
+		page, err = repo.ListGroupsInGroup(ctx, parent, ListOptions{})
+		if want := []PageItem{{ID: child, Name: prefix + "Child"}}; err != nil || !reflect.DeepEqual(page.Items, want) || page.Total != 1 {
+			t.Errorf("ListGroupsInGroup = %+v, %v; want %v", page, err, want)
+		}
+		ids, total = all(t, func(opts ListOptions) (Page, error) { return repo.ListUsersInGroup(ctx, parent, opts) }, ListOptions{})
+		if want := []int{abe1, bea, abe2}; !reflect.DeepEqual(ids, want) || total != 3 {
+			t.Errorf("ListUsersInGroup = %v (total %d), want %v", ids, total, want)
+		}
+		ids, total = all(t, func(opts ListOptions) (Page, error) { return repo.ListUsersInGroupTransitive(ctx, parent, opts) },
+			ListOptions{Sort: SortByName, Descending: true})
+		if want := []int{cid, bea, abe2, abe1}; !reflect.DeepEqual(ids, want) || total != 4 {
+			t.Errorf("ListUsersInGroupTransitive = %v (total %d), want %v", ids, total, want)
+		}
+
+		first, _ := repo.ListUsers(ctx, ListOptions{NamePrefix: prefix, Limit: 1})
+		for _, opts := range []ListOptions{
+			{Limit: -1},
+			{Sort: "age"},
+			{Cursor: "not a cursor"},
+			{NamePrefix: prefix, Cursor: first.NextCursor, Sort: SortByName},
+		} {
+			if _, err := repo.ListUsers(ctx, opts); !errors.Is(err, ErrInvalidListOptions) {
+				t.Errorf("ListUsers(%+v): expected ErrInvalidListOptions, got %v", opts, err)
+			}
+		}
+	})
+
+	t.Run("graph snapshot", func(t *testing.T) {
+		source, ok := repo.(GraphSource)
+		if !ok {
+			t.Skip("repository does not implement GraphSource")
+		}
+		user := mustUser(t, "Erin")
+		group := mustGroup(t, "Snapshot")
+		rev, _ := repo.AddUserToGroup(ctx, user, group)
+
+		snapshot, err := source.LoadGraphSnapshot(ctx)
+		if err != nil {
+			t.Fatalf("LoadGraphSnapshot failed: %v", err)
+		}
+		if snapshot.Revision < rev {
+			t.Errorf("Snapshot revision %s is older than %s", snapshot.Revision, rev)
+		}
+		found := false
+		for _, m := range snapshot.Memberships {
+			found = found || m == Membership{UserID: user, GroupID: group}
+		}
+		if !found {
+			t.Error("Expected the new membership in the snapshot")
+		}
+	})
+}
+
+func Test_Conformance_FakeRepository(t *testing.T) {
+	runRepositoryConformance(t, newFakeRepository())
+}
+
+func Test_Conformance_MySQLRepository(t *testing.T) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	repo := NewMySQLRepository(db)
+	defer repo.Close()
+
+	runRepositoryConformance(t, repo)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers that roll back the failed statement or transaction, so running
+// it again cannot apply it twice
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// RetryPolicy controls how transient database errors are retried. The n-th retry
+// waits a random duration between zero and InitialBackoff*2^(n-1), capped at
+// MaxBackoff, so concurrent transactions that deadlocked do not collide again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first; 1 or less disables retries
+	MaxAttempts int
+
+	// InitialBackoff bounds the wait before the first retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff bounds the wait before any retry
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used unless configured otherwise
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     200 * time.Millisecond,
+	}
+}
+
+// backoff returns the jittered wait before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	limit := p.InitialBackoff
+	for i := 1; i < retry && limit < p.MaxBackoff; i++ {
+		limit *= 2
+	}
+	if limit > p.MaxBackoff {
+		limit = p.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// commitError marks a failed COMMIT. If the connection dropped during COMMIT, the
+// transaction may or may not have committed.
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string {
+	return "failed to commit transaction: " + e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+	return e.err
+}
+
+// retryReason classifies err for retries: "deadlock" and "lock_wait_timeout" are
+// rolled back by the server and always safe to retry, "connection" is a dropped
+// connection, whose statement may or may not have been applied. It returns "" for
+// errors that must not be retried.
+func retryReason(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlErrDeadlock:
+			return "deadlock"
+		case mysqlErrLockWaitTimeout:
+			return "lock_wait_timeout"
+		}
+		return ""
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "connection"
+	}
+	return ""
+}
+
+// retryable reports whether an operation that failed with err may run again.
+// Operations that are not idempotent, such as inserts of new rows, and failed
+// commits are only retried if the server rolled them back.
+func retryable(err error, idempotent bool) (reason string, ok bool) {
+	reason = retryReason(err)
+	switch {
+	case reason == "":
+		return "", false
+	case reason != "connection":
+		return reason, true
+	}
+	var commitErr *commitError
+	return reason, idempotent && !errors.As(err, &commitErr)
+}
+
+// retry runs attempt until it succeeds, fails with an error that must not be
+// retried, exhausts the policy or ctx ends. It records every retry in the span,
+// the log and the retry counter.
+func (r *SQLRepository) retry(ctx context.Context, op string, span Span, kind queryKind, attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || n >= r.retryPolicy.MaxAttempts {
+			return err
+		}
+		reason, ok := retryable(err, kind != kindInsert)
+		if !ok {
+			return err
+		}
+
+		wait := r.retryPolicy.backoff(n)
+		span.SetAttributes(IntAttr("db.retries", n))
+		r.logger.Log(ctx, LevelWarn, "retrying transient database error",
+			StringAttr("operation", op), StringAttr("reason", reason),
+			IntAttr("attempt", n), StringAttr("error", err.Error()))
+		if r.metrics != nil {
+			r.metrics.inc(metricDBRetries, "operation", op, "reason", reason)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// newRetryRepository returns a repository without a database for exercising retry
+func newRetryRepository(policy RetryPolicy, metrics *Metrics, logger Logger) *SQLRepository {
+	return &SQLRepository{retryPolicy: policy, metrics: metrics, logger: logger, tracer: noopTracer{}}
+}
+
+func Test_Retry_Classification(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}
+	lockWait := &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded"}
+
+	tests := []struct {
+		name       string
+		err        error
+		idempotent bool
+		reason     string
+		ok         bool
+	}{
+		{"deadlock", fmt.Errorf("failed to insert: %w", deadlock), false, "deadlock", true},
+		{"lock wait timeout", lockWait, false, "lock_wait_timeout", true},
+		{"deadlock on commit", &commitError{err: deadlock}, false, "deadlock", true},
+		{"duplicate key", &mysql.MySQLError{Number: 1062}, true, "", false},
+		{"bad connection on read", driver.ErrBadConn, true, "connection", true},
+		{"invalid connection on read", mysql.ErrInvalidConn, true, "connection", true},
+		{"unexpected EOF on read", io.ErrUnexpectedEOF, true, "connection", true},
+		{"bad connection on insert", driver.ErrBadConn, false, "connection", false},
+		{"bad connection on commit", &commitError{err: driver.ErrBadConn}, true, "connection", false},
+		{"not found", ErrUserNotFound, true, "", false},
+		{"canceled", context.Canceled, true, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, ok := retryable(tt.err, tt.idempotent)
+			if reason != tt.reason || ok != tt.ok {
+				t.Errorf("retryable = %q, %v; want %q, %v", reason, ok, tt.reason, tt.ok)
+			}
+		})
+	}
+}
+
+func Test_Retry_Backoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	limits := []time.Duration{10, 20, 40, 50, 50}
+	for i, limit := range limits {
+		for j := 0; j < 100; j++ {
+			if wait := policy.backoff(i + 1); wait < 0 || wait > limit*time.Millisecond {
+				t.Fatalf("Retry %d waited %v, want at most %v", i+1, wait, limit*time.Millisecond)
+			}
+		}
+	}
+	if wait := (RetryPolicy{}).backoff(1); wait != 0 {
+		t.Errorf("Expected no wait without a backoff, got %v", wait)
+	}
+}
+
+func Test_Retry_Loop(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	deadlock := &mysql.MySQLError{Number: mysqlErrDeadlock}
+	ctx := context.Background()
+
+	t.Run("succeeds after transient errors", func(t *testing.T) {
+		var logs logBuffer
+		metrics := NewMetrics()
+		r := newRetryRepository(policy, metrics, NewJSONLogger(&logs, LevelDebug))
+		tracer := NewRecordingTracer()
+		_, span := tracer.Start(ctx, "mysql.AddGroupToGroup")
+
+		attempts := 0
+		err := r.retry(ctx, "AddGroupToGroup", span, kindTransaction, func() error {
+			attempts++
+			if attempts < 3 {
+				return deadlock
+			}
+			return nil
+		})
+		if err != nil || attempts != 3 {
+			t.Fatalf("Expected success on the third attempt, got %v after %d", err, attempts)
+		}
+		span.End()
+		if got := tracer.Spans()[0].Attributes["db.retries"]; got != 2 {
+			t.Errorf("Expected db.retries=2, got %v", got)
+		}
+		entry, ok := findEntry(logs.entries(t), "retrying transient database error", "")
+		if !ok || entry["level"] != "warn" || entry["reason"] != "deadlock" {
+			t.Errorf("Expected a retry warning, got %v", logs.entries(t))
+		}
+
+		var buf bytes.Buffer
+		if err := metrics.WritePrometheus(&buf); err != nil {
+			t.Fatalf("WritePrometheus failed: %v", err)
+		}
+		assertLines(t, buf.String(),
+			"# TYPE permissions_db_retries_total counter",
+			`permissions_db_retries_total{operation="AddGroupToGroup",reason="deadlock"} 2`,
+		)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		r := newRetryRepository(policy, nil, noopLogger{})
+		attempts := 0
+		err := r.retry(ctx, "GetUserByID", noopSpan{}, kindRead, func() error {
+			attempts++
+			return driver.ErrBadConn
+		})
+		if !errors.Is(err, driver.ErrBadConn) || attempts != 3 {
+			t.Errorf("Expected the last error after 3 attempts, got %v after %d", err, attempts)
+		}
+	})
+
+	t.Run("does not repeat inserts on dropped connections", func(t *testing.T) {
+		r := newRetryRepository(policy, nil, noopLogger{})
+		attempts := 0
+		err := r.retry(ctx, "CreateUser", noopSpan{}, kindInsert, func() error {
+			attempts++
+			return driver.ErrBadConn
+		})
+		if !errors.Is(err, driver.ErrBadConn) || attempts != 1 {
+			t.Errorf("Expected a single attempt, got %v after %d", err, attempts)
+		}
+	})
+
+	t.Run("stops when the context ends", func(t *testing.T) {
+		slow := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+		r := newRetryRepository(slow, nil, noopLogger{})
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		attempts := 0
+		start := time.Now()
+		err := r.retry(canceled, "AddGroupToGroup", noopSpan{}, kindTransaction, func() error {
+			attempts++
+			return deadlock
+		})
+		if !errors.Is(err, deadlock) || attempts != 1 || time.Since(start) > time.Second {
+			t.Errorf("Expected to stop after the first attempt, got %v after %d", err, attempts)
+		}
+	})
+}
+
+func Test_Retry_Config(t *testing.T) {
+	if got := DefaultConfig().Retry; got != DefaultRetryPolicy() {
+		t.Errorf("Expected the default retry policy, got %+v", got)
+	}
+	if r := NewSQLRepository(nil, MySQLDialect{}, WithSQLRetryPolicy(RetryPolicy{MaxAttempts: 1})); r.retryPolicy.MaxAttempts != 1 {
+		t.Errorf("Expected the configured policy, got %+v", r.retryPolicy)
+	}
+}
+
+func Test_Config_RepositoryOptions(t *testing.T) {
+	config := DefaultConfig()
+	config.Retry.MaxAttempts = 5
+	config.IdempotencyTTL = time.Hour
+	config.UniqueNames = true
+	config.HierarchyLimits = HierarchyLimits{MaxDepth: 4, MaxChildren: 10, MaxParents: 2}
+	config.NestingPolicy = NestingPolicy{"org": {"team"}}
+
+	m := NewMySQLRepository(nil, WithMySQLConfig(config))
+	if m.retryPolicy != config.Retry || m.idempotencyTTL != time.Hour || !m.uniqueNames ||
+		m.hierarchyLimits != config.HierarchyLimits || !reflect.DeepEqual(m.nestingPolicy, config.NestingPolicy) {
+		t.Errorf("Expected the MySQL repository to take the config, got %+v %v %v %+v %v",
+			m.retryPolicy, m.idempotencyTTL, m.uniqueNames, m.hierarchyLimits, m.nestingPolicy)
+	}
+
+	m = NewMySQLRepository(nil, WithMySQLConfig(config), WithMySQLUniqueNames(false))
+	if m.uniqueNames {
+		t.Error("Expected a later option to override the config")
+	}
+
+	f := openFileRepository(t, t.TempDir(), WithFileConfig(config))
+	defer f.Close()
+	if f.idempotencyTTL != time.Hour || !f.uniqueNames || f.hierarchyLimits != config.HierarchyLimits ||
+		!reflect.DeepEqual(f.nestingPolicy, config.NestingPolicy) {
+		t.Errorf("Expected the file repository to take the config, got %v %v %+v %v",
+			f.idempotencyTTL, f.uniqueNames, f.hierarchyLimits, f.nestingPolicy)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revision identifies a point in the write history of the permission data.
+// Every mutation produces a new, strictly greater revision. Callers should treat
+// the value as an opaque token: store it, pass it back, but do not derive meaning
+// from it beyond ordering.
+type Revision uint64
+
+// revisionTokenPrefix marks serialized revision tokens
+const revisionTokenPrefix = "rev_"
+
+// String returns the opaque token form of the revision
+func (r Revision) String() string {
+	return revisionTokenPrefix + strconv.FormatUint(uint64(r), 36)
+}
+
+// ParseRevision parses a token previously produced by Revision.String
+func ParseRevision(token string) (Revision, error) {
+	if !strings.HasPrefix(token, revisionTokenPrefix) {
+		return 0, fmt.Errorf("invalid revision token %q", token)
+	}
+	value, err := strconv.ParseUint(strings.TrimPrefix(token, revisionTokenPrefix), 36, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid revision token %q: %w", token, err)
+	}
+	return Revision(value), nil
+}
+
+// MarshalText encodes the revision as its opaque token, e.g. in JSON payloads
+func (r Revision) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes a revision token
+func (r *Revision) UnmarshalText(text []byte) error {
+	rev, err := ParseRevision(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rev
+	return nil
+}
+
+// minRevisionKey is the context key for the minimum revision a read must observe
+type minRevisionKey struct{}
+
+// WithMinRevision returns a context that requires reads to be at least as fresh as rev.
+// If the context carries a deadline, reads wait for the store to catch up until the
+// deadline expires; otherwise they fail immediately with a StaleRevisionError.
+func WithMinRevision(ctx context.Context, rev Revision) context.Context {
+	return context.WithValue(ctx, minRevisionKey{}, rev)
+}
+
+// MinRevisionFromContext returns the minimum revision required by the context, if any
+func MinRevisionFromContext(ctx context.Context) (Revision, bool) {
+	rev, ok := ctx.Value(minRevisionKey{}).(Revision)
+	return rev, ok
+}
+
+// Polling bounds used while waiting for the store to reach a required revision
+const (
+	revisionPollInitial = 10 * time.Millisecond
+	revisionPollMax     = 200 * time.Millisecond
+)
+
+// awaitRevision blocks until the repository has reached the minimum revision
+// carried by ctx. It returns immediately if no minimum revision is set.
+func (s *Server) awaitRevision(ctx context.Context) error {
+	required, ok := MinRevisionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	_, hasDeadline := ctx.Deadline()
+	wait := revisionPollInitial
+	for {
+		current, err := s.repo.CurrentRevision(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get current revision: %w", err)
+		}
+		if current >= required {
+			return nil
+		}
+		if !hasDeadline {
+			return &StaleRevisionError{Required: required, Current: current}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &StaleRevisionError{Required: required, Current: current}
+		case <-timer.C:
+		}
+
+		if wait *= 2; wait > revisionPollMax {
+			wait = revisionPollMax
+		}
+	}
+}
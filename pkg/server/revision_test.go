@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_Revision_TokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rev  Revision
+	}{
+		{name: "zero", rev: 0},
+		{name: "small", rev: 42},
+		{name: "large", rev: 1<<63 + 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseRevision(tt.rev.String())
+			if err != nil {
+				t.Fatalf("ParseRevision failed: %v", err)
+			}
+			if parsed != tt.rev {
+				t.Errorf("Expected revision %d, got %d", tt.rev, parsed)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "42", "rev_", "rev_!!"} {
+		if _, err := ParseRevision(token); err == nil {
+			t.Errorf("Expected error for token %q, got nil", token)
+		}
+	}
+}
+
+func Test_Revision_MutationsReturnIncreasingRevisions(t *testing.T) {
+	s := setupTestServer(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	parent, _ := s.CreateUserGroup(ctx, "Parent")
+	child, _ := s.CreateUserGroup(ctx, "Child")
+
+	mutations := []struct {
+		name string
+		run  func() (Revision, error)
+	}{
+		{name: "add user to group", run: func() (Revision, error) { return s.AddUserToGroupWithRevision(ctx, alice, child) }},
+		{name: "add group to group", run: func() (Revision, error) { return s.AddUserGroupToGroupWithRevision(ctx, child, parent) }},
+		{name: "user to user", run: func() (Revision, error) { return s.AddUserToUserPermissionWithRevision(ctx, alice, bob) }},
+		{name: "user to group", run: func() (Revision, error) { return s.AddUserToUserGroupPermissionWithRevision(ctx, alice, parent) }},
+		{name: "group to user", run: func() (Revision, error) { return s.AddUserGroupToUserPermissionWithRevision(ctx, child, bob) }},
+		{name: "group to group", run: func() (Revision, error) {
+			return s.AddUserGroupToUserGroupPermissionWithRevision(ctx, child, parent)
+		}},
+	}
+
+	var last Revision
+	for _, m := range mutations {
+		rev, err := m.run()
+		if err != nil {
+			t.Fatalf("%s failed: %v", m.name, err)
+		}
+		if rev <= last {
+			t.Errorf("%s: expected revision greater than %s, got %s", m.name, last, rev)
+		}
+		last = rev
+	}
+
+	// A read at the last revision must succeed and observe the writes
+	readCtx := WithMinRevision(ctx, last)
+	name, err := s.GetUserNameWithPermissionCheck(readCtx, alice, bob)
+	if err != nil {
+		t.Fatalf("GetUserNameWithPermissionCheck failed: %v", err)
+	}
+	if name != "Bob" {
+		t.Errorf("Expected name 'Bob', got %q", name)
+	}
+}
+
+func Test_Revision_StaleRead(t *testing.T) {
+	s := setupTestServer(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	groupID, _ := s.CreateUserGroup(ctx, "Group")
+	userID, _ := s.CreateUser(ctx, "Alice")
+	rev, err := s.AddUserToGroupWithRevision(ctx, userID, groupID)
+	if err != nil {
+		t.Fatalf("AddUserToGroupWithRevision failed: %v", err)
+	}
+	future := rev + 1_000_000
+
+	t.Run("fails immediately without deadline", func(t *testing.T) {
+		_, err := s.GetUsersInGroup(WithMinRevision(ctx, future), groupID)
+		if !errors.Is(err, ErrStaleRevision) {
+			t.Errorf("Expected ErrStaleRevision, got %v", err)
+		}
+	})
+
+	t.Run("waits until deadline", func(t *testing.T) {
+		deadlineCtx, cancel := context.WithTimeout(WithMinRevision(ctx, future), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := s.GetUsersInGroupTransitive(deadlineCtx, groupID)
+		if !errors.Is(err, ErrStaleRevision) {
+			t.Errorf("Expected ErrStaleRevision, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected to wait for the deadline, returned after %v", elapsed)
+		}
+	})
+}
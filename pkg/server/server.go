@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -10,7 +11,40 @@ import (
 
 // Server implements the Stage5 interface using a repository for data access
 type Server struct {
-	repo Repository
+	repo   Repository
+	tracer Tracer
+	logger Logger
+	schema AttributeSchema
+}
+
+// Option configures optional Server dependencies
+type Option func(*Server)
+
+// WithTracer sets the tracer used for Server spans. A nil tracer disables tracing.
+func WithTracer(tracer Tracer) Option {
+	return func(s *Server) {
+		if tracer != nil {
+			s.tracer = tracer
+		}
+	}
+}
+
+// WithLogger sets the logger for mutations, permission denials, rejected writes and
+// failures. A nil logger disables logging.
+func WithLogger(logger Logger) Option {
+	return func(s *Server) {
+		if logger != nil {
+			s.logger = logger
+		}
+	}
+}
+
+// WithAttributeSchema sets the attributes users and groups may have. Without a
+// schema no attributes can be set.
+func WithAttributeSchema(schema AttributeSchema) Option {
+	return func(s *Server) {
+		s.schema = schema
+	}
 }
 
 // New creates a new Server with the given repository.
@@ -31,16 +65,90 @@ type Server struct {
 //	repo := server.NewMySQLRepository(db)
 //	srv := server.New(repo)
 //	defer srv.Close()
-func New(repo Repository) *Server {
-	return &Server{repo: repo}
+//
+// Optional dependencies such as a Tracer or a Logger are passed as Options.
+func New(repo Repository, opts ...Option) *Server {
+	s := &Server{repo: repo, tracer: noopTracer{}, logger: noopLogger{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// call tracks one Server method invocation: its span and the fields of its log entry
+type call struct {
+	s        *Server
+	ctx      context.Context
+	span     Span
+	method   string
+	mutation bool
+	fields   []Attribute
+}
+
+// begin starts a span for a read-only Server method
+func (s *Server) begin(ctx context.Context, method string, attrs ...Attribute) (context.Context, *call) {
+	ctx, span := s.tracer.Start(ctx, "Server."+method)
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	c := &call{s: s, ctx: ctx, span: span, method: method, fields: attrs}
+	return ctx, c
+}
+
+// beginMutation starts a span for a Server method that writes
+func (s *Server) beginMutation(ctx context.Context, method string, attrs ...Attribute) (context.Context, *call) {
+	ctx, c := s.begin(ctx, method, attrs...)
+	c.mutation = true
+	return ctx, c
+}
+
+// set adds attributes to both the span and the log entry
+func (c *call) set(attrs ...Attribute) {
+	c.span.SetAttributes(attrs...)
+	c.fields = append(c.fields, attrs...)
+}
+
+// end ends the span and logs the outcome. Applied mutations are logged at info,
+// permission denials and cycle rejections at warn, other rejected requests such as
+// unknown IDs at info and everything else, including database errors, at error.
+// Successful reads are logged at debug.
+func (c *call) end(err error, attrs ...Attribute) {
+	endSpan(c.span, err, attrs...)
+
+	fields := append([]Attribute{StringAttr("method", c.method)}, c.fields...)
+	fields = append(fields, attrs...)
+	if err != nil {
+		fields = append(fields, StringAttr("error", err.Error()))
+	}
+
+	switch {
+	case err == nil && c.mutation:
+		c.s.logger.Log(c.ctx, LevelInfo, "mutation applied", fields...)
+	case err == nil:
+		c.s.logger.Log(c.ctx, LevelDebug, "request completed", fields...)
+	case errors.Is(err, ErrPermissionDenied):
+		c.s.logger.Log(c.ctx, LevelWarn, "permission denied", fields...)
+	case errors.Is(err, ErrCycleDetected):
+		c.s.logger.Log(c.ctx, LevelWarn, "cycle rejected", fields...)
+	case errorKind(err) != "other":
+		c.s.logger.Log(c.ctx, LevelInfo, "request rejected", fields...)
+	default:
+		c.s.logger.Log(c.ctx, LevelError, "request failed", fields...)
+	}
 }
 
 // OpenDatabase creates and configures a database connection based on the provided config.
 // This is a factory function that handles all database connection setup.
 // It follows the Single Responsibility Principle by separating connection creation
-// from Server construction.
+// from Server construction. It opens the primary at config.DatabaseDSN; OpenReplicas
+// opens the read replicas.
 func OpenDatabase(config Config) (*sql.DB, error) {
-	db, err := sql.Open("mysql", config.DatabaseDSN)
+	return openMySQL(config.DatabaseDSN, config)
+}
+
+// openMySQL opens dsn with the pool settings of config and checks the connection
+func openMySQL(dsn string, config Config) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -68,32 +176,146 @@ func (s *Server) Close() error {
 }
 
 // CreateUser creates a new user and returns their ID
-func (s *Server) CreateUser(ctx context.Context, name string) (int, error) {
+func (s *Server) CreateUser(ctx context.Context, name string) (id int, err error) {
+	ctx, c := s.beginMutation(ctx, "CreateUser", idempotencyAttrs(ctx)...)
+	defer func() { c.end(err, IntAttr("user.id", id)) }()
+
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+	}
 	return s.repo.CreateUser(ctx, name)
 }
 
 // GetUserName retrieves a user's name by their ID
-func (s *Server) GetUserName(ctx context.Context, userID int) (string, error) {
+func (s *Server) GetUserName(ctx context.Context, userID int) (name string, err error) {
+	ctx, c := s.begin(ctx, "GetUserName", IntAttr("user.id", userID))
+	defer func() { c.end(err) }()
+
 	return s.repo.GetUserByID(ctx, userID)
 }
 
 // CreateUserGroup creates a new user group and returns its ID
-func (s *Server) CreateUserGroup(ctx context.Context, name string) (int, error) {
+func (s *Server) CreateUserGroup(ctx context.Context, name string) (id int, err error) {
+	ctx, c := s.beginMutation(ctx, "CreateUserGroup", idempotencyAttrs(ctx)...)
+	defer func() { c.end(err, IntAttr("group.id", id)) }()
+
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+	}
 	return s.repo.CreateUserGroup(ctx, name)
 }
 
 // GetUserGroupName retrieves a user group's name by its ID
-func (s *Server) GetUserGroupName(ctx context.Context, userGroupID int) (string, error) {
+func (s *Server) GetUserGroupName(ctx context.Context, userGroupID int) (name string, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupName", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err) }()
+
 	return s.repo.GetUserGroupByID(ctx, userGroupID)
 }
 
+// CreateUserWithExternalID creates a new user with an external ID, e.g. the subject
+// of an identity provider, and returns their ID
+func (s *Server) CreateUserWithExternalID(ctx context.Context, name, externalID string) (id int, err error) {
+	attrs := append([]Attribute{StringAttr("external_id", externalID)}, idempotencyAttrs(ctx)...)
+	ctx, c := s.beginMutation(ctx, "CreateUserWithExternalID", attrs...)
+	defer func() { c.end(err, IntAttr("user.id", id)) }()
+
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+	}
+	return s.repo.CreateUserWithExternalID(ctx, name, externalID)
+}
+
+// CreateUserGroupWithExternalID creates a new user group with an external ID and returns its ID
+func (s *Server) CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (id int, err error) {
+	attrs := append([]Attribute{StringAttr("external_id", externalID)}, idempotencyAttrs(ctx)...)
+	ctx, c := s.beginMutation(ctx, "CreateUserGroupWithExternalID", attrs...)
+	defer func() { c.end(err, IntAttr("group.id", id)) }()
+
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+	}
+	return s.repo.CreateUserGroupWithExternalID(ctx, name, externalID)
+}
+
+// SetUserExternalID sets the external ID of a user; an empty external ID clears it
+func (s *Server) SetUserExternalID(ctx context.Context, userID int, externalID string) (err error) {
+	ctx, c := s.beginMutation(ctx, "SetUserExternalID", IntAttr("user.id", userID), StringAttr("external_id", externalID))
+	defer func() { c.end(err) }()
+
+	return s.repo.SetUserExternalID(ctx, userID, externalID)
+}
+
+// SetUserGroupExternalID sets the external ID of a user group; an empty external ID clears it
+func (s *Server) SetUserGroupExternalID(ctx context.Context, userGroupID int, externalID string) (err error) {
+	ctx, c := s.beginMutation(ctx, "SetUserGroupExternalID", IntAttr("group.id", userGroupID), StringAttr("external_id", externalID))
+	defer func() { c.end(err) }()
+
+	return s.repo.SetUserGroupExternalID(ctx, userGroupID, externalID)
+}
+
+// GetUserByExternalID returns the ID of the user with the given external ID
+func (s *Server) GetUserByExternalID(ctx context.Context, externalID string) (id int, err error) {
+	ctx, c := s.begin(ctx, "GetUserByExternalID", StringAttr("external_id", externalID))
+	defer func() { c.end(err, IntAttr("user.id", id)) }()
+
+	return s.repo.GetUserByExternalID(ctx, externalID)
+}
+
+// GetUserGroupByExternalID returns the ID of the user group with the given external ID
+func (s *Server) GetUserGroupByExternalID(ctx context.Context, externalID string) (id int, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupByExternalID", StringAttr("external_id", externalID))
+	defer func() { c.end(err, IntAttr("group.id", id)) }()
+
+	return s.repo.GetUserGroupByExternalID(ctx, externalID)
+}
+
+// FindUsersByName returns the IDs of all users with the given name in ascending order
+func (s *Server) FindUsersByName(ctx context.Context, name string) (users []int, err error) {
+	ctx, c := s.begin(ctx, "FindUsersByName")
+	defer func() { c.end(err, IntAttr("result.count", len(users))) }()
+
+	return s.repo.FindUsersByName(ctx, name)
+}
+
+// FindUserGroupsByName returns the IDs of all user groups with the given name in ascending order
+func (s *Server) FindUserGroupsByName(ctx context.Context, name string) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "FindUserGroupsByName")
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	return s.repo.FindUserGroupsByName(ctx, name)
+}
+
 // AddUserToGroup adds a user to a user group
 func (s *Server) AddUserToGroup(ctx context.Context, userID, userGroupID int) error {
+	_, err := s.AddUserToGroupWithRevision(ctx, userID, userGroupID)
+	return err
+}
+
+// AddUserToGroupWithRevision adds a user to a user group and returns the revision of the write
+func (s *Server) AddUserToGroupWithRevision(ctx context.Context, userID, userGroupID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserToGroup", IntAttr("user.id", userID), IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddUserToGroup(ctx, userID, userGroupID)
 }
 
 // GetUsersInGroup returns all users directly in the specified group
-func (s *Server) GetUsersInGroup(ctx context.Context, userGroupID int) ([]int, error) {
+func (s *Server) GetUsersInGroup(ctx context.Context, userGroupID int) (users []int, err error) {
+	ctx, c := s.begin(ctx, "GetUsersInGroup", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(users))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
 	return s.repo.GetUsersInGroup(ctx, userGroupID)
 }
 
@@ -101,46 +323,152 @@ func (s *Server) GetUsersInGroup(ctx context.Context, userGroupID int) ([]int, e
 // Returns an error if this would create a cycle
 // Uses a database transaction to ensure atomicity of cycle check and insert
 func (s *Server) AddUserGroupToGroup(ctx context.Context, childUserGroupID, parentUserGroupID int) error {
+	_, err := s.AddUserGroupToGroupWithRevision(ctx, childUserGroupID, parentUserGroupID)
+	return err
+}
+
+// AddUserGroupToGroupWithRevision adds a child group to a parent group and returns the revision of the write
+func (s *Server) AddUserGroupToGroupWithRevision(ctx context.Context, childUserGroupID, parentUserGroupID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserGroupToGroup",
+		IntAttr("group.child_id", childUserGroupID), IntAttr("group.parent_id", parentUserGroupID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddGroupToGroup(ctx, childUserGroupID, parentUserGroupID)
 }
 
+// MoveUserGroup moves a child group from one parent group to another in one write.
+// Returns an error if the child is not in fromParentUserGroupID or the move would create a cycle.
+func (s *Server) MoveUserGroup(ctx context.Context, childUserGroupID, fromParentUserGroupID, toParentUserGroupID int) error {
+	_, err := s.MoveUserGroupWithRevision(ctx, childUserGroupID, fromParentUserGroupID, toParentUserGroupID)
+	return err
+}
+
+// MoveUserGroupWithRevision moves a child group from one parent group to another and returns the revision of the write
+func (s *Server) MoveUserGroupWithRevision(ctx context.Context, childUserGroupID, fromParentUserGroupID, toParentUserGroupID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "MoveUserGroup", IntAttr("group.child_id", childUserGroupID),
+		IntAttr("group.from_parent_id", fromParentUserGroupID), IntAttr("group.to_parent_id", toParentUserGroupID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
+	return s.repo.MoveGroup(ctx, childUserGroupID, fromParentUserGroupID, toParentUserGroupID)
+}
+
 // GetUserGroupsInGroup returns all groups directly in the specified group
-func (s *Server) GetUserGroupsInGroup(ctx context.Context, userGroupID int) ([]int, error) {
+func (s *Server) GetUserGroupsInGroup(ctx context.Context, userGroupID int) (groups []int, err error) {
+	ctx, c := s.begin(ctx, "GetUserGroupsInGroup", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(groups))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
 	return s.repo.GetGroupsInGroup(ctx, userGroupID)
 }
 
 // GetUsersInGroupTransitive returns all users in the group and all nested subgroups
-func (s *Server) GetUsersInGroupTransitive(ctx context.Context, userGroupID int) ([]int, error) {
+func (s *Server) GetUsersInGroupTransitive(ctx context.Context, userGroupID int) (users []int, err error) {
+	ctx, c := s.begin(ctx, "GetUsersInGroupTransitive", IntAttr("group.id", userGroupID))
+	defer func() { c.end(err, IntAttr("result.count", len(users))) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return nil, err
+	}
 	return s.repo.GetUsersInGroupTransitive(ctx, userGroupID)
 }
 
 // AddUserToUserPermission grants a user permission to access another user
 func (s *Server) AddUserToUserPermission(ctx context.Context, sourceUserID, targetUserID int) error {
+	_, err := s.AddUserToUserPermissionWithRevision(ctx, sourceUserID, targetUserID)
+	return err
+}
+
+// AddUserToUserPermissionWithRevision grants a user permission to access another user and returns the revision of the write
+func (s *Server) AddUserToUserPermissionWithRevision(ctx context.Context, sourceUserID, targetUserID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserToUserPermission", IntAttr("source.user_id", sourceUserID), IntAttr("target.user_id", targetUserID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddPermission(ctx, "user", "user", sourceUserID, targetUserID)
 }
 
 // AddUserToUserGroupPermission grants a user permission to access a user group
 func (s *Server) AddUserToUserGroupPermission(ctx context.Context, sourceUserID, targetUserGroupID int) error {
+	_, err := s.AddUserToUserGroupPermissionWithRevision(ctx, sourceUserID, targetUserGroupID)
+	return err
+}
+
+// AddUserToUserGroupPermissionWithRevision grants a user permission to access a user group and returns the revision of the write
+func (s *Server) AddUserToUserGroupPermissionWithRevision(ctx context.Context, sourceUserID, targetUserGroupID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserToUserGroupPermission", IntAttr("source.user_id", sourceUserID), IntAttr("target.group_id", targetUserGroupID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddPermission(ctx, "user", "group", sourceUserID, targetUserGroupID)
 }
 
 // AddUserGroupToUserPermission grants a user group permission to access a user
 func (s *Server) AddUserGroupToUserPermission(ctx context.Context, sourceUserGroupID, targetUserID int) error {
+	_, err := s.AddUserGroupToUserPermissionWithRevision(ctx, sourceUserGroupID, targetUserID)
+	return err
+}
+
+// AddUserGroupToUserPermissionWithRevision grants a user group permission to access a user and returns the revision of the write
+func (s *Server) AddUserGroupToUserPermissionWithRevision(ctx context.Context, sourceUserGroupID, targetUserID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserGroupToUserPermission", IntAttr("source.group_id", sourceUserGroupID), IntAttr("target.user_id", targetUserID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddPermission(ctx, "group", "user", sourceUserGroupID, targetUserID)
 }
 
 // AddUserGroupToUserGroupPermission grants a user group permission to access another user group
 func (s *Server) AddUserGroupToUserGroupPermission(ctx context.Context, sourceUserGroupID, targetUserGroupID int) error {
+	_, err := s.AddUserGroupToUserGroupPermissionWithRevision(ctx, sourceUserGroupID, targetUserGroupID)
+	return err
+}
+
+// AddUserGroupToUserGroupPermissionWithRevision grants a user group permission to access another user group
+// and returns the revision of the write
+func (s *Server) AddUserGroupToUserGroupPermissionWithRevision(ctx context.Context, sourceUserGroupID, targetUserGroupID int) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddUserGroupToUserGroupPermission", IntAttr("source.group_id", sourceUserGroupID), IntAttr("target.group_id", targetUserGroupID))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
 	return s.repo.AddPermission(ctx, "group", "group", sourceUserGroupID, targetUserGroupID)
 }
 
+// AddConditionalPermission grants a user or user group ("user" or "group") permission
+// to access a user or user group while condition holds, replacing the condition of an
+// existing grant. An empty condition makes the grant unconditional. The condition is
+// validated here, see Condition for its syntax.
+func (s *Server) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (rev Revision, err error) {
+	ctx, c := s.beginMutation(ctx, "AddConditionalPermission",
+		IntAttr("source."+sourceType+"_id", sourceID), IntAttr("target."+targetType+"_id", targetID), StringAttr("condition", condition))
+	defer func() { c.end(err, StringAttr("revision", rev.String())) }()
+
+	for _, t := range []string{sourceType, targetType} {
+		if t != "user" && t != "group" {
+			return 0, fmt.Errorf("invalid subject type %q", t)
+		}
+	}
+	if condition != "" {
+		if _, err := ParseCondition(condition); err != nil {
+			return 0, err
+		}
+	}
+	return s.repo.AddConditionalPermission(ctx, sourceType, targetType, sourceID, targetID, condition)
+}
+
 // GetUserNameWithPermissionCheck retrieves a user's name if the context user has permission
-func (s *Server) GetUserNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserID int) (string, error) {
+func (s *Server) GetUserNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserID int) (name string, err error) {
+	ctx, c := s.begin(WithContextUser(ctx, contextUserID), "GetUserNameWithPermissionCheck",
+		IntAttr("context_user.id", contextUserID), IntAttr("target.user_id", targetUserID))
+	defer func() { c.end(err) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return "", err
+	}
+
 	// Check if contextUser has permission to access targetUser
 	hasPermission, err := s.repo.HasUserPermissionOnUser(ctx, contextUserID, targetUserID)
 	if err != nil {
 		return "", fmt.Errorf("failed to check permission: %w", err)
 	}
+	c.set(BoolAttr("permission.allowed", hasPermission))
 
 	if !hasPermission {
 		return "", &PermissionDeniedError{
@@ -155,12 +483,21 @@ func (s *Server) GetUserNameWithPermissionCheck(ctx context.Context, contextUser
 }
 
 // GetUserGroupNameWithPermissionCheck retrieves a user group's name if the context user has permission
-func (s *Server) GetUserGroupNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserGroupID int) (string, error) {
+func (s *Server) GetUserGroupNameWithPermissionCheck(ctx context.Context, contextUserID, targetUserGroupID int) (name string, err error) {
+	ctx, c := s.begin(WithContextUser(ctx, contextUserID), "GetUserGroupNameWithPermissionCheck",
+		IntAttr("context_user.id", contextUserID), IntAttr("target.group_id", targetUserGroupID))
+	defer func() { c.end(err) }()
+
+	if err := s.awaitRevision(ctx); err != nil {
+		return "", err
+	}
+
 	// Check if contextUser has permission to access targetUserGroup
 	hasPermission, err := s.repo.HasUserPermissionOnGroup(ctx, contextUserID, targetUserGroupID)
 	if err != nil {
 		return "", fmt.Errorf("failed to check permission: %w", err)
 	}
+	c.set(BoolAttr("permission.allowed", hasPermission))
 
 	if !hasPermission {
 		return "", &PermissionDeniedError{
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the SQL syntax of a database engine. SQLRepository writes each
+// query once with numbered $n placeholders and asks the dialect for the engine
+// specific parts: bind parameters, upserts, insert IDs, locks and the type of bare
+// parameters in recursive CTE anchors.
+type Dialect interface {
+	// Name identifies the engine in span names and the db.system attribute, e.g. "mysql"
+	Name() string
+
+	// Placeholder returns the bind parameter for the n-th argument, counting from 1
+	Placeholder(n int) string
+
+	// NumberedPlaceholders reports whether a placeholder may be referenced more than
+	// once. If not, arguments are repeated for every reference in query order.
+	NumberedPlaceholders() bool
+
+	// IntParam wraps a placeholder that is selected as a bare value, such as the anchor
+	// of a recursive CTE, so the engine knows its type
+	IntParam(placeholder string) string
+
+	// InsertIgnore returns an insert of $1..$n into columns of table that does nothing
+	// if the row already exists
+	InsertIgnore(table string, columns ...string) string
+
+	// InsertReturningID returns an insert of $1..$n into columns of table that yields
+	// the new ID, and whether the ID comes back as a result row rather than through
+	// LastInsertId. Without columns it inserts a row of defaults.
+	InsertReturningID(table string, columns ...string) (query string, returning bool)
+
+	// LockQuery returns a statement that holds the named lock until the transaction
+	// ends, or "" if the engine needs none. Take locks before the first read of a
+	// transaction: a repeatable-read snapshot starts with the first read, and reads
+	// from an earlier snapshot miss what the previous holder of the lock committed.
+	LockQuery(name string) string
+
+	// SnapshotTxOptions returns the options of the read-only transaction that loads
+	// a consistent graph snapshot
+	SnapshotTxOptions() *sql.TxOptions
+}
+
+// Lock names passed to Dialect.LockQuery. lockRevisions serializes revision
+// assignment so revisions commit in ID order and change feed readers never skip a
+// revision that commits late. lockHierarchy serializes hierarchy writes so two
+// concurrent edges cannot form a cycle that neither cycle check sees. lockRules
+// serializes membership rule changes with the user attribute writes and memberships
+// they are evaluated against.
+const (
+	lockRevisions  = "revisions"
+	lockHierarchy  = "hierarchy"
+	lockRules      = "rules"
+	lockMigrations = "migrations"
+)
+
+// MySQLDialect is the dialect of MySQL and compatible engines such as MariaDB
+type MySQLDialect struct{}
+
+// Name returns "mysql"
+func (MySQLDialect) Name() string { return "mysql" }
+
+// Placeholder returns "?"
+func (MySQLDialect) Placeholder(int) string { return "?" }
+
+// NumberedPlaceholders returns false, MySQL placeholders are positional
+func (MySQLDialect) NumberedPlaceholders() bool { return false }
+
+// IntParam returns the placeholder unchanged
+func (MySQLDialect) IntParam(placeholder string) string { return placeholder }
+
+// InsertIgnore uses ON DUPLICATE KEY UPDATE, which unlike INSERT IGNORE still
+// reports foreign key violations
+func (MySQLDialect) InsertIgnore(table string, columns ...string) string {
+	return insertInto(table, columns) + fmt.Sprintf(" ON DUPLICATE KEY UPDATE %s = %s", columns[0], columns[0])
+}
+
+// InsertReturningID returns a plain insert, the ID comes from LastInsertId
+func (MySQLDialect) InsertReturningID(table string, columns ...string) (string, bool) {
+	if len(columns) == 0 {
+		return "INSERT INTO " + table + " () VALUES ()", false
+	}
+	return insertInto(table, columns), false
+}
+
+// LockQuery locks the row of the lock in the locks table. Unlike SELECT ... FOR
+// UPDATE, the upsert also locks a row it has to create, so a missing row cannot
+// turn the lock into a shared gap lock. The lock is held until the transaction ends.
+func (MySQLDialect) LockQuery(name string) string {
+	return fmt.Sprintf("INSERT INTO locks (name) VALUES ('%s') ON DUPLICATE KEY UPDATE name = name", name)
+}
+
+// SnapshotTxOptions returns a read-only repeatable-read transaction
+func (MySQLDialect) SnapshotTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+}
+
+// PostgresDialect is the dialect of PostgreSQL
+type PostgresDialect struct{}
+
+// Name returns "postgresql"
+func (PostgresDialect) Name() string { return "postgresql" }
+
+// Placeholder returns "$n"
+func (PostgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+// NumberedPlaceholders returns true
+func (PostgresDialect) NumberedPlaceholders() bool { return true }
+
+// IntParam casts the placeholder, PostgreSQL cannot infer the type of a bare parameter
+func (PostgresDialect) IntParam(placeholder string) string {
+	return "CAST(" + placeholder + " AS INTEGER)"
+}
+
+// InsertIgnore uses ON CONFLICT DO NOTHING
+func (PostgresDialect) InsertIgnore(table string, columns ...string) string {
+	return insertInto(table, columns) + " ON CONFLICT DO NOTHING"
+}
+
+// InsertReturningID uses RETURNING id, PostgreSQL drivers do not support LastInsertId
+func (PostgresDialect) InsertReturningID(table string, columns ...string) (string, bool) {
+	if len(columns) == 0 {
+		return "INSERT INTO " + table + " DEFAULT VALUES RETURNING id", true
+	}
+	return insertInto(table, columns) + " RETURNING id", true
+}
+
+// LockQuery takes a transaction-scoped advisory lock keyed by the lock name
+func (PostgresDialect) LockQuery(name string) string {
+	return fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", advisoryLockKey(name))
+}
+
+// SnapshotTxOptions returns a read-only repeatable-read transaction
+func (PostgresDialect) SnapshotTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+}
+
+// SQLiteDialect is the dialect of SQLite. Enable foreign keys on every connection,
+// e.g. with the DSN parameter _pragma=foreign_keys(1) or _foreign_keys=on depending
+// on the driver, and begin transactions immediately, e.g. with _txlock=immediate, so
+// that concurrent writers wait for each other instead of failing with "database is
+// locked" when they upgrade a read lock.
+type SQLiteDialect struct{}
+
+// Name returns "sqlite"
+func (SQLiteDialect) Name() string { return "sqlite" }
+
+// Placeholder returns "?n"
+func (SQLiteDialect) Placeholder(n int) string { return "?" + strconv.Itoa(n) }
+
+// NumberedPlaceholders returns true
+func (SQLiteDialect) NumberedPlaceholders() bool { return true }
+
+// IntParam returns the placeholder unchanged, SQLite values carry their own type
+func (SQLiteDialect) IntParam(placeholder string) string { return placeholder }
+
+// InsertIgnore uses ON CONFLICT DO NOTHING
+func (SQLiteDialect) InsertIgnore(table string, columns ...string) string {
+	return insertInto(table, columns) + " ON CONFLICT DO NOTHING"
+}
+
+// InsertReturningID returns a plain insert, the ID comes from LastInsertId
+func (SQLiteDialect) InsertReturningID(table string, columns ...string) (string, bool) {
+	if len(columns) == 0 {
+		return "INSERT INTO " + table + " DEFAULT VALUES", false
+	}
+	return insertInto(table, columns), false
+}
+
+// LockQuery returns "", SQLite allows a single writer at a time
+func (SQLiteDialect) LockQuery(string) string { return "" }
+
+// SnapshotTxOptions returns default options, SQLite transactions are serializable
+// and drivers reject other isolation levels
+func (SQLiteDialect) SnapshotTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{}
+}
+
+// insertInto returns "INSERT INTO table (columns) VALUES ($1, ..., $n)"
+func insertInto(table string, columns []string) string {
+	values := make([]string, len(columns))
+	for i := range columns {
+		values[i] = "$" + strconv.Itoa(i+1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(values, ", "))
+}
+
+// advisoryLockKey derives a stable 64-bit lock key from a lock name
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("permissions." + name))
+	return int64(h.Sum64())
+}
+
+// sqlQuery is a query bound to a dialect
+type sqlQuery struct {
+	text string
+
+	// order holds the argument index for each placeholder in text, or nil if the
+	// arguments are passed through unchanged
+	order []int
+}
+
+// rawQuery wraps a query already written for the target dialect
+func rawQuery(text string) sqlQuery {
+	return sqlQuery{text: text}
+}
+
+// intParamMarker matches {{int $n}}, a parameter selected as a bare value
+var intParamMarker = regexp.MustCompile(`\{\{int (\$\d+)\}\}`)
+
+// bindQuery rewrites the $n placeholders of query for d. For dialects without
+// numbered placeholders, it records which argument each positional placeholder takes.
+func bindQuery(d Dialect, query string) sqlQuery {
+	query = intParamMarker.ReplaceAllStringFunc(query, func(marker string) string {
+		return d.IntParam(intParamMarker.FindStringSubmatch(marker)[1])
+	})
+
+	var b strings.Builder
+	var order []int
+	for i := 0; i < len(query); i++ {
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		if query[i] != '$' || j == i+1 {
+			b.WriteByte(query[i])
+			continue
+		}
+
+		n, _ := strconv.Atoi(query[i+1 : j])
+		if d.NumberedPlaceholders() {
+			b.WriteString(d.Placeholder(n))
+		} else {
+			order = append(order, n-1)
+			b.WriteString(d.Placeholder(len(order)))
+		}
+		i = j - 1
+	}
+	return sqlQuery{text: b.String(), order: order}
+}
+
+// args returns the arguments in placeholder order
+func (q sqlQuery) args(args []interface{}) []interface{} {
+	if q.order == nil {
+		return args
+	}
+	bound := make([]interface{}, len(q.order))
+	for i, n := range q.order {
+		bound[i] = args[n]
+	}
+	return bound
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var dialects = []Dialect{MySQLDialect{}, PostgresDialect{}, SQLiteDialect{}}
+
+// dialectQueries returns the queries of SQLRepository bound to d, by field name
+func dialectQueries(d Dialect) map[string]sqlQuery {
+	queries := make(map[string]sqlQuery)
+	v := reflect.ValueOf(newSQLQueries(d)).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Type() != reflect.TypeOf(sqlQuery{}) {
+			continue
+		}
+		q := sqlQuery{text: f.FieldByName("text").String()}
+		if order := f.FieldByName("order"); !order.IsNil() {
+			q.order = make([]int, order.Len())
+			for j := range q.order {
+				q.order[j] = int(order.Index(j).Int())
+			}
+		}
+		queries[v.Type().Field(i).Name] = q
+	}
+	return queries
+}
+
+// sqliteTestDB opens a fresh SQLite database with the migrated schema. The package
+// does not import a driver, so the test is skipped unless one is registered as
+// "sqlite3", e.g. by building with -tags sqlite.
+func sqliteTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == "sqlite3"
+	}
+	if !registered {
+		t.Skip(`SQLite driver "sqlite3" is not registered`)
+	}
+
+	dsn := filepath.Join(t.TempDir(), "permissions.db") + "?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if _, err := MigrateSQL(context.Background(), db, SQLiteDialect{}); err != nil {
+		t.Fatalf("MigrateSQL failed: %v", err)
+	}
+	return db
+}
+
+func Test_Dialect_BindQuery(t *testing.T) {
+	const query = "SELECT {{int $2}} WHERE a = $1 AND b = $2 OR c = $1 AND d = '$'"
+	tests := []struct {
+		dialect Dialect
+		text    string
+		args    []interface{}
+	}{
+		{MySQLDialect{}, "SELECT ? WHERE a = ? AND b = ? OR c = ? AND d = '$'", []interface{}{"b", "a", "b", "a"}},
+		{PostgresDialect{}, "SELECT CAST($2 AS INTEGER) WHERE a = $1 AND b = $2 OR c = $1 AND d = '$'", []interface{}{"a", "b"}},
+		{SQLiteDialect{}, "SELECT ?2 WHERE a = ?1 AND b = ?2 OR c = ?1 AND d = '$'", []interface{}{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dialect.Name(), func(t *testing.T) {
+			q := bindQuery(tt.dialect, query)
+			if q.text != tt.text {
+				t.Errorf("Expected %q, got %q", tt.text, q.text)
+			}
+			if args := q.args([]interface{}{"a", "b"}); !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("Expected arguments %v, got %v", tt.args, args)
+			}
+		})
+	}
+
+	if q := rawQuery("SELECT ?"); !reflect.DeepEqual(q.args([]interface{}{1}), []interface{}{1}) {
+		t.Error("Expected raw queries to pass arguments through")
+	}
+}
+
+func Test_Dialect_Inserts(t *testing.T) {
+	tests := []struct {
+		dialect          Dialect
+		ignore           string
+		insert, revision string
+		returning        bool
+	}{
+		{
+			MySQLDialect{},
+			"INSERT INTO t (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE a = a",
+			"INSERT INTO t (a) VALUES (?)", "INSERT INTO revisions () VALUES ()", false,
+		},
+		{
+			PostgresDialect{},
+			"INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			"INSERT INTO t (a) VALUES ($1) RETURNING id", "INSERT INTO revisions DEFAULT VALUES RETURNING id", true,
+		},
+		{
+			SQLiteDialect{},
+			"INSERT INTO t (a, b) VALUES (?1, ?2) ON CONFLICT DO NOTHING",
+			"INSERT INTO t (a) VALUES (?1)", "INSERT INTO revisions DEFAULT VALUES", false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dialect.Name(), func(t *testing.T) {
+			if got := bindQuery(tt.dialect, tt.dialect.InsertIgnore("t", "a", "b")).text; got != tt.ignore {
+				t.Errorf("InsertIgnore = %q, want %q", got, tt.ignore)
+			}
+			insert, returning := tt.dialect.InsertReturningID("t", "a")
+			if got := bindQuery(tt.dialect, insert).text; got != tt.insert || returning != tt.returning {
+				t.Errorf("InsertReturningID = %q, %v; want %q, %v", got, returning, tt.insert, tt.returning)
+			}
+			if got, _ := tt.dialect.InsertReturningID("revisions"); got != tt.revision {
+				t.Errorf("InsertReturningID without columns = %q, want %q", got, tt.revision)
+			}
+		})
+	}
+}
+
+func Test_Dialect_Queries(t *testing.T) {
+	numbered := regexp.MustCompile(`\$\d`)
+	positional := regexp.MustCompile(`\?\d`)
+
+	for _, d := range dialects {
+		t.Run(d.Name(), func(t *testing.T) {
+			for name, q := range dialectQueries(d) {
+				if strings.Contains(q.text, "{{") {
+					t.Errorf("%s has an unbound marker: %s", name, q.text)
+				}
+				switch d.(type) {
+				case MySQLDialect:
+					if numbered.MatchString(q.text) || positional.MatchString(q.text) {
+						t.Errorf("%s has a numbered placeholder: %s", name, q.text)
+					}
+					if count := strings.Count(q.text, "?"); count != len(q.order) {
+						t.Errorf("%s has %d placeholders but binds %d arguments", name, count, len(q.order))
+					}
+				case PostgresDialect:
+					if strings.Contains(q.text, "?") || q.order != nil {
+						t.Errorf("%s has a positional placeholder: %s", name, q.text)
+					}
+				case SQLiteDialect:
+					if numbered.MatchString(q.text) || strings.Count(q.text, "?") != len(positional.FindAllString(q.text, -1)) {
+						t.Errorf("%s mixes placeholder styles: %s", name, q.text)
+					}
+				}
+			}
+		})
+	}
+
+	// The permission check on groups references the user three times and the group once
+	mysql := dialectQueries(MySQLDialect{})["checkUserPermissionOnGroup"]
+	if args := mysql.args([]interface{}{"user", "group"}); !reflect.DeepEqual(args, []interface{}{"user", "group", "user", "user"}) {
+		t.Errorf("Expected arguments repeated in query order, got %v", args)
+	}
+}
+
+func Test_Dialect_Locks(t *testing.T) {
+	mysql, sqlite, postgres := MySQLDialect{}, SQLiteDialect{}, PostgresDialect{}
+	if sqlite.LockQuery(lockRevisions) != "" {
+		t.Error("Expected no lock statements for SQLite")
+	}
+	for _, d := range []Dialect{mysql, postgres} {
+		revisions, hierarchy := d.LockQuery(lockRevisions), d.LockQuery(lockHierarchy)
+		if revisions == "" || revisions == hierarchy {
+			t.Errorf("%s: expected distinct locks, got %q and %q", d.Name(), revisions, hierarchy)
+		}
+		if revisions != d.LockQuery(lockRevisions) {
+			t.Errorf("%s: expected stable lock statements", d.Name())
+		}
+	}
+	if revisions := postgres.LockQuery(lockRevisions); !strings.HasPrefix(revisions, "SELECT pg_advisory_xact_lock(") {
+		t.Errorf("Expected an advisory lock, got %q", revisions)
+	}
+
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		runDialectLock(t, db, mysql)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := postgresTestDB(t)
+		defer db.Close()
+		runDialectLock(t, db, postgres)
+	})
+}
+
+// runDialectLock checks that a lock of d blocks other transactions until the
+// transaction holding it ends, and leaves the other locks free
+func runDialectLock(t *testing.T, db *sql.DB, d Dialect) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lock := func(name string) (*sql.Tx, error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, d.LockQuery(name)); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	holder, err := lock(lockHierarchy)
+	if err != nil {
+		t.Fatalf("Failed to take the lock: %v", err)
+	}
+	defer func() { _ = holder.Rollback() }()
+
+	acquired := make(chan error, 1)
+	go func() {
+		tx, err := lock(lockHierarchy)
+		if err == nil {
+			err = tx.Rollback()
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Expected the second transaction to wait for the lock, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	other, err := lock(lockRules)
+	if err != nil {
+		t.Fatalf("Expected another lock to be free, got %v", err)
+	}
+	_ = other.Rollback()
+
+	if err := holder.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected the lock after the commit, got %v", err)
+	}
+}
+
+func Test_SQLite_Migrations(t *testing.T) {
+	migrations, err := SQLMigrations(SQLiteDialect{})
+	if err != nil || len(migrations) == 0 {
+		t.Fatalf("Expected embedded SQLite migrations, got %v, %v", migrations, err)
+	}
+}
+
+func Test_MySQL_Migrations(t *testing.T) {
+	migrations, err := MySQLMigrations()
+	if err != nil || len(migrations) == 0 {
+		t.Fatalf("Expected embedded MySQL migrations, got %v, %v", migrations, err)
+	}
+
+	// db.sql creates the full schema and must record every migration as applied
+	initSQL, err := os.ReadFile(filepath.Join("..", "..", "db", "initdb", "db.sql"))
+	if err != nil {
+		t.Fatalf("Failed to read db.sql: %v", err)
+	}
+	recorded := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`\((\d+), '(\w+)'\)`).FindAllStringSubmatch(string(initSQL), -1) {
+		recorded[m[1]+"_"+m[2]] = true
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected version %d, got %d (%s)", i+1, m.Version, m.Name)
+		}
+		if !recorded[fmt.Sprintf("%d_%s", m.Version, m.Name)] {
+			t.Errorf("Migration %d_%s is not recorded in db.sql", m.Version, m.Name)
+		}
+	}
+	if len(recorded) != len(migrations) {
+		t.Errorf("db.sql records %d migrations, want %d", len(recorded), len(migrations))
+	}
+}
+
+func Test_MySQL_MigrateInitializedSchema(t *testing.T) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	applied, err := MigrateMySQL(context.Background(), db)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected the db.sql schema to be up to date, got %v, %v", applied, err)
+	}
+}
+
+func Test_SplitStatements(t *testing.T) {
+	script := `-- Users; with a comment
+ALTER TABLE users
+    ADD COLUMN a INT;
+
+-- Groups
+ALTER TABLE user_groups ADD COLUMN b INT;
+SELECT 1`
+	want := []string{"ALTER TABLE users\n    ADD COLUMN a INT", "ALTER TABLE user_groups ADD COLUMN b INT", "SELECT 1"}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements = %q, want %q", got, want)
+	}
+}
+
+// Test_Conformance_SQLRepository runs the same scenarios through NewSQLRepository for
+// every dialect with a reachable database
+func Test_Conformance_SQLRepository(t *testing.T) {
+	t.Run("mysql", func(t *testing.T) {
+		db, err := OpenDatabase(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		repo := NewSQLRepository(db, MySQLDialect{})
+		defer repo.Close()
+		runRepositoryConformance(t, repo)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := postgresTestDB(t)
+		if _, err := MigrateSQL(context.Background(), db, PostgresDialect{}); err != nil {
+			t.Fatalf("MigrateSQL failed: %v", err)
+		}
+		repo := NewSQLRepository(db, PostgresDialect{})
+		defer repo.Close()
+		runRepositoryConformance(t, repo)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		repo := NewSQLRepository(sqliteTestDB(t), SQLiteDialect{})
+		defer repo.Close()
+		runRepositoryConformance(t, repo)
+	})
+}
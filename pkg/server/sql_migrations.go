@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the schema of each dialect with embedded migrations under
+// migrations/<dialect>, one file per version named <version>_<name>.sql. Applied
+// migrations must never be edited; add a new file instead. db/initdb/db.sql creates
+// the current MySQL schema for new databases and records the MySQL migrations it
+// contains as applied, so a new MySQL migration also goes into db.sql.
+//
+//go:embed migrations/mysql/*.sql migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationDirs maps Dialect.Name to its migrations directory
+var migrationDirs = map[string]string{
+	MySQLDialect{}.Name():    "migrations/mysql",
+	PostgresDialect{}.Name(): "migrations/postgres",
+	SQLiteDialect{}.Name():   "migrations/sqlite",
+}
+
+const (
+	queryCreateMigrationsTable = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`
+
+	querySelectMigrations = "SELECT version FROM schema_migrations"
+	queryInsertMigration  = "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+
+	// MySQL commits DDL statements implicitly, which releases transaction-scoped
+	// locks, so migrations hold a session lock there instead
+	queryMySQLLockMigrations   = "SELECT GET_LOCK('permissions.migrations', -1)"
+	queryMySQLUnlockMigrations = "DO RELEASE_LOCK('permissions.migrations')"
+)
+
+// Migration is one versioned step of a database schema
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// SQLMigrations returns the embedded migrations of dialect in version order
+func SQLMigrations(dialect Dialect) ([]Migration, error) {
+	dir, ok := migrationDirs[dialect.Name()]
+	if !ok {
+		return nil, fmt.Errorf("no embedded migrations for %s", dialect.Name())
+	}
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		versionText, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(versionText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q: %w", entry.Name(), err)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// MigrateSQL brings the schema of dialect up to date. It applies every migration
+// not yet recorded in schema_migrations, in version order and in a single transaction,
+// so a failing migration leaves the schema unchanged. MySQL commits every DDL
+// statement implicitly, so there the migrations before a failing one stay applied
+// and recorded. It returns the applied migrations.
+func MigrateSQL(ctx context.Context, db *sql.DB, dialect Dialect) ([]Migration, error) {
+	migrations, err := SQLMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// Serialize concurrent migrations, e.g. from several instances starting at once
+	mysql := dialect.Name() == MySQLDialect{}.Name()
+	if mysql {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, queryMySQLLockMigrations).Scan(&locked); err != nil {
+			return nil, fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		if locked.Int64 != 1 {
+			return nil, fmt.Errorf("failed to lock migrations: lock not granted")
+		}
+		defer func() { _, _ = conn.ExecContext(context.Background(), queryMySQLUnlockMigrations) }()
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+	if lock := dialect.LockQuery(lockMigrations); lock != "" && !mysql {
+		if _, err := tx.ExecContext(ctx, lock); err != nil {
+			return nil, fmt.Errorf("failed to lock migrations: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, queryCreateMigrationsTable); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	done := make(map[int]bool)
+	err = scanRows(ctx, tx, querySelectMigrations, "failed to read applied migrations", func(rows *sql.Rows) error {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return err
+		}
+		done[version] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	insert := bindQuery(dialect, queryInsertMigration)
+	applied := make([]Migration, 0)
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		for _, statement := range splitStatements(m.SQL) {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return nil, fmt.Errorf("failed to apply migration %d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, insert.text, insert.args([]interface{}{m.Version, m.Name})...); err != nil {
+			return nil, fmt.Errorf("failed to record migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit migrations: %w", err)
+	}
+	return applied, nil
+}
+
+// splitStatements splits a migration into its statements, which end with a semicolon
+// at the end of a line, and drops comment lines. Drivers such as the MySQL one
+// execute a single statement per call.
+func splitStatements(script string) []string {
+	var statements []string
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(b.String()), ";"))
+			b.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(b.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// MySQLMigrations returns the embedded MySQL migrations in version order
+func MySQLMigrations() ([]Migration, error) {
+	return SQLMigrations(MySQLDialect{})
+}
+
+// MigrateMySQL brings the MySQL schema up to date, see MigrateSQL. Databases created
+// by db/initdb/db.sql start with every migration applied; older ones are upgraded.
+func MigrateMySQL(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	return MigrateSQL(ctx, db, MySQLDialect{})
+}
+
+// PostgresMigrations returns the embedded PostgreSQL migrations in version order
+func PostgresMigrations() ([]Migration, error) {
+	return SQLMigrations(PostgresDialect{})
+}
+
+// MigratePostgres brings the PostgreSQL schema up to date, see MigrateSQL
+func MigratePostgres(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	return MigrateSQL(ctx, db, PostgresDialect{})
+}
@@ -0,0 +1,2604 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Queries shared by all dialects. They are written with numbered $n placeholders,
+// which bindQuery rewrites for each dialect; a placeholder may be referenced more than
+// once, and {{int $n}} marks a parameter selected as a bare value. Recursive CTEs
+// use UNION so a walk visits every group once and terminates even if the hierarchy
+// contains a cycle.
+const (
+	querySelectUser      = "SELECT name FROM users WHERE id = $1"
+	querySelectUserGroup = "SELECT name FROM user_groups WHERE id = $1"
+
+	querySelectUserStatus  = "SELECT status FROM users WHERE id = $1"
+	queryUpdateUserStatus  = "UPDATE users SET status = $2 WHERE id = $1 AND status <> $2"
+	querySelectInactiveIDs = "SELECT id FROM users WHERE status <> 'active'"
+
+	querySelectGroupRule = "SELECT COALESCE(membership_rule, '') FROM user_groups WHERE id = $1"
+	queryUpdateGroupRule = "UPDATE user_groups SET membership_rule = $2 WHERE id = $1"
+	querySelectGroupType = "SELECT COALESCE(group_type, '') FROM user_groups WHERE id = $1"
+	queryUpdateGroupType = "UPDATE user_groups SET group_type = $2 WHERE id = $1"
+	querySelectAllRules  = "SELECT id, membership_rule FROM user_groups WHERE membership_rule IS NOT NULL"
+
+	querySelectUsersByName           = "SELECT id FROM users WHERE name = $1 ORDER BY id"
+	querySelectUserGroupsByName      = "SELECT id FROM user_groups WHERE name = $1 ORDER BY id"
+	querySelectUserByExternalID      = "SELECT id FROM users WHERE external_id = $1"
+	querySelectUserGroupByExternalID = "SELECT id FROM user_groups WHERE external_id = $1"
+	queryUpdateUserExternalID        = "UPDATE users SET external_id = $2 WHERE id = $1"
+	queryUpdateUserGroupExternalID   = "UPDATE user_groups SET external_id = $2 WHERE id = $1"
+
+	querySelectAttributes = `
+		SELECT attr_name, value_type, attr_value
+		FROM attributes
+		WHERE subject_type = $1 AND subject_id = $2
+		ORDER BY attr_name`
+	queryDeleteAttribute = "DELETE FROM attributes WHERE subject_type = $1 AND subject_id = $2 AND attr_name = $3"
+
+	querySelectAllUserAttributes = "SELECT subject_id, attr_name, value_type, attr_value FROM attributes WHERE subject_type = 'user'"
+
+	querySelectUsersInGroup = `
+		SELECT user_id
+		FROM user_group_members
+		WHERE user_group_id = $1
+		ORDER BY user_id`
+
+	querySelectGroupsOfUser  = "SELECT user_group_id FROM user_group_members WHERE user_id = $1 ORDER BY user_group_id"
+	queryDeleteUserFromGroup = "DELETE FROM user_group_members WHERE user_id = $1 AND user_group_id = $2"
+
+	querySelectGroupsInGroup = `
+		SELECT child_group_id
+		FROM user_group_hierarchy
+		WHERE parent_group_id = $1
+		ORDER BY child_group_id`
+
+	querySelectEdge = "SELECT 1 FROM user_group_hierarchy WHERE child_group_id = $1 AND parent_group_id = $2"
+	queryDeleteEdge = "DELETE FROM user_group_hierarchy WHERE child_group_id = $1 AND parent_group_id = $2"
+
+	querySelectParentGroups = `
+		SELECT parent_group_id
+		FROM user_group_hierarchy
+		WHERE child_group_id = $1
+		ORDER BY parent_group_id`
+
+	queryCheckCycle = `
+		WITH RECURSIVE descendants AS (
+			SELECT child_group_id FROM user_group_hierarchy WHERE parent_group_id = $1
+			UNION
+			SELECT h.child_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN descendants d ON h.parent_group_id = d.child_group_id
+		)
+		SELECT 1 FROM descendants WHERE child_group_id = $2 LIMIT 1`
+
+	// querySelectGroupDepth and querySelectGroupHeight return the longest chain of
+	// edges above and below a group, capped at $2 so that a deep hierarchy cannot
+	// run into cte_max_recursion_depth. UNION keeps one row per group and distance.
+	querySelectGroupDepth = `
+		WITH RECURSIVE chain (group_id, depth) AS (
+			SELECT parent_group_id, 1 FROM user_group_hierarchy WHERE child_group_id = $1
+			UNION
+			SELECT h.parent_group_id, c.depth + 1
+			FROM user_group_hierarchy h
+			INNER JOIN chain c ON h.child_group_id = c.group_id
+			WHERE c.depth < $2
+		)
+		SELECT COALESCE(MAX(depth), 0) FROM chain`
+
+	querySelectGroupHeight = `
+		WITH RECURSIVE chain (group_id, depth) AS (
+			SELECT child_group_id, 1 FROM user_group_hierarchy WHERE parent_group_id = $1
+			UNION
+			SELECT h.child_group_id, c.depth + 1
+			FROM user_group_hierarchy h
+			INNER JOIN chain c ON h.parent_group_id = c.group_id
+			WHERE c.depth < $2
+		)
+		SELECT COALESCE(MAX(depth), 0) FROM chain`
+
+	// queryTypedEdges selects hierarchy edges with the types of both groups
+	queryTypedEdges = `
+		SELECT h.child_group_id, h.parent_group_id, COALESCE(c.group_type, ''), COALESCE(p.group_type, '')
+		FROM user_group_hierarchy h
+		INNER JOIN user_groups c ON c.id = h.child_group_id
+		INNER JOIN user_groups p ON p.id = h.parent_group_id`
+
+	querySelectTypedEdges      = queryTypedEdges
+	querySelectGroupTypedEdges = queryTypedEdges + `
+		WHERE h.child_group_id = $1 OR h.parent_group_id = $1`
+
+	queryCountChildGroups  = "SELECT COUNT(*) FROM user_group_hierarchy WHERE parent_group_id = $1"
+	queryCountParentGroups = "SELECT COUNT(*) FROM user_group_hierarchy WHERE child_group_id = $1"
+
+	querySelectAllMemberships = "SELECT user_id, user_group_id FROM user_group_members"
+	querySelectAllEdges       = "SELECT child_group_id, parent_group_id FROM user_group_hierarchy"
+	querySelectAllPermissions = "SELECT source_type, source_id, target_type, target_id, condition_expr FROM permissions"
+
+	querySelectRevision = "SELECT COALESCE((SELECT MAX(id) FROM revisions), 0)"
+
+	queryDeleteExpiredIdempotencyKey  = "DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND expires_at <= $2"
+	queryDeleteExpiredIdempotencyKeys = "DELETE FROM idempotency_keys WHERE expires_at <= $1"
+	querySelectIdempotencyKey         = "SELECT operation, request_name, resource_id FROM idempotency_keys WHERE idempotency_key = $1"
+	queryUpdateIdempotencyKey         = "UPDATE idempotency_keys SET resource_id = $2 WHERE idempotency_key = $1"
+
+	querySelectChangeEvents = `
+		SELECT revision, event_type, subject_type, subject_id, object_type, object_id,
+		       COALESCE(user_status, ''), COALESCE(previous_object_id, 0), created_at
+		FROM change_events
+		WHERE revision > $1
+		ORDER BY revision
+		LIMIT $2`
+
+	querySelectUsersInGroupTransitive = `
+		WITH RECURSIVE all_groups AS (
+			SELECT {{int $1}} AS group_id
+			UNION
+			SELECT h.child_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN all_groups ag ON h.parent_group_id = ag.group_id
+		)
+		SELECT DISTINCT m.user_id
+		FROM user_group_members m
+		INNER JOIN all_groups ag ON m.user_group_id = ag.group_id
+		ORDER BY m.user_id`
+
+	querySelectGroupsForUserTransitive = `
+		WITH RECURSIVE user_groups AS (
+			SELECT user_group_id FROM user_group_members WHERE user_id = $1
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN user_groups ug ON h.child_group_id = ug.user_group_id
+		)
+		SELECT user_group_id
+		FROM user_groups
+		ORDER BY user_group_id`
+
+	querySelectAncestorGroups = `
+		WITH RECURSIVE ancestors AS (
+			SELECT parent_group_id AS group_id FROM user_group_hierarchy WHERE child_group_id = $1
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN ancestors a ON h.child_group_id = a.group_id
+		)
+		SELECT group_id
+		FROM ancestors
+		ORDER BY group_id`
+
+	querySelectDescendantGroups = `
+		WITH RECURSIVE descendants AS (
+			SELECT child_group_id AS group_id FROM user_group_hierarchy WHERE parent_group_id = $1
+			UNION
+			SELECT h.child_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN descendants d ON h.parent_group_id = d.group_id
+		)
+		SELECT group_id
+		FROM descendants
+		ORDER BY group_id`
+
+	// The groups of the subtree below $1, including $1, and their names, edges and
+	// direct users
+	querySubtree = `
+		WITH RECURSIVE subtree AS (
+			SELECT {{int $1}} AS group_id
+			UNION
+			SELECT h.child_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN subtree s ON h.parent_group_id = s.group_id
+		)`
+	querySelectSubtreeGroups = querySubtree + `
+		SELECT g.id, g.name
+		FROM user_groups g
+		INNER JOIN subtree s ON g.id = s.group_id`
+	querySelectSubtreeEdges = querySubtree + `
+		SELECT h.child_group_id, h.parent_group_id
+		FROM user_group_hierarchy h
+		INNER JOIN subtree s ON h.parent_group_id = s.group_id
+		ORDER BY h.parent_group_id, h.child_group_id`
+	querySelectSubtreeMembers = querySubtree + `
+		SELECT m.user_id, m.user_group_id
+		FROM user_group_members m
+		INNER JOIN subtree s ON m.user_group_id = s.group_id
+		ORDER BY m.user_group_id, m.user_id`
+
+	// Hierarchy edges above the groups of a user or above a group: every edge whose
+	// child is reached from the anchor by walking up
+	querySelectUserAncestorEdges = `
+		WITH RECURSIVE reach AS (
+			SELECT user_group_id AS group_id FROM user_group_members WHERE user_id = $1
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN reach r ON h.child_group_id = r.group_id
+		)` + queryAncestorEdges
+
+	querySelectGroupAncestorEdges = `
+		WITH RECURSIVE reach AS (
+			SELECT {{int $1}} AS group_id
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN reach r ON h.child_group_id = r.group_id
+		)` + queryAncestorEdges
+
+	queryAncestorEdges = `
+		SELECT h.child_group_id, h.parent_group_id
+		FROM user_group_hierarchy h
+		INNER JOIN reach r ON h.child_group_id = r.group_id
+		ORDER BY h.child_group_id, h.parent_group_id`
+
+	// Row sets of the listings, selecting users or groups as u. The group of the
+	// listings of one group is $1; listSQL appends the filters, order and limit.
+	queryListUsers                  = "FROM users u WHERE 1 = 1"
+	queryListUserGroups             = "FROM user_groups u WHERE 1 = 1"
+	queryListUsersInGroup           = "FROM users u INNER JOIN user_group_members m ON m.user_id = u.id WHERE m.user_group_id = $1"
+	queryListGroupsInGroup          = "FROM user_groups u INNER JOIN user_group_hierarchy h ON h.child_group_id = u.id WHERE h.parent_group_id = $1"
+	queryListUsersInGroupTransitive = `
+		WITH RECURSIVE all_groups AS (
+			SELECT {{int $1}} AS group_id
+			UNION
+			SELECT h.child_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN all_groups ag ON h.parent_group_id = ag.group_id
+		)
+		SELECT {{columns}}
+		FROM users u
+		WHERE u.id IN (SELECT m.user_id FROM user_group_members m INNER JOIN all_groups ag ON m.user_group_id = ag.group_id)`
+
+	// $1..$4 identify a grant and $5 is its condition, NULL for unconditional grants
+	queryUpdatePermissionCondition = `
+		UPDATE permissions SET condition_expr = $5
+		WHERE source_type = $1 AND source_id = $2 AND target_type = $3 AND target_id = $4`
+	querySelectPermissionCondition = `
+		SELECT COALESCE(condition_expr, '') FROM permissions
+		WHERE source_type = $1 AND source_id = $2 AND target_type = $3 AND target_id = $4`
+
+	// $1 is the source user and $2 the target user. A permission applies if its
+	// source is the user or one of their groups (transitively) and its target is the
+	// target user or one of their groups (transitively), and no permission applies
+	// while the source user is not active. The conditions of the applicable grants are
+	// returned with unconditional grants (NULL) first.
+	queryCheckUserPermissionOnUser = `
+		WITH RECURSIVE source_groups AS (
+			SELECT user_group_id AS group_id FROM user_group_members WHERE user_id = $1
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN source_groups sg ON h.child_group_id = sg.group_id
+		), target_groups AS (
+			SELECT user_group_id AS group_id FROM user_group_members WHERE user_id = $2
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN target_groups tg ON h.child_group_id = tg.group_id
+		)
+		SELECT p.condition_expr
+		FROM permissions p
+		WHERE ((p.source_type = 'user' AND p.source_id = $1)
+		    OR (p.source_type = 'group' AND p.source_id IN (SELECT group_id FROM source_groups)))
+		  AND ((p.target_type = 'user' AND p.target_id = $2)
+		    OR (p.target_type = 'group' AND p.target_id IN (SELECT group_id FROM target_groups)))
+		  AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = $1 AND u.status <> 'active')
+		ORDER BY CASE WHEN p.condition_expr IS NULL THEN 0 ELSE 1 END`
+
+	// $1 is the source user and $2 the target group. A permission applies if its
+	// source is the user or one of their groups (transitively) and its target is the
+	// target group or one of its ancestors, unless the source user is not active.
+	// Conditions are ordered as above.
+	queryCheckUserPermissionOnGroup = `
+		WITH RECURSIVE source_groups AS (
+			SELECT user_group_id AS group_id FROM user_group_members WHERE user_id = $1
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN source_groups sg ON h.child_group_id = sg.group_id
+		), target_groups AS (
+			SELECT {{int $2}} AS group_id
+			UNION
+			SELECT h.parent_group_id
+			FROM user_group_hierarchy h
+			INNER JOIN target_groups tg ON h.child_group_id = tg.group_id
+		)
+		SELECT p.condition_expr
+		FROM permissions p
+		WHERE ((p.source_type = 'user' AND p.source_id = $1)
+		    OR (p.source_type = 'group' AND p.source_id IN (SELECT group_id FROM source_groups)))
+		  AND p.target_type = 'group' AND p.target_id IN (SELECT group_id FROM target_groups)
+		  AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = $1 AND u.status <> 'active')
+		ORDER BY CASE WHEN p.condition_expr IS NULL THEN 0 ELSE 1 END`
+)
+
+// sqlQueries holds the queries of SQLRepository bound to one dialect
+type sqlQueries struct {
+	insertUser, selectUser           sqlQuery
+	insertUserGroup, selectUserGroup sqlQuery
+
+	selectUsersByName, selectUserGroupsByName           sqlQuery
+	selectUserByExternalID, selectUserGroupByExternalID sqlQuery
+	updateUserExternalID, updateUserGroupExternalID     sqlQuery
+	insertAttribute, deleteAttribute, selectAttributes  sqlQuery
+	insertUserToGroup, selectUsersInGroup               sqlQuery
+	deleteUserFromGroup, selectGroupsOfUser             sqlQuery
+	selectUserStatus, updateUserStatus                  sqlQuery
+	selectGroupRule, updateGroupRule                    sqlQuery
+	selectGroupType, updateGroupType                    sqlQuery
+	selectTypedEdges, selectGroupTypedEdges             sqlQuery
+	insertGroupToGroup, selectGroupsInGroup             sqlQuery
+	selectParentGroups, checkCycle                      sqlQuery
+	selectEdge, deleteEdge                              sqlQuery
+	selectGroupDepth, selectGroupHeight                 sqlQuery
+	countChildGroups, countParentGroups                 sqlQuery
+	insertPermission, updatePermissionCondition         sqlQuery
+	selectPermissionCondition                           sqlQuery
+	insertRevision, selectRevision                      sqlQuery
+	insertChangeEvent, selectChangeEvents               sqlQuery
+
+	deleteExpiredIdempotencyKey, deleteExpiredIdempotencyKeys sqlQuery
+	insertIdempotencyKey, selectIdempotencyKey                sqlQuery
+	updateIdempotencyKey                                      sqlQuery
+
+	usersInGroupTransitive, groupsForUserTransitive, ancestorGroups sqlQuery
+	userAncestorEdges, groupAncestorEdges, descendantGroups         sqlQuery
+	subtreeGroups, subtreeEdges, subtreeMembers                     sqlQuery
+	checkUserPermissionOnUser, checkUserPermissionOnGroup           sqlQuery
+
+	// returningID reports whether inserts yield their ID as a result row
+	returningID bool
+
+	lockRevisions, lockHierarchy, lockRules string
+}
+
+// newSQLQueries binds the shared queries to d
+func newSQLQueries(d Dialect) *sqlQueries {
+	bind := func(query string) sqlQuery { return bindQuery(d, query) }
+	insert := func(table string, columns ...string) sqlQuery {
+		query, _ := d.InsertReturningID(table, columns...)
+		return bind(query)
+	}
+	_, returning := d.InsertReturningID("users", "name")
+
+	return &sqlQueries{
+		insertUser:                insert("users", "name", "external_id", "unique_name"),
+		selectUser:                bind(querySelectUser),
+		insertUserGroup:           insert("user_groups", "name", "external_id", "unique_name"),
+		selectUserGroup:           bind(querySelectUserGroup),
+		insertUserToGroup:         bind(d.InsertIgnore("user_group_members", "user_id", "user_group_id")),
+		selectUsersInGroup:        bind(querySelectUsersInGroup),
+		deleteUserFromGroup:       bind(queryDeleteUserFromGroup),
+		selectGroupsOfUser:        bind(querySelectGroupsOfUser),
+		selectUserStatus:          bind(querySelectUserStatus),
+		updateUserStatus:          bind(queryUpdateUserStatus),
+		selectGroupRule:           bind(querySelectGroupRule),
+		updateGroupRule:           bind(queryUpdateGroupRule),
+		selectGroupType:           bind(querySelectGroupType),
+		updateGroupType:           bind(queryUpdateGroupType),
+		selectTypedEdges:          bind(querySelectTypedEdges),
+		selectGroupTypedEdges:     bind(querySelectGroupTypedEdges),
+		insertGroupToGroup:        bind(d.InsertIgnore("user_group_hierarchy", "child_group_id", "parent_group_id")),
+		selectGroupsInGroup:       bind(querySelectGroupsInGroup),
+		selectParentGroups:        bind(querySelectParentGroups),
+		selectEdge:                bind(querySelectEdge),
+		deleteEdge:                bind(queryDeleteEdge),
+		checkCycle:                bind(queryCheckCycle),
+		selectGroupDepth:          bind(querySelectGroupDepth),
+		selectGroupHeight:         bind(querySelectGroupHeight),
+		countChildGroups:          bind(queryCountChildGroups),
+		countParentGroups:         bind(queryCountParentGroups),
+		insertPermission:          bind(d.InsertIgnore("permissions", "source_type", "source_id", "target_type", "target_id")),
+		updatePermissionCondition: bind(queryUpdatePermissionCondition),
+		selectPermissionCondition: bind(querySelectPermissionCondition),
+		insertRevision:            insert("revisions"),
+		selectRevision:            bind(querySelectRevision),
+		insertChangeEvent: bind(insertInto("change_events",
+			[]string{"revision", "event_type", "subject_type", "subject_id", "object_type", "object_id", "user_status", "previous_object_id"})),
+		selectChangeEvents: bind(querySelectChangeEvents),
+
+		selectUsersByName:           bind(querySelectUsersByName),
+		selectUserGroupsByName:      bind(querySelectUserGroupsByName),
+		selectUserByExternalID:      bind(querySelectUserByExternalID),
+		selectUserGroupByExternalID: bind(querySelectUserGroupByExternalID),
+		updateUserExternalID:        bind(queryUpdateUserExternalID),
+		updateUserGroupExternalID:   bind(queryUpdateUserGroupExternalID),
+		insertAttribute: bind(insertInto("attributes",
+			[]string{"subject_type", "subject_id", "attr_name", "value_type", "attr_value"})),
+		deleteAttribute:  bind(queryDeleteAttribute),
+		selectAttributes: bind(querySelectAttributes),
+
+		deleteExpiredIdempotencyKey:  bind(queryDeleteExpiredIdempotencyKey),
+		deleteExpiredIdempotencyKeys: bind(queryDeleteExpiredIdempotencyKeys),
+		insertIdempotencyKey: bind(d.InsertIgnore("idempotency_keys",
+			"idempotency_key", "operation", "request_name", "expires_at")),
+		selectIdempotencyKey: bind(querySelectIdempotencyKey),
+		updateIdempotencyKey: bind(queryUpdateIdempotencyKey),
+
+		usersInGroupTransitive:     bind(querySelectUsersInGroupTransitive),
+		groupsForUserTransitive:    bind(querySelectGroupsForUserTransitive),
+		ancestorGroups:             bind(querySelectAncestorGroups),
+		userAncestorEdges:          bind(querySelectUserAncestorEdges),
+		groupAncestorEdges:         bind(querySelectGroupAncestorEdges),
+		descendantGroups:           bind(querySelectDescendantGroups),
+		subtreeGroups:              bind(querySelectSubtreeGroups),
+		subtreeEdges:               bind(querySelectSubtreeEdges),
+		subtreeMembers:             bind(querySelectSubtreeMembers),
+		checkUserPermissionOnUser:  bind(queryCheckUserPermissionOnUser),
+		checkUserPermissionOnGroup: bind(queryCheckUserPermissionOnGroup),
+
+		returningID:   returning,
+		lockRevisions: d.LockQuery(lockRevisions),
+		lockHierarchy: d.LockQuery(lockHierarchy),
+		lockRules:     d.LockQuery(lockRules),
+	}
+}
+
+// sqlEntity holds the queries and messages of the users or the user_groups table for
+// the operations both share
+type sqlEntity struct {
+	typ, op          string // "user" or "group", and the create operation
+	errorMsg         string
+	insert, name     sqlQuery
+	byName, byExtID  sqlQuery
+	updateExternalID sqlQuery
+	notFound         func(id int) error
+}
+
+// userEntity describes the users table
+func (q *sqlQueries) userEntity() sqlEntity {
+	return sqlEntity{
+		typ: "user", op: "CreateUser", errorMsg: "failed to create user",
+		insert: q.insertUser, name: q.selectUser,
+		byName: q.selectUsersByName, byExtID: q.selectUserByExternalID,
+		updateExternalID: q.updateUserExternalID,
+		notFound:         func(id int) error { return &UserNotFoundError{UserID: id} },
+	}
+}
+
+// groupEntity describes the user_groups table
+func (q *sqlQueries) groupEntity() sqlEntity {
+	return sqlEntity{
+		typ: "group", op: "CreateUserGroup", errorMsg: "failed to create user group",
+		insert: q.insertUserGroup, name: q.selectUserGroup,
+		byName: q.selectUserGroupsByName, byExtID: q.selectUserGroupByExternalID,
+		updateExternalID: q.updateUserGroupExternalID,
+		notFound:         func(id int) error { return &UserGroupNotFoundError{UserGroupID: id} },
+	}
+}
+
+// entity describes the table of subjectType, "user" or "group"
+func (q *sqlQueries) entity(subjectType string) (sqlEntity, error) {
+	switch subjectType {
+	case "user":
+		return q.userEntity(), nil
+	case "group":
+		return q.groupEntity(), nil
+	}
+	return sqlEntity{}, fmt.Errorf("invalid subject type %q", subjectType)
+}
+
+// SQLRepository implements the Repository interface on any database/sql engine
+// described by a Dialect. The schema must exist: MigrateSQL creates it for
+// PostgreSQL and SQLite, db/initdb/db.sql for MySQL.
+type SQLRepository struct {
+	db       *sql.DB
+	replicas []*sql.DB
+	next     uint32 // round-robin position in replicas
+	dialect  Dialect
+	queries  *sqlQueries
+	tracer   Tracer
+	logger   Logger
+	metrics  *Metrics
+
+	retryPolicy     RetryPolicy
+	idempotencyTTL  time.Duration
+	uniqueNames     bool
+	hierarchyLimits HierarchyLimits
+	nestingPolicy   NestingPolicy
+	lastPurge       int64 // unix nanoseconds of the last purge of expired idempotency keys
+}
+
+// SQLOption configures optional SQLRepository dependencies
+type SQLOption func(*SQLRepository)
+
+// WithSQLTracer sets the tracer used for SQL spans. A nil tracer disables tracing.
+func WithSQLTracer(tracer Tracer) SQLOption {
+	return func(r *SQLRepository) {
+		if tracer != nil {
+			r.tracer = tracer
+		}
+	}
+}
+
+// WithSQLLogger sets the logger for database errors. A nil logger disables logging.
+func WithSQLLogger(logger Logger) SQLOption {
+	return func(r *SQLRepository) {
+		if logger != nil {
+			r.logger = logger
+		}
+	}
+}
+
+// WithSQLReplicas sets read replicas of db. Reads that tolerate replication lag are
+// spread across them, see WithPrimaryReads for the reads that are not.
+func WithSQLReplicas(replicas ...*sql.DB) SQLOption {
+	return func(r *SQLRepository) {
+		r.replicas = append(r.replicas, replicas...)
+	}
+}
+
+// WithSQLRetryPolicy sets how transient errors such as deadlocks are retried,
+// e.g. to Config.Retry
+func WithSQLRetryPolicy(policy RetryPolicy) SQLOption {
+	return func(r *SQLRepository) {
+		r.retryPolicy = policy
+	}
+}
+
+// WithSQLMetrics counts retries in metrics. A nil registry disables counting.
+func WithSQLMetrics(metrics *Metrics) SQLOption {
+	return func(r *SQLRepository) {
+		r.metrics = metrics
+	}
+}
+
+// WithSQLIdempotencyTTL sets how long idempotency keys are remembered, e.g. to
+// Config.IdempotencyTTL. The default is DefaultIdempotencyTTL.
+func WithSQLIdempotencyTTL(ttl time.Duration) SQLOption {
+	return func(r *SQLRepository) {
+		if ttl > 0 {
+			r.idempotencyTTL = ttl
+		}
+	}
+}
+
+// WithSQLUniqueNames enforces unique user names and unique group names, e.g. from
+// Config.UniqueNames. Creates then fail with a NameConflictError.
+func WithSQLUniqueNames(enforce bool) SQLOption {
+	return func(r *SQLRepository) {
+		r.uniqueNames = enforce
+	}
+}
+
+// WithSQLHierarchyLimits rejects hierarchy edges that break limits with a
+// HierarchyLimitError, e.g. from Config.HierarchyLimits
+func WithSQLHierarchyLimits(limits HierarchyLimits) SQLOption {
+	return func(r *SQLRepository) {
+		r.hierarchyLimits = limits
+	}
+}
+
+// WithSQLNestingPolicy rejects hierarchy edges and group types that policy does not
+// allow with a NestingNotAllowedError, e.g. from Config.NestingPolicy
+func WithSQLNestingPolicy(policy NestingPolicy) SQLOption {
+	return func(r *SQLRepository) {
+		r.nestingPolicy = policy
+	}
+}
+
+// WithSQLConfig applies the repository settings of config: Retry, IdempotencyTTL,
+// UniqueNames, HierarchyLimits and NestingPolicy. Start from DefaultConfig, since a
+// zero Retry disables retries. Options after it override single settings.
+func WithSQLConfig(config Config) SQLOption {
+	return func(r *SQLRepository) {
+		WithSQLRetryPolicy(config.Retry)(r)
+		WithSQLIdempotencyTTL(config.IdempotencyTTL)(r)
+		WithSQLUniqueNames(config.UniqueNames)(r)
+		WithSQLHierarchyLimits(config.HierarchyLimits)(r)
+		WithSQLNestingPolicy(config.NestingPolicy)(r)
+	}
+}
+
+// NewSQLRepository creates a repository that talks to db in the given dialect
+func NewSQLRepository(db *sql.DB, dialect Dialect, opts ...SQLOption) *SQLRepository {
+	r := &SQLRepository{
+		db:      db,
+		dialect: dialect,
+		queries: newSQLQueries(dialect),
+		tracer:  noopTracer{},
+		logger:  noopLogger{},
+
+		retryPolicy:    DefaultRetryPolicy(),
+		idempotencyTTL: DefaultIdempotencyTTL,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Dialect returns the dialect the repository was created with
+func (r *SQLRepository) Dialect() Dialect {
+	return r.dialect
+}
+
+// Helper methods to reduce repetition
+
+// replica returns the next replica for a read, or nil if the read must use the primary
+func (r *SQLRepository) replica(ctx context.Context, read bool) *sql.DB {
+	if !read || len(r.replicas) == 0 || primaryReadsRequired(ctx) {
+		return nil
+	}
+	n := atomic.AddUint32(&r.next, 1)
+	return r.replicas[int(n-1)%len(r.replicas)]
+}
+
+// queryKind tells how an operation may be routed and retried
+type queryKind int
+
+const (
+	// kindRead may use a replica and is retried on any transient error
+	kindRead queryKind = iota
+	// kindTransaction uses the primary and is retried unless its COMMIT failed
+	// with an unknown outcome
+	kindTransaction
+	// kindInsert uses the primary and is only retried if the server rolled it back,
+	// since running it twice would create two rows
+	kindInsert
+)
+
+// startSpan starts a span for the SQL operation op. The caller must end it.
+func (r *SQLRepository) startSpan(ctx context.Context, op string, query sqlQuery) (context.Context, Span) {
+	name := r.dialect.Name()
+	ctx, span := r.tracer.Start(ctx, name+"."+op)
+	span.SetAttributes(
+		StringAttr("db.system", name),
+		StringAttr("db.operation", op),
+		StringAttr("db.statement", compactSQL(query.text)),
+	)
+	return ctx, span
+}
+
+// withConn runs fn with a pooled connection and retries transient errors as allowed
+// by kind. Each attempt acquires a new connection in a child span, so time spent
+// waiting for the pool is visible apart from query time. A read uses a replica if
+// one is configured and falls back to the primary if no replica connection can be
+// acquired.
+func (r *SQLRepository) withConn(ctx context.Context, op string, span Span, kind queryKind, fn func(conn *sql.Conn) error) error {
+	return r.retry(ctx, op, span, kind, func() error {
+		conn, err := r.acquire(ctx, op, span, kind == kindRead)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return fn(conn)
+	})
+}
+
+// acquire returns a connection to a replica for reads if possible, and to the
+// primary otherwise
+func (r *SQLRepository) acquire(ctx context.Context, op string, span Span, read bool) (*sql.Conn, error) {
+	name := r.dialect.Name()
+	if replica := r.replica(ctx, read); replica != nil {
+		_, acquireSpan := r.tracer.Start(ctx, name+".acquire_connection")
+		acquireSpan.SetAttributes(BoolAttr("db.replica", true))
+		conn, err := replica.Conn(ctx)
+		endSpan(acquireSpan, err)
+		if err == nil {
+			span.SetAttributes(BoolAttr("db.replica", true))
+			return conn, nil
+		}
+		r.logger.Log(ctx, LevelWarn, "replica unavailable, reading from primary",
+			StringAttr("operation", op), StringAttr("error", err.Error()))
+	}
+
+	_, acquireSpan := r.tracer.Start(ctx, name+".acquire_connection")
+	conn, err := r.db.Conn(ctx)
+	endSpan(acquireSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	span.SetAttributes(BoolAttr("db.replica", false))
+	return conn, nil
+}
+
+// endQuery ends the span of the SQL operation op and logs database errors with the
+// operation name. Errors the repository returns by design, such as not found or
+// cycle errors, are left to the caller.
+func (r *SQLRepository) endQuery(ctx context.Context, op string, span Span, err error, attrs ...Attribute) {
+	endSpan(span, err, attrs...)
+	r.logError(ctx, op, err)
+}
+
+// logError logs err at error level if it is a database error
+func (r *SQLRepository) logError(ctx context.Context, op string, err error) {
+	if err == nil || errorKind(err) != "other" {
+		return
+	}
+	r.logger.Log(ctx, LevelError, "database operation failed",
+		StringAttr("operation", op), StringAttr("error", err.Error()))
+}
+
+// sqlExecer is implemented by *sql.Conn and *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// insertID executes an insert and returns the new ID, from a RETURNING row if
+// returning is set and from LastInsertId otherwise
+func insertID(ctx context.Context, db sqlExecer, query sqlQuery, returning bool, args ...interface{}) (int64, error) {
+	if returning {
+		var id int64
+		err := db.QueryRowContext(ctx, query.text, query.args(args)...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.ExecContext(ctx, query.text, query.args(args)...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return id, nil
+}
+
+// execInsert executes an insert query and returns the new ID
+func (r *SQLRepository) execInsert(ctx context.Context, op string, query sqlQuery, errorMsg string, args ...interface{}) (id int, err error) {
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("db.insert_id", id)) }()
+
+	err = r.withConn(ctx, op, span, kindInsert, func(conn *sql.Conn) error {
+		lastID, err := insertID(ctx, conn, query, r.queries.returningID, args...)
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return id, nil
+}
+
+// idempotencyPurgeInterval bounds how often expired idempotency keys are purged
+const idempotencyPurgeInterval = time.Minute
+
+// purgeIdempotencyKeys deletes expired idempotency keys at most once per
+// idempotencyPurgeInterval. It runs outside the create transaction, so its range
+// locks are held briefly, and a failure only delays the cleanup.
+func (r *SQLRepository) purgeIdempotencyKeys(ctx context.Context, now time.Time) {
+	last := atomic.LoadInt64(&r.lastPurge)
+	if now.UnixNano()-last < int64(idempotencyPurgeInterval) || !atomic.CompareAndSwapInt64(&r.lastPurge, last, now.UnixNano()) {
+		return
+	}
+	q := r.queries.deleteExpiredIdempotencyKeys
+	if _, err := r.db.ExecContext(ctx, q.text, q.args([]interface{}{now})...); err != nil {
+		r.logger.Log(ctx, LevelWarn, "failed to purge expired idempotency keys", StringAttr("error", err.Error()))
+	}
+}
+
+// execCreate creates a user or group. Plain creates are a single insert. Creates with
+// an idempotency key, an external ID or under unique names run in one transaction that
+// claims the key, checks for conflicts, inserts the row and records its ID, so a
+// concurrent create with the same key waits for this one and then replays its ID.
+// An expired record of the key is deleted first.
+func (r *SQLRepository) execCreate(ctx context.Context, e sqlEntity, name, externalID string) (id int, err error) {
+	if err := validateExternalID(externalID); err != nil {
+		return 0, err
+	}
+	var uniqueName interface{}
+	if r.uniqueNames {
+		uniqueName = name
+	}
+	key, keyed := IdempotencyKeyFromContext(ctx)
+	if !keyed && externalID == "" && !r.uniqueNames {
+		return r.execInsert(ctx, e.op, e.insert, e.errorMsg, name, nil, nil)
+	}
+
+	op := e.op
+	replayed := false
+	ctx, span := r.startSpan(ctx, op, e.insert)
+	defer func() {
+		r.endQuery(ctx, op, span, err, IntAttr("db.insert_id", id), BoolAttr("idempotency.replayed", replayed))
+	}()
+	if keyed {
+		if err := validateIdempotencyKey(key); err != nil {
+			return 0, err
+		}
+		r.purgeIdempotencyKeys(ctx, time.Now().UTC())
+	}
+
+	q := r.queries
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if keyed {
+			rec, err := r.claimIdempotencyKey(ctx, tx, key, op, name)
+			if err != nil || rec != nil {
+				if rec != nil {
+					replayed = true
+					id, err = rec.replay(op, name)
+				}
+				return err
+			}
+		}
+
+		if err := r.checkConflicts(ctx, tx, e, name, externalID, 0); err != nil {
+			return err
+		}
+		lastID, err := insertID(ctx, tx, e.insert, q.returningID, name, nullString(externalID), uniqueName)
+		if err != nil {
+			// A concurrent create may have taken the external ID or name after the check
+			if conflict := r.checkConflicts(ctx, r.db, e, name, externalID, 0); isConflict(conflict) {
+				return conflict
+			}
+			return fmt.Errorf("%s: %w", e.errorMsg, err)
+		}
+
+		if keyed {
+			if _, err := tx.ExecContext(ctx, q.updateIdempotencyKey.text, q.updateIdempotencyKey.args([]interface{}{key, lastID})...); err != nil {
+				return fmt.Errorf("failed to record idempotency key: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return &commitError{err: err}
+		}
+		id = int(lastID)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// claimIdempotencyKey claims key for a create inside tx. It returns nil if the key is
+// new and the record of the earlier create otherwise.
+func (r *SQLRepository) claimIdempotencyKey(ctx context.Context, tx *sql.Tx, key, op, name string) (*idempotencyRecord, error) {
+	q := r.queries
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, q.deleteExpiredIdempotencyKey.text, q.deleteExpiredIdempotencyKey.args([]interface{}{key, now})...); err != nil {
+		return nil, fmt.Errorf("failed to delete expired idempotency key: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, q.insertIdempotencyKey.text,
+		q.insertIdempotencyKey.args([]interface{}{key, op, name, now.Add(r.idempotencyTTL)})...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if claimed > 0 {
+		return nil, nil
+	}
+
+	rec := &idempotencyRecord{Key: key}
+	err = tx.QueryRowContext(ctx, q.selectIdempotencyKey.text, q.selectIdempotencyKey.args([]interface{}{key})...).
+		Scan(&rec.Operation, &rec.Name, &rec.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+	return rec, nil
+}
+
+// sqlQueryer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlRowsQueryer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type sqlRowsQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// checkConflicts returns an ExternalIDConflictError if another row than self has
+// externalID and, under unique names, a NameConflictError if another row has name
+func (r *SQLRepository) checkConflicts(ctx context.Context, db sqlQueryer, e sqlEntity, name, externalID string, self int) error {
+	if externalID != "" {
+		existing, err := queryFirstID(ctx, db, e.byExtID, externalID)
+		if err != nil {
+			return fmt.Errorf("failed to check external ID: %w", err)
+		}
+		if existing != 0 && existing != self {
+			return &ExternalIDConflictError{Type: e.typ, ExternalID: externalID, ExistingID: existing}
+		}
+	}
+	if r.uniqueNames && self == 0 {
+		existing, err := queryFirstID(ctx, db, e.byName, name)
+		if err != nil {
+			return fmt.Errorf("failed to check name: %w", err)
+		}
+		if existing != 0 {
+			return &NameConflictError{Type: e.typ, Name: name, ExistingID: existing}
+		}
+	}
+	return nil
+}
+
+// queryFirstID returns the first ID selected by query, or 0 if there is none
+func queryFirstID(ctx context.Context, db sqlQueryer, query sqlQuery, args ...interface{}) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, query.text, query.args(args)...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// isConflict reports whether err is an external ID or name conflict
+func isConflict(err error) bool {
+	return errors.Is(err, ErrExternalIDConflict) || errors.Is(err, ErrNameConflict)
+}
+
+// execSetExternalID sets or, for an empty externalID, clears the external ID of a user or group
+func (r *SQLRepository) execSetExternalID(ctx context.Context, op string, e sqlEntity, id int, externalID string) (err error) {
+	if err := validateExternalID(externalID); err != nil {
+		return err
+	}
+	ctx, span := r.startSpan(ctx, op, e.updateExternalID)
+	defer func() { r.endQuery(ctx, op, span, err) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if err := r.checkConflicts(ctx, tx, e, "", externalID, id); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, e.updateExternalID.text, e.updateExternalID.args([]interface{}{id, nullString(externalID)})...)
+		if err != nil {
+			if conflict := r.checkConflicts(ctx, r.db, e, "", externalID, id); isConflict(conflict) {
+				return conflict
+			}
+			return fmt.Errorf("failed to set external ID: %w", err)
+		}
+		// MySQL counts only changed rows, so an unchanged row needs a lookup
+		if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+			var name string
+			err := tx.QueryRowContext(ctx, e.name.text, e.name.args([]interface{}{id})...).Scan(&name)
+			if errors.Is(err, sql.ErrNoRows) {
+				return e.notFound(id)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to set external ID: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return &commitError{err: err}
+		}
+		return nil
+	})
+	return err
+}
+
+// queryExternalID returns the ID of the user or group with externalID
+func (r *SQLRepository) queryExternalID(ctx context.Context, op string, e sqlEntity, externalID string) (int, error) {
+	ids, err := r.queryIDs(ctx, op, e.byExtID, "failed to look up external ID", externalID)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, &ExternalIDNotFoundError{Type: e.typ, ExternalID: externalID}
+	}
+	return ids[0], nil
+}
+
+// subjectExists returns the not found error of e if the row id does not exist
+func subjectExists(ctx context.Context, db sqlQueryer, e sqlEntity, id int) error {
+	var name string
+	err := db.QueryRowContext(ctx, e.name.text, e.name.args([]interface{}{id})...).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e.notFound(id)
+	}
+	return err
+}
+
+// execWithRevision executes a mutation and records a new revision and its change event in the same transaction
+func (r *SQLRepository) execWithRevision(ctx context.Context, op string, event ChangeEvent, query sqlQuery, errorMsg string, args ...interface{}) (rev Revision, err error) {
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if _, err := tx.ExecContext(ctx, query.text, query.args(args)...); err != nil {
+			return fmt.Errorf("%s: %w", errorMsg, err)
+		}
+
+		rev, err = r.commitWithRevision(ctx, tx, event)
+		return err
+	})
+	return rev, err
+}
+
+// commitWithRevision records a new revision and its change event inside tx and commits it.
+// Writing the event in the same transaction as the mutation makes change_events a
+// transactional outbox: an event exists if and only if its mutation committed.
+func (r *SQLRepository) commitWithRevision(ctx context.Context, tx *sql.Tx, event ChangeEvent) (Revision, error) {
+	rev, err := r.recordRevision(ctx, tx, event)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, &commitError{err: err}
+	}
+	return rev, nil
+}
+
+// recordRevision records a new revision and its change event inside tx without
+// committing it. The revisions lock is held until tx ends, so revisions commit in
+// ID order and a change feed reader that sees a revision has seen every earlier one
+// that will ever commit. Record revisions last, after every other write of tx.
+func (r *SQLRepository) recordRevision(ctx context.Context, tx *sql.Tx, event ChangeEvent) (Revision, error) {
+	q := r.queries
+	if q.lockRevisions != "" {
+		if _, err := tx.ExecContext(ctx, q.lockRevisions); err != nil {
+			return 0, fmt.Errorf("failed to lock revisions: %w", err)
+		}
+	}
+
+	id, err := insertID(ctx, tx, q.insertRevision, q.returningID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record revision: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, q.insertChangeEvent.text, q.insertChangeEvent.args([]interface{}{
+		id, event.Type, event.SubjectType, event.SubjectID, event.ObjectType, event.ObjectID,
+		nullString(string(event.Status)), nullID(event.PreviousObjectID)})...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record change event: %w", err)
+	}
+
+	return Revision(id), nil
+}
+
+// currentRevisionTx returns the latest revision as seen by tx, for writes that turn
+// out to change nothing and so record no revision of their own
+func (r *SQLRepository) currentRevisionTx(ctx context.Context, tx *sql.Tx) (Revision, error) {
+	var current int64
+	if err := tx.QueryRowContext(ctx, r.queries.selectRevision.text).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	return Revision(current), nil
+}
+
+// nullID returns nil for a zero ID so that it is stored as NULL
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// queryString queries a single string value with custom error handling for not found
+func (r *SQLRepository) queryString(ctx context.Context, op string, query sqlQuery, notFoundErr error, errorMsg string, args ...interface{}) (value string, err error) {
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, query.text, query.args(args)...).Scan(&value)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", notFoundErr
+		}
+		return "", fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return value, nil
+}
+
+// queryIDs queries a list of integer IDs
+func (r *SQLRepository) queryIDs(ctx context.Context, op string, query sqlQuery, errorMsg string, args ...interface{}) (ids []int, err error) {
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("db.rows", len(ids))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, query.text, query.args(args)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		ids = make([]int, 0)
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return fmt.Errorf("failed to scan id: %w", err)
+			}
+			ids = append(ids, id)
+		}
+
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return ids, nil
+}
+
+// queryExists checks if a query returns any rows
+func (r *SQLRepository) queryExists(ctx context.Context, op string, query sqlQuery, errorMsg string, args ...interface{}) (exists bool, err error) {
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err, BoolAttr("db.exists", exists)) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		var found int
+		err := conn.QueryRowContext(ctx, query.text, query.args(args)...).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			exists = false
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return exists, nil
+}
+
+// CreateUser creates a new user and returns their ID
+func (r *SQLRepository) CreateUser(ctx context.Context, name string) (int, error) {
+	return r.execCreate(ctx, r.queries.userEntity(), name, "")
+}
+
+// GetUserByID retrieves a user's name by their ID
+func (r *SQLRepository) GetUserByID(ctx context.Context, userID int) (string, error) {
+	return r.queryString(ctx, "GetUserByID", r.queries.selectUser, &UserNotFoundError{UserID: userID}, "failed to get user name", userID)
+}
+
+// CreateUserGroup creates a new user group and returns its ID
+func (r *SQLRepository) CreateUserGroup(ctx context.Context, name string) (int, error) {
+	return r.execCreate(ctx, r.queries.groupEntity(), name, "")
+}
+
+// GetUserGroupByID retrieves a user group's name by its ID
+func (r *SQLRepository) GetUserGroupByID(ctx context.Context, groupID int) (string, error) {
+	return r.queryString(ctx, "GetUserGroupByID", r.queries.selectUserGroup, &UserGroupNotFoundError{UserGroupID: groupID}, "failed to get user group name", groupID)
+}
+
+// CreateUserWithExternalID creates a new user with an external ID and returns their ID
+func (r *SQLRepository) CreateUserWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	return r.execCreate(ctx, r.queries.userEntity(), name, externalID)
+}
+
+// CreateUserGroupWithExternalID creates a new user group with an external ID and returns its ID
+func (r *SQLRepository) CreateUserGroupWithExternalID(ctx context.Context, name, externalID string) (int, error) {
+	return r.execCreate(ctx, r.queries.groupEntity(), name, externalID)
+}
+
+// SetUserExternalID sets or clears the external ID of a user
+func (r *SQLRepository) SetUserExternalID(ctx context.Context, userID int, externalID string) error {
+	return r.execSetExternalID(ctx, "SetUserExternalID", r.queries.userEntity(), userID, externalID)
+}
+
+// SetUserGroupExternalID sets or clears the external ID of a user group
+func (r *SQLRepository) SetUserGroupExternalID(ctx context.Context, groupID int, externalID string) error {
+	return r.execSetExternalID(ctx, "SetUserGroupExternalID", r.queries.groupEntity(), groupID, externalID)
+}
+
+// GetUserByExternalID returns the ID of the user with the given external ID
+func (r *SQLRepository) GetUserByExternalID(ctx context.Context, externalID string) (int, error) {
+	return r.queryExternalID(ctx, "GetUserByExternalID", r.queries.userEntity(), externalID)
+}
+
+// GetUserGroupByExternalID returns the ID of the user group with the given external ID
+func (r *SQLRepository) GetUserGroupByExternalID(ctx context.Context, externalID string) (int, error) {
+	return r.queryExternalID(ctx, "GetUserGroupByExternalID", r.queries.groupEntity(), externalID)
+}
+
+// FindUsersByName returns the IDs of all users with the given name
+func (r *SQLRepository) FindUsersByName(ctx context.Context, name string) ([]int, error) {
+	return r.queryIDs(ctx, "FindUsersByName", r.queries.selectUsersByName, "failed to find users by name", name)
+}
+
+// FindUserGroupsByName returns the IDs of all user groups with the given name
+func (r *SQLRepository) FindUserGroupsByName(ctx context.Context, name string) ([]int, error) {
+	return r.queryIDs(ctx, "FindUserGroupsByName", r.queries.selectUserGroupsByName, "failed to find user groups by name", name)
+}
+
+// SetAttribute sets or, for a nil value, removes an attribute of a user or group and
+// returns the revision of the last membership change it caused, or the current
+// revision if it caused none
+func (r *SQLRepository) SetAttribute(ctx context.Context, subjectType string, subjectID int, name string, value interface{}) (rev Revision, err error) {
+	const op = "SetAttribute"
+	e, err := r.queries.entity(subjectType)
+	if err != nil {
+		return 0, err
+	}
+	var stored storedAttribute
+	if value == nil {
+		err = validateAttributeName(subjectType, name)
+	} else {
+		stored, err = encodeAttribute(subjectType, name, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.insertAttribute)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		// User attributes decide dynamic memberships, so they are written under the
+		// rules lock, taken before the first read
+		if subjectType == "user" {
+			if err := lockTx(ctx, tx, q.lockRules, "membership rules"); err != nil {
+				return err
+			}
+		}
+		if err := subjectExists(ctx, tx, e, subjectID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, q.deleteAttribute.text, q.deleteAttribute.args([]interface{}{subjectType, subjectID, name})...); err != nil {
+			return err
+		}
+		if value != nil {
+			_, err := tx.ExecContext(ctx, q.insertAttribute.text,
+				q.insertAttribute.args([]interface{}{subjectType, subjectID, name, string(stored.Type), string(stored.Value)})...)
+			if err != nil {
+				return err
+			}
+		}
+		if subjectType == "user" {
+			if rev, err = r.applyUserRules(ctx, tx, subjectID); err != nil {
+				return err
+			}
+		}
+		if rev == 0 {
+			if rev, err = r.currentRevisionTx(ctx, tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return &commitError{err: err}
+		}
+		return nil
+	})
+	if err != nil && errorKind(err) == "other" {
+		return 0, fmt.Errorf("failed to set attribute: %w", err)
+	}
+	return rev, err
+}
+
+// GetAttributes returns all attributes of a user or group
+func (r *SQLRepository) GetAttributes(ctx context.Context, subjectType string, subjectID int) (attrs Attributes, err error) {
+	const op = "GetAttributes"
+	e, err := r.queries.entity(subjectType)
+	if err != nil {
+		return nil, err
+	}
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.selectAttributes)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("db.rows", len(attrs))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		if err := subjectExists(ctx, conn, e, subjectID); err != nil {
+			return err
+		}
+		attrs, err = r.selectAttributes(ctx, conn, subjectType, subjectID)
+		return err
+	})
+	if err != nil && errorKind(err) == "other" {
+		return nil, fmt.Errorf("failed to get attributes: %w", err)
+	}
+	return attrs, err
+}
+
+// selectAttributes reads the attributes of a user or group through db
+func (r *SQLRepository) selectAttributes(ctx context.Context, db sqlRowsQueryer, subjectType string, subjectID int) (Attributes, error) {
+	q := r.queries
+	rows, err := db.QueryContext(ctx, q.selectAttributes.text, q.selectAttributes.args([]interface{}{subjectType, subjectID})...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]storedAttribute)
+	for rows.Next() {
+		var name, typ, value string
+		if err := rows.Scan(&name, &typ, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan attribute: %w", err)
+		}
+		stored[name] = storedAttribute{Type: AttributeType(typ), Value: []byte(value)}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return decodeAttributes(stored)
+}
+
+// AddUserToGroup adds a user to a group unless the group is dynamic
+func (r *SQLRepository) AddUserToGroup(ctx context.Context, userID, groupID int) (rev Revision, err error) {
+	q := r.queries
+	ctx, span := r.startSpan(ctx, "AddUserToGroup", q.insertUserToGroup)
+	defer func() { r.endQuery(ctx, "AddUserToGroup", span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, "AddUserToGroup", span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if err := lockTx(ctx, tx, q.lockRules, "membership rules"); err != nil {
+			return err
+		}
+		var rule string
+		err = tx.QueryRowContext(ctx, q.selectGroupRule.text, q.selectGroupRule.args([]interface{}{groupID})...).Scan(&rule)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get membership rule: %w", err)
+		}
+		if rule != "" {
+			return &DynamicGroupError{UserID: userID, UserGroupID: groupID}
+		}
+
+		result, err := tx.ExecContext(ctx, q.insertUserToGroup.text, q.insertUserToGroup.args([]interface{}{userID, groupID})...)
+		if err != nil {
+			return fmt.Errorf("failed to add user to group: %w", err)
+		}
+		// Adding an existing membership records nothing
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to add user to group: %w", err)
+		} else if n == 0 {
+			rev, err = r.currentRevisionTx(ctx, tx)
+			return err
+		}
+
+		rev, err = r.commitWithRevision(ctx, tx, membershipAddedEvent(userID, groupID))
+		return err
+	})
+	return rev, err
+}
+
+// SetUserStatus sets the lifecycle status of a user and records a revision unless the
+// user already has it
+func (r *SQLRepository) SetUserStatus(ctx context.Context, userID int, status UserStatus) (rev Revision, err error) {
+	const op = "SetUserStatus"
+	if err := status.validate(); err != nil {
+		return 0, err
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.updateUserStatus)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		// The update only matches a transition, so concurrent calls record it once
+		result, err := tx.ExecContext(ctx, q.updateUserStatus.text, q.updateUserStatus.args([]interface{}{userID, string(status)})...)
+		if err != nil {
+			return fmt.Errorf("failed to set user status: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to set user status: %w", err)
+		} else if n == 0 {
+			if err := subjectExists(ctx, tx, q.userEntity(), userID); err != nil {
+				return err
+			}
+			if rev, err = r.currentRevisionTx(ctx, tx); err != nil {
+				return err
+			}
+			return nil
+		}
+		rev, err = r.commitWithRevision(ctx, tx, userStatusChangedEvent(userID, status))
+		return err
+	})
+	return rev, err
+}
+
+// GetUserStatus returns the lifecycle status of a user
+func (r *SQLRepository) GetUserStatus(ctx context.Context, userID int) (UserStatus, error) {
+	status, err := r.queryString(ctx, "GetUserStatus", r.queries.selectUserStatus, &UserNotFoundError{UserID: userID},
+		"failed to get user status", userID)
+	return UserStatus(status), err
+}
+
+// GetUserStatuses returns the lifecycle statuses of users, omitting unknown IDs
+func (r *SQLRepository) GetUserStatuses(ctx context.Context, userIDs []int) (statuses map[int]UserStatus, err error) {
+	const op = "GetUserStatuses"
+	statuses = make(map[int]UserStatus, len(userIDs))
+	for len(userIDs) > 0 {
+		batch := userIDs
+		if len(batch) > statusBatchSize {
+			batch = batch[:statusBatchSize]
+		}
+		if err := r.queryStatuses(ctx, op, batch, statuses); err != nil {
+			return nil, err
+		}
+		userIDs = userIDs[len(batch):]
+	}
+	return statuses, nil
+}
+
+// statusBatchSize bounds the number of placeholders of one GetUserStatuses query
+const statusBatchSize = 500
+
+// queryStatuses adds the statuses of userIDs to statuses
+func (r *SQLRepository) queryStatuses(ctx context.Context, op string, userIDs []int, statuses map[int]UserStatus) (err error) {
+	placeholders := make([]string, len(userIDs))
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = id
+	}
+	query := bindQuery(r.dialect, "SELECT id, status FROM users WHERE id IN ("+strings.Join(placeholders, ", ")+")")
+
+	ctx, span := r.startSpan(ctx, op, query)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("db.rows", len(statuses))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, query.text, query.args(args)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int
+			var status UserStatus
+			if err := rows.Scan(&id, &status); err != nil {
+				return fmt.Errorf("failed to scan user status: %w", err)
+			}
+			statuses[id] = status
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get user statuses: %w", err)
+	}
+	return nil
+}
+
+// SetGroupRule sets or, for an empty rule, clears the membership rule of a group and
+// updates its members in the same transaction. A changed rule records a rule_changed
+// event ahead of the membership events it causes.
+func (r *SQLRepository) SetGroupRule(ctx context.Context, groupID int, rule string) (rev Revision, err error) {
+	const op = "SetGroupRule"
+	var parsed *Condition
+	if rule != "" {
+		if parsed, err = ParseMembershipRule(rule); err != nil {
+			return 0, err
+		}
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.updateGroupRule)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if err := lockTx(ctx, tx, q.lockRules, "membership rules"); err != nil {
+			return err
+		}
+		var current string
+		err = tx.QueryRowContext(ctx, q.selectGroupRule.text, q.selectGroupRule.args([]interface{}{groupID})...).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &UserGroupNotFoundError{UserGroupID: groupID}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get membership rule: %w", err)
+		}
+		var previous *Condition
+		if current != "" {
+			if previous, err = ParseMembershipRule(current); err != nil {
+				return fmt.Errorf("failed to parse stored rule of group %d: %w", groupID, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, q.updateGroupRule.text, q.updateGroupRule.args([]interface{}{groupID, nullString(rule)})...); err != nil {
+			return fmt.Errorf("failed to set membership rule: %w", err)
+		}
+
+		var events []ChangeEvent
+		if ruleString(previous) != ruleString(parsed) {
+			events = append(events, ruleChangedEvent(groupID))
+		}
+		if parsed != nil {
+			attrs, err := selectAllUserAttributes(ctx, tx)
+			if err != nil {
+				return err
+			}
+			members, err := selectIDSet(ctx, tx, q.selectUsersInGroup, groupID)
+			if err != nil {
+				return fmt.Errorf("failed to get users in group: %w", err)
+			}
+			add, remove := groupRuleChanges(parsed, members, attrs)
+			events = append(events, groupMembershipEvents(groupID, add, remove)...)
+		}
+		if rev, err = r.applyMembershipEvents(ctx, tx, events); err != nil {
+			return err
+		}
+		if rev == 0 {
+			if rev, err = r.currentRevisionTx(ctx, tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return &commitError{err: err}
+		}
+		return nil
+	})
+	if err != nil && errorKind(err) == "other" {
+		return 0, fmt.Errorf("failed to set membership rule: %w", err)
+	}
+	return rev, err
+}
+
+// GetGroupRule returns the membership rule of a group, "" for static groups
+func (r *SQLRepository) GetGroupRule(ctx context.Context, groupID int) (string, error) {
+	return r.queryString(ctx, "GetGroupRule", r.queries.selectGroupRule, &UserGroupNotFoundError{UserGroupID: groupID},
+		"failed to get membership rule", groupID)
+}
+
+// applyUserRules re-evaluates the membership rules for a user inside tx, which holds
+// the rules lock, records a revision for every membership it adds or removes and
+// returns the last one, 0 if there are none
+func (r *SQLRepository) applyUserRules(ctx context.Context, tx *sql.Tx, userID int) (Revision, error) {
+	q := r.queries
+	rules, err := selectAllRules(ctx, tx)
+	if err != nil || len(rules) == 0 {
+		return 0, err
+	}
+	attrs, err := r.selectAttributes(ctx, tx, "user", userID)
+	if err != nil {
+		return 0, err
+	}
+	groups, err := selectIDSet(ctx, tx, q.selectGroupsOfUser, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get groups of user: %w", err)
+	}
+	join, leave := userRuleChanges(rules, groups, attrs)
+	return r.applyMembershipEvents(ctx, tx, ruleMembershipEvents(userID, join, leave))
+}
+
+// applyMembershipEvents adds and removes the memberships described by events inside
+// tx, records a revision for each and returns the last one, 0 if there are none. Other
+// events, such as rule_changed, are only recorded. The memberships are written before the first revision: once tx holds the revisions
+// lock it must not wait for row locks, which a writer waiting for the revisions lock
+// may hold.
+func (r *SQLRepository) applyMembershipEvents(ctx context.Context, tx *sql.Tx, events []ChangeEvent) (rev Revision, err error) {
+	q := r.queries
+	for _, event := range events {
+		var query sqlQuery
+		switch event.Type {
+		case EventMembershipAdded:
+			query = q.insertUserToGroup
+		case EventMembershipRemoved:
+			query = q.deleteUserFromGroup
+		default:
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, query.text, query.args([]interface{}{event.SubjectID, event.ObjectID})...); err != nil {
+			return 0, fmt.Errorf("failed to update group membership: %w", err)
+		}
+	}
+	for _, event := range events {
+		if rev, err = r.recordRevision(ctx, tx, event); err != nil {
+			return 0, err
+		}
+	}
+	return rev, nil
+}
+
+// lockTx takes the lock of a dialect lock statement inside tx, if the dialect has one
+func lockTx(ctx context.Context, tx *sql.Tx, lock, name string) error {
+	if lock == "" {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, lock); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", name, err)
+	}
+	return nil
+}
+
+// selectIDSet returns the set of IDs selected by query inside tx
+func selectIDSet(ctx context.Context, tx *sql.Tx, query sqlQuery, args ...interface{}) (map[int]bool, error) {
+	rows, err := tx.QueryContext(ctx, query.text, query.args(args)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan id: %w", err)
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// selectAllRules returns the parsed membership rules of all dynamic groups inside tx
+func selectAllRules(ctx context.Context, tx *sql.Tx) (map[int]*Condition, error) {
+	stored := make(map[int]string)
+	err := scanRows(ctx, tx, querySelectAllRules, "failed to load membership rules", func(rows *sql.Rows) error {
+		var groupID int
+		var rule string
+		if err := rows.Scan(&groupID, &rule); err != nil {
+			return err
+		}
+		stored[groupID] = rule
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(stored)
+}
+
+// selectAllUserAttributes returns the attributes of every user that has any inside tx
+func selectAllUserAttributes(ctx context.Context, tx *sql.Tx) (map[int]Attributes, error) {
+	stored := make(map[int]map[string]storedAttribute)
+	err := scanRows(ctx, tx, querySelectAllUserAttributes, "failed to load user attributes", func(rows *sql.Rows) error {
+		var userID int
+		var name, typ, value string
+		if err := rows.Scan(&userID, &name, &typ, &value); err != nil {
+			return err
+		}
+		if stored[userID] == nil {
+			stored[userID] = make(map[string]storedAttribute)
+		}
+		stored[userID][name] = storedAttribute{Type: AttributeType(typ), Value: []byte(value)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[int]Attributes, len(stored))
+	for userID, userStored := range stored {
+		if attrs[userID], err = decodeAttributes(userStored); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// ListUsers returns a page of all users
+func (r *SQLRepository) ListUsers(ctx context.Context, opts ListOptions) (Page, error) {
+	return r.queryPage(ctx, "ListUsers", queryListUsers, opts, "failed to list users")
+}
+
+// ListUserGroups returns a page of all user groups
+func (r *SQLRepository) ListUserGroups(ctx context.Context, opts ListOptions) (Page, error) {
+	return r.queryPage(ctx, "ListUserGroups", queryListUserGroups, opts, "failed to list user groups")
+}
+
+// ListUsersInGroup returns a page of the users directly in a group
+func (r *SQLRepository) ListUsersInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.queryPage(ctx, "ListUsersInGroup", queryListUsersInGroup, opts, "failed to list users in group", groupID)
+}
+
+// ListGroupsInGroup returns a page of the direct child groups of a group
+func (r *SQLRepository) ListGroupsInGroup(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.queryPage(ctx, "ListGroupsInGroup", queryListGroupsInGroup, opts, "failed to list groups in group", groupID)
+}
+
+// ListUsersInGroupTransitive returns a page of the users in a group and all nested subgroups
+func (r *SQLRepository) ListUsersInGroupTransitive(ctx context.Context, groupID int, opts ListOptions) (Page, error) {
+	return r.queryPage(ctx, "ListUsersInGroupTransitive", queryListUsersInGroupTransitive, opts,
+		"failed to list users in group transitive", groupID)
+}
+
+// queryPage counts the rows of a listing and selects the page that follows the
+// cursor, reading one row more than the limit to tell whether there is a next page
+func (r *SQLRepository) queryPage(ctx context.Context, op, rowSet string, opts ListOptions, errorMsg string, args ...interface{}) (page Page, err error) {
+	q, err := newListQuery(opts)
+	if err != nil {
+		return Page{}, err
+	}
+	count, query, countArgs, queryArgs := listSQL(rowSet, q, args)
+	countQuery, selectQuery := bindQuery(r.dialect, count), bindQuery(r.dialect, query)
+
+	ctx, span := r.startSpan(ctx, op, selectQuery)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("db.rows", len(page.Items))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		var total int
+		if err := conn.QueryRowContext(ctx, countQuery.text, countQuery.args(countArgs)...).Scan(&total); err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(ctx, selectQuery.text, selectQuery.args(queryArgs)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var items []PageItem
+		for rows.Next() {
+			var item PageItem
+			if err := rows.Scan(&item.ID, &item.Name); err != nil {
+				return fmt.Errorf("failed to scan item: %w", err)
+			}
+			items = append(items, item)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+		page = q.page(items, total)
+		return nil
+	})
+	if err != nil {
+		return Page{}, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return page, nil
+}
+
+// listSQL completes the row set of a listing, whose parameters are args, to the
+// query counting its rows and the query selecting the page of q. Row sets either
+// start with FROM or contain a {{columns}} marker for the selected columns.
+func listSQL(rowSet string, q listQuery, args []interface{}) (count, query string, countArgs, queryArgs []interface{}) {
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	columns := func(cols string) string {
+		if strings.Contains(rowSet, "{{columns}}") {
+			return strings.Replace(rowSet, "{{columns}}", cols, 1)
+		}
+		return "SELECT " + cols + " " + rowSet
+	}
+
+	var prefix string
+	if q.NamePrefix != "" {
+		prefix = " AND u.name LIKE " + param(likePrefix(q.NamePrefix)) + " ESCAPE '!'"
+	}
+	count, countArgs = columns("COUNT(*)")+prefix, args
+	query = columns("u.id, u.name") + prefix
+
+	cmp, dir := ">", "ASC"
+	if q.Descending {
+		cmp, dir = "<", "DESC"
+	}
+	switch {
+	case q.after != nil && q.Sort == SortByName:
+		name, id := param(q.after.Name), param(q.after.ID)
+		query += fmt.Sprintf(" AND (u.name %s %s OR (u.name = %s AND u.id %s %s))", cmp, name, name, cmp, id)
+	case q.after != nil:
+		query += fmt.Sprintf(" AND u.id %s %s", cmp, param(q.after.ID))
+	}
+	if q.Sort == SortByName {
+		query += fmt.Sprintf(" ORDER BY u.name %s, u.id %s", dir, dir)
+	} else {
+		query += " ORDER BY u.id " + dir
+	}
+	query += " LIMIT " + param(q.Limit+1)
+	return count, query, countArgs, args
+}
+
+// likePrefix returns the LIKE pattern, escaped with '!', matching names that start with prefix
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return r.Replace(prefix) + "%"
+}
+
+// GetUsersInGroup returns all users directly in the specified group
+func (r *SQLRepository) GetUsersInGroup(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetUsersInGroup", r.queries.selectUsersInGroup, "failed to get users in group", groupID)
+}
+
+// GetUsersInGroupTransitive returns all users in the group and all nested subgroups
+func (r *SQLRepository) GetUsersInGroupTransitive(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetUsersInGroupTransitive", r.queries.usersInGroupTransitive, "failed to get users in group transitive", groupID)
+}
+
+// GetGroupsForUser returns the groups the user belongs to directly
+func (r *SQLRepository) GetGroupsForUser(ctx context.Context, userID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetGroupsForUser", r.queries.selectGroupsOfUser, "failed to get groups for user", userID)
+}
+
+// GetGroupsForUserTransitive returns all groups the user belongs to directly or through nested groups
+func (r *SQLRepository) GetGroupsForUserTransitive(ctx context.Context, userID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetGroupsForUserTransitive", r.queries.groupsForUserTransitive, "failed to get groups for user transitive", userID)
+}
+
+// AddGroupToGroup adds a child group to a parent group with cycle detection.
+// The cycle, nesting and limit checks and the insert run in one transaction under
+// the hierarchy lock, taken before the first read, so concurrent hierarchy writes
+// cannot together form a cycle or break a limit that each check alone allows.
+func (r *SQLRepository) AddGroupToGroup(ctx context.Context, childID, parentID int) (rev Revision, err error) {
+	// Check for self-cycle
+	if childID == parentID {
+		return 0, &CycleDetectedError{
+			ChildGroupID:  childID,
+			ParentGroupID: parentID,
+		}
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, "AddGroupToGroup", q.insertGroupToGroup)
+	defer func() { r.endQuery(ctx, "AddGroupToGroup", span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, "AddGroupToGroup", span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if q.lockHierarchy != "" {
+			if _, err := tx.ExecContext(ctx, q.lockHierarchy); err != nil {
+				return fmt.Errorf("failed to lock group hierarchy: %w", err)
+			}
+		}
+
+		// Check for cycle within transaction
+		var exists int
+		err = tx.QueryRowContext(ctx, q.checkCycle.text, q.checkCycle.args([]interface{}{childID, parentID})...).Scan(&exists)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to check for cycle: %w", err)
+		}
+
+		// If we found a row, it means adding this would create a cycle
+		if err == nil {
+			return &CycleDetectedError{
+				ChildGroupID:  childID,
+				ParentGroupID: parentID,
+			}
+		}
+
+		if err := r.checkNewEdge(ctx, tx, childID, parentID, false); err != nil {
+			return err
+		}
+
+		// No cycle detected, insert the relationship
+		result, err := tx.ExecContext(ctx, q.insertGroupToGroup.text, q.insertGroupToGroup.args([]interface{}{childID, parentID})...)
+		if err != nil {
+			return fmt.Errorf("failed to add group to group: %w", err)
+		}
+		// Adding an existing edge records nothing
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to add group to group: %w", err)
+		} else if n == 0 {
+			rev, err = r.currentRevisionTx(ctx, tx)
+			return err
+		}
+
+		// Record the revision and commit transaction
+		rev, err = r.commitWithRevision(ctx, tx, edgeAddedEvent(childID, parentID))
+		return err
+	})
+	return rev, err
+}
+
+// MoveGroup moves a child group from one parent group to another. The checks, the
+// delete and the insert run in one transaction under the same lock as AddGroupToGroup.
+func (r *SQLRepository) MoveGroup(ctx context.Context, childID, fromParentID, toParentID int) (rev Revision, err error) {
+	const op = "MoveGroup"
+	if childID == toParentID {
+		return 0, &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.deleteEdge)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if q.lockHierarchy != "" {
+			if _, err := tx.ExecContext(ctx, q.lockHierarchy); err != nil {
+				return fmt.Errorf("failed to lock group hierarchy: %w", err)
+			}
+		}
+		for _, groupID := range []int{childID, fromParentID, toParentID} {
+			if err := subjectExists(ctx, tx, q.groupEntity(), groupID); err != nil {
+				return err
+			}
+		}
+		if id, err := queryFirstID(ctx, tx, q.selectEdge, childID, fromParentID); err != nil {
+			return fmt.Errorf("failed to check group edge: %w", err)
+		} else if id == 0 {
+			return &EdgeNotFoundError{ChildGroupID: childID, ParentGroupID: fromParentID}
+		}
+
+		if fromParentID == toParentID {
+			if rev, err = r.currentRevisionTx(ctx, tx); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		if id, err := queryFirstID(ctx, tx, q.checkCycle, childID, toParentID); err != nil {
+			return fmt.Errorf("failed to check for cycle: %w", err)
+		} else if id != 0 {
+			return &CycleDetectedError{ChildGroupID: childID, ParentGroupID: toParentID}
+		}
+		if err := r.checkNewEdge(ctx, tx, childID, toParentID, true); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, q.deleteEdge.text, q.deleteEdge.args([]interface{}{childID, fromParentID})...); err != nil {
+			return fmt.Errorf("failed to remove group from group: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, q.insertGroupToGroup.text, q.insertGroupToGroup.args([]interface{}{childID, toParentID})...); err != nil {
+			return fmt.Errorf("failed to add group to group: %w", err)
+		}
+
+		rev, err = r.commitWithRevision(ctx, tx, edgeMovedEvent(childID, fromParentID, toParentID))
+		return err
+	})
+	return rev, err
+}
+
+// checkNewEdge returns a NestingNotAllowedError or a HierarchyLimitError if the
+// nesting policy does not allow childID in parentID or the edge breaks the hierarchy
+// limits. Existing edges are never rejected.
+func (r *SQLRepository) checkNewEdge(ctx context.Context, tx *sql.Tx, childID, parentID int, moving bool) error {
+	if r.nestingPolicy == nil && !r.hierarchyLimits.enabled() {
+		return nil
+	}
+	if id, err := queryFirstID(ctx, tx, r.queries.selectEdge, childID, parentID); err != nil {
+		return fmt.Errorf("failed to check group edge: %w", err)
+	} else if id != 0 {
+		return nil
+	}
+	if err := r.checkNestingPolicy(ctx, tx, childID, parentID); err != nil {
+		return err
+	}
+	return r.checkHierarchyLimits(ctx, tx, childID, parentID, moving)
+}
+
+// checkNestingPolicy returns a NestingNotAllowedError if the nesting policy does not
+// allow the types of childID and parentID together
+func (r *SQLRepository) checkNestingPolicy(ctx context.Context, tx *sql.Tx, childID, parentID int) error {
+	if r.nestingPolicy == nil {
+		return nil
+	}
+	q := r.queries
+	e := NestingViolation{ChildGroupID: childID, ParentGroupID: parentID}
+	for _, g := range []struct {
+		id  int
+		typ *string
+	}{{childID, &e.ChildType}, {parentID, &e.ParentType}} {
+		err := tx.QueryRowContext(ctx, q.selectGroupType.text, q.selectGroupType.args([]interface{}{g.id})...).Scan(g.typ)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &UserGroupNotFoundError{UserGroupID: g.id}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get group type: %w", err)
+		}
+	}
+	return r.nestingPolicy.checkEdge(e)
+}
+
+// checkHierarchyLimits returns a HierarchyLimitError if nesting childID in parentID
+// breaks the configured limits. A moving child keeps its number of parents because
+// it leaves its old one.
+func (r *SQLRepository) checkHierarchyLimits(ctx context.Context, tx *sql.Tx, childID, parentID int, moving bool) error {
+	limits, q := r.hierarchyLimits, r.queries
+	if !limits.enabled() {
+		return nil
+	}
+
+	var shape edgeShape
+	var err error
+	if limits.MaxChildren > 0 {
+		if shape.parentChildren, err = queryFirstID(ctx, tx, q.countChildGroups, parentID); err != nil {
+			return fmt.Errorf("failed to count child groups: %w", err)
+		}
+	}
+	if limits.MaxParents > 0 && !moving {
+		if shape.childParents, err = queryFirstID(ctx, tx, q.countParentGroups, childID); err != nil {
+			return fmt.Errorf("failed to count parent groups: %w", err)
+		}
+	}
+	if limits.MaxDepth > 0 {
+		if shape.parentDepth, err = queryFirstID(ctx, tx, q.selectGroupDepth, parentID, limits.MaxDepth); err != nil {
+			return fmt.Errorf("failed to get group depth: %w", err)
+		}
+		if shape.childHeight, err = queryFirstID(ctx, tx, q.selectGroupHeight, childID, limits.MaxDepth); err != nil {
+			return fmt.Errorf("failed to get group height: %w", err)
+		}
+	}
+	return limits.checkEdge(childID, parentID, shape)
+}
+
+// GetHierarchyViolations returns the groups that break limits
+func (r *SQLRepository) GetHierarchyViolations(ctx context.Context, limits HierarchyLimits) (violations []HierarchyViolation, err error) {
+	const op = "GetHierarchyViolations"
+	ctx, span := r.startSpan(ctx, op, rawQuery(querySelectAllEdges))
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("result.count", len(violations))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, querySelectAllEdges)
+		if err != nil {
+			return fmt.Errorf("failed to load group hierarchy: %w", err)
+		}
+		defer rows.Close()
+
+		var edges []GroupEdge
+		for rows.Next() {
+			var e GroupEdge
+			if err := rows.Scan(&e.ChildID, &e.ParentID); err != nil {
+				return fmt.Errorf("failed to scan group edge: %w", err)
+			}
+			edges = append(edges, e)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+		violations = hierarchyViolations(edges, limits)
+		return nil
+	})
+	return violations, err
+}
+
+// SetGroupType sets or, for an empty type, clears the type of a group. With a
+// nesting policy the edges of the group are checked under the hierarchy lock, taken
+// before the first read, so a concurrent AddGroupToGroup sees the new type or adds
+// an edge that the check here sees.
+func (r *SQLRepository) SetGroupType(ctx context.Context, groupID int, groupType string) (err error) {
+	const op = "SetGroupType"
+	if err := validateGroupType(groupType); err != nil {
+		return err
+	}
+
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.updateGroupType)
+	defer func() { r.endQuery(ctx, op, span, err) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		if r.nestingPolicy != nil {
+			if err := lockTx(ctx, tx, q.lockHierarchy, "group hierarchy"); err != nil {
+				return err
+			}
+		}
+		if err := subjectExists(ctx, tx, q.groupEntity(), groupID); err != nil {
+			return err
+		}
+		if r.nestingPolicy != nil {
+			edges, err := selectTypedEdges(ctx, tx, q.selectGroupTypedEdges, groupID)
+			if err != nil {
+				return err
+			}
+			for _, e := range edges {
+				if e.ChildGroupID == groupID {
+					e.ChildType = groupType
+				} else {
+					e.ParentType = groupType
+				}
+				if err := r.nestingPolicy.checkEdge(e); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := tx.ExecContext(ctx, q.updateGroupType.text, q.updateGroupType.args([]interface{}{groupID, nullString(groupType)})...); err != nil {
+			return fmt.Errorf("failed to set group type: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return &commitError{err: err}
+		}
+		return nil
+	})
+	return err
+}
+
+// GetGroupType returns the type of a group, "" for groups without one
+func (r *SQLRepository) GetGroupType(ctx context.Context, groupID int) (string, error) {
+	return r.queryString(ctx, "GetGroupType", r.queries.selectGroupType, &UserGroupNotFoundError{UserGroupID: groupID},
+		"failed to get group type", groupID)
+}
+
+// GetNestingViolations returns the edges policy does not allow
+func (r *SQLRepository) GetNestingViolations(ctx context.Context, policy NestingPolicy) (violations []NestingViolation, err error) {
+	const op = "GetNestingViolations"
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.selectTypedEdges)
+	defer func() { r.endQuery(ctx, op, span, err, IntAttr("result.count", len(violations))) }()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		edges, err := selectTypedEdges(ctx, conn, q.selectTypedEdges)
+		if err != nil {
+			return err
+		}
+		violations = nestingViolations(edges, policy)
+		return nil
+	})
+	return violations, err
+}
+
+// selectTypedEdges returns the hierarchy edges selected by query with the types of
+// both groups
+func selectTypedEdges(ctx context.Context, db sqlRowsQueryer, query sqlQuery, args ...interface{}) ([]NestingViolation, error) {
+	rows, err := db.QueryContext(ctx, query.text, query.args(args)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group types: %w", err)
+	}
+	defer rows.Close()
+
+	var edges []NestingViolation
+	for rows.Next() {
+		var e NestingViolation
+		if err := rows.Scan(&e.ChildGroupID, &e.ParentGroupID, &e.ChildType, &e.ParentType); err != nil {
+			return nil, fmt.Errorf("failed to scan group types: %w", err)
+		}
+		edges = append(edges, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return edges, nil
+}
+
+// GetGroupsInGroup returns all groups directly in the specified group
+func (r *SQLRepository) GetGroupsInGroup(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetGroupsInGroup", r.queries.selectGroupsInGroup, "failed to get groups in group", groupID)
+}
+
+// GetAncestorGroups returns all groups that transitively contain the specified group
+func (r *SQLRepository) GetAncestorGroups(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetAncestorGroups", r.queries.ancestorGroups, "failed to get ancestor groups", groupID)
+}
+
+// GetDescendantGroups returns all groups that the specified group transitively contains
+func (r *SQLRepository) GetDescendantGroups(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetDescendantGroups", r.queries.descendantGroups, "failed to get descendant groups", groupID)
+}
+
+// GetGroupSubtree returns a group and every group below it. The three queries run
+// in one snapshot transaction, so they see the same hierarchy.
+func (r *SQLRepository) GetGroupSubtree(ctx context.Context, groupID int) (subtree *GroupSubtree, err error) {
+	const op = "GetGroupSubtree"
+	ctx, span := r.startSpan(ctx, op, r.queries.subtreeEdges)
+	defer func() {
+		var rows int
+		if subtree != nil {
+			rows = len(subtree.Names) + len(subtree.Edges) + len(subtree.Memberships)
+		}
+		r.endQuery(ctx, op, span, err, IntAttr("db.rows", rows))
+	}()
+
+	err = r.withConn(ctx, op, span, kindRead, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, r.dialect.SnapshotTxOptions())
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		scan := func(query sqlQuery, row func(rows *sql.Rows) error) error {
+			rows, err := tx.QueryContext(ctx, query.text, query.args([]interface{}{groupID})...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				if err := row(rows); err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		}
+
+		s := &GroupSubtree{RootID: groupID, Names: make(map[int]string)}
+		err = scan(r.queries.subtreeGroups, func(rows *sql.Rows) error {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				return fmt.Errorf("failed to scan group: %w", err)
+			}
+			s.Names[id] = name
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := s.Names[groupID]; !ok {
+			return &UserGroupNotFoundError{UserGroupID: groupID}
+		}
+		err = scan(r.queries.subtreeEdges, func(rows *sql.Rows) error {
+			var e GroupEdge
+			if err := rows.Scan(&e.ChildID, &e.ParentID); err != nil {
+				return fmt.Errorf("failed to scan edge: %w", err)
+			}
+			s.Edges = append(s.Edges, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = scan(r.queries.subtreeMembers, func(rows *sql.Rows) error {
+			var m Membership
+			if err := rows.Scan(&m.UserID, &m.GroupID); err != nil {
+				return fmt.Errorf("failed to scan membership: %w", err)
+			}
+			s.Memberships = append(s.Memberships, m)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		subtree = s
+		return nil
+	})
+	if errors.Is(err, ErrUserGroupNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group subtree: %w", err)
+	}
+	return subtree, nil
+}
+
+// GetParentGroups returns the groups that directly contain the specified group
+func (r *SQLRepository) GetParentGroups(ctx context.Context, groupID int) ([]int, error) {
+	return r.queryIDs(ctx, "GetParentGroups", r.queries.selectParentGroups, "failed to get parent groups", groupID)
+}
+
+// GetAncestorEdges returns the hierarchy edges above a "user" or "group"
+func (r *SQLRepository) GetAncestorEdges(ctx context.Context, subjectType string, subjectID int) (edges []GroupEdge, err error) {
+	query := r.queries.userAncestorEdges
+	if subjectType == "group" {
+		query = r.queries.groupAncestorEdges
+	}
+
+	ctx, span := r.startSpan(ctx, "GetAncestorEdges", query)
+	defer func() { r.endQuery(ctx, "GetAncestorEdges", span, err, IntAttr("db.rows", len(edges))) }()
+
+	err = r.withConn(ctx, "GetAncestorEdges", span, kindRead, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, query.text, query.args([]interface{}{subjectID})...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		edges = make([]GroupEdge, 0)
+		for rows.Next() {
+			var e GroupEdge
+			if err := rows.Scan(&e.ChildID, &e.ParentID); err != nil {
+				return fmt.Errorf("failed to scan edge: %w", err)
+			}
+			edges = append(edges, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ancestor edges: %w", err)
+	}
+	return edges, nil
+}
+
+// WouldCreateCycle checks if adding child to parent would create a cycle
+func (r *SQLRepository) WouldCreateCycle(ctx context.Context, childID, parentID int) (bool, error) {
+	// If they're the same, it's definitely a cycle
+	if childID == parentID {
+		return true, nil
+	}
+
+	// Cycle checks must see the latest hierarchy
+	return r.queryExists(WithPrimaryReads(ctx), "WouldCreateCycle", r.queries.checkCycle, "failed to check for cycle", childID, parentID)
+}
+
+// AddPermission adds a permission record, or makes an existing conditional one unconditional
+func (r *SQLRepository) AddPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int) (Revision, error) {
+	return r.execGrant(ctx, "AddPermission", sourceType, targetType, sourceID, targetID, "")
+}
+
+// AddConditionalPermission adds a permission record that only applies while
+// condition holds, or replaces the condition of an existing one
+func (r *SQLRepository) AddConditionalPermission(ctx context.Context, sourceType, targetType string, sourceID, targetID int, condition string) (Revision, error) {
+	if condition != "" {
+		if _, err := ParseCondition(condition); err != nil {
+			return 0, err
+		}
+	}
+	return r.execGrant(ctx, "AddConditionalPermission", sourceType, targetType, sourceID, targetID, condition)
+}
+
+// execGrant inserts a permission record and sets its condition in one transaction.
+// Granting an existing permission with the same condition records nothing.
+func (r *SQLRepository) execGrant(ctx context.Context, op, sourceType, targetType string, sourceID, targetID int, condition string) (rev Revision, err error) {
+	q := r.queries
+	ctx, span := r.startSpan(ctx, op, q.insertPermission)
+	defer func() { r.endQuery(ctx, op, span, err, StringAttr("revision", rev.String())) }()
+
+	err = r.withConn(ctx, op, span, kindTransaction, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() { _ = tx.Rollback() }() // Rollback if not committed
+
+		args := []interface{}{sourceType, sourceID, targetType, targetID, nullString(condition)}
+		result, err := tx.ExecContext(ctx, q.insertPermission.text, q.insertPermission.args(args[:4])...)
+		if err != nil {
+			return fmt.Errorf("failed to add permission: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to add permission: %w", err)
+		}
+		if n == 0 {
+			var current string
+			err := tx.QueryRowContext(ctx, q.selectPermissionCondition.text, q.selectPermissionCondition.args(args[:4])...).Scan(&current)
+			if err != nil {
+				return fmt.Errorf("failed to get permission condition: %w", err)
+			}
+			if current == condition {
+				rev, err = r.currentRevisionTx(ctx, tx)
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, q.updatePermissionCondition.text, q.updatePermissionCondition.args(args)...); err != nil {
+			return fmt.Errorf("failed to set permission condition: %w", err)
+		}
+
+		rev, err = r.commitWithRevision(ctx, tx, permissionGrantedEvent(sourceType, targetType, sourceID, targetID))
+		return err
+	})
+	return rev, err
+}
+
+// HasUserPermissionOnUser checks if a user has permission to access another user
+func (r *SQLRepository) HasUserPermissionOnUser(ctx context.Context, sourceUserID, targetUserID int) (bool, error) {
+	return r.queryGrants(ctx, "HasUserPermissionOnUser", r.queries.checkUserPermissionOnUser, "failed to check user permission on user",
+		sourceUserID, "user", targetUserID)
+}
+
+// HasUserPermissionOnGroup checks if a user has permission to access a group
+func (r *SQLRepository) HasUserPermissionOnGroup(ctx context.Context, sourceUserID, targetGroupID int) (bool, error) {
+	return r.queryGrants(ctx, "HasUserPermissionOnGroup", r.queries.checkUserPermissionOnGroup, "failed to check user permission on group",
+		sourceUserID, "group", targetGroupID)
+}
+
+// queryGrants runs a permission check query, which returns the conditions of the
+// applicable grants, and evaluates the conditions unless a grant is unconditional
+func (r *SQLRepository) queryGrants(ctx context.Context, op string, query sqlQuery, errorMsg string, sourceUserID int, targetType string, targetID int) (allowed bool, err error) {
+	var conditions []string
+	queryCtx, span := r.startSpan(ctx, op, query)
+	err = r.withConn(queryCtx, op, span, kindRead, func(conn *sql.Conn) error {
+		allowed, conditions = false, nil
+		rows, err := conn.QueryContext(queryCtx, query.text, query.args([]interface{}{sourceUserID, targetID})...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var condition sql.NullString
+			if err := rows.Scan(&condition); err != nil {
+				return fmt.Errorf("failed to scan condition: %w", err)
+			}
+			if !condition.Valid {
+				allowed = true // unconditional grants come first
+				return nil
+			}
+			conditions = append(conditions, condition.String)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+		return nil
+	})
+	r.endQuery(queryCtx, op, span, err, BoolAttr("db.exists", allowed), IntAttr("db.conditions", len(conditions)))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	if allowed || len(conditions) == 0 {
+		return allowed, nil
+	}
+
+	parsed, err := parseConditions(conditions)
+	if err == nil {
+		allowed, err = evaluateConditions(ctx, parsed, sourceUserID, targetType, targetID, r.GetAttributes)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return allowed, nil
+}
+
+// CurrentRevision returns the latest committed revision
+func (r *SQLRepository) CurrentRevision(ctx context.Context) (Revision, error) {
+	var rev int64
+	err := r.retry(ctx, "CurrentRevision", noopSpan{}, kindRead, func() error {
+		return r.db.QueryRowContext(ctx, r.queries.selectRevision.text).Scan(&rev)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	return Revision(rev), nil
+}
+
+// ListChanges returns up to limit change events with a revision greater than afterRevision, in revision order
+func (r *SQLRepository) ListChanges(ctx context.Context, afterRevision Revision, limit int) (events []ChangeEvent, err error) {
+	err = r.retry(ctx, "ListChanges", noopSpan{}, kindRead, func() error {
+		events, err = r.listChanges(ctx, afterRevision, limit)
+		return err
+	})
+	return events, err
+}
+
+// listChanges makes one attempt of ListChanges
+func (r *SQLRepository) listChanges(ctx context.Context, afterRevision Revision, limit int) ([]ChangeEvent, error) {
+	q := r.queries.selectChangeEvents
+	rows, err := r.db.QueryContext(ctx, q.text, q.args([]interface{}{int64(afterRevision), limit})...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]ChangeEvent, 0)
+	for rows.Next() {
+		var e ChangeEvent
+		var rev int64
+		if err := rows.Scan(&rev, &e.Type, &e.SubjectType, &e.SubjectID, &e.ObjectType, &e.ObjectID, &e.Status, &e.PreviousObjectID, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan change event: %w", err)
+		}
+		e.Revision = Revision(rev)
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return events, nil
+}
+
+// LoadGraphSnapshot reads all memberships, hierarchy edges, membership rules, permissions and inactive users in one
+// transaction so the snapshot is consistent with its revision
+func (r *SQLRepository) LoadGraphSnapshot(ctx context.Context) (snapshot *GraphSnapshot, err error) {
+	err = r.retry(ctx, "LoadGraphSnapshot", noopSpan{}, kindRead, func() error {
+		snapshot, err = r.loadGraphSnapshot(ctx)
+		return err
+	})
+	return snapshot, err
+}
+
+// loadGraphSnapshot makes one attempt of LoadGraphSnapshot
+func (r *SQLRepository) loadGraphSnapshot(ctx context.Context) (*GraphSnapshot, error) {
+	tx, err := r.db.BeginTx(ctx, r.dialect.SnapshotTxOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	snapshot := &GraphSnapshot{}
+	var rev int64
+	if err := tx.QueryRowContext(ctx, r.queries.selectRevision.text).Scan(&rev); err != nil {
+		return nil, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	snapshot.Revision = Revision(rev)
+
+	err = scanRows(ctx, tx, querySelectAllMemberships, "failed to load memberships", func(rows *sql.Rows) error {
+		var m Membership
+		if err := rows.Scan(&m.UserID, &m.GroupID); err != nil {
+			return err
+		}
+		snapshot.Memberships = append(snapshot.Memberships, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, querySelectAllEdges, "failed to load group hierarchy", func(rows *sql.Rows) error {
+		var e GroupEdge
+		if err := rows.Scan(&e.ChildID, &e.ParentID); err != nil {
+			return err
+		}
+		snapshot.Edges = append(snapshot.Edges, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, querySelectAllRules, "failed to load membership rules", func(rows *sql.Rows) error {
+		var rule GroupRule
+		if err := rows.Scan(&rule.GroupID, &rule.Rule); err != nil {
+			return err
+		}
+		snapshot.Rules = append(snapshot.Rules, rule)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, querySelectAllPermissions, "failed to load permissions", func(rows *sql.Rows) error {
+		var p Permission
+		var condition sql.NullString
+		if err := rows.Scan(&p.SourceType, &p.SourceID, &p.TargetType, &p.TargetID, &condition); err != nil {
+			return err
+		}
+		p.Condition = condition.String
+		snapshot.Permissions = append(snapshot.Permissions, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, querySelectInactiveIDs, "failed to load user statuses", func(rows *sql.Rows) error {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		snapshot.InactiveUsers = append(snapshot.InactiveUsers, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// scanRows runs query inside tx and calls scan for every row
+func scanRows(ctx context.Context, tx *sql.Tx, query, errorMsg string, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return fmt.Errorf("%s: %w", errorMsg, err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %w", errorMsg, err)
+	}
+
+	return nil
+}
+
+// Close closes the database connections, including replicas
+func (r *SQLRepository) Close() error {
+	err := r.db.Close()
+	for _, replica := range r.replicas {
+		if closeErr := replica.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
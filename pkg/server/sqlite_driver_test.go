@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package server
+
+// The package itself never imports a SQLite driver. Building the tests with
+// -tags sqlite registers mattn/go-sqlite3 as "sqlite3" so the SQLite conformance
+// tests can run; add it first with: go get github.com/mattn/go-sqlite3
+import _ "github.com/mattn/go-sqlite3"
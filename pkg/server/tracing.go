@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer starts spans. Implementations adapt it to a tracing backend; the package
+// ships a no-op default and RecordingTracer for tests.
+type Tracer interface {
+	// Start begins a span named name as a child of the span in ctx, if any,
+	// and returns a context carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single timed operation
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	End()
+}
+
+// Attribute is a key/value pair attached to a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// StringAttr creates a string attribute
+func StringAttr(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// IntAttr creates an integer attribute
+func IntAttr(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// BoolAttr creates a boolean attribute
+func BoolAttr(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// noopTracer is the default Tracer; it records nothing
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) End()                       {}
+
+// endSpan sets attrs and, if err is not nil, an "error" attribute, then ends span
+func endSpan(span Span, err error, attrs ...Attribute) {
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	if err != nil {
+		span.SetAttributes(StringAttr("error", err.Error()))
+	}
+	span.End()
+}
+
+// compactSQL collapses the whitespace of a query so it reads well as a span attribute
+func compactSQL(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// RecordedSpan is a span captured by RecordingTracer
+type RecordedSpan struct {
+	ID         int
+	ParentID   int // 0 for root spans
+	Name       string
+	Attributes map[string]interface{}
+	Start      time.Time
+	End        time.Time
+	Ended      bool
+}
+
+// Duration returns how long the span was open
+func (s RecordedSpan) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// RecordingTracer keeps every span in memory, in start order. It is meant for tests.
+type RecordingTracer struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// NewRecordingTracer creates an empty RecordingTracer
+func NewRecordingTracer() *RecordingTracer {
+	return &RecordingTracer{}
+}
+
+// recordingSpanKey is the context key for the current recorded span
+type recordingSpanKey struct{}
+
+// Start begins a recorded span
+func (t *RecordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := &RecordedSpan{
+		ID:         len(t.spans) + 1,
+		Name:       name,
+		Attributes: make(map[string]interface{}),
+		Start:      time.Now(),
+	}
+	if parent, ok := ctx.Value(recordingSpanKey{}).(*recordingSpan); ok && parent.tracer == t {
+		span.ParentID = parent.span.ID
+	}
+	t.spans = append(t.spans, span)
+
+	handle := &recordingSpan{tracer: t, span: span}
+	return context.WithValue(ctx, recordingSpanKey{}, handle), handle
+}
+
+// Spans returns a copy of all recorded spans in start order
+func (t *RecordingTracer) Spans() []RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]RecordedSpan, len(t.spans))
+	for i, s := range t.spans {
+		spans[i] = *s
+		spans[i].Attributes = make(map[string]interface{}, len(s.Attributes))
+		for k, v := range s.Attributes {
+			spans[i].Attributes[k] = v
+		}
+	}
+	return spans
+}
+
+// Reset discards all recorded spans
+func (t *RecordingTracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = nil
+}
+
+// recordingSpan is the Span handle returned by RecordingTracer
+type recordingSpan struct {
+	tracer *RecordingTracer
+	span   *RecordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, a := range attrs {
+		s.span.Attributes[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	if !s.span.Ended {
+		s.span.End = time.Now()
+		s.span.Ended = true
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// spansByName indexes recorded spans by name; later spans win
+func spansByName(spans []RecordedSpan) map[string]RecordedSpan {
+	byName := make(map[string]RecordedSpan, len(spans))
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	return byName
+}
+
+func Test_Tracing_ServerSpans(t *testing.T) {
+	tracer := NewRecordingTracer()
+	s := New(newFakeRepository(), WithTracer(tracer))
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	_ = s.AddUserToUserPermission(ctx, alice, bob)
+
+	t.Run("allowed check records outcome and follow-up lookup", func(t *testing.T) {
+		tracer.Reset()
+		if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil {
+			t.Fatalf("GetUserNameWithPermissionCheck failed: %v", err)
+		}
+
+		spans := spansByName(tracer.Spans())
+		check, ok := spans["Server.GetUserNameWithPermissionCheck"]
+		if !ok || !check.Ended {
+			t.Fatalf("Expected an ended check span, got %+v", tracer.Spans())
+		}
+		if check.Attributes["context_user.id"] != alice || check.Attributes["target.user_id"] != bob {
+			t.Errorf("Unexpected check attributes %v", check.Attributes)
+		}
+		if check.Attributes["permission.allowed"] != true {
+			t.Errorf("Expected permission.allowed=true, got %v", check.Attributes["permission.allowed"])
+		}
+
+		lookup := spans["Server.GetUserName"]
+		if lookup.ParentID != check.ID {
+			t.Errorf("Expected GetUserName to be a child of the check span, got parent %d", lookup.ParentID)
+		}
+	})
+
+	t.Run("denied check records outcome and error", func(t *testing.T) {
+		tracer.Reset()
+		if _, err := s.GetUserNameWithPermissionCheck(ctx, bob, alice); err == nil {
+			t.Fatal("Expected permission denied")
+		}
+
+		check := spansByName(tracer.Spans())["Server.GetUserNameWithPermissionCheck"]
+		if check.Attributes["permission.allowed"] != false {
+			t.Errorf("Expected permission.allowed=false, got %v", check.Attributes["permission.allowed"])
+		}
+		if _, ok := check.Attributes["error"]; !ok {
+			t.Error("Expected error attribute on denied check")
+		}
+	})
+
+	t.Run("mutations record revision", func(t *testing.T) {
+		tracer.Reset()
+		group, _ := s.CreateUserGroup(ctx, "Group")
+		rev, err := s.AddUserToGroupWithRevision(ctx, alice, group)
+		if err != nil {
+			t.Fatalf("AddUserToGroupWithRevision failed: %v", err)
+		}
+
+		spans := spansByName(tracer.Spans())
+		if got := spans["Server.CreateUserGroup"].Attributes["group.id"]; got != group {
+			t.Errorf("Expected group.id %d, got %v", group, got)
+		}
+		if got := spans["Server.AddUserToGroup"].Attributes["revision"]; got != rev.String() {
+			t.Errorf("Expected revision %s, got %v", rev, got)
+		}
+	})
+}
+
+func Test_Tracing_MySQLSpans(t *testing.T) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	tracer := NewRecordingTracer()
+	s := New(NewMySQLRepository(db, WithMySQLTracer(tracer)), WithTracer(tracer))
+	defer s.Close()
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	_ = s.AddUserToUserPermission(ctx, alice, bob)
+
+	tracer.Reset()
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil {
+		t.Fatalf("GetUserNameWithPermissionCheck failed: %v", err)
+	}
+
+	spans := tracer.Spans()
+	byName := spansByName(spans)
+	check := byName["Server.GetUserNameWithPermissionCheck"]
+	query := byName["mysql.HasUserPermissionOnUser"]
+	lookup := byName["mysql.GetUserByID"]
+
+	if query.ParentID != check.ID {
+		t.Errorf("Expected the permission query to be a child of the check span")
+	}
+	if query.Attributes["db.exists"] != true {
+		t.Errorf("Expected db.exists=true, got %v", query.Attributes["db.exists"])
+	}
+	if stmt, _ := query.Attributes["db.statement"].(string); !strings.Contains(stmt, "WITH RECURSIVE") {
+		t.Errorf("Expected the recursive statement, got %q", stmt)
+	}
+	if lookup.ParentID != byName["Server.GetUserName"].ID {
+		t.Errorf("Expected GetUserByID to be a child of Server.GetUserName")
+	}
+
+	// Every SQL span has its own connection acquisition span
+	acquired := 0
+	for _, span := range spans {
+		if span.Name == "mysql.acquire_connection" {
+			acquired++
+			if span.ParentID != query.ID && span.ParentID != lookup.ID {
+				t.Errorf("Unexpected parent %d for connection span", span.ParentID)
+			}
+		}
+		if !span.Ended {
+			t.Errorf("Span %s was not ended", span.Name)
+		}
+	}
+	if acquired != 2 {
+		t.Errorf("Expected 2 connection spans, got %d", acquired)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_UserStatus_Server(t *testing.T) {
+	var logs logBuffer
+	s := New(newFakeRepository(), WithLogger(NewJSONLogger(&logs, LevelDebug)))
+	ctx := context.Background()
+
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	carol, _ := s.CreateUser(ctx, "Carol")
+	staff, _ := s.CreateUserGroup(ctx, "Staff")
+	engineers, _ := s.CreateUserGroup(ctx, "Engineers")
+	_ = s.AddUserGroupToGroup(ctx, engineers, staff)
+	_ = s.AddUserToGroup(ctx, alice, staff)
+	_ = s.AddUserToGroup(ctx, carol, engineers)
+	_ = s.AddUserGroupToUserPermission(ctx, staff, bob)
+
+	if err := s.SetUserStatus(ctx, alice, UserSuspended); err != nil {
+		t.Fatalf("SetUserStatus failed: %v", err)
+	}
+	entry, ok := findEntry(logs.entries(t), "mutation applied", "SetUserStatus")
+	if !ok || entry["status"] != "suspended" {
+		t.Errorf("Expected the status in the log entry, got %v", entry)
+	}
+	if status, err := s.GetUserStatus(ctx, alice); err != nil || status != UserSuspended {
+		t.Errorf("GetUserStatus = %q, %v; want suspended", status, err)
+	}
+
+	// Suspended users are denied through every grant but stay in their groups
+	if _, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied while suspended, got %v", err)
+	}
+	if name, err := s.GetUserNameWithPermissionCheck(ctx, carol, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v; want Bob for an active user", name, err)
+	}
+	if users, err := s.GetUsersInGroup(ctx, staff); err != nil || !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroup = %v, %v; want [%d]", users, err, alice)
+	}
+
+	// Listings filter by any of the given statuses
+	if users, err := s.GetUsersInGroupWithStatus(ctx, staff, UserActive); err != nil || len(users) != 0 {
+		t.Errorf("GetUsersInGroupWithStatus(active) = %v, %v; want none", users, err)
+	}
+	if users, err := s.GetUsersInGroupTransitiveWithStatus(ctx, staff, UserActive); err != nil || !reflect.DeepEqual(users, []int{carol}) {
+		t.Errorf("GetUsersInGroupTransitiveWithStatus(active) = %v, %v; want [%d]", users, err, carol)
+	}
+	if users, err := s.GetUsersInGroupTransitiveWithStatus(ctx, staff, UserSuspended, UserDeprovisioned); err != nil || !reflect.DeepEqual(users, []int{alice}) {
+		t.Errorf("GetUsersInGroupTransitiveWithStatus(inactive) = %v, %v; want [%d]", users, err, alice)
+	}
+	if users, err := s.GetUsersInGroupTransitiveWithStatus(ctx, staff); err != nil || !reflect.DeepEqual(users, []int{alice, carol}) {
+		t.Errorf("GetUsersInGroupTransitiveWithStatus() = %v, %v; want [%d %d]", users, err, alice, carol)
+	}
+	if _, err := s.GetUsersInGroupWithStatus(ctx, staff, "retired"); !errors.Is(err, ErrInvalidUserStatus) {
+		t.Errorf("Expected ErrInvalidUserStatus, got %v", err)
+	}
+
+	// Reinstatement restores access through the kept memberships
+	if err := s.SetUserStatus(ctx, alice, UserActive); err != nil {
+		t.Fatalf("SetUserStatus failed: %v", err)
+	}
+	if name, err := s.GetUserNameWithPermissionCheck(ctx, alice, bob); err != nil || name != "Bob" {
+		t.Errorf("GetUserNameWithPermissionCheck = %q, %v; want Bob after reinstatement", name, err)
+	}
+
+	if err := s.SetUserStatus(ctx, alice, "retired"); !errors.Is(err, ErrInvalidUserStatus) {
+		t.Errorf("Expected ErrInvalidUserStatus, got %v", err)
+	}
+	if entry, ok := findEntry(logs.entries(t), "request rejected", "SetUserStatus"); !ok || entry["level"] != "info" {
+		t.Errorf("Expected the invalid status to be logged as rejected, got %v", logs.entries(t))
+	}
+}
+
+func Test_UserStatus_CachingRepository(t *testing.T) {
+	fake := newFakeRepository()
+	repo := NewCachingRepository(fake, DefaultCacheConfig())
+	ctx := context.Background()
+
+	alice, _ := repo.CreateUser(ctx, "Alice")
+	bob, _ := repo.CreateUser(ctx, "Bob")
+	group, _ := repo.CreateUserGroup(ctx, "Staff")
+	_, _ = repo.AddUserToGroup(ctx, alice, group)
+	_, _ = repo.AddPermission(ctx, "group", "user", group, bob)
+	_, _ = repo.AddPermission(ctx, "group", "group", group, group)
+
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); !got {
+		t.Fatal("Expected alice to be allowed while active")
+	}
+	if got, _ := repo.HasUserPermissionOnGroup(ctx, alice, group); !got {
+		t.Fatal("Expected alice to be allowed on the group while active")
+	}
+	_, _ = repo.GetGroupsForUserTransitive(ctx, alice)
+
+	// Suspending alice invalidates her cached decisions but not her groups
+	checks := fake.checkCount()
+	_, _ = repo.SetUserStatus(ctx, alice, UserSuspended)
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); got {
+		t.Error("Expected the cached decision to be invalidated by the suspension")
+	}
+	if got, _ := repo.HasUserPermissionOnGroup(ctx, alice, group); got {
+		t.Error("Expected the cached group decision to be invalidated by the suspension")
+	}
+	if n := fake.checkCount(); n != checks+2 {
+		t.Errorf("Expected two new checks, got %d", n-checks)
+	}
+	if groups, _ := repo.GetGroupsForUserTransitive(ctx, alice); !reflect.DeepEqual(groups, []int{group}) {
+		t.Errorf("GetGroupsForUserTransitive = %v, want [%d]", groups, group)
+	}
+}
+
+func Test_UserStatus_IndexedRepository(t *testing.T) {
+	ctx := context.Background()
+	file := openFileRepository(t, t.TempDir())
+	defer file.Close()
+
+	alice, _ := file.CreateUser(ctx, "Alice")
+	bob, _ := file.CreateUser(ctx, "Bob")
+	group, _ := file.CreateUserGroup(ctx, "Staff")
+	_, _ = file.AddUserToGroup(ctx, alice, group)
+	_, _ = file.AddPermission(ctx, "group", "user", group, bob)
+	_, _ = file.AddConditionalPermission(ctx, "user", "group", alice, group, "true")
+	_, _ = file.SetUserStatus(ctx, alice, UserDeprovisioned)
+
+	repo, err := NewIndexedRepository(ctx, file)
+	if err != nil {
+		t.Fatalf("NewIndexedRepository failed: %v", err)
+	}
+	if got, err := repo.HasUserPermissionOnUser(ctx, alice, bob); err != nil || got {
+		t.Errorf("HasUserPermissionOnUser = %v, %v; want a denial from the loaded status", got, err)
+	}
+	if got, err := repo.HasUserPermissionOnGroup(ctx, alice, group); err != nil || got {
+		t.Errorf("HasUserPermissionOnGroup = %v, %v; want conditional grants denied too", got, err)
+	}
+
+	// Status writes through the index update it
+	if _, err := repo.SetUserStatus(ctx, alice, UserActive); err != nil {
+		t.Fatalf("SetUserStatus failed: %v", err)
+	}
+	if got, _ := repo.HasUserPermissionOnUser(ctx, alice, bob); !got {
+		t.Error("Expected alice to be allowed after reinstatement")
+	}
+	if rev, _ := repo.CurrentRevision(ctx); rev != mustRevision(t, file) {
+		t.Errorf("Index revision %s does not match the repository", rev)
+	}
+}
+
+func Test_UserStatus_FileRepositoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	r := openFileRepository(t, dir)
+	alice, _ := r.CreateUser(ctx, "Alice")
+	bob, _ := r.CreateUser(ctx, "Bob")
+	group, _ := r.CreateUserGroup(ctx, "Staff")
+	_, _ = r.AddUserToGroup(ctx, alice, group)
+	_, _ = r.AddPermission(ctx, "group", "user", group, bob)
+	_, _ = r.SetUserStatus(ctx, alice, UserSuspended)
+	_, _ = r.SetUserStatus(ctx, bob, UserDeprovisioned)
+	_, _ = r.SetUserStatus(ctx, bob, UserActive)
+	rev := mustRevision(t, r)
+	crash(t, r)
+
+	check := func(t *testing.T, r *FileRepository) {
+		t.Helper()
+		statuses, _ := r.GetUserStatuses(ctx, []int{alice, bob})
+		if want := map[int]UserStatus{alice: UserSuspended, bob: UserActive}; !reflect.DeepEqual(statuses, want) {
+			t.Errorf("GetUserStatuses = %v, want %v", statuses, want)
+		}
+		if got, _ := r.HasUserPermissionOnUser(ctx, alice, bob); got {
+			t.Error("Expected alice to stay denied")
+		}
+		if got := mustRevision(t, r); got != rev {
+			t.Errorf("Revision = %s, want %s", got, rev)
+		}
+		events, _ := r.ListChanges(ctx, 0, 100)
+		if e := events[len(events)-1]; e.Type != EventUserStatusChanged || e.SubjectID != bob || e.Status != UserActive {
+			t.Errorf("Expected bob's reinstatement as the last event, got %+v", e)
+		}
+	}
+
+	// The statuses are replayed from the log
+	r = openFileRepository(t, dir)
+	check(t, r)
+	if err := r.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	crash(t, r)
+
+	// and restored from the snapshot
+	r = openFileRepository(t, dir)
+	defer r.Close()
+	check(t, r)
+	_, _ = r.SetUserStatus(ctx, alice, UserActive)
+	if got, _ := r.HasUserPermissionOnUser(ctx, alice, bob); !got {
+		t.Error("Expected alice to be allowed after reinstatement")
+	}
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Headers set on every webhook request
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookSignaturePrefix names the signature scheme in the signature header
+const webhookSignaturePrefix = "sha256="
+
+// WebhookSubscription registers a URL for change events.
+// An empty filter matches everything. GroupIDs matches events whose object is one
+// of the groups or is nested beneath one of them, so a subscription on a sensitive
+// group also fires when a user joins one of its subgroups.
+type WebhookSubscription struct {
+	ID         int
+	URL        string
+	Secret     string
+	EventTypes []ChangeEventType
+	GroupIDs   []int
+	CreatedAt  time.Time
+}
+
+// WebhookDeliveryStatus is the state of a single delivery
+type WebhookDeliveryStatus string
+
+// Delivery states. Failed attempts keep a delivery pending until it either succeeds
+// or runs out of attempts and is moved to the dead-letter table.
+const (
+	WebhookDeliveryPending      WebhookDeliveryStatus = "pending"
+	WebhookDeliverySucceeded    WebhookDeliveryStatus = "succeeded"
+	WebhookDeliveryDeadLettered WebhookDeliveryStatus = "dead_lettered"
+)
+
+// WebhookDelivery is one change event queued for one subscription
+type WebhookDelivery struct {
+	ID             int
+	SubscriptionID int
+	Event          ChangeEvent
+	Status         WebhookDeliveryStatus
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastError      string
+	LastStatusCode int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// WebhookPayload is the JSON body posted to subscribers
+type WebhookPayload struct {
+	DeliveryID     int         `json:"delivery_id"`
+	SubscriptionID int         `json:"subscription_id"`
+	Event          ChangeEvent `json:"event"`
+}
+
+// WebhookConfig controls delivery timing and retries
+type WebhookConfig struct {
+	// MaxAttempts is the number of attempts before a delivery is dead-lettered
+	MaxAttempts int
+
+	// InitialBackoff is the delay after the first failed attempt; it doubles per attempt
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+
+	// RequestTimeout bounds each HTTP request
+	RequestTimeout time.Duration
+
+	// PollInterval is how often due deliveries are checked
+	PollInterval time.Duration
+
+	// BatchSize is the maximum number of deliveries attempted per poll
+	BatchSize int
+
+	// Client sends the requests; nil uses a client with RequestTimeout
+	Client *http.Client
+}
+
+// DefaultWebhookConfig returns a WebhookConfig with sensible defaults
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		MaxAttempts:    8,
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Minute,
+		RequestTimeout: 10 * time.Second,
+		PollInterval:   time.Second,
+		BatchSize:      50,
+	}
+}
+
+// WebhookStore persists subscriptions, deliveries and the dispatcher's change feed cursor
+type WebhookStore interface {
+	// Subscriptions
+	CreateWebhookSubscription(ctx context.Context, sub WebhookSubscription) (int, error)
+	ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+
+	// Dispatch; EnqueueWebhookDeliveries stores deliveries and advances the cursor atomically
+	WebhookCursor(ctx context.Context) (Revision, error)
+	EnqueueWebhookDeliveries(ctx context.Context, cursor Revision, deliveries []WebhookDelivery) error
+	DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error
+	DeadLetterWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error
+
+	// Status queries
+	GetWebhookDelivery(ctx context.Context, deliveryID int) (*WebhookDelivery, error)
+	ListWebhookDeliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error)
+	ListWebhookDeadLetters(ctx context.Context) ([]WebhookDelivery, error)
+}
+
+// WebhookDispatcher turns change events produced by Server mutations into signed
+// HTTP callbacks. It follows the change feed from a cursor kept in the store, so
+// events committed while the dispatcher was down are delivered after a restart.
+// Delivery is at least once; receivers should deduplicate on the delivery ID.
+type WebhookDispatcher struct {
+	server *Server
+	store  WebhookStore
+	config WebhookConfig
+	client *http.Client
+	now    func() time.Time
+	wake   chan struct{}
+}
+
+// NewWebhookDispatcher creates a dispatcher for the given server and store
+func NewWebhookDispatcher(server *Server, store WebhookStore, config WebhookConfig) *WebhookDispatcher {
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: config.RequestTimeout}
+	}
+	return &WebhookDispatcher{
+		server: server,
+		store:  store,
+		config: config,
+		client: client,
+		now:    time.Now,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Subscribe validates and stores a subscription, returning its ID
+func (d *WebhookDispatcher) Subscribe(ctx context.Context, sub WebhookSubscription) (int, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, fmt.Errorf("invalid webhook URL %q", sub.URL)
+	}
+	if sub.Secret == "" {
+		return 0, errors.New("webhook secret must not be empty")
+	}
+
+	id, err := d.store.CreateWebhookSubscription(ctx, sub)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook subscription: %w", err)
+	}
+	return id, nil
+}
+
+// Delivery returns the current status of a delivery
+func (d *WebhookDispatcher) Delivery(ctx context.Context, deliveryID int) (*WebhookDelivery, error) {
+	return d.store.GetWebhookDelivery(ctx, deliveryID)
+}
+
+// Deliveries returns all deliveries for a subscription, oldest first
+func (d *WebhookDispatcher) Deliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	return d.store.ListWebhookDeliveries(ctx, subscriptionID)
+}
+
+// DeadLetters returns deliveries that exhausted their attempts
+func (d *WebhookDispatcher) DeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	return d.store.ListWebhookDeadLetters(ctx)
+}
+
+// Run enqueues deliveries for new change events and sends due deliveries until ctx
+// is canceled or either loop fails. It returns the first error encountered.
+func (d *WebhookDispatcher) Run(ctx context.Context) error {
+	cursor, err := d.store.WebhookCursor(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get webhook cursor: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- d.server.Watch(ctx, cursor, func(event ChangeEvent) error {
+			return d.enqueue(ctx, event)
+		})
+	}()
+	go func() { errs <- d.deliverLoop(ctx) }()
+
+	err = <-errs
+	cancel()
+	<-errs
+	return err
+}
+
+// enqueue creates a delivery for every subscription matching event
+func (d *WebhookDispatcher) enqueue(ctx context.Context, event ChangeEvent) error {
+	subs, err := d.store.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+
+	var groups map[int]bool
+	var deliveries []WebhookDelivery
+	for _, sub := range subs {
+		if !matchesEventType(sub, event) {
+			continue
+		}
+		if len(sub.GroupIDs) > 0 {
+			if groups == nil {
+				if groups, err = d.eventGroups(ctx, event); err != nil {
+					return err
+				}
+			}
+			if !matchesGroup(sub, groups) {
+				continue
+			}
+		}
+		deliveries = append(deliveries, WebhookDelivery{
+			SubscriptionID: sub.ID,
+			Event:          event,
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  d.now(),
+		})
+	}
+
+	if err := d.store.EnqueueWebhookDeliveries(ctx, event.Revision, deliveries); err != nil {
+		return fmt.Errorf("failed to enqueue webhook deliveries: %w", err)
+	}
+	if len(deliveries) > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// eventGroups returns the event's object group and every group above it, and for
+// moves also the previous object group and every group above that
+func (d *WebhookDispatcher) eventGroups(ctx context.Context, event ChangeEvent) (map[int]bool, error) {
+	groups := make(map[int]bool)
+	if event.ObjectType != "group" {
+		return groups, nil
+	}
+
+	objects := []int{event.ObjectID}
+	if event.PreviousObjectID != 0 {
+		objects = append(objects, event.PreviousObjectID)
+	}
+	for _, objectID := range objects {
+		ancestors, err := d.server.repo.GetAncestorGroups(ctx, objectID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ancestor groups: %w", err)
+		}
+		groups[objectID] = true
+		for _, id := range ancestors {
+			groups[id] = true
+		}
+	}
+	return groups, nil
+}
+
+func matchesEventType(sub WebhookSubscription, event ChangeEvent) bool {
+	if len(sub.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range sub.EventTypes {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGroup(sub WebhookSubscription, groups map[int]bool) bool {
+	for _, id := range sub.GroupIDs {
+		if groups[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverLoop sends due deliveries on every poll and whenever new ones are enqueued
+func (d *WebhookDispatcher) deliverLoop(ctx context.Context) error {
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.deliverDue(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// deliverDue attempts every delivery whose next attempt is due
+func (d *WebhookDispatcher) deliverDue(ctx context.Context) error {
+	due, err := d.store.DueWebhookDeliveries(ctx, d.now(), d.config.BatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+
+	subs, err := d.store.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	byID := make(map[int]WebhookSubscription, len(subs))
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+
+	for _, delivery := range due {
+		sub, ok := byID[delivery.SubscriptionID]
+		if !ok {
+			continue
+		}
+		if err := d.attempt(ctx, sub, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt sends one delivery and records the outcome
+func (d *WebhookDispatcher) attempt(ctx context.Context, sub WebhookSubscription, delivery WebhookDelivery) error {
+	statusCode, sendErr := d.send(ctx, sub, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; leave the delivery due so it is retried on the next run
+		return ctx.Err()
+	}
+
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+
+	if sendErr == nil {
+		delivery.Status = WebhookDeliverySucceeded
+		if err := d.store.UpdateWebhookDelivery(ctx, delivery); err != nil {
+			return fmt.Errorf("failed to update webhook delivery: %w", err)
+		}
+		return nil
+	}
+
+	delivery.LastError = sendErr.Error()
+	if delivery.Attempts >= d.config.MaxAttempts {
+		delivery.Status = WebhookDeliveryDeadLettered
+		if err := d.store.DeadLetterWebhookDelivery(ctx, delivery); err != nil {
+			return fmt.Errorf("failed to dead-letter webhook delivery: %w", err)
+		}
+		return nil
+	}
+
+	delivery.NextAttemptAt = d.now().Add(d.backoff(delivery.Attempts))
+	if err := d.store.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.config.InitialBackoff
+	for i := 1; i < attempts && wait < d.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.config.MaxBackoff {
+		wait = d.config.MaxBackoff
+	}
+	return wait
+}
+
+// send posts the signed payload and returns the response status code
+func (d *WebhookDispatcher) send(ctx context.Context, sub WebhookSubscription, delivery WebhookDelivery) (int, error) {
+	body, err := json.Marshal(WebhookPayload{
+		DeliveryID:     delivery.ID,
+		SubscriptionID: sub.ID,
+		Event:          delivery.Event,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(delivery.Event.Type))
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(sub.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhookPayload returns the signature header value for a payload.
+// The HMAC-SHA256 covers the timestamp and the body, so a captured request cannot
+// be replayed later with a fresh timestamp.
+func SignWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature reports whether signature is valid for the timestamp and body.
+// Receivers should also reject timestamps outside their tolerance window.
+func VerifyWebhookSignature(secret, timestamp string, body []byte, signature string) bool {
+	expected := SignWebhookPayload(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
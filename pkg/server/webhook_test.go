@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebhookStore is an in-memory WebhookStore for tests that must run without MySQL
+type fakeWebhookStore struct {
+	mu            sync.Mutex
+	subscriptions []WebhookSubscription
+	deliveries    []WebhookDelivery
+	deadLetters   []int
+	cursor        Revision
+}
+
+func (f *fakeWebhookStore) CreateWebhookSubscription(_ context.Context, sub WebhookSubscription) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub.ID = len(f.subscriptions) + 1
+	sub.CreatedAt = time.Now()
+	f.subscriptions = append(f.subscriptions, sub)
+	return sub.ID, nil
+}
+
+func (f *fakeWebhookStore) ListWebhookSubscriptions(context.Context) ([]WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]WebhookSubscription(nil), f.subscriptions...), nil
+}
+
+func (f *fakeWebhookStore) WebhookCursor(context.Context) (Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cursor, nil
+}
+
+func (f *fakeWebhookStore) EnqueueWebhookDeliveries(_ context.Context, cursor Revision, deliveries []WebhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range deliveries {
+		d.ID = len(f.deliveries) + 1
+		d.CreatedAt, d.UpdatedAt = time.Now(), time.Now()
+		f.deliveries = append(f.deliveries, d)
+	}
+	if cursor > f.cursor {
+		f.cursor = cursor
+	}
+	return nil
+}
+
+func (f *fakeWebhookStore) DueWebhookDeliveries(_ context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var due []WebhookDelivery
+	for _, d := range f.deliveries {
+		if d.Status == WebhookDeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (f *fakeWebhookStore) UpdateWebhookDelivery(_ context.Context, delivery WebhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delivery.UpdatedAt = time.Now()
+	f.deliveries[delivery.ID-1] = delivery
+	return nil
+}
+
+func (f *fakeWebhookStore) DeadLetterWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	delivery.Status = WebhookDeliveryDeadLettered
+	_ = f.UpdateWebhookDelivery(ctx, delivery)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deadLetters = append(f.deadLetters, delivery.ID)
+	return nil
+}
+
+func (f *fakeWebhookStore) GetWebhookDelivery(_ context.Context, deliveryID int) (*WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if deliveryID < 1 || deliveryID > len(f.deliveries) {
+		return nil, &WebhookDeliveryNotFoundError{DeliveryID: deliveryID}
+	}
+	d := f.deliveries[deliveryID-1]
+	return &d, nil
+}
+
+func (f *fakeWebhookStore) ListWebhookDeliveries(_ context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []WebhookDelivery
+	for _, d := range f.deliveries {
+		if d.SubscriptionID == subscriptionID {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeWebhookStore) ListWebhookDeadLetters(context.Context) ([]WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []WebhookDelivery
+	for _, id := range f.deadLetters {
+		result = append(result, f.deliveries[id-1])
+	}
+	return result, nil
+}
+
+// webhookReceiver is an httptest endpoint that verifies signatures and records payloads
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+	status func(attempt int) int
+
+	mu       sync.Mutex
+	attempts int
+	payloads []WebhookPayload
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !VerifyWebhookSignature(rcv.secret, r.Header.Get(WebhookTimestampHeader), body, r.Header.Get(WebhookSignatureHeader)) {
+		rcv.t.Errorf("Invalid signature on delivery %s", r.Header.Get(WebhookDeliveryHeader))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rcv.mu.Lock()
+	rcv.attempts++
+	status := http.StatusOK
+	if rcv.status != nil {
+		status = rcv.status(rcv.attempts)
+	}
+	if status == http.StatusOK {
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			rcv.t.Errorf("Invalid payload: %v", err)
+		}
+		rcv.payloads = append(rcv.payloads, payload)
+	}
+	rcv.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (rcv *webhookReceiver) received() []WebhookPayload {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]WebhookPayload(nil), rcv.payloads...)
+}
+
+// testWebhookConfig keeps retries fast enough for tests
+func testWebhookConfig() WebhookConfig {
+	config := DefaultWebhookConfig()
+	config.MaxAttempts = 3
+	config.InitialBackoff = 10 * time.Millisecond
+	config.MaxBackoff = 40 * time.Millisecond
+	config.PollInterval = 10 * time.Millisecond
+	return config
+}
+
+// runDispatcher runs d in the background until the test ends
+func runDispatcher(t *testing.T, d *WebhookDispatcher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v", err)
+		}
+	})
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Webhook_Signature(t *testing.T) {
+	body := []byte(`{"delivery_id":1}`)
+	signature := SignWebhookPayload("secret", "1700000000", body)
+
+	if !VerifyWebhookSignature("secret", "1700000000", body, signature) {
+		t.Error("Expected signature to verify")
+	}
+	if VerifyWebhookSignature("other", "1700000000", body, signature) {
+		t.Error("Expected signature with wrong secret to fail")
+	}
+	if VerifyWebhookSignature("secret", "1700000001", body, signature) {
+		t.Error("Expected signature with different timestamp to fail")
+	}
+	if VerifyWebhookSignature("secret", "1700000000", []byte(`{"delivery_id":2}`), signature) {
+		t.Error("Expected signature over different body to fail")
+	}
+}
+
+func Test_Webhook_Backoff(t *testing.T) {
+	d := NewWebhookDispatcher(nil, &fakeWebhookStore{}, WebhookConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d): expected %v, got %v", i+1, w, got)
+		}
+	}
+}
+
+func Test_Webhook_Subscribe_Validation(t *testing.T) {
+	d := NewWebhookDispatcher(nil, &fakeWebhookStore{}, DefaultWebhookConfig())
+	ctx := context.Background()
+
+	if _, err := d.Subscribe(ctx, WebhookSubscription{URL: "ftp://example.com", Secret: "s"}); err == nil {
+		t.Error("Expected error for non-HTTP URL")
+	}
+	if _, err := d.Subscribe(ctx, WebhookSubscription{URL: "https://example.com/hook"}); err == nil {
+		t.Error("Expected error for empty secret")
+	}
+	if _, err := d.Subscribe(ctx, WebhookSubscription{URL: "https://example.com/hook", Secret: "s"}); err != nil {
+		t.Errorf("Subscribe failed: %v", err)
+	}
+}
+
+func Test_Webhook_DeliversMatchingEvents(t *testing.T) {
+	s := New(newFakeRepository())
+	defer s.Close()
+	ctx := context.Background()
+
+	sensitive, _ := s.CreateUserGroup(ctx, "Sensitive")
+	subgroup, _ := s.CreateUserGroup(ctx, "Subgroup")
+	other, _ := s.CreateUserGroup(ctx, "Other")
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+	_ = s.AddUserGroupToGroup(ctx, subgroup, sensitive)
+
+	receiver := &webhookReceiver{t: t, secret: "s3cret"}
+	httpServer := httptest.NewServer(receiver)
+	defer httpServer.Close()
+
+	store := &fakeWebhookStore{}
+	d := NewWebhookDispatcher(s, store, testWebhookConfig())
+	subID, err := d.Subscribe(ctx, WebhookSubscription{
+		URL:        httpServer.URL,
+		Secret:     "s3cret",
+		EventTypes: []ChangeEventType{EventMembershipAdded},
+		GroupIDs:   []int{sensitive},
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	runDispatcher(t, d)
+
+	_ = s.AddUserToGroup(ctx, bob, other)                   // wrong group
+	_ = s.AddUserToUserGroupPermission(ctx, bob, sensitive) // wrong event type
+	_ = s.AddUserToGroup(ctx, alice, subgroup)              // nested beneath the sensitive group
+
+	waitFor(t, 5*time.Second, "delivery", func() bool { return len(receiver.received()) == 1 })
+
+	payload := receiver.received()[0]
+	if payload.SubscriptionID != subID || payload.Event.SubjectID != alice || payload.Event.ObjectID != subgroup {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+
+	delivery, err := d.Delivery(ctx, payload.DeliveryID)
+	if err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+	if delivery.Status != WebhookDeliverySucceeded || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusOK {
+		t.Errorf("Unexpected delivery status %+v", delivery)
+	}
+	if _, err := d.Delivery(ctx, 999); !errors.Is(err, ErrWebhookDeliveryNotFound) {
+		t.Errorf("Expected ErrWebhookDeliveryNotFound, got %v", err)
+	}
+}
+
+func Test_Webhook_RetriesAndDeadLetters(t *testing.T) {
+	s := New(newFakeRepository())
+	defer s.Close()
+	ctx := context.Background()
+
+	group, _ := s.CreateUserGroup(ctx, "Group")
+	alice, _ := s.CreateUser(ctx, "Alice")
+	bob, _ := s.CreateUser(ctx, "Bob")
+
+	// The flaky receiver recovers on the third attempt; the broken one never does
+	flaky := &webhookReceiver{t: t, secret: "flaky", status: func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	broken := &webhookReceiver{t: t, secret: "broken", status: func(int) int { return http.StatusInternalServerError }}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+
+	d := NewWebhookDispatcher(s, &fakeWebhookStore{}, testWebhookConfig())
+	flakyID, _ := d.Subscribe(ctx, WebhookSubscription{URL: flakyServer.URL, Secret: "flaky"})
+	brokenID, _ := d.Subscribe(ctx, WebhookSubscription{URL: brokenServer.URL, Secret: "broken"})
+	runDispatcher(t, d)
+
+	_ = s.AddUserToGroup(ctx, alice, group)
+	_ = s.AddUserToUserPermission(ctx, alice, bob)
+
+	waitFor(t, 5*time.Second, "dead letters", func() bool {
+		dead, _ := d.DeadLetters(ctx)
+		return len(dead) == 2
+	})
+	waitFor(t, 5*time.Second, "flaky deliveries", func() bool { return len(flaky.received()) == 2 })
+
+	dead, _ := d.DeadLetters(ctx)
+	for _, delivery := range dead {
+		if delivery.SubscriptionID != brokenID || delivery.Attempts != 3 || delivery.LastStatusCode != http.StatusInternalServerError {
+			t.Errorf("Unexpected dead letter %+v", delivery)
+		}
+	}
+
+	deliveries, _ := d.Deliveries(ctx, flakyID)
+	attempts := 0
+	for _, delivery := range deliveries {
+		if delivery.Status != WebhookDeliverySucceeded {
+			t.Errorf("Expected flaky delivery to succeed, got %+v", delivery)
+		}
+		attempts += delivery.Attempts
+	}
+	if attempts != 4 {
+		t.Errorf("Expected 4 attempts across flaky deliveries, got %d", attempts)
+	}
+}
+
+func Test_Webhook_OverMySQLStore(t *testing.T) {
+	db, err := OpenDatabase(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// One connection keeps the dispatcher's loops serialized, which go-mysql-server (used by some
+	// local setups) needs because it does not isolate concurrent transactions
+	db.SetMaxOpenConns(1)
+	repo := NewMySQLRepository(db)
+	s := New(repo)
+	defer s.Close()
+	ctx := context.Background()
+
+	// Skip history left by other tests
+	rev, err := repo.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatalf("CurrentRevision failed: %v", err)
+	}
+	if err := repo.EnqueueWebhookDeliveries(ctx, rev, nil); err != nil {
+		t.Fatalf("EnqueueWebhookDeliveries failed: %v", err)
+	}
+
+	group, _ := s.CreateUserGroup(ctx, "Audited")
+	alice, _ := s.CreateUser(ctx, "Alice")
+
+	receiver := &webhookReceiver{t: t, secret: "mysql", status: func(attempt int) int {
+		if attempt == 1 {
+			return http.StatusBadGateway
+		}
+		return http.StatusOK
+	}}
+	httpServer := httptest.NewServer(receiver)
+	defer httpServer.Close()
+
+	d := NewWebhookDispatcher(s, repo, testWebhookConfig())
+	subID, err := d.Subscribe(ctx, WebhookSubscription{URL: httpServer.URL, Secret: "mysql", GroupIDs: []int{group}})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Committed before the dispatcher starts, so it is picked up from the stored cursor
+	if err := s.AddUserToGroup(ctx, alice, group); err != nil {
+		t.Fatalf("AddUserToGroup failed: %v", err)
+	}
+	runDispatcher(t, d)
+
+	waitFor(t, 10*time.Second, "delivery status", func() bool {
+		deliveries, _ := d.Deliveries(ctx, subID)
+		return len(deliveries) == 1 && deliveries[0].Status == WebhookDeliverySucceeded
+	})
+
+	deliveries, err := d.Deliveries(ctx, subID)
+	if err != nil {
+		t.Fatalf("Deliveries failed: %v", err)
+	}
+	delivery := deliveries[0]
+	if delivery.Attempts != 2 || delivery.Event.Type != EventMembershipAdded || delivery.Event.SubjectID != alice {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+	if got := receiver.received(); len(got) != 1 || got[0].DeliveryID != delivery.ID {
+		t.Errorf("Expected one payload for delivery %d, got %+v", delivery.ID, got)
+	}
+}